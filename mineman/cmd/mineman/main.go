@@ -2,21 +2,27 @@ package main
 
 import (
 	"context"
+	"os"
 
 	"github.com/euiko/tooyoul/mineman/pkg/app"
 
 	"github.com/euiko/tooyoul/mineman/pkg/event"
 	_ "github.com/euiko/tooyoul/mineman/pkg/event/channel"
+	_ "github.com/euiko/tooyoul/mineman/pkg/event/file"
+	_ "github.com/euiko/tooyoul/mineman/pkg/event/mqtt"
 
+	_ "github.com/euiko/tooyoul/mineman/modules/events"
 	_ "github.com/euiko/tooyoul/mineman/modules/hello"
+	_ "github.com/euiko/tooyoul/mineman/modules/history"
 	_ "github.com/euiko/tooyoul/mineman/modules/miner"
 	_ "github.com/euiko/tooyoul/mineman/modules/network"
+	_ "github.com/euiko/tooyoul/mineman/modules/scheduler"
 )
 
 func main() {
 	app := app.New("mineman", newHook(), event.NewHook(), app.NewWebHook())
 	if err := app.Run(context.Background()); err != nil {
-		println("error running app :", err)
-		return
+		println("error running app :", err.Error())
+		os.Exit(1)
 	}
 }
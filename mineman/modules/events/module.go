@@ -0,0 +1,118 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/app"
+	"github.com/euiko/tooyoul/mineman/pkg/app/api"
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+)
+
+type (
+	Settings struct {
+		Enabled bool `mapstructure:"enabled"`
+		// Heartbeat is the interval of the keep alive sent to idle streams
+		Heartbeat time.Duration `mapstructure:"heartbeat"`
+	}
+
+	Module struct {
+		settings  Settings
+		done      chan struct{}
+		closeOnce sync.Once
+	}
+)
+
+func (m *Module) Init(ctx context.Context, c config.Config) error {
+	if err := c.Get("events").Scan(&m.settings); err != nil {
+		return err
+	}
+	if m.settings.Heartbeat <= 0 {
+		return fmt.Errorf("events heartbeat must be positive")
+	}
+
+	return nil
+}
+
+// Close end all the running streams, so the web server can shutdown
+func (m *Module) Close(ctx context.Context) error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+	return nil
+}
+
+// CheckHealth make sure the broker loop is alive, the stats are answered by
+// the loop itself
+func (m *Module) CheckHealth(ctx context.Context) api.HealthStatus {
+	stats, err := event.GetStats(ctx)
+	if err != nil {
+		return api.HealthStatus{Message: err.Error()}
+	}
+
+	return api.HealthStatus{
+		OK: true,
+		Details: map[string]interface{}{
+			"broker":         stats.Broker,
+			"in_flight":      stats.InFlight,
+			"outbox_pending": stats.Counters["outbox_pending"],
+		},
+	}
+}
+
+func (m *Module) CreateEndpoints(mws ...api.Middleware) []api.Endpoint {
+	return []api.Endpoint{
+		{
+			Method:  "GET",
+			Path:    "/debug/events",
+			Handler: m.statsHandler(),
+		},
+		{
+			Method:  "GET",
+			Path:    "/events/stream",
+			Handler: m.sseHandler(),
+		},
+		{
+			Method:  "GET",
+			Path:    "/events/ws",
+			Handler: m.wsHandler(),
+		},
+	}
+}
+
+// statsHandler expose the broker internals, e.g. slow subscribers and
+// messages that stuck without acknowledgement
+func (m *Module) statsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats, err := event.GetStats(r.Context())
+		if err != nil {
+			log.Error("failed when getting event stats", log.WithError(err))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			log.Error("failed when writing event stats", log.WithError(err))
+		}
+	})
+}
+
+func NewModule() api.Module {
+	return &Module{
+		settings: Settings{
+			Heartbeat: time.Second * 15,
+		},
+		done: make(chan struct{}),
+	}
+}
+
+func init() {
+	app.RegisterModule("events", NewModule)
+}
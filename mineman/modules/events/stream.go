@@ -0,0 +1,303 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	frameMessage   = "message"
+	frameHeartbeat = "heartbeat"
+)
+
+var ErrStreamingUnsupported = errors.New("response writer doesn't support streaming")
+
+type (
+	// frame is the JSON sent to the stream clients
+	frame struct {
+		Type       string              `json:"type"`
+		ID         string              `json:"id,omitempty"`
+		Topic      string              `json:"topic,omitempty"`
+		Deliveries int                 `json:"deliveries,omitempty"`
+		Headers    map[string]string   `json:"headers,omitempty"`
+		Event      *event.EventPayload `json:"event,omitempty"`
+		Text       *string             `json:"text,omitempty"`
+		At         time.Time           `json:"at"`
+	}
+
+	// stream merge the subscriptions of the requested topics, each stream
+	// client has its own fan out subscriptions
+	stream struct {
+		subs     []event.SubscriptionMsg
+		messages chan event.Message
+	}
+)
+
+// topicsFromRequest read the topic filters, e.g. ?topic=network.#&topic=miner.*
+// all the topics are streamed when there is no filter
+func topicsFromRequest(r *http.Request) ([]string, error) {
+	topics := r.URL.Query()["topic"]
+	if len(topics) == 0 {
+		return []string{event.MultiLevelWildcard}, nil
+	}
+
+	for _, topic := range topics {
+		if err := event.ValidateTopicPattern(topic); err != nil {
+			return nil, fmt.Errorf("topic %q: %w", topic, err)
+		}
+	}
+
+	return topics, nil
+}
+
+func (s *stream) close() {
+	for _, sub := range s.subs {
+		if err := sub.Close(); err != nil {
+			log.Error("failed when closing stream subscription", log.WithError(err))
+		}
+	}
+}
+
+// next wait for the next frame, a heartbeat frame is returned when there is no
+// message within the interval
+func (s *stream) next(ctx context.Context, heartbeat <-chan time.Time) (*frame, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-heartbeat:
+		return &frame{Type: frameHeartbeat, At: time.Now()}, nil
+	case msg := <-s.messages:
+		f := newMessageFrame(msg)
+		// the stream is best effort, the message is not redelivered
+		if err := <-msg.Ack(ctx); err != nil {
+			log.Debug("failed when acknowledging streamed message", log.WithError(err))
+		}
+		return f, nil
+	}
+}
+
+func newMessageFrame(msg event.Message) *frame {
+	f := frame{
+		Type:       frameMessage,
+		ID:         msg.ID(),
+		Topic:      msg.Topic(),
+		Deliveries: msg.Deliveries(),
+		Headers:    msg.Headers(),
+		At:         time.Now(),
+	}
+
+	var payload event.EventPayload
+	if err := msg.Scan(&payload); err == nil {
+		f.Event = &payload
+		return &f
+	}
+
+	var text string
+	if err := msg.Scan(&text); err == nil {
+		f.Text = &text
+	}
+
+	return &f
+}
+
+func newStream(ctx context.Context, topics []string) (*stream, error) {
+	s := stream{
+		messages: make(chan event.Message),
+	}
+
+	for _, topic := range topics {
+		// drop the oldest messages of a slow client instead of blocking the
+		// publishers
+		sub := event.SubscribeAsync(ctx, topic, event.OnOverflow(event.DropOldest))
+		if err := sub.Error(); err != nil {
+			s.close()
+			return nil, err
+		}
+		s.subs = append(s.subs, sub)
+
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-sub.Done():
+					return
+				case msg, ok := <-sub.Message():
+					if !ok {
+						return
+					}
+
+					select {
+					case s.messages <- msg:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	return &s, nil
+}
+
+// sseHandler stream the messages as server sent events, the heartbeat is
+// sent as a comment so the EventSource clients ignore it
+func (m *Module) sseHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, ErrStreamingUnsupported.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		topics, err := topicsFromRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := m.streamContext(r.Context())
+		defer cancel()
+
+		s, err := newStream(ctx, topics)
+		if err != nil {
+			log.Error("failed when subscribing event stream", log.WithError(err))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer s.close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(m.settings.Heartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			f, err := s.next(ctx, heartbeat.C)
+			if err != nil {
+				// client disconnected or module closed
+				return
+			}
+
+			if f.Type == frameHeartbeat {
+				_, err = fmt.Fprintf(w, ": %s\n\n", frameHeartbeat)
+			} else {
+				err = writeSSE(w, f)
+			}
+			if err != nil {
+				log.Debug("event stream client gone", log.WithError(err))
+				return
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+func writeSSE(w http.ResponseWriter, f *frame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", f.ID, data)
+	return err
+}
+
+// wsHandler stream the messages as websocket text messages, each of them is
+// a JSON frame including the heartbeat
+func (m *Module) wsHandler() http.Handler {
+	return websocket.Server{
+		Handshake: sameOriginHandshake,
+		Handler: func(conn *websocket.Conn) {
+			defer conn.Close()
+
+			r := conn.Request()
+			topics, err := topicsFromRequest(r)
+			if err != nil {
+				websocket.JSON.Send(conn, map[string]string{"error": err.Error()})
+				return
+			}
+
+			ctx, cancel := m.streamContext(r.Context())
+			defer cancel()
+
+			s, err := newStream(ctx, topics)
+			if err != nil {
+				log.Error("failed when subscribing event stream", log.WithError(err))
+				websocket.JSON.Send(conn, map[string]string{"error": err.Error()})
+				return
+			}
+			defer s.close()
+
+			// the client isn't expected to send anything, reading only
+			// detect the disconnection
+			go func() {
+				defer cancel()
+				var discard []byte
+				for {
+					if err := websocket.Message.Receive(conn, &discard); err != nil {
+						return
+					}
+				}
+			}()
+
+			heartbeat := time.NewTicker(m.settings.Heartbeat)
+			defer heartbeat.Stop()
+
+			for {
+				f, err := s.next(ctx, heartbeat.C)
+				if err != nil {
+					return
+				}
+
+				if err := websocket.JSON.Send(conn, f); err != nil {
+					log.Debug("event stream client gone", log.WithError(err))
+					return
+				}
+			}
+		},
+	}
+}
+
+// sameOriginHandshake accept the clients without origin, e.g. curl, and the
+// browsers on the same host, so other sites can't read the events
+func sameOriginHandshake(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+
+	if origin != nil && origin.Host != r.Host {
+		return fmt.Errorf("origin %s is not allowed", origin.Host)
+	}
+
+	config.Origin = origin
+	return nil
+}
+
+// streamContext cancel the stream when either the client gone or the module
+// closed, otherwise the web server shutdown wait for the streams
+func (m *Module) streamContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-m.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
@@ -0,0 +1,150 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/event/eventtest"
+	"github.com/euiko/tooyoul/mineman/pkg/network"
+	"golang.org/x/net/websocket"
+)
+
+func newTestModule() *Module {
+	m := NewModule().(*Module)
+	m.settings.Heartbeat = 20 * time.Millisecond
+	return m
+}
+
+func waitSubscriptions(t *testing.T, broker *eventtest.Broker, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		stats, _ := broker.Stats(context.Background())
+		if len(stats.Subscriptions) == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expect %d subscriptions", n)
+}
+
+func TestServerSentEvents(t *testing.T) {
+	ctx := context.Background()
+	broker := eventtest.Install(t)
+	m := newTestModule()
+	defer m.Close(ctx)
+
+	server := httptest.NewServer(m.sseHandler())
+	defer server.Close()
+
+	// invalid filter is rejected
+	resp, err := http.Get(server.URL + "?topic=network.#.up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expect bad request, got %d", resp.StatusCode)
+	}
+
+	reqCtx, cancel := context.WithCancel(ctx)
+	req, _ := http.NewRequestWithContext(reqCtx, "GET", server.URL+"?topic=network.%23", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expect event stream, got %s", ct)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	readUntil := func(prefix string) string {
+		for lines.Scan() {
+			if strings.HasPrefix(lines.Text(), prefix) {
+				return strings.TrimPrefix(lines.Text(), prefix)
+			}
+		}
+		t.Fatalf("expect line with %q, got %v", prefix, lines.Err())
+		return ""
+	}
+
+	readUntil(": heartbeat")
+
+	// only the filtered topics are streamed
+	broker.Publish(ctx, "miner.status-changed", event.StringPayload("skipped"))
+	broker.Publish(ctx, network.EventStatusChangedTopic, event.FromEventDescriptor(&network.EventNetworkUp{At: time.Now()}))
+
+	var f frame
+	if err := json.Unmarshal([]byte(readUntil("data: ")), &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Topic != network.EventStatusChangedTopic || f.Event == nil || f.Event.Name != "network.up" {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+
+	// the subscription is closed once the client disconnected
+	cancel()
+	waitSubscriptions(t, broker, 0)
+}
+
+func TestWebSocket(t *testing.T) {
+	ctx := context.Background()
+	broker := eventtest.Install(t)
+	m := newTestModule()
+
+	server := httptest.NewServer(m.wsHandler())
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?topic=miner.*"
+
+	// other sites can't read the events
+	if _, err := websocket.Dial(url, "", "http://example.com"); err == nil {
+		t.Fatal("expect cross origin connection rejected")
+	}
+
+	conn, err := websocket.Dial(url, "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitSubscriptions(t, broker, 1)
+
+	broker.Publish(ctx, "miner.status-changed", event.StringPayload("running"))
+
+	var f frame
+	for f.Type != frameMessage {
+		if err := websocket.JSON.Receive(conn, &f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.Topic != "miner.status-changed" || f.Text == nil || *f.Text != "running" {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+
+	// closing the module end the streams
+	m.Close(ctx)
+	waitSubscriptions(t, broker, 0)
+}
+
+func TestInitHeartbeat(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "events.yaml"), []byte("events:\n  heartbeat: 0s\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewModule()
+	if err := m.Init(context.Background(), config.NewViper("events", config.ViperPaths(dir))); err == nil {
+		t.Fatal("expect the zero heartbeat rejected")
+	}
+}
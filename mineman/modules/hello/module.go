@@ -16,20 +16,19 @@ type Module struct {
 }
 
 func (m *Module) Init(ctx context.Context, c config.Config) error {
-	event.Subscribe(ctx, network.EventStatusChangedTopic, event.MessageHandlerFunc(func(ctx context.Context, message event.Message) {
-		var (
-			downEvent network.EventNetworkDown
-			upEvent   network.EventNetworkDown
-		)
-
-		if err := message.Scan(&downEvent); err == nil {
-			log.Info("network is down", log.WithField("time", downEvent.At))
-		} else if err := message.Scan(&upEvent); err == nil {
-			log.Info("network is up", log.WithField("time", upEvent.At))
-		}
-
-		message.Ack(ctx)
-	}))
+	router := event.NewRouter().
+		Handle(func() event.EventDescriptor { return &network.EventNetworkDown{} },
+			func(ctx context.Context, message event.Message, ed event.EventDescriptor) error {
+				log.Info("network is down", log.WithField("time", ed.(*network.EventNetworkDown).At))
+				return nil
+			}).
+		Handle(func() event.EventDescriptor { return &network.EventNetworkUp{} },
+			func(ctx context.Context, message event.Message, ed event.EventDescriptor) error {
+				log.Info("network is up", log.WithField("time", ed.(*network.EventNetworkUp).At))
+				return nil
+			})
+
+	event.Subscribe(ctx, network.EventStatusChangedTopic, router)
 	return nil
 }
 
@@ -0,0 +1,222 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/app"
+	"github.com/euiko/tooyoul/mineman/pkg/app/api"
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/event/history"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+	"github.com/euiko/tooyoul/mineman/pkg/miner"
+	"github.com/euiko/tooyoul/mineman/pkg/network"
+)
+
+type (
+	Settings struct {
+		Enabled bool   `mapstructure:"enabled"`
+		Path    string `mapstructure:"path"`
+		Sync    bool   `mapstructure:"sync"`
+		// Retention is how long the records are kept
+		Retention time.Duration `mapstructure:"retention"`
+		// PruneInterval is how often the expired records are removed
+		PruneInterval time.Duration `mapstructure:"prune_interval"`
+		// Topics to be recorded, it may contains wildcard
+		Topics []string `mapstructure:"topics"`
+	}
+
+	Module struct {
+		settings Settings
+		store    history.Store
+		cancel   context.CancelFunc
+	}
+)
+
+func (m *Module) Init(ctx context.Context, c config.Config) error {
+	if err := c.Get("history").Scan(&m.settings); err != nil {
+		return err
+	}
+	if m.settings.PruneInterval <= 0 {
+		return fmt.Errorf("history prune interval must be positive")
+	}
+
+	store, err := history.OpenFile(m.settings.Path, history.SyncWrite(m.settings.Sync))
+	if err != nil {
+		return err
+	}
+	m.store = store
+
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.prune(ctx)
+	go m.runPrune(ctx)
+
+	return nil
+}
+
+func (m *Module) Close(ctx context.Context) error {
+	if m.store == nil {
+		return nil
+	}
+
+	m.cancel()
+	return m.store.Close()
+}
+
+func (m *Module) CreateSinks() []event.Sink {
+	sinks := make([]event.Sink, len(m.settings.Topics))
+	for i, topic := range m.settings.Topics {
+		// wait a bit for the store rather than losing the records
+		sinks[i] = event.Sink{
+			Topic:   topic,
+			Handler: m.recordHandler(),
+			Options: []event.SubscribeConfigurator{event.BlockOnOverflow(time.Second)},
+		}
+	}
+
+	return sinks
+}
+
+func (m *Module) CreateEndpoints(mws ...api.Middleware) []api.Endpoint {
+	return []api.Endpoint{
+		{
+			Method:  "GET",
+			Path:    "/events/history",
+			Handler: m.queryHandler(),
+		},
+	}
+}
+
+// recordHandler store the events, the retained value replayed on subscribe
+// is skipped since it is already recorded when it was published
+func (m *Module) recordHandler() event.MessageHandler {
+	return event.MessageHandlerFuncErr(func(ctx context.Context, message event.Message) error {
+		if _, ok := message.Headers()[event.HeaderRetained]; ok {
+			return nil
+		}
+
+		r, err := history.NewRecord(message)
+		if err == history.ErrNotAnEvent {
+			log.Debug("skipping non event message from history", log.WithField("topic", message.Topic()))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return m.store.Append(ctx, r)
+	})
+}
+
+// queryHandler answer /events/history?topic=&name=&since=&until=&limit=, the
+// since and until are either RFC3339 time or a duration before now, e.g. 12h
+func (m *Module) queryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseQuery(r, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		records, err := m.store.Query(r.Context(), *q)
+		if err != nil {
+			log.Error("failed when querying event history", log.WithError(err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(records); err != nil {
+			log.Error("failed when writing event history", log.WithError(err))
+		}
+	})
+}
+
+func (m *Module) runPrune(ctx context.Context) {
+	ticker := time.NewTicker(m.settings.PruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.prune(ctx)
+		}
+	}
+}
+
+func (m *Module) prune(ctx context.Context) {
+	n, err := m.store.Prune(ctx, time.Now().Add(-m.settings.Retention))
+	if err != nil {
+		log.Error("failed when pruning event history", log.WithError(err))
+		return
+	}
+
+	if n > 0 {
+		log.Debug("event history pruned", log.WithField("count", n))
+	}
+}
+
+func parseQuery(r *http.Request, now time.Time) (*history.Query, error) {
+	values := r.URL.Query()
+	q := history.Query{
+		Topic: values.Get("topic"),
+		Name:  values.Get("name"),
+	}
+
+	var err error
+	if q.Since, err = parseTime(values.Get("since"), now); err != nil {
+		return nil, fmt.Errorf("invalid since: %w", err)
+	}
+	if q.Until, err = parseTime(values.Get("until"), now); err != nil {
+		return nil, fmt.Errorf("invalid until: %w", err)
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, fmt.Errorf("invalid limit: %w", err)
+		}
+	}
+
+	return &q, nil
+}
+
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+func New() *Module {
+	return &Module{
+		settings: Settings{
+			Path:          "data/history.jsonl",
+			Retention:     time.Hour * 24 * 7,
+			PruneInterval: time.Hour,
+			Topics: []string{
+				network.EventStatusChangedTopic,
+				miner.EventStatusChangedTopic,
+			},
+		},
+	}
+}
+
+func newModule() api.Module {
+	return New()
+}
+
+func init() {
+	app.RegisterModule("history", newModule)
+}
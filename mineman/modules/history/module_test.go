@@ -0,0 +1,92 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/event/eventtest"
+	"github.com/euiko/tooyoul/mineman/pkg/event/history"
+	"github.com/euiko/tooyoul/mineman/pkg/network"
+)
+
+func TestRecordAndQuery(t *testing.T) {
+	ctx := context.Background()
+	broker := eventtest.Install(t)
+	store, err := history.OpenFile(filepath.Join(t.TempDir(), "history.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New()
+	m.store = store
+	defer store.Close()
+
+	now := time.Now()
+	down := event.FromEventDescriptor(&network.EventNetworkDown{At: now.Add(-2 * time.Hour)})
+	up := event.FromEventDescriptor(&network.EventNetworkUp{At: now.Add(-time.Hour)})
+	handler := m.recordHandler()
+
+	msgs := []*eventtest.Message{
+		broker.NewMessage(network.EventStatusChangedTopic, down),
+		// the retained replay is already recorded
+		broker.NewMessage(network.EventStatusChangedTopic, down, event.WithHeader(event.HeaderRetained, "true")),
+		broker.NewMessage(network.EventStatusChangedTopic, up),
+		// only the events are recorded
+		broker.NewMessage(network.EventStatusChangedTopic, event.StringPayload("up")),
+	}
+	for _, msg := range msgs {
+		handler.HandleMessage(ctx, msg)
+		msg.ExpectAck(t, time.Second)
+	}
+
+	query := func(target string) []history.Record {
+		w := httptest.NewRecorder()
+		m.queryHandler().ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != 200 {
+			t.Fatalf("query %s failed with %d: %s", target, w.Code, w.Body.String())
+		}
+
+		var records []history.Record
+		if err := json.Unmarshal(w.Body.Bytes(), &records); err != nil {
+			t.Fatal(err)
+		}
+		return records
+	}
+
+	if records := query("/events/history?topic=network.%23"); len(records) != 2 ||
+		records[0].Name != "network.down" || records[1].Name != "network.up" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	if records := query("/events/history?since=90m"); len(records) != 1 || records[0].Name != "network.up" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	if records := query("/events/history?name=network.down&until=" + now.Format(time.RFC3339)); len(records) != 1 {
+		t.Fatalf("unexpected records %+v", records)
+	}
+
+	w := httptest.NewRecorder()
+	m.queryHandler().ServeHTTP(w, httptest.NewRequest("GET", "/events/history?since=yesterday", nil))
+	if w.Code != 400 {
+		t.Fatalf("expect bad request, got %d", w.Code)
+	}
+}
+
+func TestInitPruneInterval(t *testing.T) {
+	dir := t.TempDir()
+	content := "history:\n  path: " + filepath.Join(dir, "history.jsonl") + "\n  prune_interval: 0s\n"
+	if err := os.WriteFile(filepath.Join(dir, "history.yaml"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New()
+	if err := m.Init(context.Background(), config.NewViper("history", config.ViperPaths(dir))); err == nil {
+		m.Close(context.Background())
+		t.Fatal("expect the zero prune interval rejected")
+	}
+}
@@ -2,26 +2,63 @@ package miner
 
 import (
 	"context"
-	"errors"
 
 	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+	"github.com/euiko/tooyoul/mineman/pkg/miner"
 	"github.com/euiko/tooyoul/mineman/pkg/network"
 )
 
 func (m *Module) networkChangedEventHandler() event.MessageHandler {
+	return event.NewRouter().
+		Handle(func() event.EventDescriptor { return &network.EventNetworkUp{} },
+			func(ctx context.Context, message event.Message, ed event.EventDescriptor) error {
+				return m.runCommand(ctx, m.manager.Start)
+			}).
+		Handle(func() event.EventDescriptor { return &network.EventNetworkDown{} },
+			func(ctx context.Context, message event.Message, ed event.EventDescriptor) error {
+				return m.runCommand(ctx, m.manager.Stop)
+			})
+}
+
+// runCommand start or stop the miners, the status is published when the
+// running state changed
+func (m *Module) runCommand(ctx context.Context, command func(ctx context.Context) error) error {
+	running := m.manager.Status().Running
+	if err := command(m.ctx); err != nil {
+		return err
+	}
+
+	status := m.manager.Status()
+	if status.Running == running {
+		return nil
+	}
+
+	if err := <-m.publisher.Publish(ctx, miner.EventStatusChangedTopic, status.ToEvent(), event.Retain()).Error(); err != nil {
+		m.logger.Error("failed when publishing miner status", log.WithError(err))
+	}
+
+	return nil
+}
+
+// requestHandler answer the request with the miner status after running
+// the command, a failed command is replied with the error
+func (m *Module) requestHandler(command func(ctx context.Context) error) event.MessageHandler {
 	return event.MessageHandlerFuncErr(func(ctx context.Context, message event.Message) error {
-		var (
-			networkUpEvent   network.EventNetworkUp
-			networkDownEvent network.EventNetworkDown
-			err              error
-		)
-
-		if err = message.Scan(&networkUpEvent); err == nil {
-			return m.manager.Start(m.ctx)
-		} else if err = message.Scan(&networkDownEvent); err == nil {
-			return m.manager.Stop(m.ctx)
+		opts := []event.PublishConfigurator{}
+		if command != nil {
+			if err := m.runCommand(ctx, command); err != nil {
+				m.logger.Error("failed when handling miner request", log.WithError(err))
+				opts = append(opts, event.WithReplyError(err))
+			}
+		}
+
+		err := <-message.Reply(ctx, m.manager.Status().ToEvent(), opts...)
+		if err == event.ErrNoReplyTopic {
+			// the command is published without waiting for the reply
+			return nil
 		}
 
-		return errors.New("event are not handled")
+		return err
 	})
 }
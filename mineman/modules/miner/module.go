@@ -2,11 +2,13 @@ package miner
 
 import (
 	"context"
+	"time"
 
 	"github.com/euiko/tooyoul/mineman/pkg/app"
 	"github.com/euiko/tooyoul/mineman/pkg/app/api"
 	"github.com/euiko/tooyoul/mineman/pkg/config"
 	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
 	"github.com/euiko/tooyoul/mineman/pkg/miner"
 	"github.com/euiko/tooyoul/mineman/pkg/network"
 
@@ -15,12 +17,20 @@ import (
 
 type (
 	Module struct {
-		c       config.Config
-		manager *miner.Manager
-		ctx     context.Context
+		c         config.Config
+		manager   *miner.Manager
+		ctx       context.Context
+		publisher event.Publisher
+		logger    log.Printer
 	}
 )
 
+// Inject receive the publisher of the miner status and the module logger
+func (m *Module) Inject(publisher event.Publisher, logger log.Logger) {
+	m.publisher = publisher
+	m.logger = log.NewPrinter(logger)
+}
+
 func (m *Module) Init(ctx context.Context, c config.Config) error {
 	m.c = c
 	m.manager = miner.NewManager()
@@ -37,21 +47,89 @@ func (m *Module) Close(ctx context.Context) error {
 	return m.manager.Close(ctx)
 }
 
+// ValidateReload check the pools and miners that will be reloaded
+func (m *Module) ValidateReload(ctx context.Context, c config.Config) error {
+	return m.manager.ValidateReload(c.Sub("miner"))
+}
+
+// Reload restart only the miners that changed
+func (m *Module) Reload(ctx context.Context, c config.Config) error {
+	if err := m.manager.Reload(m.ctx, c.Sub("miner")); err != nil {
+		return err
+	}
+
+	m.c = c
+	return nil
+}
+
+// Provide make the miner manager available to the modules depend on it
+func (m *Module) Provide() []interface{} {
+	return []interface{}{m.manager}
+}
+
+// OptionalDependencies make the network module initialized first when it is
+// enabled, the miners follow the network status it publishes
+func (m *Module) OptionalDependencies() []string {
+	return []string{"network"}
+}
+
+// CheckHealth report whether the miners are running, stopped miners are
+// expected while the network is down
+func (m *Module) CheckHealth(ctx context.Context) api.HealthStatus {
+	status := m.manager.Status()
+	message := "miners stopped"
+	if status.Running {
+		message = "miners running"
+	}
+
+	return api.HealthStatus{
+		OK:      true,
+		Message: message,
+		Details: map[string]interface{}{
+			"running": status.Running,
+			"miners":  status.Miners,
+		},
+	}
+}
+
 func (m *Module) CreateEndpoints(mws ...api.Middleware) []api.Endpoint {
 	return []api.Endpoint{}
 }
 
+// CreateSinks only keep the latest network status when the miners are slow
+// to start or stop, while the requests wait a bit for them
 func (m *Module) CreateSinks() []event.Sink {
+	requestOverflow := event.BlockOnOverflow(time.Second)
+
 	return []event.Sink{
 		{
 			Topic:   network.EventStatusChangedTopic,
 			Handler: m.networkChangedEventHandler(),
+			Options: []event.SubscribeConfigurator{event.OnOverflow(event.DropOldest)},
+		},
+		{
+			Topic:   miner.EventStatusTopic,
+			Handler: m.requestHandler(nil),
+			Options: []event.SubscribeConfigurator{requestOverflow},
+		},
+		{
+			Topic:   miner.EventStartTopic,
+			Handler: m.requestHandler(m.manager.Start),
+			Options: []event.SubscribeConfigurator{requestOverflow},
+		},
+		{
+			Topic:   miner.EventStopTopic,
+			Handler: m.requestHandler(m.manager.Stop),
+			Options: []event.SubscribeConfigurator{requestOverflow},
 		},
 	}
 }
 
 func New() *Module {
-	return &Module{}
+	return &Module{
+		publisher: event.DefaultPublisher(),
+		logger:    log.NewPrinter(log.Named("miner", nil)),
+	}
 }
 
 func newApiModule() api.Module {
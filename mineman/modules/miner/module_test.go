@@ -0,0 +1,170 @@
+package miner
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/event/eventtest"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+	"github.com/euiko/tooyoul/mineman/pkg/miner"
+	"github.com/euiko/tooyoul/mineman/pkg/network"
+)
+
+const waitTimeout = time.Second
+
+func newTestModule() *Module {
+	m := New()
+	m.manager = miner.NewManager()
+	m.ctx = context.Background()
+	return m
+}
+
+func TestNetworkChanged(t *testing.T) {
+	ctx := context.Background()
+	broker := eventtest.Install(t)
+	m := newTestModule()
+
+	sub := event.Subscribe(ctx, network.EventStatusChangedTopic, m.networkChangedEventHandler())
+	if err := sub.Error(); err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	up := event.FromEventDescriptor(&network.EventNetworkUp{At: time.Now()})
+	down := event.FromEventDescriptor(&network.EventNetworkDown{At: time.Now()})
+
+	// network up start the miners
+	msgs := broker.Deliver(ctx, network.EventStatusChangedTopic, up)
+	if len(msgs) != 1 {
+		t.Fatalf("expect 1 delivered message, got %d", len(msgs))
+	}
+	msgs[0].ExpectAck(t, waitTimeout)
+
+	published := broker.ExpectPublish(t, miner.EventStatusChangedTopic, "miner.status", waitTimeout)
+	if !published.Option.Retain {
+		t.Fatal("expect the miner status to be retained")
+	}
+	var status miner.EventMinerStatus
+	if err := published.Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Running {
+		t.Fatal("expect the miners to be running")
+	}
+
+	// the status is only published when it changed
+	broker.Deliver(ctx, network.EventStatusChangedTopic, up)[0].ExpectAck(t, waitTimeout)
+	broker.ExpectNoPublish(t, miner.EventStatusChangedTopic, 10*time.Millisecond)
+
+	// network down stop the miners
+	broker.Deliver(ctx, network.EventStatusChangedTopic, down)[0].ExpectAck(t, waitTimeout)
+	published = broker.ExpectPublish(t, miner.EventStatusChangedTopic, "miner.status", waitTimeout)
+	if err := published.Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Running {
+		t.Fatal("expect the miners to be stopped")
+	}
+}
+
+func TestRequestHandler(t *testing.T) {
+	ctx := context.Background()
+	broker := eventtest.Install(t)
+	m := newTestModule()
+	request := func() *eventtest.Message {
+		return broker.NewMessage(miner.EventStartTopic, event.StringPayload(""),
+			event.WithHeader(event.HeaderReplyTo, "reply.start"),
+			event.WithHeader(event.HeaderCorrelationID, "1"),
+		)
+	}
+
+	// start the miners and reply with the status
+	msg := request()
+	m.requestHandler(m.manager.Start).HandleMessage(ctx, msg)
+	msg.ExpectAck(t, waitTimeout)
+	broker.ExpectPublish(t, miner.EventStatusChangedTopic, "miner.status", waitTimeout)
+	reply := broker.ExpectPublish(t, "reply.start", "miner.status", waitTimeout)
+	if reply.Option.Headers[event.HeaderCorrelationID] != "1" {
+		t.Fatalf("expect the reply correlated to the request, got %v", reply.Option.Headers)
+	}
+
+	// failed command is replied with the error
+	errFailed := errors.New("failed")
+	msg = request()
+	m.requestHandler(func(ctx context.Context) error { return errFailed }).HandleMessage(ctx, msg)
+	msg.ExpectAck(t, waitTimeout)
+	reply = broker.ExpectPublish(t, "reply.start", "miner.status", waitTimeout)
+	if reply.Option.Headers[event.HeaderError] != errFailed.Error() {
+		t.Fatalf("expect the reply to carry the error, got %v", reply.Option.Headers)
+	}
+
+	// failed reply nack the request, it is acked on redelivery
+	broker.FailPublish(func(topic string) error { return errFailed })
+	msg = request()
+	m.requestHandler(nil).HandleMessage(ctx, msg)
+	msg.ExpectNack(t, waitTimeout)
+
+	broker.FailPublish(nil)
+	redelivered := msg.Redeliver(ctx)
+	m.requestHandler(nil).HandleMessage(ctx, redelivered)
+	redelivered.ExpectAck(t, waitTimeout)
+	if redelivered.Deliveries() != 2 {
+		t.Fatalf("expect 2 deliveries, got %d", redelivered.Deliveries())
+	}
+	broker.ExpectPublish(t, "reply.start", "miner.status", waitTimeout)
+}
+
+// countingLogger count the logged messages by their level
+type countingLogger struct {
+	mu     sync.Mutex
+	levels map[log.Level]int
+}
+
+func (l *countingLogger) Init(ctx context.Context, c config.Config) error { return nil }
+func (l *countingLogger) Close(ctx context.Context) error                 { return nil }
+func (l *countingLogger) SetLevel(level log.Level)                        {}
+
+func (l *countingLogger) Log(level log.Level, msg *log.MessageLog) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.levels[level]++
+}
+
+func TestInjectedLogger(t *testing.T) {
+	ctx := context.Background()
+	broker := eventtest.Install(t)
+	logger := &countingLogger{levels: make(map[log.Level]int)}
+	m := newTestModule()
+	m.Inject(event.DefaultPublisher(), logger)
+
+	// the failed command is logged through the injected logger
+	msg := broker.NewMessage(miner.EventStartTopic, event.StringPayload(""))
+	m.requestHandler(func(ctx context.Context) error { return errors.New("failed") }).HandleMessage(ctx, msg)
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if logger.levels[log.ErrorLevel] != 1 {
+		t.Fatalf("expect the error logged through the injected logger, got %v", logger.levels)
+	}
+}
+
+func TestSinkOverflow(t *testing.T) {
+	m := newTestModule()
+
+	expects := map[string]event.OverflowPolicy{
+		network.EventStatusChangedTopic: event.DropOldest,
+		miner.EventStatusTopic:          event.Block,
+		miner.EventStartTopic:           event.Block,
+		miner.EventStopTopic:            event.Block,
+	}
+	for _, sink := range m.CreateSinks() {
+		if overflow := event.NewSubscribeOption(sink.Options...).Overflow; overflow != expects[sink.Topic] {
+			t.Errorf("expect %s sink overflow %s, got %s", sink.Topic, expects[sink.Topic], overflow)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package network
 import (
 	"context"
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -32,9 +33,22 @@ type (
 	Module struct {
 		c        config.Config
 		settings Settings
+
+		// mu guard the reloadable settings and the ping results read by
+		// the checks
+		mu       sync.Mutex
+		started  time.Time
+		lastPing time.Time
+		lastErr  error
+		status   string
 	}
 )
 
+const (
+	statusUp   = "up"
+	statusDown = "down"
+)
+
 func (m *Module) Init(ctx context.Context, c config.Config) error {
 	m.c = c
 	if err := c.Get("network").Scan(&m.settings); err != nil {
@@ -46,30 +60,152 @@ func (m *Module) Init(ctx context.Context, c config.Config) error {
 	}
 
 	log.Trace("network config is %v", log.WithValues(m.settings))
+	m.mu.Lock()
+	m.started = time.Now()
+	m.mu.Unlock()
 	go m.runPing(ctx)
 
 	return nil
 }
 
+// ValidateReload check the settings that will be reloaded
+func (m *Module) ValidateReload(ctx context.Context, c config.Config) error {
+	_, err := loadSettings(c)
+	return err
+}
+
+// Reload apply the new targets, intervals and thresholds from the next ping,
+// enabling or disabling the module requires a restart
+func (m *Module) Reload(ctx context.Context, c config.Config) error {
+	settings, err := loadSettings(c)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if settings.Enabled != m.settings.Enabled {
+		log.Warning("network enabled changes requires a restart")
+		settings.Enabled = m.settings.Enabled
+	}
+	m.c = c
+	m.settings = settings
+
+	return nil
+}
+
+// loadSettings read the reloaded settings, starting from the defaults like
+// the init does
+func loadSettings(c config.Config) (Settings, error) {
+	settings := New().settings
+	if err := c.Get("network").Scan(&settings); err != nil {
+		return settings, err
+	}
+
+	switch {
+	case len(settings.Targets) == 0:
+		return settings, fmt.Errorf("network targets can't be empty")
+	case settings.DownThreshold <= 0 || settings.UpThreshold <= 0:
+		return settings, fmt.Errorf("network thresholds must be positive")
+	case settings.Timeout <= 0 || settings.InitialInterval <= 0 || settings.MaxInterval <= 0:
+		return settings, fmt.Errorf("network timeout and intervals must be positive")
+	}
+
+	return settings, nil
+}
+
+func (m *Module) currentSettings() Settings {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.settings
+}
+
 func (m *Module) Close(ctx context.Context) error {
 	return nil
 }
 
-func (m *Module) runPing(ctx context.Context) {
+// CheckHealth make sure the ping loop is alive, the pings are apart by at
+// most the max interval and the ping timeout
+func (m *Module) CheckHealth(ctx context.Context) api.HealthStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	log.Trace("running ping...", log.WithField("initial_interval", m.settings.InitialInterval.String()))
+	last := m.lastPing
+	if last.IsZero() {
+		last = m.started
+	}
+	age := time.Since(last)
+
+	details := map[string]interface{}{
+		"last_ping_age": age.Round(time.Millisecond).String(),
+	}
+	if m.lastErr != nil {
+		details["last_error"] = m.lastErr.Error()
+	}
+
+	if maxAge := 2 * (m.settings.MaxInterval + m.settings.Timeout); age > maxAge {
+		return api.HealthStatus{
+			Message: fmt.Sprintf("no ping result for %s", age.Round(time.Second)),
+			Details: details,
+		}
+	}
+
+	return api.HealthStatus{OK: true, Details: details}
+}
+
+// CheckReadiness report whether the network is up
+func (m *Module) CheckReadiness(ctx context.Context) api.HealthStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch m.status {
+	case statusUp:
+		return api.HealthStatus{OK: true, Message: "network is up"}
+	case statusDown:
+		return api.HealthStatus{Message: "network is down"}
+	default:
+		return api.HealthStatus{Message: "network status is not yet known"}
+	}
+}
+
+// record keep the ping result for the checks
+func (m *Module) record(err error, ed event.EventDescriptor, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastPing = now
+	m.lastErr = err
+	switch ed.(type) {
+	case *network.EventNetworkUp:
+		m.status = statusUp
+	case *network.EventNetworkDown:
+		m.status = statusDown
+	}
+}
+
+func (m *Module) runPing(ctx context.Context) {
+	settings := m.currentSettings()
+	log.Trace("running ping...", log.WithField("initial_interval", settings.InitialInterval.String()))
 
 	// setup exponential backoff
 	b := backoff.NewExponentialBackOff()
-	b.InitialInterval = m.settings.InitialInterval
-	b.MaxInterval = m.settings.MaxInterval
+	b.InitialInterval = settings.InitialInterval
+	b.MaxInterval = settings.MaxInterval
 	b.Reset() // reset for the first attempt
 
-	errCount := 0
-	okCount := 0
+	tracker := newStatusTracker(settings.DownThreshold, settings.UpThreshold)
 
-	// TODO: refactor with state machine
 	for {
+		// pick up the reloaded settings
+		settings = m.currentSettings()
+		tracker.downThreshold = settings.DownThreshold
+		tracker.upThreshold = settings.UpThreshold
+		if b.InitialInterval != settings.InitialInterval || b.MaxInterval != settings.MaxInterval {
+			b.InitialInterval = settings.InitialInterval
+			b.MaxInterval = settings.MaxInterval
+			b.Reset()
+		}
+
 		waitDuration := b.NextBackOff()
 		log.Trace("waiting backoff timeout", log.WithField("wait_duration", waitDuration.String()))
 		select {
@@ -78,76 +214,53 @@ func (m *Module) runPing(ctx context.Context) {
 			// re run the tests
 		case <-time.After(waitDuration):
 			log.Debug("doing ping...")
-			if err := m.doPing(ctx); err != nil {
-				if errCount > 0 && okCount > 0 {
-					okCount = 0
-				}
-
+			err := m.doPing(ctx, settings)
+			if err != nil {
 				log.Debug("do ping error", log.WithError(err))
-
-				// when errors add the errCount
-				errCount++
-
-				// reset okCount when err threshold met
-				if errCount == m.settings.DownThreshold {
-					okCount = 0
-					log.Debug("network changes detected to down")
-					e := network.EventNetworkDown{
-						At: time.Now(),
-					}
-					if err := event.Publish(
-						ctx,
-						network.EventStatusChangedTopic,
-						event.FromEventDescriptor(&e),
-					); err != nil {
-						log.Fatal("failed when publish network status down", log.WithError(err))
-					}
-				}
-
-				continue
+			} else {
+				// always reset backoff when no error
+				b.Reset()
 			}
 
-			if errCount > 0 && okCount > 0 {
-				errCount = 0
+			now := time.Now()
+			ed := tracker.observe(err, now)
+			m.record(err, ed, now)
+			if ed != nil {
+				m.publishStatus(ctx, ed, now)
 			}
-
-			// always increment ok and reset backoff when no error
-			okCount++
-			b.Reset()
-
-			// reset errCount when ok threshold met
-			if okCount == m.settings.UpThreshold {
-				errCount = 0
-				log.Debug("network changes detected to up")
-				e := network.EventNetworkUp{
-					At: time.Now(),
-				}
-				if err := event.Publish(
-					ctx,
-					network.EventStatusChangedTopic,
-					event.FromEventDescriptor(&e),
-				); err != nil {
-					log.Fatal("failed when publish network status up", log.WithError(err))
-				}
-			}
-
 		}
 	}
 }
 
-func (m *Module) doPing(ctx context.Context) error {
-	newCtx, cancel := context.WithTimeout(ctx, m.settings.Timeout)
+// publishStatus publish the retained network status, so the late
+// subscribers receive the current status. The change is keyed by its time,
+// so the retries of the same change are delivered once
+func (m *Module) publishStatus(ctx context.Context, ed event.EventDescriptor, at time.Time) {
+	log.Debug("network changes detected", log.WithField("event", ed.Name()))
+	if err := event.Publish(
+		ctx,
+		network.EventStatusChangedTopic,
+		event.FromEventDescriptor(ed),
+		event.Retain(),
+		event.IdempotencyKey(fmt.Sprintf("%s-%d", ed.Name(), at.UnixNano())),
+	); err != nil {
+		log.Error("failed when publish network status", log.WithError(err), log.WithField("event", ed.Name()))
+	}
+}
+
+func (m *Module) doPing(ctx context.Context, settings Settings) error {
+	newCtx, cancel := context.WithTimeout(ctx, settings.Timeout)
 	defer cancel()
 
 	var (
 		totalDone   int32 = 0
-		totalTarget       = len(m.settings.Targets)
+		totalTarget       = len(settings.Targets)
 		pingChan          = make(chan icmp.PingResult)
 		result            = []icmp.PingResult{}
 	)
 
-	for _, target := range m.settings.Targets {
-		p, err := icmp.Ping(newCtx, target, icmp.PingCount(m.settings.Count), icmp.PingTimeout(m.settings.Timeout))
+	for _, target := range settings.Targets {
+		p, err := icmp.Ping(newCtx, target, icmp.PingCount(settings.Count), icmp.PingTimeout(settings.Timeout))
 		if err != nil {
 			return err
 		}
@@ -189,7 +302,7 @@ collect:
 	totalPing := len(result)
 	lossRatio := float64(totalError) / float64(totalPing)
 
-	if lossRatio >= m.settings.LossThreshold {
+	if lossRatio >= settings.LossThreshold {
 		return fmt.Errorf("loss exceed threshold, with %d/%d loss detected", totalError, totalPing)
 	}
 
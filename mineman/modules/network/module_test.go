@@ -0,0 +1,102 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event/eventtest"
+	"github.com/euiko/tooyoul/mineman/pkg/network"
+)
+
+func TestStatusTracker(t *testing.T) {
+	errPing := errors.New("ping failed")
+	tracker := newStatusTracker(2, 2)
+	now := time.Now()
+
+	steps := []struct {
+		err    error
+		expect string
+	}{
+		{nil, ""},
+		{nil, "network.up"},
+		{nil, ""},
+		{errPing, ""},
+		// an ok result in between restart the error count
+		{nil, ""},
+		{errPing, ""},
+		{errPing, "network.down"},
+		{errPing, ""},
+		{nil, ""},
+		{nil, "network.up"},
+	}
+
+	for i, step := range steps {
+		ed := tracker.observe(step.err, now)
+		name := ""
+		if ed != nil {
+			name = ed.Name()
+		}
+
+		if name != step.expect {
+			t.Fatalf("step %d expect event %q, got %q", i, step.expect, name)
+		}
+	}
+}
+
+func TestPublishStatus(t *testing.T) {
+	ctx := context.Background()
+	broker := eventtest.Install(t)
+	m := New()
+
+	now := time.Now()
+	m.publishStatus(ctx, &network.EventNetworkDown{At: now}, now)
+	published := broker.ExpectPublish(t, network.EventStatusChangedTopic, "network.down", time.Second)
+	if !published.Option.Retain {
+		t.Fatal("expect the network status to be retained")
+	}
+
+	var e network.EventNetworkDown
+	if err := published.Scan(&e); err != nil {
+		t.Fatal(err)
+	}
+
+	// retrying the same change doesn't publish it twice
+	m.publishStatus(ctx, &network.EventNetworkDown{At: now}, now)
+	broker.ExpectNoPublish(t, network.EventStatusChangedTopic, time.Millisecond*50)
+}
+
+func TestChecks(t *testing.T) {
+	ctx := context.Background()
+	m := New()
+	m.settings.MaxInterval = time.Second
+	m.settings.Timeout = time.Second
+	now := time.Now()
+	m.started = now
+
+	if status := m.CheckReadiness(ctx); status.OK {
+		t.Fatal("expect not ready while the status is unknown")
+	}
+	if status := m.CheckHealth(ctx); !status.OK {
+		t.Fatalf("expect healthy right after started, got %s", status.Message)
+	}
+
+	m.record(nil, &network.EventNetworkUp{At: now}, now)
+	if status := m.CheckReadiness(ctx); !status.OK {
+		t.Fatalf("expect ready when the network is up, got %s", status.Message)
+	}
+
+	// the ping loop is stuck
+	m.record(errors.New("ping failed"), nil, now.Add(-time.Minute))
+	status := m.CheckHealth(ctx)
+	if status.OK {
+		t.Fatal("expect unhealthy when there is no recent ping")
+	}
+	if status.Details["last_error"] != "ping failed" {
+		t.Errorf("expect the last error reported, got %v", status.Details)
+	}
+	if status := m.CheckReadiness(ctx); !status.OK {
+		t.Error("expect the status kept until it changes")
+	}
+}
@@ -0,0 +1,59 @@
+package network
+
+import (
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/network"
+)
+
+// statusTracker count the consecutive ping results, the network status only
+// changes after the results reach its threshold
+type statusTracker struct {
+	downThreshold int
+	upThreshold   int
+	errCount      int
+	okCount       int
+}
+
+// observe record a ping result, it returns the status changed event when the
+// threshold is met, otherwise nil
+func (t *statusTracker) observe(err error, now time.Time) event.EventDescriptor {
+	if err != nil {
+		if t.errCount > 0 && t.okCount > 0 {
+			t.okCount = 0
+		}
+
+		// when errors add the errCount
+		t.errCount++
+
+		// reset okCount when err threshold met
+		if t.errCount == t.downThreshold {
+			t.okCount = 0
+			return &network.EventNetworkDown{At: now}
+		}
+
+		return nil
+	}
+
+	if t.errCount > 0 && t.okCount > 0 {
+		t.errCount = 0
+	}
+
+	t.okCount++
+
+	// reset errCount when ok threshold met
+	if t.okCount == t.upThreshold {
+		t.errCount = 0
+		return &network.EventNetworkUp{At: now}
+	}
+
+	return nil
+}
+
+func newStatusTracker(downThreshold int, upThreshold int) *statusTracker {
+	return &statusTracker{
+		downThreshold: downThreshold,
+		upThreshold:   upThreshold,
+	}
+}
@@ -0,0 +1,341 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	// embed the timezone database, windows hosts don't have one
+	_ "time/tzdata"
+
+	"github.com/euiko/tooyoul/mineman/pkg/app"
+	"github.com/euiko/tooyoul/mineman/pkg/app/api"
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+	"github.com/euiko/tooyoul/mineman/pkg/miner"
+	"github.com/euiko/tooyoul/mineman/pkg/schedule"
+)
+
+// window actions
+const (
+	// ActionEvent only publish the window state
+	ActionEvent = "event"
+	// ActionMiner start the miners while the window is open and stop them
+	// otherwise, the miners run when any of the miner windows is open
+	ActionMiner = "miner"
+)
+
+// maxWait bound the sleep between evaluations, so a suspended host or a
+// wall clock change is noticed
+const maxWait = time.Minute
+
+type (
+	WindowSettings struct {
+		Name string `mapstructure:"name"`
+		// Open and Close are cron expressions, e.g. "0 22 * * *"
+		Open  string `mapstructure:"open"`
+		Close string `mapstructure:"close"`
+		// Timezone of the expressions, the scheduler timezone by default
+		Timezone string `mapstructure:"timezone"`
+		Action   string `mapstructure:"action"`
+	}
+
+	OverrideSettings struct {
+		Name string `mapstructure:"name"`
+		// Window is the overridden window, empty means all the windows
+		Window string `mapstructure:"window"`
+		// From and Until are RFC3339 time
+		From  string `mapstructure:"from"`
+		Until string `mapstructure:"until"`
+		// State is either open or closed
+		State string `mapstructure:"state"`
+	}
+
+	Settings struct {
+		Enabled  bool   `mapstructure:"enabled"`
+		Timezone string `mapstructure:"timezone"`
+		// RetryInterval is the wait before retrying a failed action
+		RetryInterval time.Duration `mapstructure:"retry_interval"`
+		// RequestTimeout bound the wait of the miner replies
+		RequestTimeout time.Duration      `mapstructure:"request_timeout"`
+		Windows        []WindowSettings   `mapstructure:"windows"`
+		Overrides      []OverrideSettings `mapstructure:"overrides"`
+	}
+
+	Module struct {
+		settings Settings
+		calendar *schedule.Calendar
+		actions  map[string]string
+		cancel   context.CancelFunc
+
+		// applied is the last published window states and minerRunning is
+		// the last applied miner state, they are only touched by evaluate
+		mu           sync.Mutex
+		applied      map[string]schedule.State
+		minerRunning *bool
+	}
+)
+
+func (m *Module) Init(ctx context.Context, c config.Config) error {
+	if err := c.Get("scheduler").Scan(&m.settings); err != nil {
+		return err
+	}
+
+	calendar, actions, err := newCalendar(&m.settings)
+	if err != nil {
+		return err
+	}
+	m.calendar = calendar
+	m.actions = actions
+
+	ctx, m.cancel = context.WithCancel(ctx)
+	go m.run(ctx)
+
+	return nil
+}
+
+func (m *Module) Close(ctx context.Context) error {
+	if m.cancel != nil {
+		m.cancel()
+	}
+
+	return nil
+}
+
+func (m *Module) CreateEndpoints(mws ...api.Middleware) []api.Endpoint {
+	return []api.Endpoint{
+		{
+			Method:  "GET",
+			Path:    "/schedule/windows",
+			Handler: m.windowsHandler(),
+		},
+		{
+			Method:  "GET",
+			Path:    "/schedule/upcoming",
+			Handler: m.upcomingHandler(),
+		},
+	}
+}
+
+func (m *Module) run(ctx context.Context) {
+	for {
+		now := time.Now()
+		wait := maxWait
+		if !m.evaluate(ctx, now) {
+			wait = m.settings.RetryInterval
+		}
+
+		if next := m.calendar.NextChange(now); !next.IsZero() && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// evaluate publish the changed window states and apply the miner action, it
+// returns false when any of them failed so it is retried
+func (m *Module) evaluate(ctx context.Context, now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ok := true
+	minerWindows, minerOpen := 0, false
+	for _, s := range m.calendar.States(now) {
+		if m.actions[s.Window] == ActionMiner {
+			minerWindows++
+			minerOpen = minerOpen || s.Open
+		}
+
+		if prev, applied := m.applied[s.Window]; applied && prev.Open == s.Open {
+			continue
+		}
+
+		log.Info("schedule window changed", log.WithField("window", s.Window), log.WithField("open", s.Open))
+		if err := event.Publish(
+			ctx,
+			schedule.WindowChangedTopic(s.Window),
+			event.FromEventDescriptor(schedule.NewStateEvent(s)),
+			event.Retain(),
+		); err != nil {
+			log.Error("failed when publishing schedule window state", log.WithError(err), log.WithField("window", s.Window))
+			ok = false
+			continue
+		}
+		m.applied[s.Window] = s
+	}
+
+	if minerWindows > 0 && (m.minerRunning == nil || *m.minerRunning != minerOpen) {
+		if err := m.applyMiner(ctx, minerOpen); err != nil {
+			log.Error("failed when applying schedule to the miners", log.WithError(err), log.WithField("running", minerOpen))
+			return false
+		}
+		m.minerRunning = &minerOpen
+	}
+
+	return ok
+}
+
+// applyMiner request the miner module to start or stop the miners
+func (m *Module) applyMiner(ctx context.Context, running bool) error {
+	topic := miner.EventStopTopic
+	if running {
+		topic = miner.EventStartTopic
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.settings.RequestTimeout)
+	defer cancel()
+
+	_, err := event.Request(ctx, topic, event.StringPayload(""))
+	return err
+}
+
+func (m *Module) windowsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.calendar.States(time.Now()))
+	})
+}
+
+// upcomingHandler list the next window changes, ?count= limit them to
+// at most 100, the overrides are taken into account
+func (m *Module) upcomingHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := 10
+		if value := r.URL.Query().Get("count"); value != "" {
+			var err error
+			if count, err = strconv.Atoi(value); err != nil || count < 1 || count > 100 {
+				http.Error(w, "count must be between 1 and 100", http.StatusBadRequest)
+				return
+			}
+		}
+
+		writeJSON(w, m.calendar.Upcoming(time.Now(), count))
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("failed when writing schedule", log.WithError(err))
+	}
+}
+
+func newCalendar(s *Settings) (*schedule.Calendar, map[string]string, error) {
+	defaultLoc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	calendar := schedule.Calendar{}
+	actions := make(map[string]string, len(s.Windows))
+	for _, ws := range s.Windows {
+		if err := event.ValidateTopic(schedule.WindowChangedTopic(ws.Name)); err != nil {
+			return nil, nil, fmt.Errorf("window %q: %w", ws.Name, err)
+		}
+		if _, ok := actions[ws.Name]; ok {
+			return nil, nil, fmt.Errorf("window %q is defined twice", ws.Name)
+		}
+
+		loc := defaultLoc
+		if ws.Timezone != "" {
+			if loc, err = time.LoadLocation(ws.Timezone); err != nil {
+				return nil, nil, fmt.Errorf("window %q: %w", ws.Name, err)
+			}
+		}
+
+		open, err := schedule.ParseCron(ws.Open, loc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("window %q: %w", ws.Name, err)
+		}
+		closing, err := schedule.ParseCron(ws.Close, loc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("window %q: %w", ws.Name, err)
+		}
+
+		switch ws.Action {
+		case "":
+			ws.Action = ActionEvent
+		case ActionEvent, ActionMiner:
+		default:
+			return nil, nil, fmt.Errorf("window %q: unknown action %q", ws.Name, ws.Action)
+		}
+
+		actions[ws.Name] = ws.Action
+		calendar.Windows = append(calendar.Windows, &schedule.Window{
+			Name:  ws.Name,
+			Open:  open,
+			Close: closing,
+		})
+	}
+
+	for i := range s.Overrides {
+		o, err := newOverride(&s.Overrides[i], defaultLoc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("override %q: %w", s.Overrides[i].Name, err)
+		}
+		if _, ok := actions[o.Window]; o.Window != "" && !ok {
+			return nil, nil, fmt.Errorf("override %q: unknown window %q", o.Name, o.Window)
+		}
+
+		calendar.Overrides = append(calendar.Overrides, o)
+	}
+
+	return &calendar, actions, nil
+}
+
+func newOverride(s *OverrideSettings, loc *time.Location) (*schedule.Override, error) {
+	o := schedule.Override{
+		Name:   s.Name,
+		Window: s.Window,
+	}
+
+	var err error
+	if o.From, err = time.ParseInLocation(time.RFC3339, s.From, loc); err != nil {
+		return nil, err
+	}
+	if o.Until, err = time.ParseInLocation(time.RFC3339, s.Until, loc); err != nil {
+		return nil, err
+	}
+	if !o.From.Before(o.Until) {
+		return nil, fmt.Errorf("from must be before until")
+	}
+
+	switch s.State {
+	case "open":
+		o.Open = true
+	case "closed":
+		o.Open = false
+	default:
+		return nil, fmt.Errorf("unknown state %q, expect open or closed", s.State)
+	}
+
+	return &o, nil
+}
+
+func New() *Module {
+	return &Module{
+		settings: Settings{
+			Timezone:       "Local",
+			RetryInterval:  time.Second * 30,
+			RequestTimeout: time.Second * 10,
+		},
+		applied: make(map[string]schedule.State),
+	}
+}
+
+func newModule() api.Module {
+	return New()
+}
+
+func init() {
+	app.RegisterModule("scheduler", newModule)
+}
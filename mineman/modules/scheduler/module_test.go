@@ -0,0 +1,114 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/event/eventtest"
+	"github.com/euiko/tooyoul/mineman/pkg/miner"
+	"github.com/euiko/tooyoul/mineman/pkg/schedule"
+)
+
+func TestEvaluate(t *testing.T) {
+	ctx := context.Background()
+	broker := eventtest.Install(t)
+
+	m := New()
+	m.settings.Timezone = "UTC"
+	m.settings.Windows = []WindowSettings{
+		{Name: "night", Open: "0 22 * * *", Close: "0 6 * * *", Action: ActionMiner},
+		{Name: "weekend", Open: "0 0 * * sat", Close: "0 0 * * mon"},
+	}
+	m.settings.Overrides = []OverrideSettings{
+		{Name: "maintenance", Window: "night", From: "2021-10-01T23:00:00Z", Until: "2021-10-02T01:00:00Z", State: "closed"},
+	}
+	var err error
+	if m.calendar, m.actions, err = newCalendar(&m.settings); err != nil {
+		t.Fatal(err)
+	}
+
+	// answer the miner requests like the miner module does
+	commands := []string{}
+	replier := event.MessageHandlerFunc(func(ctx context.Context, message event.Message) {
+		commands = append(commands, message.Topic())
+		<-message.Reply(ctx, event.StringPayload("ok"))
+		<-message.Ack(ctx)
+	})
+	event.Subscribe(ctx, miner.EventStartTopic, replier)
+	event.Subscribe(ctx, miner.EventStopTopic, replier)
+
+	at := func(value string) time.Time {
+		tm, _ := time.Parse(time.RFC3339, value)
+		return tm
+	}
+	expectWindow := func(window string, name string) {
+		t.Helper()
+		p := broker.ExpectPublish(t, schedule.WindowChangedTopic(window), name, time.Second)
+		if !p.Option.Retain {
+			t.Fatal("expect the window state to be retained")
+		}
+	}
+
+	// the initial states are published and applied
+	if !m.evaluate(ctx, at("2021-10-01T12:00:00Z")) {
+		t.Fatal("expect evaluation succeeded")
+	}
+	expectWindow("night", "schedule.mining-window-closed")
+	expectWindow("weekend", "schedule.mining-window-closed")
+
+	// unchanged states are not published again
+	m.evaluate(ctx, at("2021-10-01T13:00:00Z"))
+	broker.ExpectNoPublish(t, schedule.WindowChangedTopic("night"), 10*time.Millisecond)
+
+	m.evaluate(ctx, at("2021-10-01T22:00:00Z"))
+	expectWindow("night", "schedule.mining-window-open")
+	m.evaluate(ctx, at("2021-10-01T23:00:00Z"))
+	expectWindow("night", "schedule.mining-window-closed")
+
+	// the failed miner request is retried on the next evaluation
+	broker.FailPublish(func(topic string) error {
+		if topic == miner.EventStartTopic {
+			return event.ErrRequestFailed
+		}
+		return nil
+	})
+	if m.evaluate(ctx, at("2021-10-02T01:00:00Z")) {
+		t.Fatal("expect evaluation failed")
+	}
+	expectWindow("night", "schedule.mining-window-open")
+	broker.FailPublish(nil)
+	if !m.evaluate(ctx, at("2021-10-02T01:01:00Z")) {
+		t.Fatal("expect evaluation succeeded")
+	}
+
+	expect := []string{
+		miner.EventStopTopic,
+		miner.EventStartTopic,
+		miner.EventStopTopic,
+		miner.EventStartTopic,
+	}
+	if len(commands) != len(expect) {
+		t.Fatalf("expect miner commands %v, got %v", expect, commands)
+	}
+	for i := range expect {
+		if commands[i] != expect[i] {
+			t.Fatalf("expect miner commands %v, got %v", expect, commands)
+		}
+	}
+}
+
+func TestNewCalendarInvalid(t *testing.T) {
+	for name, s := range map[string]Settings{
+		"timezone": {Timezone: "Mars/Olympus"},
+		"cron":     {Windows: []WindowSettings{{Name: "night", Open: "0 25 * * *", Close: "0 6 * * *"}}},
+		"name":     {Windows: []WindowSettings{{Name: "night.*", Open: "0 22 * * *", Close: "0 6 * * *"}}},
+		"action":   {Windows: []WindowSettings{{Name: "night", Open: "0 22 * * *", Close: "0 6 * * *", Action: "reboot"}}},
+		"override": {Overrides: []OverrideSettings{{Name: "x", Window: "night", From: "2021-10-01T00:00:00Z", Until: "2021-10-02T00:00:00Z", State: "open"}}},
+	} {
+		if _, _, err := newCalendar(&s); err == nil {
+			t.Fatalf("expect invalid %s", name)
+		}
+	}
+}
@@ -18,4 +18,32 @@ type (
 	DefaultModule interface {
 		Default() bool
 	}
+
+	// DependentModule is extension to Module that declare the names of the
+	// modules it depends on, they are initialized before it and closed
+	// after it
+	DependentModule interface {
+		Dependencies() []string
+	}
+
+	// OptionalDependentModule is extension to Module that declare the names
+	// of the modules it works better with, they only affect the order when
+	// they are enabled
+	OptionalDependentModule interface {
+		OptionalDependencies() []string
+	}
+
+	// Reloadable is extension to Module that apply a new config without
+	// restarting. The config is validated by every module before any of
+	// them reload it, the current one should be kept when returning error
+	Reloadable interface {
+		ValidateReload(ctx context.Context, c config.Config) error
+		Reload(ctx context.Context, c config.Config) error
+	}
+
+	// ProviderModule is extension to Module that provide values to be
+	// injected into the modules initialized after it
+	ProviderModule interface {
+		Provide() []interface{}
+	}
 )
@@ -0,0 +1,25 @@
+package api
+
+import "context"
+
+type (
+	// HealthChecker is extension to Module that report whether it is still
+	// alive, a failing check means the process is worth restarting
+	HealthChecker interface {
+		CheckHealth(ctx context.Context) HealthStatus
+	}
+
+	// ReadinessChecker is extension to Module that report whether it is
+	// ready to do its work, e.g. the network is up
+	ReadinessChecker interface {
+		CheckReadiness(ctx context.Context) HealthStatus
+	}
+
+	// HealthStatus is the result of a check, Details hold the module
+	// specific values, e.g. the age of the last ping
+	HealthStatus struct {
+		OK      bool                   `json:"ok"`
+		Message string                 `json:"message,omitempty"`
+		Details map[string]interface{} `json:"details,omitempty"`
+	}
+)
@@ -2,9 +2,12 @@ package app
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/euiko/tooyoul/mineman/pkg/app/api"
 	"github.com/euiko/tooyoul/mineman/pkg/config"
@@ -16,15 +19,43 @@ type App struct {
 	config config.Config
 	name   string
 	hook   Hook
+	logger log.Logger
+
+	// reloads queue the config reloads, the requests made while one is
+	// pending are merged into it
+	reloads  chan struct{}
+	reloadMu sync.Mutex
+
+	injector injector
+
+	// mu guard the shutdown state, the modules are closed from the signal
+	// handler while they may still be initialized
+	mu        sync.Mutex
+	closed    bool
+	hookReady bool
+	modules   []loadedModule
+
+	gracePeriod   time.Duration
+	moduleTimeout time.Duration
+	shutdownOnce  sync.Once
+	shutdownErr   error
+}
 
-	injectedVals []interface{}
-	modules      []api.Module
+// loadedModule is an initialized module, ordered after its dependencies
+type loadedModule struct {
+	name   string
+	module api.Module
 }
 
 var registry ModuleRegistry
 
+// Inject provide the values to the modules, a module receive them by
+// declaring an Inject method with the types it needs as parameters, e.g.
+// Inject(publisher event.Publisher, logger log.Logger). The values are
+// matched by their type or the interface they implement, the rest are
+// created by the providers registered with RegisterProvider.
 func (a *App) Inject(vals ...interface{}) {
-	a.injectedVals = append(a.injectedVals, vals...)
+	a.injector.provide(vals...)
 }
 
 func (a *App) Run(ctx context.Context) error {
@@ -49,7 +80,20 @@ func (a *App) Run(ctx context.Context) error {
 	l.Init(ctx, a.config)
 	defer l.Close(ctx)
 	log.SetDefault(l)
+	a.logger = l
 
+	// SIGHUP always reload the config, the file changes only when watched
+	a.config.OnChange(a.requestReload)
+	if a.config.Get("config.watch").Bool(false) {
+		log.Info("watching config changes")
+		a.config.Watch()
+	}
+	a.gracePeriod = loadGracePeriod(a.config)
+	a.moduleTimeout = loadModuleTimeout(a.config)
+
+	// the run error is sent before the cancel, so it is there once the wait
+	// is done
+	runErr := make(chan error, 1)
 	runner.Run(ctx, runner.OperationFunc(func(ctx context.Context) error {
 		log.Trace("running application...")
 		err := a.run(ctx)
@@ -57,48 +101,48 @@ func (a *App) Run(ctx context.Context) error {
 			log.Error("running app error", log.WithError(err))
 		}
 
+		runErr <- err
 		cancel()
 		return err
 	})).OnSignal(runner.SignalHandlerFunc(func(ctx context.Context, sig os.Signal) {
 		if sig == syscall.SIGHUP {
+			a.requestReload()
 			return
 		}
 
-		newCtx := context.TODO()
-		for _, m := range a.modules {
-			if err := m.Close(newCtx); err != nil {
-				log.Error("error when closing modules", log.WithError(err))
-				return
-			}
-		}
-
-		if err := a.hook.Close(newCtx); err != nil {
-			log.Error("error when closing hook", log.WithError(err))
-			return
-		}
-
+		a.shutdown(fmt.Sprintf("received %s signal", sig))
 		cancel()
-		log.Trace("application closed")
 	})).Wait(ctx)
 
-	return nil
+	select {
+	case err := <-runErr:
+		if err != nil {
+			return err
+		}
+	default:
+	}
+
+	return a.shutdown("application stopped")
 }
 
 func (a *App) run(ctx context.Context) error {
-
-	moduleFactories := registry.LoadMap()
-	modules := []api.Module{}
+	// the modules and hook are closed only once, either here or by the
+	// signal handler
+	defer a.shutdown("application stopped")
 
 	log.Trace("initalizing hook...")
 	if err := a.hook.Init(ctx, a.config); err != nil {
 		return err
 	}
-	defer a.hook.Close(ctx)
+	a.mu.Lock()
+	a.hookReady = true
+	a.mu.Unlock()
 	log.Trace("hook initialized")
 
 	// instantiate all modules
 	log.Trace("loading modules...")
-	for n, f := range moduleFactories {
+	modules := make(map[string]api.Module)
+	for n, f := range registry.LoadMap() {
 		enabled := true
 		m := f()
 
@@ -115,42 +159,78 @@ func (a *App) run(ctx context.Context) error {
 			ext.ModuleLoaded(ctx, m)
 		}
 
-		modules = append(modules, m)
+		modules[n] = m
 	}
-	a.modules = modules
 	log.Trace("%d modules loaded", log.WithValues(len(modules)))
 
-	// calls modules init
-	log.Trace("initializing modules...")
-	for _, m := range a.modules {
+	names, err := sortModules(modules)
+	if err != nil {
+		return err
+	}
 
-		if err := m.Init(ctx, a.config); err != nil {
+	// calls modules init, the dependencies come first
+	log.Trace("initializing modules...")
+	for _, n := range names {
+		m := modules[n]
+		if err := a.injector.inject(n, m); err != nil {
 			return err
 		}
-		if ext, ok := a.hook.(HookModuleExt); ok {
-			ext.ModuleInitialized(ctx, m)
-		}
 
-		// inject values after module initialized
+		if err := m.Init(ctx, a.config); err != nil {
+			return fmt.Errorf("failed when initialize module %s: %w", n, err)
+		}
 
-		defer func(m api.Module) {
+		if !a.track(loadedModule{name: n, module: m}) {
+			// shutting down, it is too late for the module to be closed
+			// along with the others
 			if err := m.Close(ctx); err != nil {
-				log.Error("error while closing module", log.WithError(err))
+				log.Error("error when closing module", log.WithError(err), log.WithField("module", n))
 			}
-		}(m)
+			return nil
+		}
+
+		// the values are available to the modules depend on it
+		if pm, ok := m.(api.ProviderModule); ok {
+			a.injector.provide(pm.Provide()...)
+		}
+
+		if ext, ok := a.hook.(HookModuleExt); ok {
+			ext.ModuleInitialized(ctx, m)
+		}
+		if ext, ok := a.hook.(HookModuleNameExt); ok {
+			ext.ModuleNamed(ctx, n, m)
+		}
 	}
 	log.Trace("modules initialized")
 
+	go a.watchReload(ctx)
+
 	log.Trace("running hook")
 	defer log.Trace("hook run done")
 
 	return a.hook.Run(ctx)
 }
 
+// track keep the initialized module to be closed later, it returns false
+// when the app already closed
+func (a *App) track(m loadedModule) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return false
+	}
+
+	a.modules = append(a.modules, m)
+	return true
+}
+
 func New(name string, hooks ...Hook) *App {
 	return &App{
-		name: name,
-		hook: &chainedHook{hooks: hooks},
+		name:        name,
+		hook:        &chainedHook{hooks: hooks},
+		reloads:     make(chan struct{}, 1),
+		gracePeriod: defaultGracePeriod,
 	}
 }
 
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/euiko/tooyoul/mineman/pkg/app/api"
+)
+
+var (
+	ErrModuleDependencyMissing = errors.New("module dependency is not registered nor enabled")
+	ErrModuleDependencyCycle   = errors.New("module dependency cycle")
+)
+
+// sortModules order the module names so every module comes after its
+// dependencies and the enabled optional ones, the independent modules are
+// ordered by their names
+func sortModules(modules map[string]api.Module) ([]string, error) {
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		visiting = iota + 1
+		visited
+	)
+
+	states := make(map[string]int, len(modules))
+	sorted := make([]string, 0, len(modules))
+	path := []string{}
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch states[name] {
+		case visited:
+			return nil
+		case visiting:
+			// cut the path from the first occurrence to show only the cycle
+			for i, n := range path {
+				if n == name {
+					path = append(path[i:], name)
+					break
+				}
+			}
+			return fmt.Errorf("%w: %s", ErrModuleDependencyCycle, strings.Join(path, " -> "))
+		}
+
+		states[name] = visiting
+		path = append(path, name)
+
+		if dm, ok := modules[name].(api.DependentModule); ok {
+			for _, dep := range dm.Dependencies() {
+				if _, ok := modules[dep]; !ok {
+					return fmt.Errorf("%w: %s depends on %s", ErrModuleDependencyMissing, name, dep)
+				}
+
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+
+		if om, ok := modules[name].(api.OptionalDependentModule); ok {
+			for _, dep := range om.OptionalDependencies() {
+				if _, ok := modules[dep]; !ok {
+					continue
+				}
+
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		states[name] = visited
+		sorted = append(sorted, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return sorted, nil
+}
@@ -0,0 +1,95 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/euiko/tooyoul/mineman/pkg/app/api"
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+)
+
+type dependentModule []string
+
+func (m dependentModule) Init(ctx context.Context, c config.Config) error { return nil }
+func (m dependentModule) Close(ctx context.Context) error                 { return nil }
+func (m dependentModule) Dependencies() []string                          { return m }
+
+type optionalModule []string
+
+func (m optionalModule) Init(ctx context.Context, c config.Config) error { return nil }
+func (m optionalModule) Close(ctx context.Context) error                 { return nil }
+func (m optionalModule) OptionalDependencies() []string                  { return m }
+
+func TestSortModules(t *testing.T) {
+	sorted, err := sortModules(map[string]api.Module{
+		"web":       dependentModule{"miner"},
+		"miner":     dependentModule{"network"},
+		"scheduler": dependentModule{"miner", "events"},
+		"network":   dependentModule{},
+		"events":    dependentModule{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{"events", "network", "miner", "scheduler", "web"}
+	if !reflect.DeepEqual(sorted, expect) {
+		t.Errorf("expect order %v, got %v", expect, sorted)
+	}
+
+	_, err = sortModules(map[string]api.Module{
+		"miner": dependentModule{"network"},
+	})
+	if !errors.Is(err, ErrModuleDependencyMissing) {
+		t.Errorf("expect missing dependency error, got %v", err)
+	}
+
+	_, err = sortModules(map[string]api.Module{
+		"events":    dependentModule{},
+		"miner":     dependentModule{"network"},
+		"network":   dependentModule{"scheduler"},
+		"scheduler": dependentModule{"miner"},
+	})
+	if !errors.Is(err, ErrModuleDependencyCycle) {
+		t.Fatalf("expect dependency cycle error, got %v", err)
+	}
+	if msg := err.Error(); msg != "module dependency cycle: miner -> network -> scheduler -> miner" {
+		t.Errorf("expect the cycle described, got %s", msg)
+	}
+}
+
+func TestSortOptionalModules(t *testing.T) {
+	// the enabled optional dependency comes first
+	sorted, err := sortModules(map[string]api.Module{
+		"miner":   optionalModule{"network"},
+		"network": dependentModule{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"network", "miner"}; !reflect.DeepEqual(sorted, expect) {
+		t.Errorf("expect order %v, got %v", expect, sorted)
+	}
+
+	// the disabled one is skipped
+	sorted, err = sortModules(map[string]api.Module{
+		"miner":     optionalModule{"network"},
+		"scheduler": dependentModule{"miner"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []string{"miner", "scheduler"}; !reflect.DeepEqual(sorted, expect) {
+		t.Errorf("expect order %v, got %v", expect, sorted)
+	}
+
+	_, err = sortModules(map[string]api.Module{
+		"miner":   optionalModule{"network"},
+		"network": dependentModule{"miner"},
+	})
+	if !errors.Is(err, ErrModuleDependencyCycle) {
+		t.Errorf("expect dependency cycle error, got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/app/api"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+)
+
+const (
+	healthStatusOK      = "ok"
+	healthStatusFailing = "failing"
+)
+
+type (
+	// healthCheck is a check of a module by its registered name
+	healthCheck struct {
+		name  string
+		check func(ctx context.Context) api.HealthStatus
+	}
+
+	// healthReport aggregate the checks, it is failing when any of the
+	// checks isn't ok
+	healthReport struct {
+		Status string                      `json:"status"`
+		Checks map[string]api.HealthStatus `json:"checks"`
+	}
+)
+
+// runHealthChecks run all the checks concurrently, a check that doesn't
+// return within the timeout is reported as failing
+func runHealthChecks(ctx context.Context, checks []healthCheck, timeout time.Duration) healthReport {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		name   string
+		status api.HealthStatus
+	}
+
+	// buffered, so the late checks doesn't leak
+	results := make(chan result, len(checks))
+	for _, c := range checks {
+		go func(c healthCheck) {
+			results <- result{name: c.name, status: c.check(ctx)}
+		}(c)
+	}
+
+	report := healthReport{
+		Status: healthStatusOK,
+		Checks: make(map[string]api.HealthStatus, len(checks)),
+	}
+	for _, c := range checks {
+		report.Checks[c.name] = api.HealthStatus{Message: "check timed out"}
+	}
+
+wait:
+	for range checks {
+		select {
+		case r := <-results:
+			report.Checks[r.name] = r.status
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	for _, status := range report.Checks {
+		if !status.OK {
+			report.Status = healthStatusFailing
+		}
+	}
+
+	return report
+}
+
+// healthHandler serve the report of the checks, it responds with 503 when
+// the report is failing
+func healthHandler(checks []healthCheck, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := runHealthChecks(r.Context(), checks, timeout)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if report.Status != healthStatusOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Error("failed when writing health report", log.WithError(err))
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/app/api"
+)
+
+func TestHealthHandler(t *testing.T) {
+	ok := healthCheck{name: "network", check: func(ctx context.Context) api.HealthStatus {
+		return api.HealthStatus{OK: true}
+	}}
+	stuck := healthCheck{name: "miner", check: func(ctx context.Context) api.HealthStatus {
+		<-ctx.Done()
+		time.Sleep(time.Millisecond * 10)
+		return api.HealthStatus{OK: true}
+	}}
+
+	serve := func(checks ...healthCheck) (int, healthReport) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		healthHandler(checks, time.Millisecond*50).ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+
+		var report healthReport
+		if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, report
+	}
+
+	code, report := serve(ok)
+	if code != http.StatusOK || report.Status != healthStatusOK {
+		t.Errorf("expect ok report, got %d %s", code, report.Status)
+	}
+
+	// the checks that doesn't return in time are failing
+	code, report = serve(ok, stuck)
+	if code != http.StatusServiceUnavailable || report.Status != healthStatusFailing {
+		t.Errorf("expect failing report, got %d %s", code, report.Status)
+	}
+	if !report.Checks["network"].OK || report.Checks["miner"].OK {
+		t.Errorf("expect only the miner check failing, got %v", report.Checks)
+	}
+
+	// nothing to check is healthy
+	if code, _ := serve(); code != http.StatusOK {
+		t.Errorf("expect ok without any check, got %d", code)
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/euiko/tooyoul/mineman/pkg/app/api"
 	"github.com/euiko/tooyoul/mineman/pkg/config"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
 )
 
 type Waiter interface {
@@ -22,6 +23,18 @@ type HookModuleExt interface {
 	ModuleInitialized(ctx context.Context, m api.Module)
 }
 
+// HookModuleNameExt receive the registered name of the initialized module,
+// it is called after ModuleInitialized
+type HookModuleNameExt interface {
+	ModuleNamed(ctx context.Context, name string, m api.Module)
+}
+
+// HookStopExt stop the hook from calling into the modules, e.g. the event
+// subscriptions, it is called before the modules are closed
+type HookStopExt interface {
+	Stop(ctx context.Context) error
+}
+
 // HookModuleInterceptor intercept loading of an module
 // you can use this to selectively load/unload module based on hook
 // e.g. selectively load modules by platform
@@ -55,14 +68,41 @@ func (h *chainedHook) Init(ctx context.Context, c config.Config) error {
 	return nil
 }
 
+// Close close the hooks in the reverse order, the first error is returned
+// after all of them are closed
 func (h *chainedHook) Close(ctx context.Context) error {
-	for _, h := range h.hooks {
-		if err := h.Close(ctx); err != nil {
-			return err
+	var first error
+	for i := len(h.hooks) - 1; i >= 0; i-- {
+		if err := h.hooks[i].Close(ctx); err != nil {
+			log.Error("error when closing hook", log.WithError(err))
+			if first == nil {
+				first = err
+			}
 		}
 	}
 
-	return nil
+	return first
+}
+
+// Stop stop the hooks in the reverse order, the first error is returned
+// after all of them are stopped
+func (h *chainedHook) Stop(ctx context.Context) error {
+	var first error
+	for i := len(h.hooks) - 1; i >= 0; i-- {
+		stopper, ok := h.hooks[i].(HookStopExt)
+		if !ok {
+			continue
+		}
+
+		if err := stopper.Stop(ctx); err != nil {
+			log.Error("error when stopping hook", log.WithError(err))
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	return first
 }
 
 func (h *chainedHook) Run(ctx context.Context) error {
@@ -103,6 +143,14 @@ func (h *chainedHook) ModuleInitialized(ctx context.Context, m api.Module) {
 	}
 }
 
+func (h *chainedHook) ModuleNamed(ctx context.Context, name string, m api.Module) {
+	for _, h := range h.hooks {
+		if ext, ok := h.(HookModuleNameExt); ok {
+			ext.ModuleNamed(ctx, name, m)
+		}
+	}
+}
+
 func (h *chainedHook) Intercept(name string, m api.Module) bool {
 	// only one effective interceptor
 	var effectiveInterceptor HookModuleInterceptor
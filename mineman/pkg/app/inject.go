@@ -0,0 +1,157 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/euiko/tooyoul/mineman/pkg/app/api"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+	"github.com/euiko/tooyoul/mineman/pkg/metrics"
+)
+
+var (
+	ErrInvalidProvider = errors.New("provider must be a function that returns a value and optionally an error")
+	ErrNoProvider      = errors.New("no value nor provider available")
+	ErrProviderCycle   = errors.New("provider depends on its own value")
+)
+
+type (
+	// ModuleName is the registered name of the module being injected, the
+	// providers may ask for it, e.g. to create a logger named after it
+	ModuleName string
+
+	// injector resolve the parameters of the module Inject method, from
+	// the injected values first then the registered providers
+	injector struct {
+		values []reflect.Value
+	}
+)
+
+var (
+	providers sync.Map
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	nameType  = reflect.TypeOf(ModuleName(""))
+)
+
+// RegisterProvider register a function that create the value of its return
+// type, e.g. func(name app.ModuleName) (*Client, error). Its parameters are
+// resolved the same way as the module Inject method, and it is called on
+// every injection. Registering the same type twice replaces the previous one.
+func RegisterProvider(provider interface{}) {
+	fn := reflect.ValueOf(provider)
+	t := fn.Type()
+	if t.Kind() != reflect.Func || t.IsVariadic() {
+		panic(ErrInvalidProvider)
+	}
+
+	switch {
+	case t.NumOut() == 1:
+	case t.NumOut() == 2 && t.Out(1) == errorType:
+	default:
+		panic(ErrInvalidProvider)
+	}
+
+	providers.Store(t.Out(0), fn)
+}
+
+// provide add the values, the later value wins over the earlier one of
+// the same type
+func (i *injector) provide(vals ...interface{}) {
+	for _, v := range vals {
+		if v == nil {
+			continue
+		}
+		i.values = append(i.values, reflect.ValueOf(v))
+	}
+}
+
+// inject call the Inject method of the module when it has any, with its
+// parameters resolved by their type
+func (i *injector) inject(name string, m api.Module) error {
+	method := reflect.ValueOf(m).MethodByName("Inject")
+	if !method.IsValid() {
+		return nil
+	}
+
+	out, err := i.call(name, method, map[reflect.Type]bool{})
+	if err != nil {
+		return fmt.Errorf("failed when inject module %s: %w", name, err)
+	}
+
+	if n := len(out); n > 0 && out[n-1].Type() == errorType && !out[n-1].IsNil() {
+		return fmt.Errorf("failed when inject module %s: %w", name, out[n-1].Interface().(error))
+	}
+
+	return nil
+}
+
+func (i *injector) call(name string, fn reflect.Value, resolving map[reflect.Type]bool) ([]reflect.Value, error) {
+	t := fn.Type()
+	if t.IsVariadic() {
+		return nil, fmt.Errorf("%s can't be variadic", t)
+	}
+
+	args := make([]reflect.Value, t.NumIn())
+	for n := range args {
+		arg, err := i.resolve(name, t.In(n), resolving)
+		if err != nil {
+			return nil, err
+		}
+		args[n] = arg
+	}
+
+	return fn.Call(args), nil
+}
+
+// resolve return the value of the type, the exact type is preferred over
+// the one that implements the interface type
+func (i *injector) resolve(name string, t reflect.Type, resolving map[reflect.Type]bool) (reflect.Value, error) {
+	if t == nameType {
+		return reflect.ValueOf(ModuleName(name)), nil
+	}
+
+	for n := len(i.values) - 1; n >= 0; n-- {
+		if i.values[n].Type() == t {
+			return i.values[n], nil
+		}
+	}
+
+	if t.Kind() == reflect.Interface {
+		for n := len(i.values) - 1; n >= 0; n-- {
+			if i.values[n].Type().Implements(t) {
+				return i.values[n], nil
+			}
+		}
+	}
+
+	provider, ok := providers.Load(t)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("%w: %s", ErrNoProvider, t)
+	}
+
+	if resolving[t] {
+		return reflect.Value{}, fmt.Errorf("%w: %s", ErrProviderCycle, t)
+	}
+	resolving[t] = true
+	defer delete(resolving, t)
+
+	out, err := i.call(name, provider.(reflect.Value), resolving)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	if len(out) == 2 && !out[1].IsNil() {
+		return reflect.Value{}, fmt.Errorf("failed when provide %s: %w", t, out[1].Interface().(error))
+	}
+
+	return out[0], nil
+}
+
+func init() {
+	RegisterProvider(metrics.Default)
+	RegisterProvider(func(name ModuleName) log.Logger {
+		return log.Named(string(name), nil)
+	})
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"errors"
+	"testing"
+)
+
+type (
+	testGreeter interface {
+		Greet() string
+	}
+
+	testEnglish struct{}
+
+	testClient struct {
+		owner ModuleName
+	}
+
+	testUnknown struct{}
+
+	injectedModule struct {
+		dependentModule
+		greeter testGreeter
+		client  *testClient
+	}
+
+	failingModule struct {
+		dependentModule
+	}
+
+	unknownModule struct {
+		dependentModule
+	}
+)
+
+var errTestInject = errors.New("inject failed")
+
+func (testEnglish) Greet() string { return "hello" }
+
+func (m *injectedModule) Inject(greeter testGreeter, client *testClient) {
+	m.greeter = greeter
+	m.client = client
+}
+
+func (m *failingModule) Inject(name ModuleName) error { return errTestInject }
+func (m *unknownModule) Inject(v *testUnknown)        {}
+
+func TestInjector(t *testing.T) {
+	RegisterProvider(func(name ModuleName) (*testClient, error) {
+		return &testClient{owner: name}, nil
+	})
+
+	var i injector
+	i.provide(testEnglish{}, nil)
+
+	m := injectedModule{}
+	if err := i.inject("miner", &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.greeter == nil || m.greeter.Greet() != "hello" {
+		t.Errorf("expect the greeter injected by its interface, got %v", m.greeter)
+	}
+	if m.client == nil || m.client.owner != "miner" {
+		t.Errorf("expect the client created for the miner module, got %v", m.client)
+	}
+
+	if err := i.inject("failing", &failingModule{}); !errors.Is(err, errTestInject) {
+		t.Errorf("expect the inject error returned, got %v", err)
+	}
+	if err := i.inject("unknown", &unknownModule{}); !errors.Is(err, ErrNoProvider) {
+		t.Errorf("expect no provider error, got %v", err)
+	}
+
+	// the module without Inject method is left as is
+	if err := i.inject("plain", dependentModule{}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,108 @@
+package app
+
+import (
+	"context"
+
+	"github.com/euiko/tooyoul/mineman/pkg/app/api"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+)
+
+// requestReload queue a config reload, it doesn't block
+func (a *App) requestReload() {
+	select {
+	case a.reloads <- struct{}{}:
+	default:
+		// already pending
+	}
+}
+
+// watchReload run the queued reloads until the app is done, the requests
+// made before the modules initialized are run right away
+func (a *App) watchReload(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.reloads:
+			a.reload(ctx)
+		}
+	}
+}
+
+// reload read the config again and pass it to the reloadable modules in
+// their init order. The config is applied only when all the modules accept
+// it, the reloaded modules are rolled back when one of them fails to apply
+func (a *App) reload(ctx context.Context) {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	a.mu.Lock()
+	modules := a.modules
+	closed := a.closed
+	a.mu.Unlock()
+
+	if closed {
+		return
+	}
+
+	log.Info("reloading config...")
+	c, err := a.config.Reload()
+	if err != nil {
+		log.Error("failed when reloading config, the current config is kept", log.WithError(err))
+		return
+	}
+
+	reloadables := []loadedModule{}
+	for _, m := range modules {
+		r, ok := m.module.(api.Reloadable)
+		if !ok {
+			continue
+		}
+
+		if err := r.ValidateReload(ctx, c); err != nil {
+			log.Error("invalid module config, the current config is kept",
+				log.WithError(err),
+				log.WithField("module", m.name),
+			)
+			return
+		}
+		reloadables = append(reloadables, m)
+	}
+
+	for i, m := range reloadables {
+		if err := m.module.(api.Reloadable).Reload(ctx, c); err != nil {
+			log.Error("failed when reloading module, the current config is kept",
+				log.WithError(err),
+				log.WithField("module", m.name),
+			)
+			a.rollback(ctx, reloadables[:i])
+			return
+		}
+		log.Debug("module reloaded", log.WithField("module", m.name))
+	}
+
+	a.config = c
+	a.gracePeriod = loadGracePeriod(c)
+	a.moduleTimeout = loadModuleTimeout(c)
+	if a.logger != nil {
+		a.logger.SetLevel(log.Level(log.LoadConfig(c).Level))
+	}
+
+	log.Info("config reloaded")
+}
+
+// rollback reload the current config into the modules that already applied
+// the new one, in the reverse order
+func (a *App) rollback(ctx context.Context, reloaded []loadedModule) {
+	for i := len(reloaded) - 1; i >= 0; i-- {
+		m := reloaded[i]
+		if err := m.module.(api.Reloadable).Reload(ctx, a.config); err != nil {
+			log.Error("failed when rolling back module config",
+				log.WithError(err),
+				log.WithField("module", m.name),
+			)
+			continue
+		}
+		log.Debug("module rolled back", log.WithField("module", m.name))
+	}
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+)
+
+// reloadingModule record the version of every config it reloads
+type reloadingModule struct {
+	closingModule
+	invalid  bool
+	failing  bool
+	reloaded *[]string
+}
+
+func (m reloadingModule) ValidateReload(ctx context.Context, c config.Config) error {
+	if m.invalid && c.Get("version").String() == "2" {
+		return errors.New("invalid config")
+	}
+	return nil
+}
+
+func (m reloadingModule) Reload(ctx context.Context, c config.Config) error {
+	version := c.Get("version").String()
+	if m.failing && version == "2" {
+		return errors.New("failed to apply")
+	}
+
+	*m.reloaded = append(*m.reloaded, fmt.Sprintf("%s=%s", m.name, version))
+	return nil
+}
+
+func TestReload(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "reload.yaml")
+	write := func(version string) {
+		if err := os.WriteFile(file, []byte("version: \""+version+"\"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name    string
+		invalid bool
+		failing bool
+		expect  []string
+	}{
+		{name: "applied", expect: []string{"network=2", "scheduler=2", "miner=2"}},
+		// nothing is applied when one of the modules rejects the config
+		{name: "invalid", invalid: true, expect: []string{}},
+		// the modules reloaded before the failing one are rolled back
+		{name: "failing", failing: true, expect: []string{"network=2", "scheduler=2", "scheduler=1", "network=1"}},
+	}
+
+	for _, c := range cases {
+		write("1")
+		reloaded := []string{}
+		a := New("test")
+		a.config = config.NewViper("reload", config.ViperPaths(dir))
+		for _, name := range []string{"network", "scheduler", "miner"} {
+			m := reloadingModule{closingModule: closingModule{name: name}, reloaded: &reloaded}
+			if name == "miner" {
+				m.invalid = c.invalid
+				m.failing = c.failing
+			}
+			a.track(loadedModule{name: name, module: m})
+		}
+
+		write("2")
+		a.reload(ctx)
+
+		if !reflect.DeepEqual(reloaded, c.expect) {
+			t.Errorf("%s: expect reloaded %v, got %v", c.name, c.expect, reloaded)
+		}
+
+		expectVersion := "2"
+		if c.invalid || c.failing {
+			expectVersion = "1"
+		}
+		if version := a.config.Get("version").String(); version != expectVersion {
+			t.Errorf("%s: expect the app config version %s, got %s", c.name, expectVersion, version)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+)
+
+const defaultGracePeriod = time.Second * 30
+
+var ErrShutdownTimeout = errors.New("shutdown exceeded the grace period")
+
+// shutdownTimeline log how long each close takes, measured from the
+// beginning of the shutdown
+type shutdownTimeline struct {
+	ctx           context.Context
+	began         time.Time
+	moduleTimeout time.Duration
+	timedOut      []string
+}
+
+func loadGracePeriod(c config.Config) time.Duration {
+	return c.Get("shutdown.grace_period").Duration(defaultGracePeriod)
+}
+
+// loadModuleTimeout return the longest close of a single module, zero means
+// it is only limited by the grace period
+func loadModuleTimeout(c config.Config) time.Duration {
+	return c.Get("shutdown.module_timeout").Duration(0)
+}
+
+// shutdown stop the hook from calling into the modules, then close the
+// modules in the reverse order of their initialization and the hook, all of
+// them within the grace period. Each close is also capped by the module
+// timeout when it is set, so a stuck module doesn't take the time of the
+// rest. It is the only path the app is closed by, the later calls wait for
+// the first one and get its result.
+func (a *App) shutdown(reason string) error {
+	a.shutdownOnce.Do(func() {
+		a.mu.Lock()
+		a.closed = true
+		modules := a.modules
+		hookReady := a.hookReady
+		a.mu.Unlock()
+
+		// let the running reload finish first
+		a.reloadMu.Lock()
+		defer a.reloadMu.Unlock()
+
+		log.Info("shutting down...",
+			log.WithField("reason", reason),
+			log.WithField("grace_period", a.gracePeriod.String()),
+			log.WithField("module_timeout", a.moduleTimeout.String()),
+		)
+
+		ctx, cancel := context.WithTimeout(context.Background(), a.gracePeriod)
+		defer cancel()
+
+		t := shutdownTimeline{ctx: ctx, began: time.Now(), moduleTimeout: a.moduleTimeout}
+
+		// the events received while the modules are closed would call into
+		// the closed ones
+		if stopper, ok := a.hook.(HookStopExt); ok && hookReady {
+			t.close("hook sinks", stopper.Stop)
+		}
+
+		for i := len(modules) - 1; i >= 0; i-- {
+			t.close(modules[i].name, modules[i].module.Close)
+		}
+
+		if hookReady {
+			t.close("hook", a.hook.Close)
+		}
+
+		a.shutdownErr = t.done()
+	})
+
+	return a.shutdownErr
+}
+
+// close run the close until the deadline or the module timeout, the one that
+// doesn't return in time is left behind so the rest still get closed
+func (t *shutdownTimeline) close(name string, close func(ctx context.Context) error) {
+	ctx := t.ctx
+	if t.moduleTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.moduleTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- close(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	opts := []log.Options{
+		log.WithField("closing", name),
+		log.WithField("took", time.Since(start).Round(time.Millisecond).String()),
+		log.WithField("elapsed", time.Since(t.began).Round(time.Millisecond).String()),
+	}
+
+	switch {
+	case err == nil:
+		log.Info("closed", opts...)
+	case ctx.Err() != nil:
+		t.timedOut = append(t.timedOut, name)
+		log.Error("close exceeded the grace period", append(opts, log.WithError(err))...)
+	default:
+		log.Error("error when closing", append(opts, log.WithError(err))...)
+	}
+}
+
+// done return error when any of the close exceeded the grace period
+func (t *shutdownTimeline) done() error {
+	log.Info("shutdown completed", log.WithField("took", time.Since(t.began).Round(time.Millisecond).String()))
+	if len(t.timedOut) > 0 {
+		return fmt.Errorf("%w: %s", ErrShutdownTimeout, strings.Join(t.timedOut, ", "))
+	}
+
+	return nil
+}
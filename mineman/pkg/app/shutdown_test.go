@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+)
+
+// closingModule record its name when closed, it blocks until the context is
+// done when stuck
+type closingModule struct {
+	name   string
+	stuck  bool
+	closed *[]string
+}
+
+func (m closingModule) Init(ctx context.Context, c config.Config) error { return nil }
+
+func (m closingModule) Close(ctx context.Context) error {
+	if m.stuck {
+		// never returns, like a module that ignores the deadline
+		select {}
+	}
+
+	*m.closed = append(*m.closed, m.name)
+	return nil
+}
+
+// stoppingHook record when its sinks are stopped and when it is closed
+type stoppingHook struct {
+	closingModule
+}
+
+func (h stoppingHook) Run(ctx context.Context) error { return nil }
+
+func (h stoppingHook) Stop(ctx context.Context) error {
+	*h.closed = append(*h.closed, "sinks")
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	closed := []string{}
+	a := New("test", stoppingHook{closingModule{name: "hook", closed: &closed}})
+	a.hookReady = true
+	a.gracePeriod = time.Second
+	a.moduleTimeout = time.Millisecond * 50
+	for _, m := range []closingModule{
+		{name: "network", closed: &closed},
+		{name: "miner", stuck: true, closed: &closed},
+		{name: "scheduler", closed: &closed},
+	} {
+		a.track(loadedModule{name: m.name, module: m})
+	}
+
+	err := a.shutdown("test")
+	if !errors.Is(err, ErrShutdownTimeout) {
+		t.Fatalf("expect shutdown timeout, got %v", err)
+	}
+
+	// the sinks are stopped first, then the modules are closed in the
+	// reverse order, the stuck one is left behind after the module timeout
+	expect := []string{"sinks", "scheduler", "network", "hook"}
+	if !reflect.DeepEqual(closed, expect) {
+		t.Errorf("expect closed %v, got %v", expect, closed)
+	}
+
+	// closed once, the later calls get the same result
+	if again := a.shutdown("again"); again != err {
+		t.Errorf("expect the first result, got %v", again)
+	}
+	if a.track(loadedModule{name: "late", module: closingModule{closed: &closed}}) {
+		t.Error("expect no module tracked after shutdown")
+	}
+}
+
+func TestLoadGracePeriod(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"configured.yaml": "shutdown:\n  grace_period: 2s\n  module_timeout: 1s\n",
+		"default.yaml":    "logger:\n  level: 6\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if d := loadGracePeriod(config.NewViper("configured", config.ViperPaths(dir))); d != time.Second*2 {
+		t.Errorf("expect the configured grace period, got %s", d)
+	}
+
+	if d := loadModuleTimeout(config.NewViper("configured", config.ViperPaths(dir))); d != time.Second {
+		t.Errorf("expect the configured module timeout, got %s", d)
+	}
+
+	if d := loadGracePeriod(config.NewViper("default", config.ViperPaths(dir))); d != defaultGracePeriod {
+		t.Errorf("expect the default grace period, got %s", d)
+	}
+
+	if d := loadModuleTimeout(config.NewViper("default", config.ViperPaths(dir))); d != 0 {
+		t.Errorf("expect no module timeout by default, got %s", d)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	closed := []string{}
+	a := New("test")
+	a.gracePeriod = time.Millisecond * 50
+	for _, m := range []closingModule{
+		{name: "network", stuck: true, closed: &closed},
+		{name: "miner", stuck: true, closed: &closed},
+	} {
+		a.track(loadedModule{name: m.name, module: m})
+	}
+
+	// the stuck modules share a single grace period
+	start := time.Now()
+	if err := a.shutdown("test"); !errors.Is(err, ErrShutdownTimeout) {
+		t.Fatalf("expect shutdown timeout, got %v", err)
+	}
+	if took := time.Since(start); took > a.gracePeriod*3/2 {
+		t.Errorf("expect the shutdown done within the grace period, took %s", took)
+	}
+}
@@ -17,6 +17,8 @@ type (
 		Address      string        `mapstructure:"address"`
 		WriteTimeout time.Duration `mapstructure:"write_timeout"`
 		ReadTimeout  time.Duration `mapstructure:"read_timeout"`
+		// HealthTimeout bound each check of /healthz and /readyz
+		HealthTimeout time.Duration `mapstructure:"health_timeout"`
 	}
 	WebHook struct {
 		option    WebConfig
@@ -25,9 +27,14 @@ type (
 		errChan   chan error
 		endpoints []api.Endpoint
 		defaultMw []api.Middleware
+
+		healthChecks    []healthCheck
+		readinessChecks []healthCheck
 	}
 )
 
+const defaultHealthTimeout = time.Second * 5
+
 func (h *WebHook) Init(ctx context.Context, c config.Config) error {
 
 	// load config
@@ -64,6 +71,16 @@ func (h *WebHook) ModuleInitialized(ctx context.Context, m api.Module) {
 	}
 }
 
+// ModuleNamed collect the health and readiness checks of the module
+func (h *WebHook) ModuleNamed(ctx context.Context, name string, m api.Module) {
+	if checker, ok := m.(api.HealthChecker); ok {
+		h.healthChecks = append(h.healthChecks, healthCheck{name: name, check: checker.CheckHealth})
+	}
+	if checker, ok := m.(api.ReadinessChecker); ok {
+		h.readinessChecks = append(h.readinessChecks, healthCheck{name: name, check: checker.CheckReadiness})
+	}
+}
+
 func (h *WebHook) Run(ctx context.Context) error {
 
 	// skip if disabled
@@ -71,6 +88,24 @@ func (h *WebHook) Run(ctx context.Context) error {
 		return nil
 	}
 
+	// the liveness and readiness of the modules, e.g. for watchdog
+	timeout := h.option.HealthTimeout
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	h.endpoints = append(h.endpoints,
+		api.Endpoint{
+			Method:  "GET",
+			Path:    "/healthz",
+			Handler: healthHandler(h.healthChecks, timeout),
+		},
+		api.Endpoint{
+			Method:  "GET",
+			Path:    "/readyz",
+			Handler: healthHandler(h.readinessChecks, timeout),
+		},
+	)
+
 	// create new router
 	router := httprouter.New()
 
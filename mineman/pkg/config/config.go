@@ -26,5 +26,11 @@ type (
 		Scan(out interface{}) error
 		Write() error
 		OnChange(callback OnChangedFunc)
+		// Reload read the config source again into a new config, the current
+		// one is left untouched when the source is invalid
+		Reload() (Config, error)
+		// Watch start watching the config source, the OnChange callback is
+		// called on every change
+		Watch()
 	}
 )
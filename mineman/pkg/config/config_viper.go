@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -8,6 +9,8 @@ import (
 	"github.com/spf13/viper"
 )
 
+var ErrNoConfigFile = errors.New("config is not loaded from a file")
+
 type (
 	Viper struct {
 		viper *viper.Viper
@@ -71,6 +74,29 @@ func (c *Viper) OnChange(callback OnChangedFunc) {
 	})
 }
 
+func (c *Viper) Reload() (Config, error) {
+	file := c.viper.ConfigFileUsed()
+	if file == "" {
+		return nil, ErrNoConfigFile
+	}
+
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	return &Viper{
+		viper:      v,
+		standalone: c.standalone,
+		paths:      c.paths,
+	}, nil
+}
+
+func (c *Viper) Watch() {
+	c.viper.WatchConfig()
+}
+
 func (v *valueViper) Bool(def ...bool) bool {
 	d := false
 	if len(def) > 0 {
@@ -117,9 +143,9 @@ func (v *valueViper) Duration(def ...time.Duration) time.Duration {
 		d = def[0]
 	}
 
-	value := v.viper.Get(v.key)
-	if val, ok := value.(time.Duration); ok {
-		return val
+	// the file config has the duration as string, e.g. 30s
+	if value, err := cast.ToDurationE(v.viper.Get(v.key)); err == nil {
+		return value
 	}
 
 	return d
@@ -1,6 +1,25 @@
 package event
 
-import "context"
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// reserved headers
+const (
+	// HeaderOriginalTopic hold the topic of a message moved to the dead letter topic
+	HeaderOriginalTopic = "x-original-topic"
+	// HeaderExpiresAt hold the expiry time in RFC3339 of a message that sent
+	// through a remote broker
+	HeaderExpiresAt = "x-expires-at"
+	// HeaderIdempotencyKey hold the key of a publish, the brokers drop the
+	// publishes with the same key on the same topic within their window
+	HeaderIdempotencyKey = "x-idempotency-key"
+	// HeaderRetained mark a message that delivered from the retained value
+	// of its topic, instead of being published after the subscription made
+	HeaderRetained = "x-retained"
+)
 
 // public types
 type (
@@ -11,6 +30,7 @@ type (
 	Sink struct {
 		Topic   string
 		Handler MessageHandler
+		Options []SubscribeConfigurator
 	}
 
 	PublishConfigurator interface {
@@ -26,14 +46,43 @@ type (
 	SubscribeOptionFunc func(o *SubscribeOption)
 
 	PublishOption struct {
+		// Headers hold the metadata of the message
+		Headers map[string]string
+		// DeliverAt delay the delivery until the given time, zero means
+		// delivered immediately
+		DeliverAt time.Time
+		// ExpiresAt drop the message when it is not yet delivered by the given
+		// time, zero means never expire
+		ExpiresAt time.Time
+		// Retain keep the message as the last value of its topic, it is
+		// delivered right away to the new fan out subscriptions
+		Retain bool
 	}
 
+	// defaultPublisher publish through the package level functions
+	defaultPublisher struct{}
+
 	SubscribeOption struct {
 		Policy SubscribePolicy
+		// Group name of the competing consumers, only used by WorkQueuePolicy
+		Group string
+		// Overflow is applied when the subscription buffer is full, a slow
+		// subscription never affects the delivery to the others
+		Overflow OverflowPolicy
+		// OverflowTimeout is the longest wait of the Block policy
+		OverflowTimeout time.Duration
 	}
 )
 
-var globalBroker Broker
+var (
+	globalMu     sync.RWMutex
+	globalBroker Broker
+	globalOutbox = NewOutbox(DefaultOutboxConfig())
+)
+
+func (defaultPublisher) Publish(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) Publishing {
+	return PublishAsync(ctx, topic, payload, opts...)
+}
 
 func (f PublishOptionFunc) ConfigurePublish(o *PublishOption) {
 	f(o)
@@ -43,45 +92,197 @@ func (f SubscribeOptionFunc) ConfigureSubscribe(o *SubscribeOption) {
 	f(o)
 }
 
+// ConfigurePublish copy the option, so a loaded option can be passed
+// through to another broker
+func (o *PublishOption) ConfigurePublish(target *PublishOption) {
+	*target = *o
+	if o.Headers != nil {
+		target.Headers = make(map[string]string, len(o.Headers))
+		for k, v := range o.Headers {
+			target.Headers[k] = v
+		}
+	}
+}
+
+// IdempotencyKey return the key set by IdempotencyKey, empty when not set
+func (o *PublishOption) IdempotencyKey() string {
+	return o.Headers[HeaderIdempotencyKey]
+}
+
+// Expired check whether the message should be dropped at the given time
+func (o *PublishOption) Expired(now time.Time) bool {
+	return !o.ExpiresAt.IsZero() && !now.Before(o.ExpiresAt)
+}
+
+// WithHeader add a metadata header to the message
+func WithHeader(key string, value string) PublishConfigurator {
+	return PublishOptionFunc(func(o *PublishOption) {
+		if o.Headers == nil {
+			o.Headers = make(map[string]string)
+		}
+		o.Headers[key] = value
+	})
+}
+
+// WithHeaders add multiple metadata headers to the message
+func WithHeaders(headers map[string]string) PublishConfigurator {
+	return PublishOptionFunc(func(o *PublishOption) {
+		if o.Headers == nil {
+			o.Headers = make(map[string]string)
+		}
+		for k, v := range headers {
+			o.Headers[k] = v
+		}
+	})
+}
+
+// DeliverAt delay the delivery of the message until the given time
+func DeliverAt(t time.Time) PublishConfigurator {
+	return PublishOptionFunc(func(o *PublishOption) {
+		o.DeliverAt = t
+	})
+}
+
+// DeliverAfter delay the delivery of the message for the given duration
+func DeliverAfter(d time.Duration) PublishConfigurator {
+	return PublishOptionFunc(func(o *PublishOption) {
+		o.DeliverAt = time.Now().Add(d)
+	})
+}
+
+// TTL drop the message when it is not yet delivered after the given duration
+func TTL(d time.Duration) PublishConfigurator {
+	return PublishOptionFunc(func(o *PublishOption) {
+		o.ExpiresAt = time.Now().Add(d)
+	})
+}
+
+// Retain keep the message as the last value of the topic, so the late
+// subscribers receive the current state without waiting for the next change
+func Retain() PublishConfigurator {
+	return PublishOptionFunc(func(o *PublishOption) {
+		o.Retain = true
+	})
+}
+
+// IdempotencyKey mark the publish with a key, the broker drop the later
+// publishes with the same key on the same topic within its dedup window
+func IdempotencyKey(key string) PublishConfigurator {
+	return WithHeader(HeaderIdempotencyKey, key)
+}
+
+// NewPublishOption load all the configurators into publish option, broker
+// implementation should use this to keep the same defaults
+func NewPublishOption(opts ...PublishConfigurator) *PublishOption {
+	o := PublishOption{}
+
+	for _, f := range opts {
+		f.ConfigurePublish(&o)
+	}
+
+	return &o
+}
+
+// WorkQueue make the subscription compete with the other work queue
+// subscriptions of the same topic that doesn't specify any group
 func WorkQueue() SubscribeConfigurator {
 	return SubscribeOptionFunc(func(o *SubscribeOption) {
 		o.Policy = WorkQueuePolicy
 	})
 }
 
-func Publish(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) error {
-	// TODO: handle publish option
-	if globalBroker == nil {
-		return ErrEventHookNotInitialized
-	}
+// Group make the subscription compete with the other subscriptions of
+// the same topic and group name, each message only received by one of them
+func Group(name string) SubscribeConfigurator {
+	return SubscribeOptionFunc(func(o *SubscribeOption) {
+		o.Policy = WorkQueuePolicy
+		o.Group = name
+	})
+}
 
-	publishing := globalBroker.Publish(ctx, topic, payload)
-	return <-publishing.Error()
+// OnOverflow set the policy applied when the subscription buffer is full
+func OnOverflow(policy OverflowPolicy) SubscribeConfigurator {
+	return SubscribeOptionFunc(func(o *SubscribeOption) {
+		o.Overflow = policy
+	})
 }
 
-func PublishAsync(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) Publishing {
-	// TODO: add publish option
-	if globalBroker == nil {
-		return NewPublishingChan(ErrEventHookNotInitialized)
+// BlockOnOverflow wait for the subscription up to the timeout when its
+// buffer is full, the message is dropped afterward
+func BlockOnOverflow(timeout time.Duration) SubscribeConfigurator {
+	return SubscribeOptionFunc(func(o *SubscribeOption) {
+		o.Overflow = Block
+		o.OverflowTimeout = timeout
+	})
+}
+
+// NewSubscribeOption load all the configurators into subscribe option, broker
+// implementation should use this to keep the same defaults
+func NewSubscribeOption(opts ...SubscribeConfigurator) *SubscribeOption {
+	o := SubscribeOption{
+		Policy:          FanOutPolicy,
+		Overflow:        Reject,
+		OverflowTimeout: time.Second,
+	}
+
+	for _, f := range opts {
+		f.ConfigureSubscribe(&o)
 	}
 
-	return globalBroker.Publish(ctx, topic, payload)
+	return &o
+}
+
+// SetDefault replace the broker used by the package level functions, it is
+// set by the event hook, tests may use it to inject their own broker. The
+// publishes queued in the outbox are flushed to the broker.
+func SetDefault(b Broker) {
+	globalMu.Lock()
+	globalBroker = b
+	globalMu.Unlock()
+
+	globalOutbox.SetPublisher(b)
+}
+
+// DefaultPublisher return the publisher of the default broker, the
+// publishes go through the outbox like the package level Publish
+func DefaultPublisher() Publisher {
+	return defaultPublisher{}
+}
+
+func Default() Broker {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+
+	return globalBroker
+}
+
+// Publish wait until the message is published, the publishes made before the
+// broker is ready or while it is unavailable are queued in the outbox and
+// reported as published
+func Publish(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) error {
+	return <-PublishAsync(ctx, topic, payload, opts...).Error()
+}
+
+func PublishAsync(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) Publishing {
+	return globalOutbox.Publish(ctx, topic, payload, opts...)
 }
 
 func Subscribe(ctx context.Context, topic string, handler MessageHandler, opts ...SubscribeConfigurator) Subscription {
-	// TODO: add subscribe option
-	if globalBroker == nil {
+	broker := Default()
+	if broker == nil {
 		return NewSubscriptionDirect(ErrEventHookNotInitialized)
 	}
 
-	return globalBroker.SubscribeHandler(ctx, topic, handler)
+	return broker.SubscribeHandler(ctx, topic, handler, opts...)
 }
 
-func SubscribeAsync(ctx context.Context, topic string, handler MessageHandler, opts ...SubscribeConfigurator) SubscriptionMsg {
-	// TODO: add subscribe option
-	if globalBroker == nil {
+// SubscribeAsync subscribe without handler, the messages are received from
+// the subscription channel
+func SubscribeAsync(ctx context.Context, topic string, opts ...SubscribeConfigurator) SubscriptionMsg {
+	broker := Default()
+	if broker == nil {
 		return NewSubscriptionDirect(ErrEventHookNotInitialized)
 	}
 
-	return globalBroker.Subscribe(ctx, topic)
+	return broker.Subscribe(ctx, topic, opts...)
 }
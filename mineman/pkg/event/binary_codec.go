@@ -0,0 +1,455 @@
+package event
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// binaryCodecVersion is bumped whenever the layout changes, the version 1
+// layout doesn't have the headers
+const binaryCodecVersion byte = 2
+
+// value tags of the binary codec
+const (
+	binaryNil byte = iota
+	binaryFalse
+	binaryTrue
+	binaryInt
+	binaryUint
+	binaryFloat
+	binaryString
+	binaryBytes
+	binaryList
+	binaryMap
+	binaryTime
+)
+
+var (
+	ErrBinaryCodecVersion   = errors.New("unsupported binary codec version")
+	ErrBinaryCodecMalformed = errors.New("malformed binary encoded envelope")
+)
+
+type (
+	// BinaryCodec encode the envelope into a compact tagged binary format,
+	// unlike json it keeps integer, bytes and time values as is
+	BinaryCodec struct{}
+
+	binaryWriter struct {
+		bytes.Buffer
+	}
+
+	binaryReader struct {
+		*bytes.Reader
+	}
+)
+
+func (BinaryCodec) Name() string {
+	return "binary"
+}
+
+func (BinaryCodec) Marshal(e *Envelope) ([]byte, error) {
+	var w binaryWriter
+	w.WriteByte(binaryCodecVersion)
+	w.writeString(e.ContentType)
+	w.writeString(e.Name)
+	w.writeTime(e.Time)
+	if err := w.writeMap(e.Data); err != nil {
+		return nil, err
+	}
+	if err := w.writeMap(e.Meta); err != nil {
+		return nil, err
+	}
+	w.writeHeaders(e.Headers)
+	w.writeBytes(e.Body)
+
+	return w.Bytes(), nil
+}
+
+func (BinaryCodec) Unmarshal(b []byte, e *Envelope) error {
+	r := binaryReader{bytes.NewReader(b)}
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return ErrBinaryCodecMalformed
+	}
+	if version < 1 || version > binaryCodecVersion {
+		return ErrBinaryCodecVersion
+	}
+
+	var decoded Envelope
+	if decoded.ContentType, err = r.readString(); err != nil {
+		return err
+	}
+	if decoded.Name, err = r.readString(); err != nil {
+		return err
+	}
+	if decoded.Time, err = r.readTime(); err != nil {
+		return err
+	}
+	if decoded.Data, err = r.readMap(); err != nil {
+		return err
+	}
+	if decoded.Meta, err = r.readMap(); err != nil {
+		return err
+	}
+	if version >= 2 {
+		if decoded.Headers, err = r.readHeaders(); err != nil {
+			return err
+		}
+	}
+	if decoded.Body, err = r.readBytes(); err != nil {
+		return err
+	}
+
+	*e = decoded
+	return nil
+}
+
+func (w *binaryWriter) writeUvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	w.Write(b[:n])
+}
+
+func (w *binaryWriter) writeVarint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], v)
+	w.Write(b[:n])
+}
+
+func (w *binaryWriter) writeString(s string) {
+	w.writeUvarint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w *binaryWriter) writeBytes(b []byte) {
+	w.writeUvarint(uint64(len(b)))
+	w.Write(b)
+}
+
+// writeTime write zero time as a single zero byte, so it is decoded as zero time
+func (w *binaryWriter) writeTime(t time.Time) {
+	if t.IsZero() {
+		w.WriteByte(0)
+		return
+	}
+
+	w.WriteByte(1)
+	w.writeVarint(t.UnixNano())
+}
+
+// writeMap write the map with sorted keys, so the same map always
+// produce the same bytes
+func (w *binaryWriter) writeMap(m map[string]interface{}) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w.writeUvarint(uint64(len(keys)))
+	for _, k := range keys {
+		w.writeString(k)
+		if err := w.writeValue(m[k]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *binaryWriter) writeHeaders(headers map[string]string) {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w.writeUvarint(uint64(len(keys)))
+	for _, k := range keys {
+		w.writeString(k)
+		w.writeString(headers[k])
+	}
+}
+
+func (w *binaryWriter) writeValue(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		w.WriteByte(binaryNil)
+	case bool:
+		if v {
+			w.WriteByte(binaryTrue)
+		} else {
+			w.WriteByte(binaryFalse)
+		}
+	case int:
+		w.WriteByte(binaryInt)
+		w.writeVarint(int64(v))
+	case int8:
+		w.WriteByte(binaryInt)
+		w.writeVarint(int64(v))
+	case int16:
+		w.WriteByte(binaryInt)
+		w.writeVarint(int64(v))
+	case int32:
+		w.WriteByte(binaryInt)
+		w.writeVarint(int64(v))
+	case int64:
+		w.WriteByte(binaryInt)
+		w.writeVarint(v)
+	case uint:
+		w.WriteByte(binaryUint)
+		w.writeUvarint(uint64(v))
+	case uint8:
+		w.WriteByte(binaryUint)
+		w.writeUvarint(uint64(v))
+	case uint16:
+		w.WriteByte(binaryUint)
+		w.writeUvarint(uint64(v))
+	case uint32:
+		w.WriteByte(binaryUint)
+		w.writeUvarint(uint64(v))
+	case uint64:
+		w.WriteByte(binaryUint)
+		w.writeUvarint(v)
+	case float32:
+		w.WriteByte(binaryFloat)
+		w.writeFloat(float64(v))
+	case float64:
+		w.WriteByte(binaryFloat)
+		w.writeFloat(v)
+	case string:
+		w.WriteByte(binaryString)
+		w.writeString(v)
+	case []byte:
+		w.WriteByte(binaryBytes)
+		w.writeBytes(v)
+	case time.Time:
+		w.WriteByte(binaryTime)
+		w.writeTime(v)
+	case []interface{}:
+		w.WriteByte(binaryList)
+		w.writeUvarint(uint64(len(v)))
+		for _, item := range v {
+			if err := w.writeValue(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		w.WriteByte(binaryMap)
+		return w.writeMap(v)
+	default:
+		return w.writeReflect(v)
+	}
+
+	return nil
+}
+
+// writeReflect write the other slices, maps and structs by normalizing
+// them through json first
+func (w *binaryWriter) writeReflect(v interface{}) error {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice {
+		items := make([]interface{}, rv.Len())
+		for i := range items {
+			items[i] = rv.Index(i).Interface()
+		}
+		return w.writeValue(items)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var normalized interface{}
+	if err := json.Unmarshal(b, &normalized); err != nil {
+		return err
+	}
+
+	return w.writeValue(normalized)
+}
+
+func (w *binaryWriter) writeFloat(f float64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(f))
+	w.Write(b[:])
+}
+
+func (r *binaryReader) readUvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, ErrBinaryCodecMalformed
+	}
+	return v, nil
+}
+
+func (r *binaryReader) readVarint() (int64, error) {
+	v, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, ErrBinaryCodecMalformed
+	}
+	return v, nil
+}
+
+func (r *binaryReader) readBytes() ([]byte, error) {
+	n, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, ErrBinaryCodecMalformed
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, ErrBinaryCodecMalformed
+	}
+	return b, nil
+}
+
+func (r *binaryReader) readString() (string, error) {
+	b, err := r.readBytes()
+	return string(b), err
+}
+
+func (r *binaryReader) readTime() (time.Time, error) {
+	set, err := r.ReadByte()
+	if err != nil {
+		return time.Time{}, ErrBinaryCodecMalformed
+	}
+	if set == 0 {
+		return time.Time{}, nil
+	}
+
+	nanos, err := r.readVarint()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos), nil
+}
+
+func (r *binaryReader) readFloat() (float64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, ErrBinaryCodecMalformed
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b[:])), nil
+}
+
+// readMap return nil for empty map, as omitted map in the json codec
+func (r *binaryReader) readMap() (map[string]interface{}, error) {
+	n, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if n > uint64(r.Len()) {
+		return nil, ErrBinaryCodecMalformed
+	}
+
+	m := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		k, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		if m[k], err = r.readValue(); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (r *binaryReader) readHeaders() (map[string]string, error) {
+	n, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if n > uint64(r.Len()) {
+		return nil, ErrBinaryCodecMalformed
+	}
+
+	headers := make(map[string]string, n)
+	for i := uint64(0); i < n; i++ {
+		k, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		if headers[k], err = r.readString(); err != nil {
+			return nil, err
+		}
+	}
+
+	return headers, nil
+}
+
+func (r *binaryReader) readValue() (interface{}, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, ErrBinaryCodecMalformed
+	}
+
+	switch tag {
+	case binaryNil:
+		return nil, nil
+	case binaryFalse:
+		return false, nil
+	case binaryTrue:
+		return true, nil
+	case binaryInt:
+		return r.readVarint()
+	case binaryUint:
+		return r.readUvarint()
+	case binaryFloat:
+		return r.readFloat()
+	case binaryString:
+		return r.readString()
+	case binaryBytes:
+		return r.readBytes()
+	case binaryTime:
+		return r.readTime()
+	case binaryList:
+		n, err := r.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(r.Len()) {
+			return nil, ErrBinaryCodecMalformed
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = r.readValue(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case binaryMap:
+		m, err := r.readMap()
+		if m == nil && err == nil {
+			m = map[string]interface{}{}
+		}
+		return m, err
+	default:
+		return nil, ErrBinaryCodecMalformed
+	}
+}
+
+func init() {
+	RegisterCodec(BinaryCodec{})
+}
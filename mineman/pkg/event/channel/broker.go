@@ -1,9 +1,12 @@
 package channel
 
 import (
+	"container/heap"
 	"context"
 	"errors"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/euiko/tooyoul/mineman/pkg/app"
 	"github.com/euiko/tooyoul/mineman/pkg/app/api"
@@ -19,6 +22,7 @@ var (
 	ErrPublishBufferExceeded   = errors.New("can't handle anymore publish, buffer exceeded")
 	ErrSubscribeBufferExceeded = errors.New("can't send to the subscriber, buffer exceeded")
 	ErrStopped                 = errors.New("channel broker stopped")
+	ErrMessageNotFound         = errors.New("message not found, it may already acknowledged or expired")
 )
 
 type (
@@ -27,6 +31,20 @@ type (
 		CmdBufferSize int  `mapstructure:"cmd_buffer_size"`
 		PubBufferSize int  `mapstructure:"pub_buffer_size"`
 		SubBufferSize int  `mapstructure:"sub_buffer_size"`
+		// AckDeadline is the time given to a subscriber to ack the message before
+		// it redelivered, zero means the message wait forever
+		AckDeadline time.Duration `mapstructure:"ack_deadline"`
+		// RedeliveryInterval is how often the expired messages are checked
+		RedeliveryInterval time.Duration `mapstructure:"redelivery_interval"`
+		// MaxDeliveries limit delivery attempt of a message before it moved
+		// to the dead letter topic, zero means unlimited
+		MaxDeliveries int `mapstructure:"max_deliveries"`
+		// DeadLetterTopic receive the messages that exceed max deliveries,
+		// empty means those messages are dropped
+		DeadLetterTopic string `mapstructure:"dead_letter_topic"`
+		// DedupWindow is how long the idempotency keys are remembered, zero
+		// means the duplicates are not dropped
+		DedupWindow time.Duration `mapstructure:"dedup_window"`
 	}
 
 	Broker struct {
@@ -43,9 +61,30 @@ type (
 		cmdBuffer chan command
 		pubBuffer chan publishCommand
 
-		progressMsg map[messageID]event.Message
-		subsByTopic map[topicID][]subscriberID
-		subs        map[subscriberID]*subscriptionChan
+		progressMsg   map[messageID]*inflightMsg
+		scheduled     scheduleQueue
+		scheduleTimer *time.Timer
+		subsByTopic   *topicTree
+		subs          map[subscriberID]*subscriptionChan
+		groupCursor   map[groupID]int
+		retained      map[topicID]*retainedMsg
+
+		// blockedTimer fire on the earliest deadline of the blocked messages,
+		// drained is signaled when a subscriber of the Block policy takes a
+		// message from its buffer
+		blockedTimer *time.Timer
+		drained      chan struct{}
+
+		// counters are only accessed inside the event loop
+		counters map[string]int64
+
+		// dedup is nil when the duplicates are dropped by the caller
+		dedup     *event.Deduplicator
+		skipDedup bool
+
+		// deadLetterHook is called with the messages that exceed the max
+		// deliveries, inside the event loop
+		deadLetterHook func(subscriber string, payload event.Payload)
 	}
 
 	Options interface {
@@ -58,6 +97,12 @@ type (
 	messageID    string
 	subscriberID string
 	topicID      string
+
+	// groupID identify competing subscriptions of a topic
+	groupID struct {
+		topic topicID
+		name  string
+	}
 )
 
 func (f OptionsFunc) Configure(b *Broker) {
@@ -97,23 +142,36 @@ func (b *Broker) Close(ctx context.Context) error {
 	return nil
 }
 
-func (b *Broker) Publish(ctx context.Context, topic string, payload event.Payload) event.Publishing {
+func (b *Broker) Publish(ctx context.Context, topic string, payload event.Payload, opts ...event.PublishConfigurator) event.Publishing {
 	errChan := make(chan error, 1)
 
+	if err := event.ValidateTopic(topic); err != nil {
+		errChan <- err
+		close(errChan)
+		return event.NewPublishingChanForward(errChan)
+	}
+
 	b.do(&publishCommand{
 		topic:   topicID(topic),
 		payload: payload,
+		option:  event.NewPublishOption(opts...),
 		err:     errChan,
 		ctx:     ctx,
 	}, errChan, true)
 	return event.NewPublishingChanForward(errChan)
 }
 
-func (b *Broker) Subscribe(ctx context.Context, topic string) event.SubscriptionMsg {
+func (b *Broker) Subscribe(ctx context.Context, topic string, opts ...event.SubscribeConfigurator) event.SubscriptionMsg {
 	subscriptionChan := make(chan event.SubscriptionMsg, 1)
 	defer close(subscriptionChan)
 	id := subscriberID(generateID())
 
+	if err := event.ValidateTopicPattern(topic); err != nil {
+		subscription := newSubscriptionChan(b, err)
+		subscription.cancel()
+		return subscription
+	}
+
 	select {
 	case <-b.ctx.Done():
 		subscriptionChan <- newSubscriptionChan(b, errors.New("context already canceled"))
@@ -123,6 +181,7 @@ func (b *Broker) Subscribe(ctx context.Context, topic string) event.Subscription
 			subscription: subscriptionChan,
 			id:           id,
 			topic:        topicID(topic),
+			option:       event.NewSubscribeOption(opts...),
 		}
 	}
 
@@ -137,8 +196,8 @@ func (b *Broker) Subscribe(ctx context.Context, topic string) event.Subscription
 	return subscription
 }
 
-func (b *Broker) SubscribeHandler(ctx context.Context, topic string, handler event.MessageHandler) event.Subscription {
-	subscription := b.Subscribe(ctx, topic)
+func (b *Broker) SubscribeHandler(ctx context.Context, topic string, handler event.MessageHandler, opts ...event.SubscribeConfigurator) event.Subscription {
+	subscription := b.Subscribe(ctx, topic, opts...)
 	go func() {
 		for {
 			select {
@@ -159,9 +218,41 @@ func (b *Broker) SubscribeHandler(ctx context.Context, topic string, handler eve
 	return subscription
 }
 
+// Stats report the subscriptions, their buffer fill and in flight messages
+func (b *Broker) Stats(ctx context.Context) (*event.Stats, error) {
+	result := make(chan *event.Stats, 1)
+	errChan := make(chan error, 1)
+
+	if err := b.do(&statsCommand{
+		ctx:    ctx,
+		result: result,
+		err:    errChan,
+	}, errChan); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case err := <-errChan:
+		return nil, err
+	case stats := <-result:
+		return stats, nil
+	}
+}
+
 func (b *Broker) run(ctx context.Context) error {
 	defer log.Trace("channel broker event loop exited")
 
+	// watch the expired messages and retry the nacked ones that didn't fit
+	// in the subscriber buffer
+	var redelivery <-chan time.Time
+	if b.config.RedeliveryInterval > 0 {
+		ticker := time.NewTicker(b.config.RedeliveryInterval)
+		defer ticker.Stop()
+		redelivery = ticker.C
+	}
+
 	for {
 		select {
 		case <-b.ctx.Done():
@@ -171,10 +262,21 @@ func (b *Broker) run(ctx context.Context) error {
 			for _, v := range b.subs {
 				// cancel subscription
 				v.cancel()
+				v.releaseBlocked(ErrAlreadyClosed)
 			}
+			b.blockedTimer.Stop()
 			// clear the map
 			b.subs = make(map[subscriberID]*subscriptionChan)
-			b.subsByTopic = make(map[topicID][]subscriberID)
+			b.subsByTopic = newTopicTree()
+			b.groupCursor = make(map[groupID]int)
+			b.progressMsg = make(map[messageID]*inflightMsg)
+
+			// the delayed messages only live in memory
+			b.scheduleTimer.Stop()
+			if len(b.scheduled) > 0 {
+				log.Warning("dropping delayed messages on close", log.WithField("count", len(b.scheduled)))
+			}
+			b.scheduled = nil
 
 			b.drainCommands()
 			b.drainPublish()
@@ -192,6 +294,14 @@ func (b *Broker) run(ctx context.Context) error {
 		case publish := <-b.pubBuffer: // separate publish with command
 			log.Trace("received a publish")
 			b.handlePublish(b.ctx, publish)
+		case now := <-redelivery:
+			b.handleExpiredMsg(b.ctx, now)
+		case now := <-b.scheduleTimer.C:
+			b.handleScheduled(b.ctx, now)
+		case now := <-b.blockedTimer.C:
+			b.flushBlocked(now)
+		case <-b.drained:
+			b.flushBlocked(time.Now())
 		case <-b.closeWait: // less prioritize the close wait command
 			log.Trace("received a close wait")
 			b.cancel()
@@ -279,9 +389,21 @@ func (b *Broker) init() {
 	b.closeWait = make(chan closeCommand)
 	b.cmdBuffer = make(chan command, b.config.CmdBufferSize)
 	b.pubBuffer = make(chan publishCommand, b.config.PubBufferSize)
-	b.progressMsg = make(map[messageID]event.Message)
-	b.subsByTopic = make(map[topicID][]subscriberID)
+	b.progressMsg = make(map[messageID]*inflightMsg)
+	b.scheduled = scheduleQueue{}
+	b.scheduleTimer = time.NewTimer(time.Hour)
+	b.scheduleTimer.Stop()
+	b.blockedTimer = time.NewTimer(time.Hour)
+	b.blockedTimer.Stop()
+	b.drained = make(chan struct{}, 1)
+	b.subsByTopic = newTopicTree()
 	b.subs = make(map[subscriberID]*subscriptionChan)
+	b.groupCursor = make(map[groupID]int)
+	b.retained = make(map[topicID]*retainedMsg)
+	b.counters = make(map[string]int64)
+	if !b.skipDedup {
+		b.dedup = event.NewDeduplicator(b.config.DedupWindow)
+	}
 }
 
 func (b *Broker) handleCmd(ctx context.Context, cmd command) {
@@ -296,6 +418,8 @@ func (b *Broker) handleCmd(ctx context.Context, cmd command) {
 		b.handleProgressMsg(ctx, cmd)
 	case *nackMsgCommand:
 		b.handleNackMsg(ctx, cmd)
+	case *statsCommand:
+		b.handleStats(ctx, cmd)
 	case *publishCommand:
 		select {
 		case <-ctx.Done():
@@ -320,41 +444,387 @@ func (b *Broker) handlePublish(ctx context.Context, publish publishCommand) {
 		return
 	}
 
-	defer close(publish.err)
-	// also check subscriber presence, skip all the logic if not present
-	subs, ok := b.subsByTopic[publish.topic]
-	if !ok {
+	// the publisher is notified after the blocked subscribers accept the
+	// message or their overflow timeout reached
+	waiter := newPublishWaiter(publish.err)
+	defer waiter.done()
+
+	option := publish.option
+	if option == nil {
+		option = event.NewPublishOption()
+	}
+
+	now := time.Now()
+	if option.Expired(now) {
+		log.Trace("dropping expired message", log.WithField("topic", publish.topic))
+		b.counters["expired"]++
 		return
 	}
 
-	// peek all the subs not exceed buffer size
-	// expect all operation must success
-	for _, s := range subs {
-		c := b.subs[s]
-		if len(c.channel) < b.config.SubBufferSize-1 {
-			continue
+	// the scheduled message is already checked when it was published
+	if !publish.delayed && b.dedup.Duplicate(string(publish.topic), option.IdempotencyKey(), now) {
+		log.Debug("dropping duplicated message",
+			log.WithField("topic", publish.topic),
+			log.WithField("idempotency_key", option.IdempotencyKey()),
+		)
+		b.counters["duplicates"]++
+		return
+	}
+
+	// keep the message until its delivery time
+	if option.DeliverAt.After(now) {
+		b.schedule(publish, option.DeliverAt)
+		b.counters["scheduled"]++
+		return
+	}
+	b.counters["published"]++
+
+	// also check subscriber presence, only keep the retained value if not
+	// present
+	subs := b.subsByTopic.match(publish.topic)
+	if len(subs) == 0 {
+		if option.Retain {
+			b.retain(publish.topic, publish.payload, option)
 		}
+		return
+	}
+
+	// only one subscriber of each group will receive the message
+	recipients := b.selectRecipients(subs)
+
+	// the publish only fails as a whole when none of the recipients have
+	// room, so the delayed messages can be retried later
+	if b.rejected(recipients) {
+		b.counters["buffer_exceeded"]++
 		publish.err <- ErrSubscribeBufferExceeded
 		return
 	}
 
-	// walk through all subs and send the message
-	for _, s := range subs {
+	// the value is retained once the publish is accepted
+	if option.Retain {
+		b.retain(publish.topic, publish.payload, option)
+	}
+
+	// walk through all subs and send the message, a slow subscriber is
+	// handled by its own overflow policy without affecting the others
+	for _, s := range recipients {
 		// make the message for each subscriber
 		id := messageID(generateID())
-		msg := &message{
+		inflight := &inflightMsg{
 			id:           id,
+			topic:        publish.topic,
 			payload:      publish.payload,
-			broker:       b,
+			headers:      option.Headers,
+			expiresAt:    option.ExpiresAt,
+			createdAt:    now,
 			subscriberID: s,
 		}
 
-		// append to the processing message list
-		b.progressMsg[id] = msg
+		b.offer(b.subs[s], inflight, waiter)
+	}
+}
+
+// removeSubscription forget the subscription, its unacknowledged messages
+// are handed over to the rest of its work queue group or released
+func (b *Broker) removeSubscription(c *subscriptionChan) {
+	// close the channel
+	close(c.channel)
+
+	// clear the cache by topic
+	b.subsByTopic.remove(c.topic, c.id)
+
+	// remove the subscription
+	delete(b.subs, c.id)
+
+	// release the messages that never be acknowledged
+	pending := []*inflightMsg{}
+	for id, inflight := range b.progressMsg {
+		if inflight.subscriberID == c.id {
+			delete(b.progressMsg, id)
+			pending = append(pending, inflight)
+		}
+	}
+
+	// the blocked ones are not delivered yet, the publishers are unblocked
+	// as the group takes them over
+	for _, blocked := range c.blocked {
+		pending = append(pending, blocked.inflight)
+	}
+	c.releaseBlocked(nil)
+
+	if c.policy == event.WorkQueuePolicy {
+		b.handOver(c, pending)
+	}
+}
+
+// handOver redeliver the messages of the leaving work queue member to the
+// rest of its group in round robin, in the order they were published
+func (b *Broker) handOver(c *subscriptionChan, pending []*inflightMsg) {
+	gid := groupID{topic: c.topic, name: c.group}
+	members := []subscriberID{}
+	for id, s := range b.subs {
+		if s.policy == event.WorkQueuePolicy && s.topic == c.topic && s.group == c.group {
+			members = append(members, id)
+		}
+	}
+	if len(members) == 0 || len(pending) == 0 {
+		return
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i] < members[j]
+	})
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].createdAt.Before(pending[j].createdAt)
+	})
+
+	// nobody wait for the redeliveries
+	waiter := newPublishWaiter(make(chan error, 1))
+	defer waiter.done()
+
+	for _, inflight := range pending {
+		if inflight.expired(time.Now()) {
+			b.counters["expired"]++
+			continue
+		}
+		if b.config.MaxDeliveries > 0 && inflight.deliveries >= b.config.MaxDeliveries {
+			b.deadLetter(b.ctx, inflight)
+			continue
+		}
+
+		// the member may be disconnected by a previous offer
+		var member *subscriptionChan
+		for i := 0; i < len(members) && member == nil; i++ {
+			cursor := b.groupCursor[gid] % len(members)
+			b.groupCursor[gid] = cursor + 1
+			member = b.subs[members[cursor]]
+		}
+		if member == nil {
+			return
+		}
+
+		inflight.subscriberID = member.id
+		b.counters["handed_over"]++
+		b.offer(member, inflight, waiter)
+	}
+}
+
+// deliver record the next delivery attempt of the message and make the
+// message instance for the subscriber
+func (b *Broker) deliver(inflight *inflightMsg) *message {
+	inflight.deliveries++
+	b.counters["delivered"]++
+	if inflight.deliveries > 1 {
+		b.counters["redelivered"]++
+	}
+	inflight.deadline = time.Time{}
+	if b.config.AckDeadline > 0 {
+		inflight.deadline = time.Now().Add(b.config.AckDeadline)
+	}
+
+	return &message{
+		id:           inflight.id,
+		topic:        inflight.topic,
+		subscriberID: inflight.subscriberID,
+		payload:      inflight.payload,
+		headers:      inflight.headers,
+		deliveries:   inflight.deliveries,
+		broker:       b,
+	}
+}
+
+// schedule keep the publish until the given time, the publisher is
+// notified directly as the message is accepted
+func (b *Broker) schedule(publish publishCommand, at time.Time) {
+	// the publish error chan is closed by the caller, the scheduled
+	// message use its own on delivery
+	publish.err = nil
+	heap.Push(&b.scheduled, &scheduledMsg{publish: publish, at: at})
+	b.resetScheduleTimer()
+}
+
+// handleScheduled publish the scheduled messages that reach their time,
+// those which are rejected due to busy subscribers are retried later
+func (b *Broker) handleScheduled(ctx context.Context, now time.Time) {
+	for len(b.scheduled) > 0 && !b.scheduled[0].at.After(now) {
+		scheduled := heap.Pop(&b.scheduled).(*scheduledMsg)
+
+		publish := scheduled.publish
+		publish.err = make(chan error, 1)
+		publish.delayed = true
+		b.handlePublish(ctx, publish)
+
+		// the rejection is known right away, nobody wait for the blocked
+		// subscribers of the delayed message
+		var err error
+		select {
+		case err = <-publish.err:
+		default:
+		}
+
+		if err == ErrSubscribeBufferExceeded && b.config.RedeliveryInterval > 0 {
+			heap.Push(&b.scheduled, &scheduledMsg{
+				publish: scheduled.publish,
+				at:      now.Add(b.config.RedeliveryInterval),
+			})
+			continue
+		}
+
+		if err != nil {
+			log.Error("failed when publishing delayed message", log.WithField("topic", publish.topic), log.WithError(err))
+		}
+	}
+
+	b.resetScheduleTimer()
+}
+
+// resetScheduleTimer fire the timer on the earliest scheduled message, it
+// is safe to drain the timer channel since only the loop reads it
+func (b *Broker) resetScheduleTimer() {
+	if !b.scheduleTimer.Stop() {
+		select {
+		case <-b.scheduleTimer.C:
+		default:
+		}
+	}
+
+	if len(b.scheduled) > 0 {
+		b.scheduleTimer.Reset(time.Until(b.scheduled[0].at))
+	}
+}
+
+// redeliver send back the message to its subscriber, when it exceeds the
+// max deliveries the message moved to the dead letter topic instead
+func (b *Broker) redeliver(ctx context.Context, inflight *inflightMsg) error {
+	if inflight.expired(time.Now()) {
+		log.Trace("dropping expired message", log.WithField("id", inflight.id), log.WithField("topic", inflight.topic))
+		b.counters["expired"]++
+		delete(b.progressMsg, inflight.id)
+		return nil
+	}
+
+	if b.config.MaxDeliveries > 0 && inflight.deliveries >= b.config.MaxDeliveries {
+		delete(b.progressMsg, inflight.id)
+		b.deadLetter(ctx, inflight)
+		return nil
+	}
+
+	c, ok := b.subs[inflight.subscriberID]
+	if !ok {
+		// the subscriber already gone, nobody will ack the message
+		delete(b.progressMsg, inflight.id)
+		return ErrAlreadyClosed
+	}
+
+	// try again on the next check when the subscriber is busy
+	if len(c.channel) >= b.config.SubBufferSize {
+		return ErrSubscribeBufferExceeded
+	}
+
+	c.channel <- b.deliver(inflight)
+	return nil
+}
+
+func (b *Broker) deadLetter(ctx context.Context, inflight *inflightMsg) {
+	fields := log.WithFields(map[string]interface{}{
+		"id":         inflight.id,
+		"topic":      inflight.topic,
+		"deliveries": inflight.deliveries,
+	})
+
+	if b.deadLetterHook != nil {
+		b.deadLetterHook(string(inflight.subscriberID), inflight.payload)
+	}
+
+	// avoid endless loop when the dead letter subscriber also fails
+	if b.config.DeadLetterTopic == "" || string(inflight.topic) == b.config.DeadLetterTopic {
+		log.Warning("message exceeds max deliveries, dropping it", fields)
+		b.counters["dropped"]++
+		return
+	}
+	b.counters["dead_lettered"]++
+
+	log.Warning("message exceeds max deliveries, moving it to the dead letter topic", fields,
+		log.WithField("dead_letter_topic", b.config.DeadLetterTopic),
+	)
+	errChan := make(chan error, 1)
+	b.handlePublish(ctx, publishCommand{
+		ctx:     ctx,
+		topic:   topicID(b.config.DeadLetterTopic),
+		payload: inflight.payload,
+		option: event.NewPublishOption(
+			event.WithHeaders(inflight.headers),
+			event.WithHeader(event.HeaderOriginalTopic, string(inflight.topic)),
+		),
+		err: errChan,
+	})
+
+	// the loop can't wait for the blocked dead letter subscribers, only the
+	// rejection is known right away
+	select {
+	case err := <-errChan:
+		if err != nil {
+			log.Error("failed when publish to the dead letter topic", log.WithError(err), fields)
+		}
+	default:
+	}
+}
+
+func (b *Broker) handleExpiredMsg(ctx context.Context, now time.Time) {
+	for _, inflight := range b.progressMsg {
+		if inflight.deadline.IsZero() || inflight.deadline.After(now) {
+			continue
+		}
+
+		log.Trace("message ack deadline exceeded, redelivering...", log.WithField("id", inflight.id))
+		if err := b.redeliver(ctx, inflight); err != nil {
+			log.Trace("failed to redeliver expired message", log.WithField("id", inflight.id), log.WithError(err))
+		}
+	}
+}
+
+// selectRecipients pick the subscribers that will receive a message, fan out
+// subscribers always receive it while each work queue group only has one
+// recipient that chosen in round robin fashion
+func (b *Broker) selectRecipients(subs []subscriberID) []subscriberID {
+	recipients := make([]subscriberID, 0, len(subs))
+	groups := make(map[groupID][]subscriberID)
+	groupOrder := []groupID{}
 
+	for _, s := range subs {
 		c := b.subs[s]
-		c.channel <- msg
+		if c.policy != event.WorkQueuePolicy {
+			recipients = append(recipients, s)
+			continue
+		}
+
+		gid := groupID{topic: c.topic, name: c.group}
+		if _, ok := groups[gid]; !ok {
+			groupOrder = append(groupOrder, gid)
+		}
+		groups[gid] = append(groups[gid], s)
+	}
+
+	for _, gid := range groupOrder {
+		members := groups[gid]
+		cursor := b.groupCursor[gid] % len(members)
+
+		// prefer the next member that still has room in its buffer
+		selected := members[cursor]
+		for i := 0; i < len(members); i++ {
+			candidate := members[(cursor+i)%len(members)]
+			if c := b.subs[candidate].channel; len(c) < cap(c) {
+				selected = candidate
+				cursor = (cursor + i) % len(members)
+				break
+			}
+		}
+
+		b.groupCursor[gid] = cursor + 1
+		recipients = append(recipients, selected)
 	}
+
+	return recipients
 }
 
 func (b *Broker) handleUnsubscribe(ctx context.Context, unsubscribe *unsubscribeCommand) {
@@ -383,24 +853,7 @@ func (b *Broker) handleUnsubscribe(ctx context.Context, unsubscribe *unsubscribe
 			unsubscribe.cancel()
 		}
 
-		// close the channel
-		close(s.channel)
-
-		// clear the cache by topic
-		subs := b.subsByTopic[unsubscribe.topic]
-		newSubs := make([]subscriberID, len(subs)-1)
-		i := 0
-		for _, sub := range subs {
-			if sub == unsubscribe.id {
-				continue
-			}
-			newSubs[i] = sub
-			i++
-		}
-		b.subsByTopic[unsubscribe.topic] = newSubs
-
-		// remove the subscription
-		delete(b.subs, unsubscribe.id)
+		b.removeSubscription(s)
 
 		// send the result
 		unsubscribe.errChan <- nil
@@ -440,9 +893,17 @@ func (b *Broker) handleSubscribe(ctx context.Context, subscribe *subscribeComman
 					subscribe.id,
 					channel,
 				)
+				subscription.policy = subscribe.option.Policy
+				subscription.group = subscribe.option.Group
+				subscription.overflow = subscribe.option.Overflow
+				subscription.overflowTimeout = subscribe.option.OverflowTimeout
+				if subscription.overflow == event.Block {
+					subscription.out = make(chan event.Message)
+					go subscription.pump(b.drained)
+				}
 				b.subs[subscribe.id] = subscription
 				// cache by topic
-				b.subsByTopic[subscribe.topic] = append(b.subsByTopic[subscribe.topic], subscribe.id)
+				b.subsByTopic.add(subscribe.topic, subscribe.id)
 
 				// send the result
 				subscribe.subscription <- subscription
@@ -456,6 +917,10 @@ func (b *Broker) handleSubscribe(ctx context.Context, subscribe *subscribeComman
 
 	// wait till registered
 	<-doneChan
+
+	if s, ok := b.subs[subscribe.id]; ok {
+		b.deliverRetained(s)
+	}
 }
 
 func (b *Broker) handleAckMsg(ctx context.Context, cmd *ackMsgCommand) {
@@ -469,6 +934,9 @@ func (b *Broker) handleAckMsg(ctx context.Context, cmd *ackMsgCommand) {
 		return
 	default:
 		// delete from progress message
+		if _, ok := b.progressMsg[cmd.id]; ok {
+			b.counters["acked"]++
+		}
 		delete(b.progressMsg, cmd.id)
 		// send result
 		cmd.err <- nil
@@ -477,43 +945,122 @@ func (b *Broker) handleAckMsg(ctx context.Context, cmd *ackMsgCommand) {
 }
 
 func (b *Broker) handleProgressMsg(ctx context.Context, cmd *progressMsgCommand) {
-	// noop
-	// TODO: add time limit for handle the message
-
 	defer close(cmd.err)
 
-	// send result
-	cmd.err <- nil
+	select {
+	case <-ctx.Done(): // for the global context
+		cmd.err <- ErrAlreadyClosed
+		return
+	case <-cmd.ctx.Done():
+		cmd.err <- ErrOperationCanceled
+		return
+	default:
+		inflight, ok := b.progressMsg[cmd.id]
+		if !ok {
+			cmd.err <- ErrMessageNotFound
+			return
+		}
+
+		// reserve the message for another deadline period
+		if b.config.AckDeadline > 0 {
+			inflight.deadline = time.Now().Add(b.config.AckDeadline)
+		}
+
+		// send result
+		cmd.err <- nil
+	}
 }
 
 func (b *Broker) handleNackMsg(ctx context.Context, cmd *nackMsgCommand) {
 	defer close(cmd.err)
 
-	// do inside goroutine to also watch the context for cancel operation
-	doChan := make(chan struct{}, 1)
-	defer close(doChan)
-	doChan <- struct{}{}
-
-	for {
-		select {
-		case <-ctx.Done(): // for the global context
-			cmd.err <- ErrOperationCanceled
-			// close synchronization channel
-			return
-		case <-cmd.ctx.Done():
-			cmd.err <- ErrOperationCanceled
-			return
-		case <-doChan:
-			// resubmit the message
-			msg := b.progressMsg[cmd.id]
-			c := b.subs[cmd.subscriberID]
-			c.channel <- msg
-
-			// send result
-			cmd.err <- nil
+	select {
+	case <-ctx.Done(): // for the global context
+		cmd.err <- ErrOperationCanceled
+		return
+	case <-cmd.ctx.Done():
+		cmd.err <- ErrOperationCanceled
+		return
+	default:
+		inflight, ok := b.progressMsg[cmd.id]
+		if !ok {
+			cmd.err <- ErrMessageNotFound
 			return
 		}
+
+		// resubmit the message
+		b.counters["nacked"]++
+		err := b.redeliver(ctx, inflight)
+		if err == ErrSubscribeBufferExceeded && b.config.RedeliveryInterval > 0 {
+			// let the redelivery check retry it later
+			inflight.deadline = time.Now()
+			err = nil
+		}
+
+		// send result
+		cmd.err <- err
+	}
+}
+
+func (b *Broker) handleStats(ctx context.Context, cmd *statsCommand) {
+	select {
+	case <-ctx.Done(): // for the global context
+		cmd.err <- ErrAlreadyClosed
+		return
+	case <-cmd.ctx.Done():
+		cmd.err <- ErrOperationCanceled
+		return
+	default:
+	}
+
+	now := time.Now()
+	subs := make(map[subscriberID]*event.SubscriptionStats, len(b.subs))
+	for id, c := range b.subs {
+		subs[id] = &event.SubscriptionStats{
+			ID:       string(id),
+			Topic:    string(c.topic),
+			Policy:   c.policy.String(),
+			Group:    c.group,
+			Buffered: len(c.channel),
+			Capacity: cap(c.channel),
+			Overflow: c.overflow.String(),
+			Dropped:  c.dropped,
+		}
+	}
+
+	// the age is measured since the first delivery, so redeliveries
+	// don't hide a stuck message
+	for _, inflight := range b.progressMsg {
+		s, ok := subs[inflight.subscriberID]
+		if !ok {
+			continue
+		}
+
+		s.InFlight++
+		if age := now.Sub(inflight.createdAt); age > s.OldestUnacked {
+			s.OldestUnacked = age
+		}
+	}
+
+	stats := event.Stats{
+		Broker:        "channel",
+		Subscriptions: make([]event.SubscriptionStats, 0, len(subs)),
+		InFlight:      len(b.progressMsg),
+		Counters:      make(map[string]int64, len(b.counters)+1),
 	}
+	for _, s := range subs {
+		stats.Subscriptions = append(stats.Subscriptions, *s)
+	}
+	event.SortSubscriptions(stats.Subscriptions)
+	stats.Topics = event.SummarizeTopics(stats.Subscriptions)
+
+	for k, v := range b.counters {
+		stats.Counters[k] = v
+	}
+	stats.Counters["scheduled_pending"] = int64(len(b.scheduled))
+	stats.Counters["retained"] = int64(len(b.retained))
+
+	cmd.result <- &stats
 }
 
 func WithRunOnInit(runOnInit bool) OptionsFunc {
@@ -522,6 +1069,23 @@ func WithRunOnInit(runOnInit bool) OptionsFunc {
 	})
 }
 
+// WithSkipDedup never drop the duplicated publishes, it is used by the
+// brokers that wrap the channel broker and already drop them
+func WithSkipDedup(skip bool) OptionsFunc {
+	return OptionsFunc(func(b *Broker) {
+		b.skipDedup = skip
+	})
+}
+
+// WithDeadLetterHook call the hook with the messages that exceed the max
+// deliveries before they are moved or dropped, it is used by the brokers
+// that wrap the channel broker to release them
+func WithDeadLetterHook(hook func(subscriber string, payload event.Payload)) OptionsFunc {
+	return OptionsFunc(func(b *Broker) {
+		b.deadLetterHook = hook
+	})
+}
+
 func WithConfig(config Config) OptionsFunc {
 	return OptionsFunc(func(b *Broker) {
 		b.config = config
@@ -536,6 +1100,10 @@ func New(opts ...Options) *Broker {
 			CmdBufferSize: 256,
 			PubBufferSize: 256,
 			SubBufferSize: 16,
+
+			// the redelivery is opt in by setting the ack deadline
+			RedeliveryInterval: time.Second,
+			DedupWindow:        time.Minute,
 		},
 	}
 
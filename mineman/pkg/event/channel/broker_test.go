@@ -2,7 +2,11 @@ package channel
 
 import (
 	"context"
+	"errors"
 	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -24,6 +28,23 @@ func TestPubSub(t *testing.T) {
 	defer close(doneB)
 	resultB := []string{}
 
+	// the accepted messages may still be buffered when the broker closed
+	drain := func(sub event.SubscriptionMsg, result *[]string) {
+		for {
+			select {
+			case msg := <-sub.Message():
+				if msg == nil {
+					return
+				}
+				var payload string
+				msg.Scan(&payload)
+				*result = append(*result, payload)
+			default:
+				return
+			}
+		}
+	}
+
 	subscriberA := func(sub event.SubscriptionMsg) {
 		defer func() {
 			doneA <- struct{}{}
@@ -31,6 +52,7 @@ func TestPubSub(t *testing.T) {
 		for {
 			select {
 			case <-sub.Done():
+				drain(sub, &resultA)
 				return
 			case msg := <-sub.Message():
 				var payload string
@@ -46,6 +68,7 @@ func TestPubSub(t *testing.T) {
 		for {
 			select {
 			case <-sub.Done():
+				drain(sub, &resultB)
 				return
 			case msg := <-sub.Message():
 				if msg == nil {
@@ -129,3 +152,938 @@ func TestPubSub(t *testing.T) {
 	check(resultA)
 	check(resultB)
 }
+
+func TestWorkQueue(t *testing.T) {
+	const total = 100
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := New()
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	var (
+		mu       sync.Mutex
+		received = make(map[string][]string)
+		done     = make(chan struct{}, total*2)
+	)
+
+	handler := func(name string) event.MessageHandler {
+		return event.MessageHandlerFunc(func(ctx context.Context, msg event.Message) {
+			var payload string
+			msg.Scan(&payload)
+			<-msg.Ack(ctx)
+
+			mu.Lock()
+			received[name] = append(received[name], payload)
+			mu.Unlock()
+			done <- struct{}{}
+		})
+	}
+
+	// the publishes are faster than the handlers, wait for them instead of
+	// rejecting the publish
+	block := event.BlockOnOverflow(time.Second)
+	broker.SubscribeHandler(ctx, "job", handler("worker-a"), event.Group("workers"), block)
+	broker.SubscribeHandler(ctx, "job", handler("worker-b"), event.Group("workers"), block)
+	broker.SubscribeHandler(ctx, "job", handler("audit"), block)
+
+	for i := 0; i < total; i++ {
+		if err := <-broker.Publish(ctx, "job", event.StringPayload(strconv.Itoa(i))).Error(); err != nil {
+			t.Fatalf("publish %d failed with %s", i, err)
+		}
+	}
+
+	for i := 0; i < total*2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("expect %d deliveries, but only got %d", total*2, i)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received["audit"]) != total {
+		t.Errorf("expect fan out subscriber receive %d messages, but got %d", total, len(received["audit"]))
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range []string{"worker-a", "worker-b"} {
+		if len(received[name]) != total/2 {
+			t.Errorf("expect %s receive %d messages, but got %d", name, total/2, len(received[name]))
+		}
+		for _, payload := range received[name] {
+			if seen[payload] {
+				t.Errorf("expect message '%s' delivered once to the group", payload)
+			}
+			seen[payload] = true
+		}
+	}
+
+	if len(seen) != total {
+		t.Errorf("expect group receive %d distinct messages, but got %d", total, len(seen))
+	}
+}
+
+func TestWorkQueueHandOver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := New()
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	workerA := broker.Subscribe(ctx, "job", event.Group("workers"))
+	workerB := broker.Subscribe(ctx, "job", event.Group("workers"))
+
+	for i := 0; i < 2; i++ {
+		if err := <-broker.Publish(ctx, "job", event.StringPayload(strconv.Itoa(i))).Error(); err != nil {
+			t.Fatalf("publish %d failed with %s", i, err)
+		}
+	}
+
+	receive := func(sub event.SubscriptionMsg, name string) string {
+		select {
+		case msg := <-sub.Message():
+			var payload string
+			msg.Scan(&payload)
+			return payload
+		case <-time.After(time.Second):
+			t.Fatalf("expect %s receive a message", name)
+		}
+		return ""
+	}
+
+	// worker a leaves without acking its message
+	left := receive(workerA, "worker a")
+	own := receive(workerB, "worker b")
+	if left == own {
+		t.Fatalf("expect each worker receive a different message, both got '%s'", left)
+	}
+	if err := workerA.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload := receive(workerB, "worker b"); payload != left {
+		t.Errorf("expect worker b take over message '%s', but got '%s'", left, payload)
+	}
+
+	select {
+	case msg := <-workerB.Message():
+		var payload string
+		msg.Scan(&payload)
+		t.Errorf("expect no more delivery, but got '%s'", payload)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestWorkQueueHandOverDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := New(WithConfig(Config{
+		CmdBufferSize: 16,
+		PubBufferSize: 16,
+		SubBufferSize: 2,
+	}))
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	disconnect := event.OnOverflow(event.Disconnect)
+	workerA := broker.Subscribe(ctx, "job", event.Group("workers"), disconnect)
+	workerB := broker.Subscribe(ctx, "job", event.Group("workers"), disconnect)
+
+	// fill both workers without reading
+	for i := 0; i < 4; i++ {
+		if err := <-broker.Publish(ctx, "job", event.StringPayload(strconv.Itoa(i))).Error(); err != nil {
+			t.Fatalf("publish %d failed with %s", i, err)
+		}
+	}
+
+	// the first handed over message disconnect worker b, the next one has
+	// nobody left to receive it
+	if err := workerA.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-workerB.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expect worker b disconnected")
+	}
+
+	statsCtx, statsCancel := context.WithTimeout(ctx, time.Second)
+	defer statsCancel()
+	if _, err := broker.Stats(statsCtx); err != nil {
+		t.Fatalf("expect the broker still serving, got %s", err)
+	}
+}
+
+func TestWildcardSubscription(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := New()
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	expects := map[string]int{
+		"network.*":              2,
+		"miner.#":                3,
+		"network.status-changed": 1,
+		"#":                      5,
+	}
+
+	subscriptions := make(map[string]event.SubscriptionMsg)
+	for pattern := range expects {
+		subscriptions[pattern] = broker.Subscribe(ctx, pattern)
+	}
+
+	topics := []string{
+		"network.status-changed",
+		"network.ping",
+		"miner",
+		"miner.status-changed",
+		"miner.teamredminer.hashrate",
+	}
+	for _, topic := range topics {
+		if err := <-broker.Publish(ctx, topic, event.StringPayload(topic)).Error(); err != nil {
+			t.Fatalf("publish to %s failed with %s", topic, err)
+		}
+	}
+
+	for pattern, expect := range expects {
+		sub := subscriptions[pattern]
+		for i := 0; i < expect; i++ {
+			select {
+			case msg := <-sub.Message():
+				var topic string
+				msg.Scan(&topic)
+				if !event.MatchTopic(pattern, topic) {
+					t.Errorf("pattern '%s' shouldn't receive message from '%s'", pattern, topic)
+				}
+				msg.Ack(ctx)
+			case <-time.After(time.Second):
+				t.Fatalf("expect pattern '%s' receive %d messages, but got %d", pattern, expect, i)
+			}
+		}
+
+		select {
+		case msg := <-sub.Message():
+			var topic string
+			msg.Scan(&topic)
+			t.Errorf("pattern '%s' receive unexpected message from '%s'", pattern, topic)
+		default:
+		}
+	}
+
+	if err := <-broker.Publish(ctx, "network.*", event.StringPayload("invalid")).Error(); err != event.ErrInvalidTopic {
+		t.Errorf("expect publish to a pattern rejected, but got %v", err)
+	}
+}
+
+func TestRedeliveryAndDeadLetter(t *testing.T) {
+	const maxDeliveries = 3
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := New(WithConfig(Config{
+		WaitOnClose:        true,
+		CmdBufferSize:      16,
+		PubBufferSize:      16,
+		SubBufferSize:      16,
+		AckDeadline:        time.Millisecond * 50,
+		RedeliveryInterval: time.Millisecond * 10,
+		MaxDeliveries:      maxDeliveries,
+		DeadLetterTopic:    "dead",
+	}))
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	expired := broker.Subscribe(ctx, "expired")
+	nacked := broker.Subscribe(ctx, "nacked")
+	dead := broker.Subscribe(ctx, "dead")
+
+	for _, topic := range []string{"expired", "nacked"} {
+		if err := <-broker.Publish(ctx, topic, event.StringPayload(topic)).Error(); err != nil {
+			t.Fatalf("publish to %s failed with %s", topic, err)
+		}
+	}
+
+	receive := func(sub event.SubscriptionMsg, name string) event.Message {
+		select {
+		case msg := <-sub.Message():
+			return msg
+		case <-time.After(time.Second):
+			t.Fatalf("expect %s receive a message", name)
+		}
+		return nil
+	}
+
+	// explicitly reject the message
+	for i := 1; i <= maxDeliveries; i++ {
+		msg := receive(nacked, "nacked")
+		if msg.Deliveries() != i {
+			t.Errorf("expect nacked message delivered %d times, but got %d", i, msg.Deliveries())
+		}
+		if err := <-msg.Nack(ctx); err != nil {
+			t.Fatalf("nack failed with %s", err)
+		}
+	}
+
+	// let the ack deadline exceeded
+	for i := 1; i <= maxDeliveries; i++ {
+		msg := receive(expired, "expired")
+		if msg.Deliveries() != i {
+			t.Errorf("expect expired message delivered %d times, but got %d", i, msg.Deliveries())
+		}
+	}
+
+	// unread dead letter may also be redelivered, only check the distinct one
+	deadLetters := map[string]bool{}
+	for !deadLetters["expired"] || !deadLetters["nacked"] {
+		msg := receive(dead, "dead letter")
+		var payload string
+		msg.Scan(&payload)
+		deadLetters[payload] = true
+		<-msg.Ack(ctx)
+	}
+
+	select {
+	case <-expired.Message():
+		t.Error("expect no more delivery after moved to dead letter")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestNackBufferFull(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the ack deadline is not set, the nack retry doesn't rely on it
+	broker := New(WithConfig(Config{
+		CmdBufferSize:      16,
+		PubBufferSize:      16,
+		SubBufferSize:      2,
+		RedeliveryInterval: time.Millisecond * 10,
+	}))
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	sub := broker.Subscribe(ctx, "job", event.OnOverflow(event.DropOldest))
+	receive := func() event.Message {
+		select {
+		case msg := <-sub.Message():
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("expect receiving a message")
+		}
+		return nil
+	}
+
+	var nacked event.Message
+	for _, payload := range []string{"a", "b", "c"} {
+		if err := <-broker.Publish(ctx, "job", event.StringPayload(payload)).Error(); err != nil {
+			t.Fatal(err)
+		}
+		if payload == "a" {
+			nacked = receive()
+		}
+	}
+
+	// the buffer is full of b and c when a is nacked
+	if err := <-nacked.Nack(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expect := range []string{"b", "c", "a"} {
+		msg := receive()
+		var payload string
+		msg.Scan(&payload)
+		if payload != expect {
+			t.Errorf("expect '%s', but got '%s'", expect, payload)
+		}
+	}
+}
+
+func TestDeadLetterBlocked(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := New(WithConfig(Config{
+		CmdBufferSize:   16,
+		PubBufferSize:   16,
+		SubBufferSize:   2,
+		MaxDeliveries:   1,
+		DeadLetterTopic: "dead",
+	}))
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	// fill the dead letter subscriber, the pump hold one and the buffer the
+	// others
+	broker.Subscribe(ctx, "dead", event.BlockOnOverflow(time.Millisecond*50))
+	for i := 0; i < 3; i++ {
+		if err := <-broker.Publish(ctx, "dead", event.StringPayload(strconv.Itoa(i))).Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sub := broker.Subscribe(ctx, "job")
+	if err := <-broker.Publish(ctx, "job", event.StringPayload("poison")).Error(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-sub.Message():
+		<-msg.Nack(ctx)
+	case <-time.After(time.Second):
+		t.Fatal("expect receiving the message")
+	}
+
+	// the loop keeps serving while the dead letter is blocked
+	statsCtx, statsCancel := context.WithTimeout(ctx, time.Second)
+	defer statsCancel()
+	stats, err := broker.Stats(statsCtx)
+	if err != nil {
+		t.Fatalf("expect the broker still serving, got %s", err)
+	}
+	if stats.Counters["dead_lettered"] != 1 {
+		t.Errorf("expect the message dead lettered, got %v", stats.Counters)
+	}
+}
+
+func TestRecoverOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := New()
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	handler := event.ChainConsume(event.MessageHandlerFunc(func(ctx context.Context, msg event.Message) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		panic("poison")
+	}), event.Recover())
+	broker.SubscribeHandler(ctx, "job", handler)
+
+	if err := <-broker.Publish(ctx, "job", event.StringPayload("poison")).Error(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("expect the panicking message handled once, got %d", calls)
+	}
+}
+
+func TestPublishOption(t *testing.T) {
+	ctx := context.Background()
+	broker := New()
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	sub := broker.Subscribe(ctx, "miner.resume")
+	publishedAt := time.Now()
+
+	// the expired one must be dropped before its delivery time
+	if err := <-broker.Publish(ctx, "miner.resume", event.StringPayload("stale"),
+		event.DeliverAfter(time.Millisecond*100),
+		event.TTL(time.Millisecond*50),
+	).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-broker.Publish(ctx, "miner.resume", event.StringPayload("resume"),
+		event.DeliverAfter(time.Millisecond*200),
+		event.WithHeader("reason", "network-up"),
+	).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-sub.Message():
+		var payload string
+		msg.Scan(&payload)
+		if payload != "resume" {
+			t.Fatalf("expect only the resume message delivered, got %s", payload)
+		}
+		if elapsed := time.Since(publishedAt); elapsed < time.Millisecond*200 {
+			t.Errorf("expect message delayed for 200ms, got %s", elapsed)
+		}
+		if reason := msg.Headers()["reason"]; reason != "network-up" {
+			t.Errorf("expect reason header network-up, got %s", reason)
+		}
+		msg.Ack(ctx)
+	case <-time.After(time.Second):
+		t.Fatal("expect receiving the delayed message")
+	}
+
+	select {
+	case msg := <-sub.Message():
+		var payload string
+		msg.Scan(&payload)
+		t.Fatalf("expect no other message, got %s", payload)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	ctx := context.Background()
+	broker := New()
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	broker.SubscribeHandler(ctx, "miner.status", event.MessageHandlerFunc(func(ctx context.Context, msg event.Message) {
+		var name string
+		msg.Scan(&name)
+
+		var opts []event.PublishConfigurator
+		if name == "unknown" {
+			opts = append(opts, event.WithReplyError(errors.New("unknown miner")))
+		}
+		msg.Reply(ctx, event.StringPayload("status of "+name), opts...)
+		msg.Ack(ctx)
+	}))
+
+	reqCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	reply, err := event.RequestWith(reqCtx, broker, "miner.status", event.StringPayload("teamredminer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status string
+	reply.Scan(&status)
+	if status != "status of teamredminer" {
+		t.Errorf("expect status of teamredminer, got %s", status)
+	}
+
+	if _, err := event.RequestWith(reqCtx, broker, "miner.status", event.StringPayload("unknown")); !errors.Is(err, event.ErrRequestFailed) {
+		t.Errorf("expect request failed, got %v", err)
+	}
+
+	// nobody answer the request
+	timeoutCtx, cancelTimeout := context.WithTimeout(ctx, time.Millisecond*100)
+	defer cancelTimeout()
+	if _, err := event.RequestWith(timeoutCtx, broker, "miner.start", event.StringPayload("")); err != context.DeadlineExceeded {
+		t.Errorf("expect deadline exceeded, got %v", err)
+	}
+}
+
+func TestRequestClosed(t *testing.T) {
+	ctx := context.Background()
+	broker := New()
+	broker.Start(ctx)
+
+	// the broker is gone before anybody replies
+	broker.SubscribeHandler(ctx, "miner.start", event.MessageHandlerFunc(func(ctx context.Context, msg event.Message) {
+		msg.Ack(ctx)
+		go broker.Close(context.Background())
+	}))
+
+	reqCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	reply, err := event.RequestWith(reqCtx, broker, "miner.start", event.StringPayload(""))
+	if err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect the request failed as soon as the broker closed, got %v with %v", err, reply)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	broker := New()
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	fast := broker.Subscribe(ctx, "network.status-changed")
+	// the slow one never receive its messages
+	broker.Subscribe(ctx, "network.*")
+
+	for i := 0; i < 3; i++ {
+		if err := <-broker.Publish(ctx, "network.status-changed", event.StringPayload(strconv.Itoa(i))).Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		msg := <-fast.Message()
+		<-msg.Ack(ctx)
+	}
+	time.Sleep(time.Millisecond * 20)
+
+	stats, err := broker.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.InFlight != 3 {
+		t.Errorf("expect 3 in flight messages, got %d", stats.InFlight)
+	}
+	if len(stats.Topics) != 2 {
+		t.Fatalf("expect 2 topics, got %d", len(stats.Topics))
+	}
+	if acked := stats.Counters["acked"]; acked != 3 {
+		t.Errorf("expect 3 acked messages, got %d", acked)
+	}
+
+	for _, s := range stats.Subscriptions {
+		switch s.Topic {
+		case "network.*":
+			if s.Buffered != 3 || s.InFlight != 3 {
+				t.Errorf("expect slow subscriber has 3 buffered and in flight, got %d and %d", s.Buffered, s.InFlight)
+			}
+			if s.OldestUnacked < time.Millisecond*20 {
+				t.Errorf("expect oldest unacked at least 20ms, got %s", s.OldestUnacked)
+			}
+		case "network.status-changed":
+			if s.Buffered != 0 || s.InFlight != 0 {
+				t.Errorf("expect fast subscriber has nothing pending, got %d and %d", s.Buffered, s.InFlight)
+			}
+		}
+	}
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	ctx := context.Background()
+	broker := New(WithConfig(Config{
+		WaitOnClose:   true,
+		CmdBufferSize: 256,
+		PubBufferSize: 256,
+		SubBufferSize: 2,
+	}))
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	topic := "network.status-changed"
+	fast := broker.Subscribe(ctx, topic)
+	newest := broker.Subscribe(ctx, topic, event.OnOverflow(event.DropNewest))
+	oldest := broker.Subscribe(ctx, topic, event.OnOverflow(event.DropOldest))
+	blocked := broker.Subscribe(ctx, topic, event.BlockOnOverflow(time.Millisecond*10))
+	disconnected := broker.Subscribe(ctx, topic, event.OnOverflow(event.Disconnect))
+
+	received := []string{}
+	for i := 0; i < 4; i++ {
+		if err := <-broker.Publish(ctx, topic, event.StringPayload(strconv.Itoa(i))).Error(); err != nil {
+			t.Fatalf("expect a slow subscriber doesn't fail the publish, got %v", err)
+		}
+
+		// the fast one keeps receiving while the others are full
+		msg := <-fast.Message()
+		var payload string
+		msg.Scan(&payload)
+		received = append(received, payload)
+		msg.Ack(ctx)
+	}
+	if len(received) != 4 {
+		t.Fatalf("expect fast subscriber receive all messages, got %v", received)
+	}
+
+	expectBuffered := func(name string, sub event.SubscriptionMsg, expected ...string) {
+		for _, e := range expected {
+			msg := <-sub.Message()
+			var payload string
+			msg.Scan(&payload)
+			if payload != e {
+				t.Errorf("expect %s subscriber receive %s, got %s", name, e, payload)
+			}
+		}
+	}
+	expectBuffered("drop newest", newest, "0", "1")
+	expectBuffered("drop oldest", oldest, "2", "3")
+	// the pump of the blocked subscriber hold one more message
+	expectBuffered("block", blocked, "0", "1", "2")
+
+	select {
+	case <-disconnected.Done():
+		if disconnected.Error() != event.ErrSlowConsumer {
+			t.Errorf("expect slow consumer error, got %v", disconnected.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect slow subscriber disconnected")
+	}
+
+	stats, err := broker.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := stats.Counters["dropped_newest"]; n != 2 {
+		t.Errorf("expect 2 newest messages dropped, got %d", n)
+	}
+	if n := stats.Counters["dropped_oldest"]; n != 2 {
+		t.Errorf("expect 2 oldest messages dropped, got %d", n)
+	}
+	if n := stats.Counters["dropped_blocked"]; n != 1 {
+		t.Errorf("expect 1 blocked message dropped, got %d", n)
+	}
+	if n := stats.Counters["disconnected"]; n != 1 {
+		t.Errorf("expect 1 subscriber disconnected, got %d", n)
+	}
+}
+
+func TestRetainedRejected(t *testing.T) {
+	ctx := context.Background()
+	broker := New(WithConfig(Config{
+		WaitOnClose:   true,
+		CmdBufferSize: 256,
+		PubBufferSize: 256,
+		SubBufferSize: 1,
+	}))
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	topic := "network.status-changed"
+	slow := broker.Subscribe(ctx, topic)
+	if err := <-broker.Publish(ctx, topic, event.StringPayload("up"), event.Retain()).Error(); err != nil {
+		t.Fatal(err)
+	}
+	// the only subscriber is full, the publish fails and keeps the old value
+	err := <-broker.Publish(ctx, topic, event.StringPayload("down"), event.Retain()).Error()
+	if !errors.Is(err, ErrSubscribeBufferExceeded) {
+		t.Fatalf("expect buffer exceeded error, got %v", err)
+	}
+	slow.Close()
+
+	sub := broker.Subscribe(ctx, topic)
+	select {
+	case msg := <-sub.Message():
+		var payload string
+		msg.Scan(&payload)
+		if payload != "up" {
+			t.Errorf("expect the accepted retained value up, got %s", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect receiving the retained message")
+	}
+}
+
+func TestOverflowReject(t *testing.T) {
+	ctx := context.Background()
+	broker := New(WithConfig(Config{
+		WaitOnClose:   true,
+		CmdBufferSize: 256,
+		PubBufferSize: 256,
+		SubBufferSize: 2,
+	}))
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	topic := "network.status-changed"
+	slow := broker.Subscribe(ctx, topic)
+	fast := broker.Subscribe(ctx, topic)
+
+	receive := func(sub event.SubscriptionMsg) string {
+		select {
+		case msg := <-sub.Message():
+			var payload string
+			msg.Scan(&payload)
+			return payload
+		case <-time.After(time.Second):
+			t.Fatal("expect receiving a message")
+		}
+		return ""
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-broker.Publish(ctx, topic, event.StringPayload(strconv.Itoa(i))).Error(); err != nil {
+			t.Fatal(err)
+		}
+		receive(fast)
+	}
+
+	// only the slow one miss the message, the publish name it
+	err := <-broker.Publish(ctx, topic, event.StringPayload("2")).Error()
+	if !errors.Is(err, ErrSubscribeBufferExceeded) || !strings.Contains(err.Error(), slow.ID()) || strings.Contains(err.Error(), fast.ID()) {
+		t.Fatalf("expect the slow subscriber reported as missed, got %v", err)
+	}
+	if payload := receive(fast); payload != "2" {
+		t.Errorf("expect fast subscriber receive 2, got %s", payload)
+	}
+
+	// nobody has room, the publish fails as a whole
+	if err := fast.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-broker.Publish(ctx, topic, event.StringPayload("3")).Error(); err != ErrSubscribeBufferExceeded {
+		t.Fatalf("expect buffer exceeded error, got %v", err)
+	}
+
+	for _, expect := range []string{"0", "1"} {
+		if payload := receive(slow); payload != expect {
+			t.Errorf("expect slow subscriber receive %s, got %s", expect, payload)
+		}
+	}
+	select {
+	case msg := <-slow.Message():
+		t.Errorf("expect slow subscriber doesn't receive the rejected messages, got %s", msg.ID())
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	stats, err := broker.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := stats.Counters["dropped_rejected"]; n != 1 {
+		t.Errorf("expect 1 message rejected by the slow subscriber, got %d", n)
+	}
+	if n := stats.Counters["buffer_exceeded"]; n != 1 {
+		t.Errorf("expect 1 publish rejected, got %d", n)
+	}
+}
+
+func TestOverflowBlockClose(t *testing.T) {
+	ctx := context.Background()
+	broker := New(WithConfig(Config{
+		CmdBufferSize: 256,
+		PubBufferSize: 256,
+		SubBufferSize: 1,
+	}))
+	broker.Start(ctx)
+
+	topic := "network.status-changed"
+	fast := broker.Subscribe(ctx, topic, event.OnOverflow(event.DropNewest))
+	blocked := broker.Subscribe(ctx, topic, event.BlockOnOverflow(time.Minute))
+
+	// fill the blocked subscriber, the pump hold one and the buffer the other
+	for i := 0; i < 2; i++ {
+		if err := <-broker.Publish(ctx, topic, event.StringPayload(strconv.Itoa(i))).Error(); err != nil {
+			t.Fatal(err)
+		}
+		<-fast.Message()
+	}
+
+	result := broker.Publish(ctx, topic, event.StringPayload("2")).Error()
+	<-fast.Message()
+	broker.Close(ctx)
+
+	// delivered to the fast one, the result name the one missed it
+	err := <-result
+	if !errors.Is(err, ErrAlreadyClosed) || !strings.Contains(err.Error(), blocked.ID()) {
+		t.Errorf("expect the blocked subscriber reported as missed, got %v", err)
+	}
+}
+
+func TestRetained(t *testing.T) {
+	ctx := context.Background()
+	broker := New()
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	for _, status := range []string{"down", "up"} {
+		if err := <-broker.Publish(ctx, "network.status-changed", event.StringPayload(status), event.Retain()).Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-broker.Publish(ctx, "miner.status-changed", event.StringPayload("stopped"),
+		event.Retain(),
+		event.TTL(time.Millisecond*50),
+	).Error(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// only the last value of the matching topics, the expired one is gone
+	sub := broker.Subscribe(ctx, "*.status-changed")
+	var msg event.Message
+	select {
+	case msg = <-sub.Message():
+	case <-time.After(time.Second):
+		t.Fatal("expect receiving the retained message")
+	}
+	var payload string
+	msg.Scan(&payload)
+	if payload != "up" {
+		t.Errorf("expect the last retained value up, got %s", payload)
+	}
+	if msg.Headers()[event.HeaderRetained] != "true" {
+		t.Errorf("expect retained header, got %v", msg.Headers())
+	}
+	msg.Ack(ctx)
+
+	// the group already handled the retained value
+	worker := broker.Subscribe(ctx, "network.status-changed", event.Group("workers"))
+
+	select {
+	case msg := <-sub.Message():
+		msg.Scan(&payload)
+		t.Fatalf("expect no other retained message, got %s", payload)
+	case msg := <-worker.Message():
+		msg.Scan(&payload)
+		t.Fatalf("expect work queue doesn't receive retained message, got %s", payload)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+	broker := New(WithConfig(Config{
+		WaitOnClose:   true,
+		CmdBufferSize: 16,
+		PubBufferSize: 16,
+		SubBufferSize: 16,
+		DedupWindow:   time.Millisecond * 100,
+	}))
+	broker.Start(ctx)
+	defer broker.Close(ctx)
+
+	sub := broker.Subscribe(ctx, "miner.restart")
+	publish := func(key string, opts ...event.PublishConfigurator) {
+		opts = append(opts, event.IdempotencyKey(key))
+		if err := <-broker.Publish(ctx, "miner.restart", event.StringPayload(key), opts...).Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publish("a")
+	publish("a")
+	publish("b")
+	// the delayed message is delivered once even after its window
+	publish("c", event.DeliverAfter(time.Millisecond*150))
+	publish("c")
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case msg := <-sub.Message():
+			var payload string
+			msg.Scan(&payload)
+			if payload != want {
+				t.Fatalf("expect %s, got %s", want, payload)
+			}
+			msg.Ack(ctx)
+		case <-time.After(time.Second):
+			t.Fatalf("expect receiving %s", want)
+		}
+	}
+	expect("a")
+	expect("b")
+	expect("c")
+
+	select {
+	case msg := <-sub.Message():
+		var payload string
+		msg.Scan(&payload)
+		t.Fatalf("expect no duplicate, got %s", payload)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// the window is passed
+	publish("a")
+	expect("a")
+
+	stats, err := broker.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duplicates := stats.Counters["duplicates"]; duplicates != 2 {
+		t.Errorf("expect 2 duplicates, got %d", duplicates)
+	}
+}
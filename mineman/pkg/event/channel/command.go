@@ -13,7 +13,10 @@ type (
 		ctx     context.Context
 		topic   topicID
 		payload event.Payload
+		option  *event.PublishOption
 		err     chan error
+		// delayed mark a scheduled message that is due
+		delayed bool
 	}
 
 	subscribeCommand struct {
@@ -21,6 +24,7 @@ type (
 		subscription chan event.SubscriptionMsg
 		id           subscriberID
 		topic        topicID
+		option       *event.SubscribeOption
 	}
 
 	unsubscribeCommand struct {
@@ -52,5 +56,11 @@ type (
 		err          chan error
 	}
 
+	statsCommand struct {
+		ctx    context.Context
+		result chan *event.Stats
+		err    chan error
+	}
+
 	closeCommand struct{}
 )
@@ -2,6 +2,7 @@ package channel
 
 import (
 	"context"
+	"time"
 
 	"github.com/euiko/tooyoul/mineman/pkg/event"
 )
@@ -9,10 +10,28 @@ import (
 type (
 	message struct {
 		id           messageID
+		topic        topicID
 		subscriberID subscriberID
 		payload      event.Payload
+		headers      map[string]string
+		deliveries   int
 		broker       *Broker
 	}
+
+	// inflightMsg track delivery state of an unacknowledged message,
+	// only accessed inside the broker loop
+	inflightMsg struct {
+		id           messageID
+		topic        topicID
+		subscriberID subscriberID
+		payload      event.Payload
+		headers      map[string]string
+		deliveries   int
+		deadline     time.Time
+		expiresAt    time.Time
+		// createdAt is when the message first delivered to the subscriber
+		createdAt time.Time
+	}
 )
 
 func (m *message) Scan(v interface{}, opts ...event.ScanOption) error {
@@ -23,6 +42,28 @@ func (m *message) ID() string {
 	return string(m.id)
 }
 
+func (m *message) Topic() string {
+	return string(m.topic)
+}
+
+func (m *message) Deliveries() int {
+	return m.deliveries
+}
+
+func (m *message) Headers() map[string]string {
+	return m.headers
+}
+
+// Reply will publish the payload to the reply topic of the request
+func (m *message) Reply(ctx context.Context, payload event.Payload, opts ...event.PublishConfigurator) <-chan error {
+	return event.ReplyWith(ctx, m.broker, m, payload, opts...).Error()
+}
+
+// expired check whether the message passed its ttl
+func (m *inflightMsg) expired(now time.Time) bool {
+	return !m.expiresAt.IsZero() && !now.Before(m.expiresAt)
+}
+
 // Ack will acknowledge the message and release the message
 func (m *message) Ack(ctx context.Context) <-chan error {
 	errChan := make(chan error, 1)
@@ -0,0 +1,229 @@
+package channel
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+)
+
+type (
+	// blockedMsg is a message that wait for room in the subscription buffer,
+	// only accessed inside the broker loop
+	blockedMsg struct {
+		inflight *inflightMsg
+		deadline time.Time
+		waiter   *publishWaiter
+	}
+
+	// publishWaiter close the publish result after all the blocked
+	// subscriptions settled the message, the result name the subscribers
+	// that missed it
+	publishWaiter struct {
+		remaining int
+		err       chan error
+		missed    []string
+		cause     error
+	}
+)
+
+func (w *publishWaiter) wait() {
+	w.remaining++
+}
+
+func (w *publishWaiter) done() {
+	w.remaining--
+	if w.remaining > 0 {
+		return
+	}
+
+	if len(w.missed) > 0 {
+		w.err <- fmt.Errorf("%w, missed by subscribers %s", w.cause, strings.Join(w.missed, ", "))
+	}
+	close(w.err)
+}
+
+// miss record the subscriber that will never receive the message, the first
+// error is reported as the cause
+func (w *publishWaiter) miss(id subscriberID, err error) {
+	w.missed = append(w.missed, string(id))
+	if w.cause == nil {
+		w.cause = err
+	}
+	w.done()
+}
+
+func newPublishWaiter(err chan error) *publishWaiter {
+	return &publishWaiter{
+		remaining: 1,
+		err:       err,
+	}
+}
+
+// releaseBlocked unblock the publishers of the messages that will never be
+// delivered to the subscription, err is reported to them when not nil
+func (s *subscriptionChan) releaseBlocked(err error) {
+	for _, blocked := range s.blocked {
+		if err != nil {
+			blocked.waiter.miss(s.id, err)
+			continue
+		}
+		blocked.waiter.done()
+	}
+	s.blocked = nil
+}
+
+// pump hand the buffered messages to the subscriber of the Block policy, the
+// broker is woken on every taken message so the blocked ones get the room
+func (s *subscriptionChan) pump(drained chan<- struct{}) {
+	defer close(s.out)
+
+	for msg := range s.channel {
+		select {
+		case drained <- struct{}{}:
+		default:
+			// already woken
+		}
+
+		select {
+		case s.out <- msg:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// rejected check whether the publish must fail, none of the recipients
+// will receive the message as all of them reject it
+func (b *Broker) rejected(recipients []subscriberID) bool {
+	for _, s := range recipients {
+		c := b.subs[s]
+		if c.overflow != event.Reject || len(c.channel) < cap(c.channel) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// offer send the message to the subscriber following its overflow policy
+// when the buffer is full, the message is only tracked once it is buffered
+func (b *Broker) offer(c *subscriptionChan, inflight *inflightMsg, waiter *publishWaiter) {
+	// keep the order behind the blocked messages
+	if len(c.blocked) == 0 && len(c.channel) < cap(c.channel) {
+		b.progressMsg[inflight.id] = inflight
+		c.channel <- b.deliver(inflight)
+		return
+	}
+
+	switch c.overflow {
+	case event.DropOldest:
+		// the loop is the only sender, so there is room after the receive
+		// even when the subscriber takes the message first
+		select {
+		case oldest := <-c.channel:
+			if oldest != nil {
+				delete(b.progressMsg, messageID(oldest.ID()))
+				b.drop(c, messageID(oldest.ID()), "oldest")
+			}
+		default:
+		}
+
+		b.progressMsg[inflight.id] = inflight
+		c.channel <- b.deliver(inflight)
+	case event.Disconnect:
+		b.disconnect(c)
+	case event.Block:
+		// block the publisher only, the loop keeps serving the others
+		waiter.wait()
+		c.blocked = append(c.blocked, &blockedMsg{
+			inflight: inflight,
+			deadline: time.Now().Add(c.overflowTimeout),
+			waiter:   waiter,
+		})
+		b.resetBlockedTimer()
+	case event.DropNewest:
+		b.drop(c, inflight.id, "newest")
+	default:
+		// only this subscriber miss the message, the publisher is told
+		// about it along with the others that missed it
+		b.drop(c, inflight.id, "rejected")
+		waiter.wait()
+		waiter.miss(c.id, ErrSubscribeBufferExceeded)
+	}
+}
+
+// flushBlocked move the blocked messages into the subscription buffers,
+// those which exceed their deadline are dropped
+func (b *Broker) flushBlocked(now time.Time) {
+	for _, c := range b.subs {
+		for len(c.blocked) > 0 {
+			blocked := c.blocked[0]
+			if len(c.channel) < cap(c.channel) {
+				b.progressMsg[blocked.inflight.id] = blocked.inflight
+				c.channel <- b.deliver(blocked.inflight)
+			} else if now.After(blocked.deadline) {
+				b.drop(c, blocked.inflight.id, "blocked")
+			} else {
+				break
+			}
+
+			blocked.waiter.done()
+			c.blocked = c.blocked[1:]
+		}
+	}
+
+	b.resetBlockedTimer()
+}
+
+// resetBlockedTimer fire the timer on the earliest blocked deadline, the
+// room made by the subscribers wake the loop by the drained channel instead
+func (b *Broker) resetBlockedTimer() {
+	if !b.blockedTimer.Stop() {
+		select {
+		case <-b.blockedTimer.C:
+		default:
+		}
+	}
+
+	var earliest time.Time
+	for _, c := range b.subs {
+		if len(c.blocked) == 0 {
+			continue
+		}
+		if deadline := c.blocked[0].deadline; earliest.IsZero() || deadline.Before(earliest) {
+			earliest = deadline
+		}
+	}
+
+	if !earliest.IsZero() {
+		b.blockedTimer.Reset(time.Until(earliest))
+	}
+}
+
+func (b *Broker) drop(c *subscriptionChan, id messageID, reason string) {
+	c.dropped++
+	b.counters["dropped_"+reason]++
+	log.Warning("subscriber buffer is full, dropping message", log.WithFields(map[string]interface{}{
+		"id":         id,
+		"subscriber": c.id,
+		"topic":      c.topic,
+		"overflow":   c.overflow.String(),
+	}))
+}
+
+// disconnect close the subscription that can't keep up with the messages
+func (b *Broker) disconnect(c *subscriptionChan) {
+	log.Warning("subscriber buffer is full, disconnecting it",
+		log.WithField("subscriber", c.id),
+		log.WithField("topic", c.topic),
+	)
+	b.counters["disconnected"]++
+
+	// set the error before cancelation, so it is visible after done
+	c.err = event.ErrSlowConsumer
+	c.cancel()
+	b.removeSubscription(c)
+}
@@ -0,0 +1,79 @@
+package channel
+
+import (
+	"sort"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+)
+
+type (
+	// retainedMsg is the last value of a topic, only accessed inside the
+	// broker loop
+	retainedMsg struct {
+		payload   event.Payload
+		headers   map[string]string
+		expiresAt time.Time
+	}
+)
+
+func (r *retainedMsg) expired(now time.Time) bool {
+	return !r.expiresAt.IsZero() && !now.Before(r.expiresAt)
+}
+
+// retain replace the last value of the topic
+func (b *Broker) retain(topic topicID, payload event.Payload, option *event.PublishOption) {
+	b.retained[topic] = &retainedMsg{
+		payload:   payload,
+		headers:   option.Headers,
+		expiresAt: option.ExpiresAt,
+	}
+}
+
+// deliverRetained send the last values of the matching topics to a new
+// subscription, the work queue subscriptions are skipped since their group
+// already received those values
+func (b *Broker) deliverRetained(c *subscriptionChan) {
+	if c.policy == event.WorkQueuePolicy {
+		return
+	}
+
+	now := time.Now()
+	topics := []topicID{}
+	for topic, r := range b.retained {
+		if r.expired(now) {
+			delete(b.retained, topic)
+			continue
+		}
+
+		if event.MatchTopic(string(c.topic), string(topic)) {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i] < topics[j]
+	})
+
+	// nobody wait for the retained messages
+	waiter := newPublishWaiter(make(chan error, 1))
+	defer waiter.done()
+
+	for _, topic := range topics {
+		r := b.retained[topic]
+		option := event.NewPublishOption(
+			event.WithHeaders(r.headers),
+			event.WithHeader(event.HeaderRetained, "true"),
+		)
+
+		b.offer(c, &inflightMsg{
+			id:           messageID(generateID()),
+			topic:        topic,
+			payload:      r.payload,
+			headers:      option.Headers,
+			expiresAt:    r.expiresAt,
+			createdAt:    now,
+			subscriberID: c.id,
+		}, waiter)
+		b.counters["retained_delivered"]++
+	}
+}
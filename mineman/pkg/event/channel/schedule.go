@@ -0,0 +1,42 @@
+package channel
+
+import (
+	"time"
+)
+
+type (
+	// scheduledMsg is a publish that wait for its delivery time
+	scheduledMsg struct {
+		publish publishCommand
+		at      time.Time
+	}
+
+	// scheduleQueue is a min heap of scheduled messages ordered by their
+	// delivery time, only accessed inside the broker loop
+	scheduleQueue []*scheduledMsg
+)
+
+func (q scheduleQueue) Len() int {
+	return len(q)
+}
+
+func (q scheduleQueue) Less(i, j int) bool {
+	return q[i].at.Before(q[j].at)
+}
+
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+	*q = append(*q, x.(*scheduledMsg))
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return item
+}
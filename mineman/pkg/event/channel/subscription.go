@@ -2,6 +2,7 @@ package channel
 
 import (
 	"context"
+	"time"
 
 	"github.com/euiko/tooyoul/mineman/pkg/event"
 )
@@ -13,6 +14,18 @@ type (
 		topic   topicID
 		err     error
 		channel chan event.Message
+		policy  event.SubscribePolicy
+		group   string
+
+		// overflow decide what to do when the channel is full, the rest
+		// are only accessed inside the broker loop
+		overflow        event.OverflowPolicy
+		overflowTimeout time.Duration
+		dropped         int64
+		blocked         []*blockedMsg
+		// out is the channel read by the subscriber of the Block policy,
+		// the messages are pumped into it from the channel
+		out chan event.Message
 
 		// to hold cancelation with ease
 		ctx    context.Context
@@ -44,6 +57,9 @@ func (s *subscriptionChan) Close() error {
 }
 
 func (s *subscriptionChan) Message() <-chan event.Message {
+	if s.out != nil {
+		return s.out
+	}
 	return s.channel
 }
 
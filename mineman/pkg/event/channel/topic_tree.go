@@ -0,0 +1,103 @@
+package channel
+
+import (
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+)
+
+type (
+	// topicTree index subscriptions by their topic pattern levels, so
+	// matching a published topic only walks the related branches instead
+	// of comparing with every subscription
+	topicTree struct {
+		root *topicNode
+	}
+
+	topicNode struct {
+		children map[string]*topicNode
+		subs     []subscriberID
+	}
+)
+
+func (t *topicTree) add(pattern topicID, id subscriberID) {
+	node := t.root
+	for _, level := range event.SplitTopic(string(pattern)) {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+
+	node.subs = append(node.subs, id)
+}
+
+func (t *topicTree) remove(pattern topicID, id subscriberID) {
+	levels := event.SplitTopic(string(pattern))
+	path := make([]*topicNode, 0, len(levels)+1)
+
+	node := t.root
+	path = append(path, node)
+	for _, level := range levels {
+		child, ok := node.children[level]
+		if !ok {
+			return
+		}
+		node = child
+		path = append(path, node)
+	}
+
+	for i, sub := range node.subs {
+		if sub == id {
+			node.subs = append(node.subs[:i], node.subs[i+1:]...)
+			break
+		}
+	}
+
+	// prune the empty branches from the leaf
+	for i := len(path) - 1; i > 0; i-- {
+		n := path[i]
+		if len(n.subs) > 0 || len(n.children) > 0 {
+			break
+		}
+		delete(path[i-1].children, levels[i-1])
+	}
+}
+
+// match collect all subscriptions that the pattern match the topic
+func (t *topicTree) match(topic topicID) []subscriberID {
+	return t.root.match(event.SplitTopic(string(topic)), nil)
+}
+
+func (n *topicNode) match(levels []string, result []subscriberID) []subscriberID {
+	// multi level wildcard also match zero level
+	if wildcard, ok := n.children[event.MultiLevelWildcard]; ok {
+		result = append(result, wildcard.subs...)
+	}
+
+	if len(levels) == 0 {
+		return append(result, n.subs...)
+	}
+
+	if child, ok := n.children[levels[0]]; ok {
+		result = child.match(levels[1:], result)
+	}
+
+	if wildcard, ok := n.children[event.SingleLevelWildcard]; ok {
+		result = wildcard.match(levels[1:], result)
+	}
+
+	return result
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children: make(map[string]*topicNode),
+	}
+}
+
+func newTopicTree() *topicTree {
+	return &topicTree{
+		root: newTopicNode(),
+	}
+}
@@ -0,0 +1,186 @@
+package event
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// ContentTypeEvent is the content type of an envelope holding EventPayload
+	ContentTypeEvent = "application/vnd.mineman.event"
+	// ContentTypeText is the content type of an envelope holding StringPayload
+	ContentTypeText = "text/plain; charset=utf-8"
+
+	DefaultCodec = "json"
+)
+
+var (
+	ErrCodecNotFound          = errors.New("couldn't find the event codec")
+	ErrPayloadNotSerializable = errors.New("payload can't be serialized, only event and string payload are supported")
+	ErrContentTypeUnsupported = errors.New("envelope has an unsupported content type")
+)
+
+var codecRegistry sync.Map
+
+type (
+	// Envelope is the stable wire representation of a payload, every codec
+	// must be able to round trip all of its fields
+	Envelope struct {
+		ContentType string
+		Name        string
+		Time        time.Time
+		Data        map[string]interface{}
+		Meta        map[string]interface{}
+		// Headers hold the message metadata supplied by the publisher
+		Headers map[string]string
+		// Body hold the raw content of non event payload, e.g. text
+		Body []byte
+	}
+
+	// Codec serialize an envelope so it can be stored or sent
+	// outside of the process
+	Codec interface {
+		Name() string
+		Marshal(e *Envelope) ([]byte, error)
+		Unmarshal(b []byte, e *Envelope) error
+	}
+
+	// RawPayload hold an encoded payload that only decoded on its first Scan
+	RawPayload struct {
+		codec Codec
+		data  []byte
+
+		once    sync.Once
+		payload Payload
+		headers map[string]string
+		err     error
+	}
+)
+
+// Payload convert the envelope back into the in memory payload
+func (e *Envelope) Payload() (Payload, error) {
+	switch e.ContentType {
+	case ContentTypeEvent:
+		return &EventPayload{
+			Name: e.Name,
+			At:   e.Time,
+			Data: e.Data,
+			Meta: e.Meta,
+		}, nil
+	case ContentTypeText:
+		return StringPayload(e.Body), nil
+	default:
+		return nil, ErrContentTypeUnsupported
+	}
+}
+
+func (p *RawPayload) Scan(v interface{}, opts ...ScanOption) error {
+	payload, err := p.Decode()
+	if err != nil {
+		return err
+	}
+
+	return payload.Scan(v, opts...)
+}
+
+// Decode the payload, the result is cached for the subsequent calls
+func (p *RawPayload) Decode() (Payload, error) {
+	p.once.Do(func() {
+		var e Envelope
+		if p.err = p.codec.Unmarshal(p.data, &e); p.err != nil {
+			return
+		}
+		p.headers = e.Headers
+		p.payload, p.err = e.Payload()
+	})
+
+	return p.payload, p.err
+}
+
+// Headers return the message headers carried by the envelope
+func (p *RawPayload) Headers() map[string]string {
+	if _, err := p.Decode(); err != nil {
+		return nil
+	}
+
+	return p.headers
+}
+
+// Bytes return the encoded payload
+func (p *RawPayload) Bytes() []byte {
+	return p.data
+}
+
+func (p *RawPayload) Codec() Codec {
+	return p.codec
+}
+
+// NewEnvelope wrap the payload into an envelope
+func NewEnvelope(p Payload) (*Envelope, error) {
+	switch p := p.(type) {
+	case *EventPayload:
+		return &Envelope{
+			ContentType: ContentTypeEvent,
+			Name:        p.Name,
+			Time:        p.At,
+			Data:        p.Data,
+			Meta:        p.Meta,
+		}, nil
+	case StringPayload:
+		return &Envelope{
+			ContentType: ContentTypeText,
+			Body:        []byte(p),
+		}, nil
+	case *RawPayload:
+		decoded, err := p.Decode()
+		if err != nil {
+			return nil, err
+		}
+		return NewEnvelope(decoded)
+	default:
+		return nil, ErrPayloadNotSerializable
+	}
+}
+
+// Encode serialize the payload with the codec, a raw payload that already
+// encoded with the same codec is returned as is
+func Encode(c Codec, p Payload) ([]byte, error) {
+	return EncodeWithHeaders(c, p, nil)
+}
+
+// EncodeWithHeaders serialize the payload along with the message headers
+func EncodeWithHeaders(c Codec, p Payload, headers map[string]string) ([]byte, error) {
+	if raw, ok := p.(*RawPayload); ok && raw.codec.Name() == c.Name() && headers == nil {
+		return raw.data, nil
+	}
+
+	e, err := NewEnvelope(p)
+	if err != nil {
+		return nil, err
+	}
+	e.Headers = headers
+
+	return c.Marshal(e)
+}
+
+// Decode wrap the encoded data into a lazily decoded payload
+func Decode(c Codec, b []byte) *RawPayload {
+	return &RawPayload{
+		codec: c,
+		data:  b,
+	}
+}
+
+func RegisterCodec(c Codec) {
+	codecRegistry.Store(c.Name(), c)
+}
+
+func GetCodec(name string) (Codec, error) {
+	value, ok := codecRegistry.Load(name)
+	if !ok {
+		return nil, ErrCodecNotFound
+	}
+
+	return value.(Codec), nil
+}
@@ -0,0 +1,86 @@
+package event
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	at := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	payloads := []Payload{
+		&EventPayload{
+			Name: "test.happened",
+			At:   at,
+			Data: map[string]interface{}{
+				"value": "ok",
+				"count": 3,
+				"tags":  []string{"a", "b"},
+			},
+			Meta: map[string]interface{}{"rig": "rig-1"},
+		},
+		StringPayload("hello"),
+	}
+
+	for _, name := range []string{"json", "binary"} {
+		codec, err := GetCodec(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, payload := range payloads {
+			b, err := Encode(codec, payload)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+
+			raw := Decode(codec, b)
+			switch expected := payload.(type) {
+			case *EventPayload:
+				var e testEvent
+				if err := raw.Scan(&e); err != nil {
+					t.Fatalf("%s: %s", name, err)
+				}
+				if e.Value != "ok" || !e.At.Equal(at) {
+					t.Errorf("%s: expect event decoded, got %+v", name, e)
+				}
+
+				var decoded EventPayload
+				if err := raw.Scan(&decoded); err != nil {
+					t.Fatalf("%s: %s", name, err)
+				}
+				if decoded.Meta["rig"] != "rig-1" || len(decoded.Data) != len(expected.Data) {
+					t.Errorf("%s: expect event payload decoded, got %+v", name, decoded)
+				}
+			case StringPayload:
+				var s string
+				if err := raw.Scan(&s); err != nil {
+					t.Fatalf("%s: %s", name, err)
+				}
+				if s != string(expected) {
+					t.Errorf("%s: expect %s, got %s", name, expected, s)
+				}
+			}
+
+			// re-encoding with the same codec keeps the bytes as is
+			if again, err := Encode(codec, raw); err != nil || string(again) != string(b) {
+				t.Errorf("%s: expect raw payload encoded as is", name)
+			}
+		}
+	}
+}
+
+func TestBinaryCodecMalformed(t *testing.T) {
+	codec := BinaryCodec{}
+	b, err := Encode(codec, StringPayload("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var e Envelope
+	if err := codec.Unmarshal(b[:len(b)-2], &e); err == nil {
+		t.Error("expect truncated envelope rejected")
+	}
+	if err := codec.Unmarshal(append([]byte{9}, b[1:]...), &e); err != ErrBinaryCodecVersion {
+		t.Errorf("expect unsupported version rejected, got %v", err)
+	}
+}
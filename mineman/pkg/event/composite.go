@@ -0,0 +1,304 @@
+package event
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+)
+
+type (
+	// BrokerRoute send the topics matched by any of the patterns to the broker
+	BrokerRoute struct {
+		Topics []string
+		Broker Broker
+	}
+
+	// CompositeBroker route every topic to one of its brokers, the first
+	// matching route wins and the unmatched topics go to the fallback. The
+	// subscriptions are made on every broker that may serve the pattern, so
+	// the subscribers doesn't need to know where a topic lives.
+	CompositeBroker struct {
+		routes   []BrokerRoute
+		fallback Broker
+		// brokers is the distinct brokers in the init order
+		brokers []Broker
+	}
+
+	// subscriptionGroup is a subscription made on several brokers
+	subscriptionGroup []Subscription
+
+	// subscriptionMerge merge the messages of several subscriptions
+	subscriptionMerge struct {
+		subscriptionGroup
+		messages  chan Message
+		done      chan struct{}
+		closing   chan struct{}
+		closeOnce sync.Once
+	}
+)
+
+func (b *CompositeBroker) Init(ctx context.Context, c config.Config) error {
+	for i, broker := range b.brokers {
+		if err := broker.Init(ctx, c); err != nil {
+			// don't leave the already running brokers behind
+			for j := i - 1; j >= 0; j-- {
+				if err := b.brokers[j].Close(ctx); err != nil {
+					log.Error("failed when close event broker", log.WithError(err))
+				}
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close close the brokers in the reverse order, the first error is returned
+// after all of them are closed
+func (b *CompositeBroker) Close(ctx context.Context) error {
+	var first error
+	for i := len(b.brokers) - 1; i >= 0; i-- {
+		if err := b.brokers[i].Close(ctx); err != nil {
+			log.Error("failed when close event broker", log.WithError(err))
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	return first
+}
+
+func (b *CompositeBroker) Publish(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) Publishing {
+	return b.route(topic).Publish(ctx, topic, payload, opts...)
+}
+
+func (b *CompositeBroker) Subscribe(ctx context.Context, topic string, opts ...SubscribeConfigurator) SubscriptionMsg {
+	brokers := b.subscribers(topic)
+	if len(brokers) == 1 {
+		return brokers[0].Subscribe(ctx, topic, opts...)
+	}
+
+	subs := make([]SubscriptionMsg, 0, len(brokers))
+	for _, broker := range brokers {
+		sub := broker.Subscribe(ctx, topic, opts...)
+		if err := sub.Error(); err != nil {
+			for _, s := range subs {
+				s.Close()
+			}
+			return NewSubscriptionDirect(err)
+		}
+		subs = append(subs, sub)
+	}
+
+	return newSubscriptionMerge(subs)
+}
+
+func (b *CompositeBroker) SubscribeHandler(ctx context.Context, topic string, handler MessageHandler, opts ...SubscribeConfigurator) Subscription {
+	brokers := b.subscribers(topic)
+	if len(brokers) == 1 {
+		return brokers[0].SubscribeHandler(ctx, topic, handler, opts...)
+	}
+
+	group := make(subscriptionGroup, 0, len(brokers))
+	for _, broker := range brokers {
+		sub := broker.SubscribeHandler(ctx, topic, handler, opts...)
+		if err := sub.Error(); err != nil {
+			group.Close()
+			return NewSubscriptionDirect(err)
+		}
+		group = append(group, sub)
+	}
+
+	return group
+}
+
+// Stats merge the stats of all the brokers, the counters are summed
+func (b *CompositeBroker) Stats(ctx context.Context) (*Stats, error) {
+	merged := Stats{
+		Counters: make(map[string]int64),
+	}
+
+	names := make([]string, 0, len(b.brokers))
+	for _, broker := range b.brokers {
+		stats, err := broker.Stats(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, stats.Broker)
+		merged.Subscriptions = append(merged.Subscriptions, stats.Subscriptions...)
+		merged.InFlight += stats.InFlight
+		for name, n := range stats.Counters {
+			merged.Counters[name] += n
+		}
+	}
+
+	merged.Broker = strings.Join(names, ",")
+	SortSubscriptions(merged.Subscriptions)
+	merged.Topics = SummarizeTopics(merged.Subscriptions)
+
+	return &merged, nil
+}
+
+// route return the broker of the topic
+func (b *CompositeBroker) route(topic string) Broker {
+	for _, r := range b.routes {
+		for _, pattern := range r.Topics {
+			if MatchTopic(pattern, topic) {
+				return r.Broker
+			}
+		}
+	}
+
+	return b.fallback
+}
+
+// subscribers return the brokers that may serve the topics matched by the
+// pattern, the fallback is skipped only when a route covers the pattern
+func (b *CompositeBroker) subscribers(pattern string) []Broker {
+	brokers := []Broker{}
+	covered := false
+	for _, r := range b.routes {
+		for _, topic := range r.Topics {
+			if TopicsOverlap(topic, pattern) {
+				brokers = appendBroker(brokers, r.Broker)
+			}
+			if TopicCovers(topic, pattern) {
+				covered = true
+			}
+		}
+	}
+
+	if !covered {
+		brokers = appendBroker(brokers, b.fallback)
+	}
+
+	return brokers
+}
+
+func (g subscriptionGroup) ID() string {
+	ids := make([]string, len(g))
+	for i, sub := range g {
+		ids[i] = sub.ID()
+	}
+
+	return strings.Join(ids, ",")
+}
+
+func (g subscriptionGroup) Error() error {
+	for _, sub := range g {
+		if err := sub.Error(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (g subscriptionGroup) Close() error {
+	var first error
+	for _, sub := range g {
+		if err := sub.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+func (s *subscriptionMerge) Message() <-chan Message {
+	return s.messages
+}
+
+// Done is closed once all of the subscriptions are done
+func (s *subscriptionMerge) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *subscriptionMerge) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+
+	return s.subscriptionGroup.Close()
+}
+
+func (s *subscriptionMerge) forward(sub SubscriptionMsg) {
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-sub.Done():
+			return
+		case msg, ok := <-sub.Message():
+			if !ok {
+				return
+			}
+
+			select {
+			case s.messages <- msg:
+			case <-s.closing:
+				return
+			}
+		}
+	}
+}
+
+func newSubscriptionMerge(subs []SubscriptionMsg) *subscriptionMerge {
+	s := subscriptionMerge{
+		subscriptionGroup: make(subscriptionGroup, len(subs)),
+		messages:          make(chan Message),
+		done:              make(chan struct{}),
+		closing:           make(chan struct{}),
+	}
+
+	var wg sync.WaitGroup
+	for i, sub := range subs {
+		s.subscriptionGroup[i] = sub
+		wg.Add(1)
+		go func(sub SubscriptionMsg) {
+			defer wg.Done()
+			s.forward(sub)
+		}(sub)
+	}
+
+	// the forwarders are the only senders
+	go func() {
+		wg.Wait()
+		close(s.messages)
+		close(s.done)
+	}()
+
+	return &s
+}
+
+// appendBroker append the broker when it isn't in the list yet
+func appendBroker(brokers []Broker, broker Broker) []Broker {
+	for _, existing := range brokers {
+		if existing == broker {
+			return brokers
+		}
+	}
+
+	return append(brokers, broker)
+}
+
+// NewCompositeBroker create a broker that route the topics to the brokers,
+// the routes are matched in order
+func NewCompositeBroker(fallback Broker, routes ...BrokerRoute) *CompositeBroker {
+	b := CompositeBroker{
+		routes:   routes,
+		fallback: fallback,
+		brokers:  []Broker{fallback},
+	}
+
+	for _, r := range routes {
+		b.brokers = appendBroker(b.brokers, r.Broker)
+	}
+
+	return &b
+}
@@ -0,0 +1,78 @@
+package event_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/event/eventtest"
+)
+
+func TestCompositeBroker(t *testing.T) {
+	ctx := context.Background()
+	local := eventtest.NewBroker()
+	remote := eventtest.NewBroker()
+	broker := event.NewCompositeBroker(local, event.BrokerRoute{
+		Topics: []string{"fleet.#"},
+		Broker: remote,
+	})
+
+	all := broker.Subscribe(ctx, "#")
+	if err := all.Error(); err != nil {
+		t.Fatal(err)
+	}
+	fleet := broker.SubscribeHandler(ctx, "fleet.*", event.MessageHandlerFunc(func(ctx context.Context, message event.Message) {
+		message.Ack(ctx)
+	}))
+	if err := fleet.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range []string{"miner.status-changed", "fleet.status-changed"} {
+		if err := <-broker.Publish(ctx, topic, event.StringPayload(topic)).Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if published := local.Published(); len(published) != 1 || published[0].Topic != "miner.status-changed" {
+		t.Errorf("expect only the miner topic stay in the local broker, got %v", published)
+	}
+	if published := remote.Published(); len(published) != 1 || published[0].Topic != "fleet.status-changed" {
+		t.Errorf("expect only the fleet topic routed to the remote broker, got %v", published)
+	}
+
+	// the subscription of every topic receive from both
+	received := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-all.Message():
+			received[msg.Topic()] = true
+			msg.Ack(ctx)
+		case <-time.After(time.Second):
+			t.Fatal("expect receiving the messages of both brokers")
+		}
+	}
+	if !received["miner.status-changed"] || !received["fleet.status-changed"] {
+		t.Errorf("expect receiving both topics, got %v", received)
+	}
+
+	// the fleet subscription is covered by the route
+	stats, err := broker.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Subscriptions) != 3 {
+		t.Errorf("expect 3 subscriptions, got %d", len(stats.Subscriptions))
+	}
+	if published := stats.Counters["published"]; published != 2 {
+		t.Errorf("expect 2 published messages in total, got %d", published)
+	}
+
+	all.Close()
+	select {
+	case <-all.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expect the merged subscription done after closed")
+	}
+}
@@ -0,0 +1,93 @@
+package event
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// Deduplicator remember the idempotency keys seen within the window, the
+	// brokers use it to drop the duplicated publishes. The keys are scoped by
+	// topic, a zero window disable it.
+	Deduplicator struct {
+		window time.Duration
+
+		mu    sync.Mutex
+		seen  map[string]time.Time
+		order []dedupEntry
+	}
+
+	dedupEntry struct {
+		key string
+		at  time.Time
+	}
+)
+
+// Duplicate check whether the key already seen on the topic within the
+// window, otherwise it is remembered. Empty key is never a duplicate, and
+// a nil deduplicator never drop anything.
+func (d *Deduplicator) Duplicate(topic string, key string, now time.Time) bool {
+	if d == nil || key == "" || d.window <= 0 {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(now)
+
+	scoped := topic + "\x00" + key
+	if _, ok := d.seen[scoped]; ok {
+		return true
+	}
+
+	d.seen[scoped] = now
+	d.order = append(d.order, dedupEntry{key: scoped, at: now})
+	return false
+}
+
+// Forget remove the key of a failed publish, so its retry isn't dropped
+func (d *Deduplicator) Forget(topic string, key string) {
+	if d == nil || key == "" {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// the order entry is left behind, it is removed once expired
+	delete(d.seen, topic+"\x00"+key)
+}
+
+// Len return the number of remembered keys
+func (d *Deduplicator) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.seen)
+}
+
+// expire forget the keys older than the window, they are ordered by the
+// time they were seen
+func (d *Deduplicator) expire(now time.Time) {
+	n := 0
+	for n < len(d.order) && now.Sub(d.order[n].at) >= d.window {
+		entry := d.order[n]
+		// the key may be forgotten and seen again later
+		if at, ok := d.seen[entry.key]; ok && at.Equal(entry.at) {
+			delete(d.seen, entry.key)
+		}
+		n++
+	}
+
+	if n > 0 {
+		d.order = append(d.order[:0], d.order[n:]...)
+	}
+}
+
+func NewDeduplicator(window time.Duration) *Deduplicator {
+	return &Deduplicator{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
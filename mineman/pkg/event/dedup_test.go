@@ -0,0 +1,46 @@
+package event
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduplicator(t *testing.T) {
+	now := time.Now()
+	d := NewDeduplicator(time.Minute)
+
+	if d.Duplicate("miner.start", "a", now) {
+		t.Fatal("expect the first key is not a duplicate")
+	}
+	if !d.Duplicate("miner.start", "a", now.Add(time.Second)) {
+		t.Fatal("expect the same key within the window is a duplicate")
+	}
+	if d.Duplicate("miner.stop", "a", now) {
+		t.Fatal("expect the key is scoped by topic")
+	}
+	if d.Duplicate("miner.start", "", now) || d.Duplicate("miner.start", "", now) {
+		t.Fatal("expect empty key is never a duplicate")
+	}
+
+	d.Forget("miner.start", "a")
+	later := now.Add(time.Second * 30)
+	if d.Duplicate("miner.start", "a", later) {
+		t.Fatal("expect the forgotten key is not a duplicate")
+	}
+	// the key seen again after forgotten live for its own window
+	if !d.Duplicate("miner.start", "a", now.Add(time.Minute)) {
+		t.Fatal("expect the key seen again is still a duplicate")
+	}
+
+	if d.Duplicate("miner.start", "a", later.Add(time.Minute)) {
+		t.Fatal("expect the key is expired after the window")
+	}
+	if n := d.Len(); n != 1 {
+		t.Errorf("expect 1 remembered key, got %d", n)
+	}
+
+	var none *Deduplicator
+	if none.Duplicate("miner.start", "a", now) || none.Duplicate("miner.start", "a", now) {
+		t.Fatal("expect nil deduplicator never drop")
+	}
+}
@@ -5,4 +5,9 @@ import "errors"
 var (
 	ErrEventModuleTypeInvalid  = errors.New("event module has an invalid type")
 	ErrEventHookNotInitialized = errors.New("event hook not yet initialized")
+	ErrSlowConsumer            = errors.New("subscription disconnected, it can't keep up with the messages")
+	// ErrBrokerUnavailable is wrapped by the broker errors that are worth
+	// retrying later, e.g. a remote broker that is not connected
+	ErrBrokerUnavailable = errors.New("event broker is unavailable")
+	ErrOutboxFull        = errors.New("event outbox is full")
 )
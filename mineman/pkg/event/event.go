@@ -8,20 +8,51 @@ import (
 )
 
 const (
-	WorkQueuePolicy SubscribePolicy = iota
+	// FanOutPolicy delivers every message to every subscription of the topic
+	FanOutPolicy SubscribePolicy = iota
+	// WorkQueuePolicy delivers every message once per group, subscriptions that
+	// share the same group name are competing with each other
+	WorkQueuePolicy
+)
+
+const (
+	// Reject skips the subscription when its buffer is full, the others still
+	// receive the message while the publish fails naming the subscriptions
+	// that missed it. The remote publishers of mqtt can't be failed, the
+	// message is only dropped. It is the default
+	Reject OverflowPolicy = iota
+	// Block makes the publisher wait for room in the subscription buffer up to
+	// the overflow timeout, the message is dropped once the timeout reached
+	Block
+	// DropNewest discards the incoming message when the subscription buffer is full
+	DropNewest
+	// DropOldest discards the oldest buffered message to make room for the
+	// incoming one
+	DropOldest
+	// Disconnect closes the subscription that can't keep up, its Error
+	// returns ErrSlowConsumer afterward
+	Disconnect
 )
 
 type (
 	SubscribePolicy int
 
+	// OverflowPolicy decide what happen when a subscription buffer is full
+	OverflowPolicy int
+
+	// Broker deliver the published messages to the matching subscriptions.
+	// The implementations must drop a publish carrying an idempotency key
+	// already published on the same topic within their dedup window, the
+	// dropped publish succeed and counted as duplicates in the stats.
 	Broker interface {
 		api.Module
 		Subscriber
 		Publisher
+		Inspector
 	}
 
 	Publisher interface {
-		Publish(ctx context.Context, topic string, payload Payload) Publishing
+		Publish(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) Publishing
 	}
 
 	MessageHandler interface {
@@ -33,8 +64,8 @@ type (
 	MessageHandlerFuncErr func(ctx context.Context, message Message) error
 
 	Subscriber interface {
-		Subscribe(ctx context.Context, topic string) SubscriptionMsg
-		SubscribeHandler(ctx context.Context, topic string, handler MessageHandler) Subscription
+		Subscribe(ctx context.Context, topic string, opts ...SubscribeConfigurator) SubscriptionMsg
+		SubscribeHandler(ctx context.Context, topic string, handler MessageHandler, opts ...SubscribeConfigurator) Subscription
 	}
 
 	Publishing interface {
@@ -78,7 +109,8 @@ func (p *publishingChan) Error() <-chan error {
 
 }
 func NewPublishingChan(initial error) Publishing {
-	errChan := make(chan error)
+	// buffered, so the initial error doesn't block until it is read
+	errChan := make(chan error, 1)
 
 	if initial != nil {
 		errChan <- initial
@@ -127,11 +159,11 @@ func NewSubscriptionDirect(initial error) SubscriptionMsg {
 	doneChan := make(chan struct{})
 	msgChan := make(chan Message)
 
-	// close directly after its creation
-	defer close(doneChan)
-	defer close(msgChan)
+	// close directly after its creation, receiving from the closed
+	// channels returns immediately
+	close(doneChan)
+	close(msgChan)
 
-	doneChan <- struct{}{}
 	return &subscriptionDirect{
 		err:         initial,
 		closer:      nil,
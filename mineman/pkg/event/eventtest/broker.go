@@ -0,0 +1,427 @@
+// Package eventtest provides an in memory event broker that records every
+// publish, so the modules can be tested without running a real broker.
+package eventtest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+)
+
+type (
+	// Broker records the publishes and delivers them synchronously to the
+	// matching subscriptions, the handlers already ran once Publish returns.
+	// The duplicated idempotency keys within a minute are not recorded.
+	// The messages are never redelivered by the broker, use Message.Redeliver
+	// to drive the redelivery step by step.
+	Broker struct {
+		mu        sync.Mutex
+		published []*Published
+		messages  []*Message
+		subs      map[string]*subscription
+		cursor    int
+		nextID    int64
+		publishFn func(topic string) error
+
+		dedup      *event.Deduplicator
+		duplicates int64
+
+		// changed is closed and replaced on every recorded change, so the
+		// assertions can wait without polling
+		changed chan struct{}
+	}
+
+	// Published is a recorded publish
+	Published struct {
+		Topic   string
+		Payload event.Payload
+		Option  *event.PublishOption
+		At      time.Time
+	}
+)
+
+// Event scan the payload into event payload, it returns nil when the payload
+// isn't an event
+func (p *Published) Event() *event.EventPayload {
+	var ep event.EventPayload
+	if err := p.Payload.Scan(&ep); err != nil {
+		return nil
+	}
+
+	return &ep
+}
+
+func (p *Published) Scan(v interface{}, opts ...event.ScanOption) error {
+	return p.Payload.Scan(v, opts...)
+}
+
+func (b *Broker) Init(ctx context.Context, c config.Config) error {
+	return nil
+}
+
+func (b *Broker) Close(ctx context.Context) error {
+	b.mu.Lock()
+	subs := b.subs
+	b.subs = make(map[string]*subscription)
+	b.mu.Unlock()
+
+	for _, s := range subs {
+		s.cancel()
+	}
+
+	return nil
+}
+
+// FailPublish make the publishes fail with the error returned by fn, a nil
+// fn restore the successful publishes
+func (b *Broker) FailPublish(fn func(topic string) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.publishFn = fn
+}
+
+func (b *Broker) Publish(ctx context.Context, topic string, payload event.Payload, opts ...event.PublishConfigurator) event.Publishing {
+	errChan := make(chan error, 1)
+	defer close(errChan)
+
+	if err := event.ValidateTopic(topic); err != nil {
+		errChan <- err
+		return event.NewPublishingChanForward(errChan)
+	}
+
+	b.mu.Lock()
+	if b.publishFn != nil {
+		if err := b.publishFn(topic); err != nil {
+			b.mu.Unlock()
+			errChan <- err
+			return event.NewPublishingChanForward(errChan)
+		}
+	}
+
+	option := event.NewPublishOption(opts...)
+	if b.dedup.Duplicate(topic, option.IdempotencyKey(), time.Now()) {
+		b.duplicates++
+		b.mu.Unlock()
+		errChan <- nil
+		return event.NewPublishingChanForward(errChan)
+	}
+
+	b.published = append(b.published, &Published{
+		Topic:   topic,
+		Payload: payload,
+		Option:  option,
+		At:      time.Now(),
+	})
+	b.notifyLocked()
+	b.mu.Unlock()
+
+	b.deliver(ctx, topic, payload, option.Headers)
+	errChan <- nil
+	return event.NewPublishingChanForward(errChan)
+}
+
+// Deliver send a message to the matching subscriptions without recording
+// it as published, e.g. to simulate a publish of another module
+func (b *Broker) Deliver(ctx context.Context, topic string, payload event.Payload, opts ...event.PublishConfigurator) []*Message {
+	return b.deliver(ctx, topic, payload, event.NewPublishOption(opts...).Headers)
+}
+
+// NewMessage make a message that isn't delivered to any subscription, so
+// it can be passed to a handler directly
+func (b *Broker) NewMessage(topic string, payload event.Payload, opts ...event.PublishConfigurator) *Message {
+	msg := b.newMessage(nil, topic, payload, event.NewPublishOption(opts...).Headers)
+
+	b.mu.Lock()
+	b.messages = append(b.messages, msg)
+	b.mu.Unlock()
+
+	return msg
+}
+
+func (b *Broker) Subscribe(ctx context.Context, topic string, opts ...event.SubscribeConfigurator) event.SubscriptionMsg {
+	return b.subscribe(ctx, topic, nil, opts...)
+}
+
+func (b *Broker) SubscribeHandler(ctx context.Context, topic string, handler event.MessageHandler, opts ...event.SubscribeConfigurator) event.Subscription {
+	return b.subscribe(ctx, topic, handler, opts...)
+}
+
+// Stats report the subscriptions and the messages that not yet settled
+func (b *Broker) Stats(ctx context.Context) (*event.Stats, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := event.Stats{
+		Broker:        "eventtest",
+		Subscriptions: make([]event.SubscriptionStats, 0, len(b.subs)),
+		Counters: map[string]int64{
+			"published":  int64(len(b.published)),
+			"delivered":  int64(len(b.messages)),
+			"duplicates": b.duplicates,
+		},
+	}
+	for _, s := range b.subs {
+		stats.Subscriptions = append(stats.Subscriptions, event.SubscriptionStats{
+			ID:       s.id,
+			Topic:    s.topic,
+			Policy:   s.option.Policy.String(),
+			Group:    s.option.Group,
+			Buffered: len(s.channel),
+			Capacity: cap(s.channel),
+			Overflow: s.option.Overflow.String(),
+		})
+	}
+	for _, msg := range b.messages {
+		if !msg.Settled() {
+			stats.InFlight++
+		}
+	}
+	event.SortSubscriptions(stats.Subscriptions)
+	stats.Topics = event.SummarizeTopics(stats.Subscriptions)
+
+	return &stats, nil
+}
+
+// Published return all the recorded publishes
+func (b *Broker) Published() []*Published {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	published := make([]*Published, len(b.published))
+	copy(published, b.published)
+	return published
+}
+
+// Messages return all the delivered messages, including the redeliveries
+func (b *Broker) Messages() []*Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	messages := make([]*Message, len(b.messages))
+	copy(messages, b.messages)
+	return messages
+}
+
+// Reset forget the recorded publishes, messages and idempotency keys, the
+// subscriptions are kept
+func (b *Broker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.published = nil
+	b.messages = nil
+	b.cursor = 0
+	b.dedup = event.NewDeduplicator(time.Minute)
+	b.duplicates = 0
+}
+
+// ExpectPublish wait for a publish on the topic, with the event name when it
+// isn't empty. The publishes are matched in order, each one only once.
+func (b *Broker) ExpectPublish(t testing.TB, topic string, name string, within time.Duration) *Published {
+	t.Helper()
+
+	var found *Published
+	ok := b.wait(within, func() bool {
+		for i := b.cursor; i < len(b.published); i++ {
+			p := b.published[i]
+			if p.Topic != topic {
+				continue
+			}
+			if name != "" {
+				if ep := p.Event(); ep == nil || ep.Name != name {
+					continue
+				}
+			}
+
+			found = p
+			b.cursor = i + 1
+			return true
+		}
+		return false
+	})
+	if !ok {
+		t.Fatalf("expect publish on topic %s with event %q within %s, got %s", topic, name, within, b.describe())
+	}
+
+	return found
+}
+
+// ExpectNoPublish fail when there is an unmatched publish on the topic
+// within the duration
+func (b *Broker) ExpectNoPublish(t testing.TB, topic string, within time.Duration) {
+	t.Helper()
+
+	var found *Published
+	b.wait(within, func() bool {
+		for i := b.cursor; i < len(b.published); i++ {
+			if b.published[i].Topic == topic {
+				found = b.published[i]
+				return true
+			}
+		}
+		return false
+	})
+	if found != nil {
+		t.Fatalf("expect no publish on topic %s, got one at %s", topic, found.At.Format(time.RFC3339Nano))
+	}
+}
+
+func (b *Broker) subscribe(ctx context.Context, topic string, handler event.MessageHandler, opts ...event.SubscribeConfigurator) *subscription {
+	if err := event.ValidateTopicPattern(topic); err != nil {
+		return newSubscriptionErr(err)
+	}
+
+	b.mu.Lock()
+	b.nextID++
+	s := newSubscription(ctx, strconv.FormatInt(b.nextID, 10), topic, handler, event.NewSubscribeOption(opts...))
+	b.subs[s.id] = s
+	b.mu.Unlock()
+
+	go func() {
+		<-s.Done()
+		b.unsubscribe(s)
+	}()
+
+	return s
+}
+
+func (b *Broker) unsubscribe(s *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subs, s.id)
+}
+
+// deliver send the message to every fan out subscription and the first
+// member of each group
+func (b *Broker) deliver(ctx context.Context, topic string, payload event.Payload, headers map[string]string) []*Message {
+	b.mu.Lock()
+	subs := make([]*subscription, 0, len(b.subs))
+	for _, s := range b.subs {
+		if event.MatchTopic(s.topic, topic) {
+			subs = append(subs, s)
+		}
+	}
+	b.mu.Unlock()
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].seq < subs[j].seq
+	})
+
+	groups := make(map[string]bool)
+	messages := []*Message{}
+	for _, s := range subs {
+		if s.option.Policy == event.WorkQueuePolicy {
+			key := s.topic + "\x00" + s.option.Group
+			if groups[key] {
+				continue
+			}
+			groups[key] = true
+		}
+
+		msg := b.newMessage(s, topic, payload, headers)
+		b.mu.Lock()
+		b.messages = append(b.messages, msg)
+		b.notifyLocked()
+		b.mu.Unlock()
+
+		s.deliver(ctx, msg)
+		messages = append(messages, msg)
+	}
+
+	return messages
+}
+
+func (b *Broker) newMessage(s *subscription, topic string, payload event.Payload, headers map[string]string) *Message {
+	b.mu.Lock()
+	b.nextID++
+	id := strconv.FormatInt(b.nextID, 10)
+	b.mu.Unlock()
+
+	return &Message{
+		broker:       b,
+		subscription: s,
+		id:           id,
+		topic:        topic,
+		payload:      payload,
+		headers:      headers,
+		deliveries:   1,
+	}
+}
+
+func (b *Broker) notify() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.notifyLocked()
+}
+
+func (b *Broker) notifyLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// wait check the condition on every change until it is met or the duration
+// exceeded, the condition is called with the lock held
+func (b *Broker) wait(within time.Duration, cond func() bool) bool {
+	timer := time.NewTimer(within)
+	defer timer.Stop()
+
+	for {
+		b.mu.Lock()
+		if cond() {
+			b.mu.Unlock()
+			return true
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+func (b *Broker) describe() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	topics := make([]string, 0, len(b.published)-b.cursor)
+	for _, p := range b.published[b.cursor:] {
+		topics = append(topics, p.Topic)
+	}
+
+	return fmt.Sprintf("unmatched publishes %v", topics)
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		subs:    make(map[string]*subscription),
+		changed: make(chan struct{}),
+		dedup:   event.NewDeduplicator(time.Minute),
+	}
+}
+
+// Install make a broker as the default broker of the event package, the
+// previous one is restored when the test finished
+func Install(t testing.TB) *Broker {
+	b := NewBroker()
+	previous := event.Default()
+	event.SetDefault(b)
+
+	t.Cleanup(func() {
+		b.Close(context.Background())
+		event.SetDefault(previous)
+	})
+
+	return b
+}
@@ -0,0 +1,185 @@
+package eventtest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+)
+
+// ErrAlreadySettled returned when a message is acked or nacked twice
+var ErrAlreadySettled = errors.New("message already acked or nacked")
+
+// Message is a delivered message that records how it is settled, the ack
+// and nack don't trigger any redelivery, the test drive it with Redeliver
+type Message struct {
+	broker       *Broker
+	subscription *subscription
+	id           string
+	topic        string
+	payload      event.Payload
+	headers      map[string]string
+	deliveries   int
+
+	mu       sync.Mutex
+	acked    bool
+	nacked   bool
+	progress int
+}
+
+func (m *Message) Scan(v interface{}, opts ...event.ScanOption) error {
+	return m.payload.Scan(v, opts...)
+}
+
+func (m *Message) ID() string {
+	return m.id
+}
+
+func (m *Message) Topic() string {
+	return m.topic
+}
+
+func (m *Message) Deliveries() int {
+	return m.deliveries
+}
+
+func (m *Message) Headers() map[string]string {
+	headers := make(map[string]string, len(m.headers))
+	for k, v := range m.headers {
+		headers[k] = v
+	}
+
+	return headers
+}
+
+func (m *Message) Ack(ctx context.Context) <-chan error {
+	return m.settle(func() {
+		m.acked = true
+	})
+}
+
+func (m *Message) Nack(ctx context.Context) <-chan error {
+	return m.settle(func() {
+		m.nacked = true
+	})
+}
+
+func (m *Message) Progress(ctx context.Context) <-chan error {
+	errChan := make(chan error, 1)
+	defer close(errChan)
+
+	m.mu.Lock()
+	if m.acked || m.nacked {
+		errChan <- ErrAlreadySettled
+	} else {
+		m.progress++
+		errChan <- nil
+	}
+	m.mu.Unlock()
+
+	m.broker.notify()
+	return errChan
+}
+
+func (m *Message) Reply(ctx context.Context, payload event.Payload, opts ...event.PublishConfigurator) <-chan error {
+	return event.ReplyWith(ctx, m.broker, m, payload, opts...).Error()
+}
+
+func (m *Message) Acked() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.acked
+}
+
+func (m *Message) Nacked() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.nacked
+}
+
+// Settled report whether the message is already acked or nacked
+func (m *Message) Settled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.acked || m.nacked
+}
+
+// ProgressCount return how many times the message reserved more time
+func (m *Message) ProgressCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.progress
+}
+
+// ExpectAck wait until the message is acked, it fails when it is nacked
+func (m *Message) ExpectAck(t testing.TB, within time.Duration) {
+	t.Helper()
+
+	m.broker.wait(within, func() bool {
+		return m.Settled()
+	})
+	if !m.Acked() {
+		t.Fatalf("expect message %s on topic %s to be acked within %s, nacked: %t", m.id, m.topic, within, m.Nacked())
+	}
+}
+
+// ExpectNack wait until the message is nacked, it fails when it is acked
+func (m *Message) ExpectNack(t testing.TB, within time.Duration) {
+	t.Helper()
+
+	m.broker.wait(within, func() bool {
+		return m.Settled()
+	})
+	if !m.Nacked() {
+		t.Fatalf("expect message %s on topic %s to be nacked within %s, acked: %t", m.id, m.topic, within, m.Acked())
+	}
+}
+
+// Redeliver deliver the message again to the same subscription with the
+// deliveries incremented, as the broker does after a nack or ack deadline
+func (m *Message) Redeliver(ctx context.Context) *Message {
+	redelivered := &Message{
+		broker:       m.broker,
+		subscription: m.subscription,
+		id:           m.id,
+		topic:        m.topic,
+		payload:      m.payload,
+		headers:      m.headers,
+		deliveries:   m.deliveries + 1,
+	}
+
+	m.broker.mu.Lock()
+	m.broker.messages = append(m.broker.messages, redelivered)
+	m.broker.notifyLocked()
+	m.broker.mu.Unlock()
+
+	if m.subscription != nil {
+		m.subscription.deliver(ctx, redelivered)
+	}
+
+	return redelivered
+}
+
+func (m *Message) settle(fn func()) <-chan error {
+	errChan := make(chan error, 1)
+	defer close(errChan)
+
+	m.mu.Lock()
+	if m.acked || m.nacked {
+		errChan <- ErrAlreadySettled
+	} else {
+		fn()
+		errChan <- nil
+	}
+	m.mu.Unlock()
+
+	m.broker.notify()
+	return errChan
+}
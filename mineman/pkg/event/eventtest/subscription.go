@@ -0,0 +1,105 @@
+package eventtest
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+)
+
+// bufferSize of the subscriptions without handler
+const bufferSize = 64
+
+var subscriptionSeq int64
+
+// subscription either call the handler synchronously or buffer the
+// messages to its channel
+type subscription struct {
+	id      string
+	seq     int64
+	topic   string
+	handler event.MessageHandler
+	option  *event.SubscribeOption
+	channel chan event.Message
+	err     error
+
+	doneChan  chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *subscription) ID() string {
+	return s.id
+}
+
+func (s *subscription) Error() error {
+	return s.err
+}
+
+func (s *subscription) Close() error {
+	s.cancel()
+	return nil
+}
+
+func (s *subscription) Done() <-chan struct{} {
+	return s.doneChan
+}
+
+func (s *subscription) Message() <-chan event.Message {
+	return s.channel
+}
+
+func (s *subscription) cancel() {
+	s.closeOnce.Do(func() {
+		close(s.doneChan)
+	})
+}
+
+func (s *subscription) deliver(ctx context.Context, msg *Message) {
+	if s.handler != nil {
+		s.handler.HandleMessage(ctx, msg)
+		return
+	}
+
+	select {
+	case s.channel <- msg:
+	case <-s.doneChan:
+	case <-ctx.Done():
+	}
+}
+
+func newSubscription(ctx context.Context, id string, topic string, handler event.MessageHandler, option *event.SubscribeOption) *subscription {
+	s := subscription{
+		id:       id,
+		seq:      atomic.AddInt64(&subscriptionSeq, 1),
+		topic:    topic,
+		handler:  handler,
+		option:   option,
+		doneChan: make(chan struct{}),
+	}
+	if handler == nil {
+		s.channel = make(chan event.Message, bufferSize)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.cancel()
+		case <-s.doneChan:
+		}
+	}()
+
+	return &s
+}
+
+func newSubscriptionErr(err error) *subscription {
+	s := subscription{
+		id:       "<no-id>",
+		err:      err,
+		doneChan: make(chan struct{}),
+		channel:  make(chan event.Message),
+	}
+	s.cancel()
+
+	return &s
+}
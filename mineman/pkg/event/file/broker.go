@@ -0,0 +1,672 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/app/api"
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/event/channel"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+)
+
+var (
+	ErrBrokerClosed = errors.New("file broker already closed")
+)
+
+type (
+	Config struct {
+		// Path is the directory where the log segments are stored
+		Path string `mapstructure:"path"`
+		// SegmentSize is the size in bytes before a new segment created
+		SegmentSize int64 `mapstructure:"segment_size"`
+		// Sync flush every write to the disk
+		Sync bool `mapstructure:"sync"`
+		// Codec used to encode the payloads, e.g. json or binary
+		Codec string `mapstructure:"codec"`
+		// DedupWindow is how long the idempotency keys are remembered, zero
+		// means the duplicates are not dropped
+		DedupWindow time.Duration `mapstructure:"dedup_window"`
+		// PendingTTL is how long a record without any consumer is kept for
+		// the next matching subscription, zero keeps it until one is made
+		PendingTTL time.Duration `mapstructure:"pending_ttl"`
+	}
+
+	// Broker persist every published message to an append only log before
+	// dispatching it through the in memory channel broker. Messages that are
+	// not acknowledged yet will be redelivered after restart, as soon as a
+	// matching subscription is made within the pending ttl. Each subscription,
+	// or work queue group, receive the pending message once.
+	Broker struct {
+		config Config
+		codec  event.Codec
+		inner  *channel.Broker
+		dedup  *event.Deduplicator
+
+		mu       sync.Mutex
+		closed   bool
+		nextSeq  uint64
+		segments []*segment
+		pending  map[uint64]*pendingRecord
+		subs     map[string]*subscription
+
+		// duplicates is dropped before persisted, the inner broker never
+		// sees them
+		duplicates int64
+	}
+
+	// pendingRecord is a published record that not yet acknowledged
+	pendingRecord struct {
+		seq     uint64
+		topic   string
+		payload event.Payload
+		option  *event.PublishOption
+		segment *segment
+		// idle is since when the record has no consumer
+		idle time.Time
+
+		// consumers are the subscriptions or the work queue groups that
+		// the record is dispatched to, mapped to whether their ack is still
+		// awaited. The record is released when none is awaited
+		consumers map[string]bool
+	}
+
+	Options interface {
+		Configure(b *Broker)
+	}
+
+	OptionsFunc func(b *Broker)
+)
+
+func (f OptionsFunc) Configure(b *Broker) {
+	f(b)
+}
+
+func (b *Broker) Init(ctx context.Context, c config.Config) error {
+	log.Trace("loading event file config...")
+	if err := c.Get("file").Scan(&b.config); err != nil {
+		return err
+	}
+	b.dedup = event.NewDeduplicator(b.config.DedupWindow)
+
+	if err := b.load(); err != nil {
+		return err
+	}
+
+	return b.inner.Init(ctx, c)
+}
+
+func (b *Broker) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrBrokerClosed
+	}
+	b.closed = true
+	b.mu.Unlock()
+
+	err := b.inner.Close(ctx)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.segments {
+		if closeErr := s.close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+func (b *Broker) Publish(ctx context.Context, topic string, payload event.Payload, opts ...event.PublishConfigurator) event.Publishing {
+	if err := event.ValidateTopic(topic); err != nil {
+		return publishingErr(err)
+	}
+
+	option := event.NewPublishOption(opts...)
+	now := time.Now()
+	if option.Expired(now) {
+		return publishingErr(nil)
+	}
+
+	if b.dedup.Duplicate(topic, option.IdempotencyKey(), now) {
+		log.Debug("dropping duplicated message", log.WithField("topic", topic), log.WithField("idempotency_key", option.IdempotencyKey()))
+		b.mu.Lock()
+		b.duplicates++
+		b.mu.Unlock()
+		return publishingErr(nil)
+	}
+
+	data, err := event.Encode(b.codec, payload)
+	if err != nil {
+		return b.publishFailed(topic, option, err)
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return b.publishFailed(topic, option, ErrBrokerClosed)
+	}
+
+	seq := b.nextSeq
+	s, err := b.activeSegment()
+	if err != nil {
+		b.mu.Unlock()
+		return b.publishFailed(topic, option, err)
+	}
+
+	rec := record{
+		Seq:   seq,
+		Op:    publishOp,
+		Topic: topic,
+		At:    time.Now(),
+	}
+	rec.setPayload(b.codec, data)
+	rec.setOption(option)
+	if err := s.append(&rec, b.config.Sync); err != nil {
+		b.mu.Unlock()
+		return b.publishFailed(topic, option, err)
+	}
+
+	b.nextSeq++
+	s.pending++
+	r := newPendingRecord(seq, topic, payload, option, s, rec.At)
+	b.pending[seq] = r
+	b.sweep(rec.At)
+
+	// keep the record until a matching subscription is made
+	targets := []string{}
+	for _, sub := range b.subs {
+		if event.MatchTopic(sub.topic, r.topic) && r.assign(sub.consumer()) {
+			targets = append(targets, sub.consumer())
+		}
+	}
+	if len(targets) == 0 && option.Retain {
+		// the in memory broker keeps the retained value for the next
+		// subscriptions, replaying the record would deliver it twice
+		err := b.release(r)
+		b.mu.Unlock()
+		if err != nil {
+			return publishingErr(err)
+		}
+
+		return publishingErr(b.dispatch(ctx, r, nil))
+	}
+	b.mu.Unlock()
+
+	if len(targets) == 0 {
+		return publishingErr(nil)
+	}
+
+	return publishingErr(b.dispatch(ctx, r, targets))
+}
+
+func (b *Broker) Subscribe(ctx context.Context, topic string, opts ...event.SubscribeConfigurator) event.SubscriptionMsg {
+	inner := b.inner.Subscribe(ctx, topic, opts...)
+	if inner.Error() != nil {
+		return inner
+	}
+
+	s := newSubscription(b, inner, topic, event.NewSubscribeOption(opts...))
+	consumer := s.consumer()
+
+	b.mu.Lock()
+	b.subs[s.ID()] = s
+
+	// collect records that never be dispatched to the subscription or its
+	// work queue group
+	replay := []*pendingRecord{}
+	now := time.Now()
+	b.sweep(now)
+	for _, r := range b.pending {
+		if _, ok := r.consumers[consumer]; ok || !event.MatchTopic(topic, r.topic) {
+			continue
+		}
+
+		if r.option.Expired(now) {
+			if err := b.release(r); err != nil {
+				log.Error("failed when releasing expired event", log.WithField("seq", r.seq), log.WithError(err))
+			}
+			continue
+		}
+
+		r.assign(consumer)
+		replay = append(replay, r)
+	}
+	b.mu.Unlock()
+
+	sort.Slice(replay, func(i, j int) bool {
+		return replay[i].seq < replay[j].seq
+	})
+	for _, r := range replay {
+		log.Trace("replaying pending event", log.WithField("seq", r.seq), log.WithField("topic", r.topic))
+		if err := b.dispatch(ctx, r, []string{consumer}); err != nil {
+			log.Error("failed when replaying pending event", log.WithField("seq", r.seq), log.WithError(err))
+		}
+	}
+
+	return s
+}
+
+func (b *Broker) SubscribeHandler(ctx context.Context, topic string, handler event.MessageHandler, opts ...event.SubscribeConfigurator) event.Subscription {
+	subscription := b.Subscribe(ctx, topic, opts...)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-subscription.Done():
+				return
+			case msg := <-subscription.Message():
+				// msg nil due to closed chan, skip the loop
+				if msg == nil {
+					continue
+				}
+				handler.HandleMessage(ctx, msg)
+			}
+		}
+	}()
+
+	return subscription
+}
+
+// Stats report the inner broker stats along with the persisted records
+// that not yet released
+func (b *Broker) Stats(ctx context.Context) (*event.Stats, error) {
+	stats, err := b.inner.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	undispatched := 0
+	for _, r := range b.pending {
+		if len(r.consumers) == 0 {
+			undispatched++
+		}
+	}
+
+	stats.Broker = "file"
+	stats.Counters["pending"] = int64(len(b.pending))
+	stats.Counters["undispatched"] = int64(undispatched)
+	stats.Counters["segments"] = int64(len(b.segments))
+	stats.Counters["duplicates"] = b.duplicates
+	return stats, nil
+}
+
+// load read all the existing segments to rebuild the pending records
+func (b *Broker) load() error {
+	codec, err := event.GetCodec(b.config.Codec)
+	if err != nil {
+		return err
+	}
+	b.codec = codec
+
+	if err := os.MkdirAll(b.config.Path, 0755); err != nil {
+		return err
+	}
+
+	segments, err := loadSegments(b.config.Path)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextSeq = 1
+	for _, s := range segments {
+		err := s.read(func(r *record) {
+			if r.Seq >= b.nextSeq {
+				b.nextSeq = r.Seq + 1
+			}
+
+			switch r.Op {
+			case publishOp:
+				payload, err := r.payload()
+				if err != nil {
+					log.Warning("skipping undecodable event", log.WithField("seq", r.Seq), log.WithError(err))
+					return
+				}
+
+				s.pending++
+				b.pending[r.Seq] = newPendingRecord(r.Seq, r.Topic, payload, r.option(), s, r.At)
+			case ackOp:
+				if p, ok := b.pending[r.Seq]; ok {
+					p.segment.pending--
+					delete(b.pending, r.Seq)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	b.segments = segments
+
+	// the expired records will never be delivered, release them right away
+	now := time.Now()
+	for _, r := range b.pending {
+		if !r.option.Expired(now) {
+			continue
+		}
+		if err := b.release(r); err != nil {
+			return err
+		}
+	}
+	b.sweep(now)
+
+	log.Debug("event log loaded",
+		log.WithField("segments", len(b.segments)),
+		log.WithField("pending", len(b.pending)),
+	)
+
+	return b.compact()
+}
+
+// ack record the acknowledgement of the consumer, the record is released
+// after all the consumers that receive it are acknowledged
+func (b *Broker) ack(seq uint64, consumer string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, ok := b.pending[seq]
+	if !ok || !r.consumers[consumer] {
+		return nil
+	}
+
+	r.consumers[consumer] = false
+	if r.awaited() {
+		return nil
+	}
+
+	return b.release(r)
+}
+
+// deadLettered count the record that exceeds the max deliveries as
+// acknowledged by its consumer, so it isn't replayed on every restart
+func (b *Broker) deadLettered(subscriber string, payload event.Payload) {
+	p, ok := payload.(*recordPayload)
+	if !ok {
+		return
+	}
+
+	// the subscription may already be gone, its id is the consumer unless
+	// it is a work queue member
+	consumer := subscriber
+	b.mu.Lock()
+	if s, ok := b.subs[subscriber]; ok {
+		consumer = s.consumer()
+	}
+	b.mu.Unlock()
+
+	if err := b.ack(p.seq, consumer); err != nil {
+		log.Error("failed when writing dead lettered event ack record", log.WithField("seq", p.seq), log.WithError(err))
+	}
+}
+
+// release write the ack record, so the record is no longer redelivered
+func (b *Broker) release(r *pendingRecord) error {
+	if b.closed {
+		return ErrBrokerClosed
+	}
+
+	s, err := b.activeSegment()
+	if err != nil {
+		return err
+	}
+
+	if err := s.append(&record{Seq: r.seq, Op: ackOp, At: time.Now()}, b.config.Sync); err != nil {
+		return err
+	}
+
+	r.segment.pending--
+	delete(b.pending, r.seq)
+	return b.compact()
+}
+
+// dispatch send the record to the target consumers through the in memory
+// broker, nil targets mean every subscriber. The targets will receive the
+// record again on their next subscription when it failed
+func (b *Broker) dispatch(ctx context.Context, r *pendingRecord, targets []string) error {
+	p := &recordPayload{seq: r.seq, payload: r.payload}
+	if targets != nil {
+		p.targets = make(map[string]bool, len(targets))
+		for _, t := range targets {
+			p.targets[t] = true
+		}
+	}
+
+	err := <-b.inner.Publish(ctx, r.topic, p, r.option).Error()
+	if err != nil {
+		b.mu.Lock()
+		for _, t := range targets {
+			delete(r.consumers, t)
+		}
+		if len(r.consumers) == 0 {
+			r.idle = time.Now()
+		}
+		b.mu.Unlock()
+	}
+
+	return err
+}
+
+// unsubscribe stop awaiting the ack of the subscription, a work queue group
+// is still awaited while any of its members left. The records acknowledged by
+// all the remaining consumers are released, the ones left without any
+// consumer are kept for the next matching subscription up to the pending ttl
+func (b *Broker) unsubscribe(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.subs[id]
+	if !ok {
+		return
+	}
+	delete(b.subs, id)
+
+	consumer := s.consumer()
+	for _, other := range b.subs {
+		if other.consumer() == consumer {
+			return
+		}
+	}
+
+	now := time.Now()
+	for _, r := range b.pending {
+		if _, ok := r.consumers[consumer]; !ok {
+			continue
+		}
+
+		delete(r.consumers, consumer)
+		if len(r.consumers) == 0 {
+			r.idle = now
+			continue
+		}
+		if r.awaited() {
+			continue
+		}
+		if err := b.release(r); err != nil {
+			log.Error("failed when releasing unsubscribed event", log.WithField("seq", r.seq), log.WithError(err))
+		}
+	}
+	b.sweep(now)
+}
+
+// sweep release the records that have no consumer for longer than the
+// pending ttl
+func (b *Broker) sweep(now time.Time) {
+	if b.config.PendingTTL <= 0 {
+		return
+	}
+
+	for _, r := range b.pending {
+		if len(r.consumers) > 0 || now.Sub(r.idle) < b.config.PendingTTL {
+			continue
+		}
+
+		log.Trace("releasing event without consumer", log.WithField("seq", r.seq), log.WithField("topic", r.topic))
+		if err := b.release(r); err != nil {
+			log.Error("failed when releasing event without consumer", log.WithField("seq", r.seq), log.WithError(err))
+			return
+		}
+	}
+}
+
+// assign await the ack of the consumer, it returns false when the record
+// already dispatched to the consumer
+func (r *pendingRecord) assign(consumer string) bool {
+	if _, ok := r.consumers[consumer]; ok {
+		return false
+	}
+
+	r.consumers[consumer] = true
+	return true
+}
+
+// awaited report whether any of the consumers not yet acknowledged
+func (r *pendingRecord) awaited() bool {
+	for _, awaited := range r.consumers {
+		if awaited {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newPendingRecord(seq uint64, topic string, payload event.Payload, option *event.PublishOption, s *segment, at time.Time) *pendingRecord {
+	return &pendingRecord{
+		seq:       seq,
+		topic:     topic,
+		payload:   payload,
+		option:    option,
+		segment:   s,
+		idle:      at,
+		consumers: make(map[string]bool),
+	}
+}
+
+// activeSegment return the segment for appending, a new segment is made when
+// the current one exceeds the segment size
+func (b *Broker) activeSegment() (*segment, error) {
+	id := uint64(1)
+	if n := len(b.segments); n > 0 {
+		s := b.segments[n-1]
+		id = s.id + 1
+		if b.config.SegmentSize <= 0 || s.size < b.config.SegmentSize || s.size == 0 {
+			if s.file == nil {
+				if err := s.open(); err != nil {
+					return nil, err
+				}
+			}
+			return s, nil
+		}
+
+		// the full segment only need to be read from now on
+		if err := s.close(); err != nil {
+			return nil, err
+		}
+	}
+
+	s := newSegment(b.config.Path, id)
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	b.segments = append(b.segments, s)
+
+	if err := b.compact(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// compact remove the oldest segments that have all of their records
+// acknowledged, it stops at the first segment that still has pending record
+// so the ack records of the remaining segments are kept
+func (b *Broker) compact() error {
+	for len(b.segments) > 1 {
+		s := b.segments[0]
+		if s.pending > 0 {
+			break
+		}
+
+		log.Trace("removing acknowledged event log segment", log.WithField("segment", s.path))
+		if err := s.remove(); err != nil {
+			return err
+		}
+		b.segments = b.segments[1:]
+	}
+
+	return nil
+}
+
+// publishFailed forget the idempotency key of the message that isn't
+// persisted, so it can be retried
+func (b *Broker) publishFailed(topic string, option *event.PublishOption, err error) event.Publishing {
+	b.dedup.Forget(topic, option.IdempotencyKey())
+	return publishingErr(err)
+}
+
+func publishingErr(err error) event.Publishing {
+	errChan := make(chan error, 1)
+	errChan <- err
+	close(errChan)
+	return event.NewPublishingChanForward(errChan)
+}
+
+func WithConfig(config Config) OptionsFunc {
+	return OptionsFunc(func(b *Broker) {
+		b.config = config
+	})
+}
+
+func New(opts ...Options) *Broker {
+	broker := Broker{
+		config: Config{
+			Path:        "data/events",
+			SegmentSize: 4 * 1024 * 1024,
+			Sync:        true,
+			Codec:       event.DefaultCodec,
+			DedupWindow: time.Minute,
+			PendingTTL:  time.Hour * 24,
+		},
+		pending: make(map[uint64]*pendingRecord),
+		subs:    make(map[string]*subscription),
+	}
+
+	// the duplicates are dropped before they are persisted
+	broker.inner = channel.New(
+		channel.WithSkipDedup(true),
+		channel.WithDeadLetterHook(broker.deadLettered),
+	)
+
+	for _, o := range opts {
+		o.Configure(&broker)
+	}
+
+	return &broker
+}
+
+// newEventBroker return the event's Broker interface, to help
+// static check whether our implementation comply with the interface
+func newEventBroker() event.Broker {
+	return New()
+}
+
+func newModule() api.Module {
+	return newEventBroker()
+}
+
+func init() {
+	event.RegisterBroker("file", newModule)
+}
@@ -0,0 +1,286 @@
+package file
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/event/channel"
+)
+
+func TestRedeliverAfterRestart(t *testing.T) {
+	const total = 10
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	newBroker := func() *Broker {
+		b := New(WithConfig(Config{
+			Path:        dir,
+			SegmentSize: 256,
+			Sync:        true,
+			Codec:       event.DefaultCodec,
+		}))
+		if err := b.load(); err != nil {
+			t.Fatal(err)
+		}
+		b.inner.Start(ctx)
+		return b
+	}
+
+	receive := func(sub event.SubscriptionMsg) string {
+		select {
+		case msg := <-sub.Message():
+			var payload string
+			if err := msg.Scan(&payload); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-msg.Ack(ctx); err != nil {
+				t.Fatal(err)
+			}
+			return payload
+		case <-time.After(time.Second):
+			t.Fatal("expect receiving a message")
+		}
+		return ""
+	}
+
+	// publish without any subscriber, all of them must be kept
+	broker := newBroker()
+	for i := 0; i < total; i++ {
+		if err := <-broker.Publish(ctx, "network.status-changed", event.StringPayload(strconv.Itoa(i))).Error(); err != nil {
+			t.Fatalf("publish %d failed with %s", i, err)
+		}
+	}
+	broker.Close(ctx)
+
+	// only acknowledge half of them before restart
+	broker = newBroker()
+	if len(broker.pending) != total {
+		t.Fatalf("expect %d pending records after restart, but got %d", total, len(broker.pending))
+	}
+	sub := broker.Subscribe(ctx, "network.*")
+	for i := 0; i < total/2; i++ {
+		if got := receive(sub); got != strconv.Itoa(i) {
+			t.Errorf("expect message %d replayed in order, but got %s", i, got)
+		}
+	}
+	broker.Close(ctx)
+
+	broker = newBroker()
+	defer broker.Close(ctx)
+	if len(broker.pending) != total/2 {
+		t.Fatalf("expect %d pending records after restart, but got %d", total/2, len(broker.pending))
+	}
+
+	sub = broker.Subscribe(ctx, "network.status-changed")
+	for i := total / 2; i < total; i++ {
+		if got := receive(sub); got != strconv.Itoa(i) {
+			t.Errorf("expect message %d replayed in order, but got %s", i, got)
+		}
+	}
+
+	// all records acknowledged, only the active segment should be left
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(broker.pending) != 0 || len(entries) != 1 {
+		t.Errorf("expect log compacted into a single segment, but got %d segments with %d pending", len(entries), len(broker.pending))
+	}
+}
+
+func TestReplayEachSubscription(t *testing.T) {
+	ctx := context.Background()
+
+	broker := New(WithConfig(Config{
+		Path:  t.TempDir(),
+		Sync:  true,
+		Codec: event.DefaultCodec,
+	}))
+	if err := broker.load(); err != nil {
+		t.Fatal(err)
+	}
+	broker.inner.Start(ctx)
+	defer broker.Close(ctx)
+
+	if err := <-broker.Publish(ctx, "job", event.StringPayload("pending")).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func(sub event.SubscriptionMsg, name string) event.Message {
+		select {
+		case msg := <-sub.Message():
+			return msg
+		case <-time.After(time.Second):
+			t.Fatalf("expect %s receive the pending message", name)
+		}
+		return nil
+	}
+
+	// both the subscription and the group made after the publish receive
+	// the pending record once
+	first := broker.Subscribe(ctx, "job")
+	msgs := []event.Message{receive(first, "first subscription")}
+	workerA := broker.Subscribe(ctx, "job", event.Group("workers"))
+	workerB := broker.Subscribe(ctx, "job", event.Group("workers"))
+	select {
+	case msg := <-workerA.Message():
+		msgs = append(msgs, msg)
+	case msg := <-workerB.Message():
+		msgs = append(msgs, msg)
+	case <-time.After(time.Second):
+		t.Fatal("expect the group receive the pending message")
+	}
+
+	for _, sub := range []event.SubscriptionMsg{first, workerA, workerB} {
+		select {
+		case <-sub.Message():
+			t.Errorf("expect subscription %s not receive the pending message twice", sub.ID())
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+
+	for i, msg := range msgs {
+		broker.mu.Lock()
+		pending := len(broker.pending)
+		broker.mu.Unlock()
+		if pending != 1 {
+			t.Fatalf("expect the record kept until all acked, but got %d pending after %d acks", pending, i)
+		}
+
+		if err := <-msg.Ack(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if len(broker.pending) != 0 {
+		t.Errorf("expect the record released, but got %d pending", len(broker.pending))
+	}
+}
+
+func TestDeadLetterReleased(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	newBroker := func() *Broker {
+		b := New(WithConfig(Config{
+			Path:  dir,
+			Sync:  true,
+			Codec: event.DefaultCodec,
+		}))
+		channel.WithConfig(channel.Config{
+			WaitOnClose:        true,
+			CmdBufferSize:      16,
+			PubBufferSize:      16,
+			SubBufferSize:      16,
+			RedeliveryInterval: time.Millisecond * 10,
+			MaxDeliveries:      1,
+			DeadLetterTopic:    "dead",
+		}).Configure(b.inner)
+		if err := b.load(); err != nil {
+			t.Fatal(err)
+		}
+		b.inner.Start(ctx)
+		return b
+	}
+
+	broker := newBroker()
+	sub := broker.Subscribe(ctx, "job")
+	dead := broker.Subscribe(ctx, "dead")
+	if err := <-broker.Publish(ctx, "job", event.StringPayload("poison")).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-sub.Message():
+		if err := <-msg.Nack(ctx); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect receiving the message")
+	}
+
+	select {
+	case msg := <-dead.Message():
+		var payload string
+		msg.Scan(&payload)
+		if payload != "poison" {
+			t.Errorf("expect the dead letter 'poison', but got '%s'", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect the message moved to the dead letter topic")
+	}
+	broker.Close(ctx)
+
+	// the dead lettered record is acked, it isn't replayed after restart
+	broker = newBroker()
+	defer broker.Close(ctx)
+	if len(broker.pending) != 0 {
+		t.Errorf("expect no pending record after restart, but got %d", len(broker.pending))
+	}
+}
+
+func TestUnsubscribeReleased(t *testing.T) {
+	ctx := context.Background()
+
+	broker := New(WithConfig(Config{
+		Path:       t.TempDir(),
+		Sync:       true,
+		Codec:      event.DefaultCodec,
+		PendingTTL: time.Millisecond * 50,
+	}))
+	if err := broker.load(); err != nil {
+		t.Fatal(err)
+	}
+	broker.inner.Start(ctx)
+	defer broker.Close(ctx)
+
+	pending := func() int {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		return len(broker.pending)
+	}
+
+	acked := broker.Subscribe(ctx, "job")
+	gone := broker.Subscribe(ctx, "job")
+	if err := <-broker.Publish(ctx, "job", event.StringPayload("done")).Error(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-acked.Message():
+		if err := <-msg.Ack(ctx); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect receiving the message")
+	}
+
+	// the only awaited consumer is gone, the record is settled
+	gone.Close()
+	if n := pending(); n != 0 {
+		t.Fatalf("expect the record released after unsubscribe, but got %d pending", n)
+	}
+
+	// the record left without consumer is kept up to the pending ttl
+	if err := <-broker.Publish(ctx, "job", event.StringPayload("left")).Error(); err != nil {
+		t.Fatal(err)
+	}
+	acked.Close()
+	if n := pending(); n != 1 {
+		t.Fatalf("expect the record kept for the next subscription, but got %d pending", n)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	if err := <-broker.Publish(ctx, "other", event.StringPayload("fresh")).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if n := pending(); n != 1 {
+		t.Errorf("expect only the fresh record pending, but got %d", n)
+	}
+}
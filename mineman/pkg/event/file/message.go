@@ -0,0 +1,107 @@
+package file
+
+import (
+	"context"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+)
+
+type (
+	// recordPayload carry the record sequence through the in memory broker,
+	// targets are the consumers that should receive it, nil means all
+	recordPayload struct {
+		seq     uint64
+		payload event.Payload
+		targets map[string]bool
+	}
+
+	// message wrap the in memory broker message to release the
+	// record from the log upon acknowledgement
+	message struct {
+		event.Message
+		broker   *Broker
+		consumer string
+		seq      uint64
+		payload  event.Payload
+		targets  map[string]bool
+	}
+)
+
+func (p *recordPayload) Scan(v interface{}, opts ...event.ScanOption) error {
+	// allow the subscription to unwrap the record
+	if r, ok := v.(*recordPayload); ok {
+		*r = *p
+		return nil
+	}
+
+	return p.payload.Scan(v, opts...)
+}
+
+// targeted check whether the consumer should receive the message, the
+// retained and dead lettered copies are always received
+func (m *message) targeted() bool {
+	headers := m.Headers()
+	if m.targets == nil || headers[event.HeaderRetained] != "" || headers[event.HeaderOriginalTopic] != "" {
+		return true
+	}
+
+	return m.targets[m.consumer]
+}
+
+func (m *message) Scan(v interface{}, opts ...event.ScanOption) error {
+	return m.payload.Scan(v, opts...)
+}
+
+// Ack will acknowledge the message and release the record when all of
+// the subscribers already acknowledged it
+func (m *message) Ack(ctx context.Context) <-chan error {
+	errChan := make(chan error, 1)
+
+	go func() {
+		defer close(errChan)
+
+		if err := <-m.Message.Ack(ctx); err != nil {
+			errChan <- err
+			return
+		}
+
+		// the retained value isn't counted, the record expect the acks of
+		// the subscribers at the time it was published
+		if m.Headers()[event.HeaderRetained] != "" {
+			errChan <- nil
+			return
+		}
+
+		if err := m.broker.ack(m.seq, m.consumer); err != nil {
+			log.Error("failed when writing event ack record", log.WithField("seq", m.seq), log.WithError(err))
+			errChan <- err
+			return
+		}
+
+		errChan <- nil
+	}()
+
+	return errChan
+}
+
+// Reply will publish the reply through the file broker, so it is persisted
+func (m *message) Reply(ctx context.Context, payload event.Payload, opts ...event.PublishConfigurator) <-chan error {
+	return event.ReplyWith(ctx, m.broker, m, payload, opts...).Error()
+}
+
+func newMessage(b *Broker, consumer string, msg event.Message) event.Message {
+	var p recordPayload
+	if err := msg.Scan(&p); err != nil {
+		return msg
+	}
+
+	return &message{
+		Message:  msg,
+		broker:   b,
+		consumer: consumer,
+		seq:      p.seq,
+		payload:  p.payload,
+		targets:  p.targets,
+	}
+}
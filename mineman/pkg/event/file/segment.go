@@ -0,0 +1,217 @@
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+)
+
+const (
+	segmentExt = ".log"
+
+	publishOp = "publish"
+	ackOp     = "ack"
+)
+
+type (
+	// record is a single line of the append only log
+	record struct {
+		Seq   uint64    `json:"seq"`
+		Op    string    `json:"op"`
+		Topic string    `json:"topic,omitempty"`
+		At    time.Time `json:"at"`
+		// Headers, DeliverAt and ExpiresAt keep the publish option
+		Headers   map[string]string `json:"headers,omitempty"`
+		DeliverAt *time.Time        `json:"deliver_at,omitempty"`
+		ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+		Codec     string            `json:"codec,omitempty"`
+		// Payload hold json encoded payload as is to keep the log readable,
+		// while Data hold the payload of the other codecs
+		Payload json.RawMessage `json:"payload,omitempty"`
+		Data    []byte          `json:"data,omitempty"`
+	}
+
+	// segment is one file of the log, named after its ordering id
+	segment struct {
+		path string
+		id   uint64
+		size int64
+		file *os.File
+
+		// number of published records that not yet acknowledged
+		pending int
+	}
+)
+
+func (r *record) setPayload(codec event.Codec, data []byte) {
+	r.Codec = codec.Name()
+	if _, ok := codec.(event.JSONCodec); ok {
+		r.Payload = data
+		return
+	}
+
+	r.Data = data
+}
+
+func (r *record) setOption(o *event.PublishOption) {
+	r.Headers = o.Headers
+	if !o.DeliverAt.IsZero() {
+		r.DeliverAt = &o.DeliverAt
+	}
+	if !o.ExpiresAt.IsZero() {
+		r.ExpiresAt = &o.ExpiresAt
+	}
+}
+
+func (r *record) option() *event.PublishOption {
+	o := event.PublishOption{Headers: r.Headers}
+	if r.DeliverAt != nil {
+		o.DeliverAt = *r.DeliverAt
+	}
+	if r.ExpiresAt != nil {
+		o.ExpiresAt = *r.ExpiresAt
+	}
+	return &o
+}
+
+// payload decode the record payload with the codec it was written
+func (r *record) payload() (event.Payload, error) {
+	name := r.Codec
+	if name == "" {
+		name = event.DefaultCodec
+	}
+
+	codec, err := event.GetCodec(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Payload != nil {
+		return event.Decode(codec, r.Payload), nil
+	}
+
+	return event.Decode(codec, r.Data), nil
+}
+
+func (s *segment) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+func (s *segment) append(r *record, sync bool) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if sync {
+		return s.file.Sync()
+	}
+
+	return nil
+}
+
+func (s *segment) close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *segment) remove() error {
+	if err := s.close(); err != nil {
+		return err
+	}
+
+	return os.Remove(s.path)
+}
+
+// read walk through all records of the segment, a broken trailing line that
+// caused by crash in the middle of write will be skipped
+func (s *segment) read(fn func(r *record)) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			log.Warning("skipping broken event log record", log.WithField("segment", s.path), log.WithError(err))
+			continue
+		}
+		fn(&r)
+	}
+
+	return scanner.Err()
+}
+
+func newSegment(dir string, id uint64) *segment {
+	return &segment{
+		path: filepath.Join(dir, fmt.Sprintf("%020d%s", id, segmentExt)),
+		id:   id,
+	}
+}
+
+// loadSegments list all segments inside the directory ordered by their sequence
+func loadSegments(dir string) ([]*segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []*segment{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, newSegment(dir, id))
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].id < segments[j].id
+	})
+
+	return segments, nil
+}
@@ -0,0 +1,79 @@
+package file
+
+import (
+	"context"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+)
+
+type (
+	// subscription forward the in memory broker subscription
+	// while unwrapping its messages
+	subscription struct {
+		event.SubscriptionMsg
+		broker  *Broker
+		topic   string
+		option  *event.SubscribeOption
+		channel chan event.Message
+	}
+)
+
+func (s *subscription) Message() <-chan event.Message {
+	return s.channel
+}
+
+// consumer identify who acknowledge the records, the members of a work
+// queue group share it as only one of them receive the record
+func (s *subscription) consumer() string {
+	if s.option.Policy == event.WorkQueuePolicy {
+		return s.topic + "\x00" + s.option.Group
+	}
+
+	return s.ID()
+}
+
+func (s *subscription) Close() error {
+	s.broker.unsubscribe(s.ID())
+	return s.SubscriptionMsg.Close()
+}
+
+func (s *subscription) forward() {
+	defer close(s.channel)
+
+	for {
+		select {
+		case <-s.Done():
+			return
+		case msg, ok := <-s.SubscriptionMsg.Message():
+			if !ok {
+				return
+			}
+
+			m := newMessage(s.broker, s.consumer(), msg)
+			if r, ok := m.(*message); ok && !r.targeted() {
+				// the record is replayed for the other subscriptions
+				msg.Ack(context.Background())
+				continue
+			}
+
+			select {
+			case s.channel <- m:
+			case <-s.Done():
+				return
+			}
+		}
+	}
+}
+
+func newSubscription(b *Broker, inner event.SubscriptionMsg, topic string, option *event.SubscribeOption) *subscription {
+	s := &subscription{
+		SubscriptionMsg: inner,
+		broker:          b,
+		topic:           topic,
+		option:          option,
+		channel:         make(chan event.Message),
+	}
+
+	go s.forward()
+	return s
+}
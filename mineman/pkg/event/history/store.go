@@ -0,0 +1,336 @@
+// Package history keep the past events queryable, e.g. to find out the exact
+// sequence of network and miner status changes of a rig.
+package history
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+)
+
+var (
+	ErrStoreClosed = errors.New("history store already closed")
+	ErrNotAnEvent  = errors.New("message payload is not an event")
+)
+
+type (
+	// Record is a stored event, ordered by its occurrence time
+	Record struct {
+		ID      string                 `json:"id"`
+		Topic   string                 `json:"topic"`
+		Name    string                 `json:"name"`
+		At      time.Time              `json:"at"`
+		Data    map[string]interface{} `json:"data,omitempty"`
+		Meta    map[string]interface{} `json:"meta,omitempty"`
+		Headers map[string]string      `json:"headers,omitempty"`
+	}
+
+	// Query filter the records, the zero values match everything
+	Query struct {
+		// Topic is a topic pattern, it may contains wildcard
+		Topic string
+		// Name is the exact event name
+		Name string
+		// Since is inclusive and Until is exclusive
+		Since time.Time
+		Until time.Time
+		// Limit keep only the latest records when it is greater than zero
+		Limit int
+	}
+
+	Store interface {
+		Append(ctx context.Context, r Record) error
+		Query(ctx context.Context, q Query) ([]Record, error)
+		// Prune remove the records that occurred before the given time
+		Prune(ctx context.Context, before time.Time) (int, error)
+		Close() error
+	}
+
+	// FileStore keep all the records in memory and append them to a JSON
+	// lines file, the file is rewritten when the records are pruned
+	FileStore struct {
+		path string
+		sync bool
+
+		mu      sync.RWMutex
+		file    *os.File
+		records []Record
+		closed  bool
+	}
+
+	Options interface {
+		Configure(s *FileStore)
+	}
+
+	OptionsFunc func(s *FileStore)
+)
+
+func (f OptionsFunc) Configure(s *FileStore) {
+	f(s)
+}
+
+// Match check whether the record satisfy the query
+func (q *Query) Match(r *Record) bool {
+	if q.Topic != "" && !event.MatchTopic(q.Topic, r.Topic) {
+		return false
+	}
+
+	if q.Name != "" && q.Name != r.Name {
+		return false
+	}
+
+	if !q.Since.IsZero() && r.At.Before(q.Since) {
+		return false
+	}
+
+	if !q.Until.IsZero() && !r.At.Before(q.Until) {
+		return false
+	}
+
+	return true
+}
+
+func (s *FileStore) Append(ctx context.Context, r Record) error {
+	line, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	if s.sync {
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	s.insert(r)
+	return nil
+}
+
+func (s *FileStore) Query(ctx context.Context, q Query) ([]Record, error) {
+	if q.Topic != "" {
+		if err := event.ValidateTopicPattern(q.Topic); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+
+	result := []Record{}
+	for i := range s.records {
+		if q.Match(&s.records[i]) {
+			result = append(result, s.records[i])
+		}
+	}
+
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+
+	return result, nil
+}
+
+func (s *FileStore) Prune(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, ErrStoreClosed
+	}
+
+	// the records are sorted, so the pruned ones are at the beginning
+	n := sort.Search(len(s.records), func(i int) bool {
+		return !s.records[i].At.Before(before)
+	})
+	if n == 0 {
+		return 0, nil
+	}
+
+	if err := s.rewrite(s.records[n:]); err != nil {
+		return 0, err
+	}
+
+	s.records = append([]Record{}, s.records[n:]...)
+	return n, nil
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrStoreClosed
+	}
+	s.closed = true
+
+	return s.file.Close()
+}
+
+// insert keep the records sorted by time, the records mostly arrive in order
+// so it searches from the end
+func (s *FileStore) insert(r Record) {
+	i := len(s.records)
+	for i > 0 && s.records[i-1].At.After(r.At) {
+		i--
+	}
+
+	s.records = append(s.records, Record{})
+	copy(s.records[i+1:], s.records[i:])
+	s.records[i] = r
+}
+
+func (s *FileStore) load() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	corrupted := false
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// most likely a torn write of the last record
+			log.Warning("skipping corrupted history record", log.WithError(err))
+			corrupted = true
+			continue
+		}
+		s.records = append(s.records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return err
+	}
+
+	sort.SliceStable(s.records, func(i, j int) bool {
+		return s.records[i].At.Before(s.records[j].At)
+	})
+	s.file = file
+
+	// rewrite so the next record isn't appended to the corrupted line
+	if corrupted {
+		return s.rewrite(s.records)
+	}
+
+	return nil
+}
+
+// rewrite replace the file with the given records, the new file is written
+// aside then renamed so a crash never lose the old records
+func (s *FileStore) rewrite(records []Record) error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(w)
+	for i := range records {
+		if err := encoder.Encode(&records[i]); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.file.Close()
+	s.file = file
+	return nil
+}
+
+// NewRecord make a record from an event message, the event time is kept so
+// the records are ordered by the time the events occurred
+func NewRecord(msg event.Message) (Record, error) {
+	var payload event.EventPayload
+	if err := msg.Scan(&payload); err != nil {
+		return Record{}, ErrNotAnEvent
+	}
+
+	at := payload.At
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	return Record{
+		ID:      msg.ID(),
+		Topic:   msg.Topic(),
+		Name:    payload.Name,
+		At:      at,
+		Data:    payload.Data,
+		Meta:    payload.Meta,
+		Headers: msg.Headers(),
+	}, nil
+}
+
+// SyncWrite flush every append to the disk
+func SyncWrite(sync bool) Options {
+	return OptionsFunc(func(s *FileStore) {
+		s.sync = sync
+	})
+}
+
+// OpenFile load the records of the file, it is created when not exists
+func OpenFile(path string, opts ...Options) (*FileStore, error) {
+	s := FileStore{
+		path: path,
+	}
+
+	for _, o := range opts {
+		o.Configure(&s)
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
@@ -0,0 +1,96 @@
+package history
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	store, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+	records := []Record{
+		{ID: "1", Topic: "network.status-changed", Name: "network.down", At: base.Add(time.Minute)},
+		{ID: "2", Topic: "miner.status-changed", Name: "miner.status", At: base.Add(2 * time.Minute)},
+		{ID: "3", Topic: "network.status-changed", Name: "network.up", At: base.Add(4 * time.Minute)},
+		// arrives late, it is ordered by the event time
+		{ID: "4", Topic: "miner.status-changed", Name: "miner.status", At: base.Add(3 * time.Minute)},
+	}
+	for _, r := range records {
+		if err := store.Append(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectIDs := func(q Query, ids ...string) {
+		t.Helper()
+		result, err := store.Query(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result) != len(ids) {
+			t.Fatalf("query %+v expect %v, got %v", q, ids, result)
+		}
+		for i, r := range result {
+			if r.ID != ids[i] {
+				t.Fatalf("query %+v expect %v, got %v", q, ids, result)
+			}
+		}
+	}
+
+	expectIDs(Query{}, "1", "2", "4", "3")
+	expectIDs(Query{Topic: "network.*"}, "1", "3")
+	expectIDs(Query{Name: "miner.status"}, "2", "4")
+	expectIDs(Query{Since: base.Add(2 * time.Minute), Until: base.Add(4 * time.Minute)}, "2", "4")
+	expectIDs(Query{Limit: 2}, "4", "3")
+	if _, err := store.Query(ctx, Query{Topic: "network.#.up"}); err == nil {
+		t.Fatal("expect invalid topic pattern error")
+	}
+
+	// pruned records are removed from the file as well
+	n, err := store.Prune(ctx, base.Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expect 1 pruned record, got %d", n)
+	}
+	if err := store.Append(ctx, Record{ID: "5", Topic: "network.status-changed", Name: "network.down", At: base.Add(5 * time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a torn write is skipped on load
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"6","topic":`)
+	f.Close()
+
+	store, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(ctx, Record{ID: "7", Topic: "network.status-changed", Name: "network.up", At: base.Add(6 * time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	expectIDs(Query{}, "2", "4", "3", "5", "7")
+}
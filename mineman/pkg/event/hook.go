@@ -2,6 +2,7 @@ package event
 
 import (
 	"context"
+	"fmt"
 	"sync"
 
 	"github.com/euiko/tooyoul/mineman/pkg/app/api"
@@ -13,6 +14,20 @@ type (
 	HookConfig struct {
 		Enabled bool   `mapstructure:"enabled"`
 		Broker  string `mapstructure:"broker"`
+		// Middlewares enable the builtin middlewares by name, e.g. logging,
+		// metrics and trace, they are applied in order
+		Middlewares []string `mapstructure:"middlewares"`
+		// Outbox queue the publishes made before the broker is ready or while
+		// it is unavailable
+		Outbox OutboxConfig `mapstructure:"outbox"`
+		// Routes send the matching topics to another broker, the first
+		// matching route wins and the rest stay in the main broker
+		Routes []RouteConfig `mapstructure:"routes"`
+	}
+
+	RouteConfig struct {
+		Topics []string `mapstructure:"topics"`
+		Broker string   `mapstructure:"broker"`
 	}
 
 	Hook struct {
@@ -21,11 +36,49 @@ type (
 		broker Broker
 		module api.Module
 
+		publishMws []PublishMiddleware
+		consumeMws []ConsumeMiddleware
+
 		sinks         []Sink
 		subscriptions sync.Map
+
+		// handling count the running sink handlers, no handler is started
+		// once stopped
+		mu       sync.Mutex
+		stopped  bool
+		handling sync.WaitGroup
+	}
+
+	// hookBroker apply the middlewares around the actual broker
+	hookBroker struct {
+		Broker
+		publish PublishFunc
+		consume []ConsumeMiddleware
 	}
 )
 
+func (b *hookBroker) Publish(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) Publishing {
+	return b.publish(ctx, topic, payload, opts...)
+}
+
+func (b *hookBroker) SubscribeHandler(ctx context.Context, topic string, handler MessageHandler, opts ...SubscribeConfigurator) Subscription {
+	return b.Broker.SubscribeHandler(ctx, topic, ChainConsume(handler, b.consume...), opts...)
+}
+
+// UsePublish add middlewares around every publish, they are applied
+// after the ones enabled by config
+func (h *Hook) UsePublish(mws ...PublishMiddleware) *Hook {
+	h.publishMws = append(h.publishMws, mws...)
+	return h
+}
+
+// UseConsume add middlewares around every subscribed handler, they are
+// applied after the panic recovery and the ones enabled by config
+func (h *Hook) UseConsume(mws ...ConsumeMiddleware) *Hook {
+	h.consumeMws = append(h.consumeMws, mws...)
+	return h
+}
+
 func (h *Hook) Init(ctx context.Context, c config.Config) error {
 	h.c = c
 
@@ -44,16 +97,11 @@ func (h *Hook) Init(ctx context.Context, c config.Config) error {
 	}
 
 	// load and instantiate broker
-	f, err := GetBroker(h.conf.Broker)
+	broker, err := h.loadBroker()
 	if err != nil {
 		return err
 	}
-
-	h.module = f()
-	ok := false
-	if h.broker, ok = h.module.(Broker); !ok {
-		return ErrEventModuleTypeInvalid
-	}
+	h.module = broker
 	log.Trace("event broker loaded")
 
 	if err := h.module.Init(ctx, c.Sub("event")); err != nil {
@@ -61,8 +109,27 @@ func (h *Hook) Init(ctx context.Context, c config.Config) error {
 	}
 	log.Trace("event broker initialized")
 
-	// register to global broker
-	globalBroker = h.broker
+	// recovery always comes first, so no handler can take down the process
+	publishMws := []PublishMiddleware{}
+	consumeMws := []ConsumeMiddleware{Recover()}
+	for _, name := range h.conf.Middlewares {
+		publishMw, consumeMw, err := builtinMiddlewares(name)
+		if err != nil {
+			return err
+		}
+		publishMws = append(publishMws, publishMw)
+		consumeMws = append(consumeMws, consumeMw)
+	}
+
+	h.broker = &hookBroker{
+		Broker:  broker,
+		publish: ChainPublish(broker.Publish, append(publishMws, h.publishMws...)...),
+		consume: append(consumeMws, h.consumeMws...),
+	}
+
+	// register to global broker, it flushes the early publishes
+	globalOutbox.Configure(h.conf.Outbox)
+	SetDefault(h.broker)
 
 	return nil
 }
@@ -74,22 +141,68 @@ func (h *Hook) Close(ctx context.Context) error {
 	}
 
 	// close all subscription first
-	h.subscriptions.Range(func(key, value interface{}) bool {
-		sub := value.(Subscription)
-		log.Trace("closing subscriber...", log.WithField("id", sub.ID()))
-		if err := sub.Close(); err != nil {
-			log.Error("failed when close event subscription", log.WithError(err))
-			return false
-		}
+	if err := h.Stop(ctx); err != nil {
+		log.Error("failed when stopping event sinks", log.WithError(err))
+	}
 
-		return true
-	})
+	// flush the queued publishes while the broker still open, the later
+	// publishes are queued again
+	if !globalOutbox.Flush() {
+		log.Error("event broker unavailable, the queued publishes are lost")
+	}
+	SetDefault(nil)
 
 	log.Trace("closing the broker...")
 	// then close module
 	return h.module.Close(ctx)
 }
 
+// loadBroker instantiate the configured broker, it is composed with the
+// brokers of the routes when there is any
+func (h *Hook) loadBroker() (Broker, error) {
+	brokers := make(map[string]Broker)
+	get := func(name string) (Broker, error) {
+		if broker, ok := brokers[name]; ok {
+			return broker, nil
+		}
+
+		f, err := GetBroker(name)
+		if err != nil {
+			return nil, err
+		}
+
+		broker, ok := f().(Broker)
+		if !ok {
+			return nil, ErrEventModuleTypeInvalid
+		}
+		brokers[name] = broker
+		return broker, nil
+	}
+
+	fallback, err := get(h.conf.Broker)
+	if err != nil || len(h.conf.Routes) == 0 {
+		return fallback, err
+	}
+
+	routes := make([]BrokerRoute, 0, len(h.conf.Routes))
+	for _, r := range h.conf.Routes {
+		for _, topic := range r.Topics {
+			if err := ValidateTopicPattern(topic); err != nil {
+				return nil, fmt.Errorf("invalid route topic %q: %w", topic, err)
+			}
+		}
+
+		broker, err := get(r.Broker)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, BrokerRoute{Topics: r.Topics, Broker: broker})
+		log.Info("event topics routed", log.WithField("topics", r.Topics), log.WithField("broker", r.Broker))
+	}
+
+	return NewCompositeBroker(fallback, routes...), nil
+}
+
 func (h *Hook) ModuleLoaded(ctx context.Context, m api.Module) {}
 func (h *Hook) ModuleInitialized(ctx context.Context, m api.Module) {
 	if svc, ok := m.(EventService); ok {
@@ -97,9 +210,63 @@ func (h *Hook) ModuleInitialized(ctx context.Context, m api.Module) {
 	}
 }
 
+// Stop close the subscriptions of the sinks and wait for their running
+// handlers, so the modules no longer receive events while they are closed
+func (h *Hook) Stop(ctx context.Context) error {
+	// skip if disabled
+	if !h.conf.Enabled {
+		return nil
+	}
+
+	h.mu.Lock()
+	h.stopped = true
+	h.mu.Unlock()
+
+	h.subscriptions.Range(func(key, value interface{}) bool {
+		sub := value.(Subscription)
+		log.Trace("closing subscriber...", log.WithField("id", sub.ID()))
+		if err := sub.Close(); err != nil {
+			log.Error("failed when close event subscription", log.WithError(err))
+		}
+		h.subscriptions.Delete(key)
+
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		h.handling.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// track count the running handler of the sink, the messages received after
+// stopped are left unsettled
+func (h *Hook) track(handler MessageHandler) MessageHandler {
+	return MessageHandlerFunc(func(ctx context.Context, message Message) {
+		h.mu.Lock()
+		if h.stopped {
+			h.mu.Unlock()
+			return
+		}
+		h.handling.Add(1)
+		h.mu.Unlock()
+		defer h.handling.Done()
+
+		handler.HandleMessage(ctx, message)
+	})
+}
+
 func (h *Hook) Run(ctx context.Context) error {
 	for i, sink := range h.sinks {
-		sub := h.broker.SubscribeHandler(ctx, sink.Topic, sink.Handler)
+		sub := h.broker.SubscribeHandler(ctx, sink.Topic, h.track(sink.Handler), sink.Options...)
 		if err := sub.Error(); err != nil {
 			return err
 		}
@@ -0,0 +1,44 @@
+package event
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type (
+	// JSONCodec encode the envelope as a json object, it is readable by
+	// any other tools but number types are lost on decode
+	JSONCodec struct{}
+
+	jsonEnvelope struct {
+		ContentType string                 `json:"content_type"`
+		Name        string                 `json:"name,omitempty"`
+		Time        time.Time              `json:"time"`
+		Data        map[string]interface{} `json:"data,omitempty"`
+		Meta        map[string]interface{} `json:"meta,omitempty"`
+		Headers     map[string]string      `json:"headers,omitempty"`
+		Body        []byte                 `json:"body,omitempty"`
+	}
+)
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Marshal(e *Envelope) ([]byte, error) {
+	return json.Marshal(jsonEnvelope(*e))
+}
+
+func (JSONCodec) Unmarshal(b []byte, e *Envelope) error {
+	var j jsonEnvelope
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+
+	*e = Envelope(j)
+	return nil
+}
+
+func init() {
+	RegisterCodec(JSONCodec{})
+}
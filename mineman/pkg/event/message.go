@@ -9,7 +9,7 @@ import (
 )
 
 var (
-	ErrScanEventInvalidType  = errors.New("invalid type for scan event payload, only accept event descriptor")
+	ErrScanEventInvalidType  = errors.New("invalid type for scan event payload, only accept event descriptor or event payload")
 	ErrScanEventNameNotMatch = errors.New("invalid event name for scan event payload, only can marshal with matched name")
 	ErrScanStringInvalidType = errors.New("invalid type for scan string payload, only accept string ptr")
 )
@@ -19,12 +19,21 @@ type (
 		// Payload of the message
 		Payload
 		ID() string
+		// Topic where the message is published to, not the subscription pattern
+		Topic() string
+		// Deliveries is the number of delivery attempt of the message, starts from 1
+		Deliveries() int
+		// Headers is the metadata supplied by the publisher
+		Headers() map[string]string
 		// Ack will acknowledge the message and release the message
 		Ack(context.Context) <-chan error
 		// Progress will reserve the message for additional time
 		Progress(context.Context) <-chan error
 		// Nack will reschedule the message for current subscriber
 		Nack(context.Context) <-chan error
+		// Reply will answer the request message, it fails when the message
+		// isn't sent through Request
+		Reply(ctx context.Context, payload Payload, opts ...PublishConfigurator) <-chan error
 	}
 
 	scanOption struct {
@@ -80,6 +89,12 @@ func (p StringPayload) Scan(v interface{}, opts ...ScanOption) error {
 func (p *EventPayload) Scan(v interface{}, opts ...ScanOption) error {
 	opt := loadScanOption(opts...)
 
+	// copy the whole payload, so it can be decoded once and scanned later
+	if target, ok := v.(*EventPayload); ok {
+		*target = *p
+		return nil
+	}
+
 	ed, ok := v.(EventDescriptor)
 	if !ok {
 		return ErrScanEventInvalidType
@@ -0,0 +1,314 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+	"github.com/euiko/tooyoul/mineman/pkg/metrics"
+)
+
+// HeaderTraceID propagate the trace id from the publisher to the subscribers
+const HeaderTraceID = "x-trace-id"
+
+var (
+	ErrUnknownMiddleware = errors.New("unknown event middleware")
+)
+
+type (
+	// PublishFunc is the signature of Publisher.Publish
+	PublishFunc func(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) Publishing
+
+	// PublishMiddleware intercept every publish made through the hook
+	PublishMiddleware interface {
+		HandlePublish(next PublishFunc) PublishFunc
+	}
+
+	PublishMiddlewareFunc func(next PublishFunc) PublishFunc
+
+	// ConsumeMiddleware intercept every message handled by the handlers
+	// subscribed through the hook
+	ConsumeMiddleware interface {
+		Handle(h MessageHandler) MessageHandler
+	}
+
+	ConsumeMiddlewareFunc func(h MessageHandler) MessageHandler
+
+	// Validator check the payload of a topic, returning error rejects it
+	Validator func(topic string, payload Payload) error
+
+	// observedMessage notify the (n)acknowledgement of a message
+	observedMessage struct {
+		Message
+		onSettled func(acked bool)
+	}
+
+	traceContextKey struct{}
+)
+
+func (f PublishMiddlewareFunc) HandlePublish(next PublishFunc) PublishFunc {
+	return f(next)
+}
+
+func (f ConsumeMiddlewareFunc) Handle(h MessageHandler) MessageHandler {
+	return f(h)
+}
+
+func (m *observedMessage) Ack(ctx context.Context) <-chan error {
+	m.onSettled(true)
+	return m.Message.Ack(ctx)
+}
+
+func (m *observedMessage) Nack(ctx context.Context) <-chan error {
+	m.onSettled(false)
+	return m.Message.Nack(ctx)
+}
+
+// ChainPublish wrap the publish with the middlewares, the first
+// middleware is the outermost one
+func ChainPublish(publish PublishFunc, mws ...PublishMiddleware) PublishFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		publish = mws[i].HandlePublish(publish)
+	}
+
+	return publish
+}
+
+// ChainConsume wrap the handler with the middlewares, the first
+// middleware is the outermost one
+func ChainConsume(handler MessageHandler, mws ...ConsumeMiddleware) MessageHandler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		handler = mws[i].Handle(handler)
+	}
+
+	return handler
+}
+
+// Recover stop a panicking handler from taking down the process, the
+// message is acknowledged after the panic recorded, redelivering it would
+// only panic again
+func Recover() ConsumeMiddleware {
+	return ConsumeMiddlewareFunc(func(h MessageHandler) MessageHandler {
+		return MessageHandlerFunc(func(ctx context.Context, message Message) {
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+
+				log.Error("recovered from panic when handling event",
+					log.WithField("topic", message.Topic()),
+					log.WithField("id", message.ID()),
+					log.WithField("stack", string(debug.Stack())),
+					log.WithError(fmt.Errorf("%v", r)),
+				)
+				metrics.Default().Counter("event_consume_panics_total", "topic", message.Topic()).Inc()
+
+				if err := <-message.Ack(ctx); err != nil {
+					log.Error("error when acknowledge panicking event message", log.WithError(err))
+				}
+			}()
+
+			h.HandleMessage(ctx, message)
+		})
+	})
+}
+
+// PublishLogging log every publish along with its result
+func PublishLogging() PublishMiddleware {
+	return PublishMiddlewareFunc(func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) Publishing {
+			start := time.Now()
+			errChan := make(chan error, 1)
+			publishing := next(ctx, topic, payload, opts...)
+
+			go func() {
+				defer close(errChan)
+				err := <-publishing.Error()
+				fields := log.WithFields(map[string]interface{}{
+					"topic":    topic,
+					"duration": time.Since(start).String(),
+				})
+
+				if err != nil {
+					log.Error("failed when publishing event", fields, log.WithError(err))
+				} else {
+					log.Debug("event published", fields)
+				}
+				errChan <- err
+			}()
+
+			return NewPublishingChanForward(errChan)
+		}
+	})
+}
+
+// ConsumeLogging log every handled message along with its result
+func ConsumeLogging() ConsumeMiddleware {
+	return ConsumeMiddlewareFunc(func(h MessageHandler) MessageHandler {
+		return MessageHandlerFunc(func(ctx context.Context, message Message) {
+			start := time.Now()
+			result := "unsettled"
+			h.HandleMessage(ctx, &observedMessage{
+				Message: message,
+				onSettled: func(acked bool) {
+					result = "nack"
+					if acked {
+						result = "ack"
+					}
+				},
+			})
+
+			log.Debug("event handled", log.WithFields(map[string]interface{}{
+				"topic":      message.Topic(),
+				"id":         message.ID(),
+				"deliveries": message.Deliveries(),
+				"result":     result,
+				"duration":   time.Since(start).String(),
+			}))
+		})
+	})
+}
+
+// PublishMetrics count the publishes and their failures per topic
+func PublishMetrics(registry *metrics.Registry) PublishMiddleware {
+	return PublishMiddlewareFunc(func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) Publishing {
+			errChan := make(chan error, 1)
+			publishing := next(ctx, topic, payload, opts...)
+
+			go func() {
+				defer close(errChan)
+				err := <-publishing.Error()
+				registry.Counter("event_published_total", "topic", topic).Inc()
+				if err != nil {
+					registry.Counter("event_publish_errors_total", "topic", topic).Inc()
+				}
+				errChan <- err
+			}()
+
+			return NewPublishingChanForward(errChan)
+		}
+	})
+}
+
+// ConsumeMetrics count the handled messages by their result and measure
+// the handling duration per topic
+func ConsumeMetrics(registry *metrics.Registry) ConsumeMiddleware {
+	return ConsumeMiddlewareFunc(func(h MessageHandler) MessageHandler {
+		return MessageHandlerFunc(func(ctx context.Context, message Message) {
+			topic := message.Topic()
+			start := time.Now()
+
+			h.HandleMessage(ctx, &observedMessage{
+				Message: message,
+				onSettled: func(acked bool) {
+					if acked {
+						registry.Counter("event_acked_total", "topic", topic).Inc()
+					} else {
+						registry.Counter("event_nacked_total", "topic", topic).Inc()
+					}
+				},
+			})
+
+			registry.Counter("event_consumed_total", "topic", topic).Inc()
+			registry.Timer("event_consume_duration", "topic", topic).Since(start)
+		})
+	})
+}
+
+// PublishValidate reject the invalid payload before it is published
+func PublishValidate(validate Validator) PublishMiddleware {
+	return PublishMiddlewareFunc(func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) Publishing {
+			if err := validate(topic, payload); err != nil {
+				errChan := make(chan error, 1)
+				errChan <- err
+				close(errChan)
+				return NewPublishingChanForward(errChan)
+			}
+
+			return next(ctx, topic, payload, opts...)
+		}
+	})
+}
+
+// ConsumeValidate skip the handler of an invalid message, the message is
+// not acknowledged so it ends up in the dead letter topic
+func ConsumeValidate(validate Validator) ConsumeMiddleware {
+	return ConsumeMiddlewareFunc(func(h MessageHandler) MessageHandler {
+		return MessageHandlerFunc(func(ctx context.Context, message Message) {
+			if err := validate(message.Topic(), message); err != nil {
+				log.Warning("rejecting invalid event", log.WithField("topic", message.Topic()), log.WithError(err))
+				if err := <-message.Nack(ctx); err != nil {
+					log.Error("error when not acknowledge event message", log.WithError(err))
+				}
+				return
+			}
+
+			h.HandleMessage(ctx, message)
+		})
+	})
+}
+
+// PublishTrace attach the trace id of the context to the message headers,
+// a new trace id is made when the context doesn't have any
+func PublishTrace() PublishMiddleware {
+	return PublishMiddlewareFunc(func(next PublishFunc) PublishFunc {
+		return func(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) Publishing {
+			traceID := TraceIDFromContext(ctx)
+			if traceID == "" {
+				id, err := newCorrelationID()
+				if err != nil {
+					return next(ctx, topic, payload, opts...)
+				}
+				traceID = id
+			}
+
+			// keep the trace id supplied explicitly by the publisher
+			opts = append([]PublishConfigurator{WithHeader(HeaderTraceID, traceID)}, opts...)
+			return next(ContextWithTraceID(ctx, traceID), topic, payload, opts...)
+		}
+	})
+}
+
+// ConsumeTrace continue the trace of the publisher, so the publishes made
+// by the handler share the same trace id
+func ConsumeTrace() ConsumeMiddleware {
+	return ConsumeMiddlewareFunc(func(h MessageHandler) MessageHandler {
+		return MessageHandlerFunc(func(ctx context.Context, message Message) {
+			if traceID, ok := message.Headers()[HeaderTraceID]; ok {
+				ctx = ContextWithTraceID(ctx, traceID)
+			}
+
+			h.HandleMessage(ctx, message)
+		})
+	})
+}
+
+func ContextWithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, traceID)
+}
+
+func TraceIDFromContext(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceContextKey{}).(string)
+	return traceID
+}
+
+// builtinMiddlewares return the middlewares that can be enabled by name
+// through the hook config
+func builtinMiddlewares(name string) (PublishMiddleware, ConsumeMiddleware, error) {
+	switch name {
+	case "logging":
+		return PublishLogging(), ConsumeLogging(), nil
+	case "metrics":
+		return PublishMetrics(metrics.Default()), ConsumeMetrics(metrics.Default()), nil
+	case "trace":
+		return PublishTrace(), ConsumeTrace(), nil
+	default:
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnknownMiddleware, name)
+	}
+}
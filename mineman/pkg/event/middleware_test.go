@@ -0,0 +1,72 @@
+package event
+
+import (
+	"context"
+	"testing"
+
+	"github.com/euiko/tooyoul/mineman/pkg/metrics"
+)
+
+func TestConsumeMiddleware(t *testing.T) {
+	ctx := context.Background()
+	registry := metrics.NewRegistry()
+
+	order := []string{}
+	tag := func(name string) ConsumeMiddleware {
+		return ConsumeMiddlewareFunc(func(h MessageHandler) MessageHandler {
+			return MessageHandlerFunc(func(ctx context.Context, message Message) {
+				order = append(order, name)
+				h.HandleMessage(ctx, message)
+			})
+		})
+	}
+
+	handler := ChainConsume(MessageHandlerFunc(func(ctx context.Context, message Message) {
+		var payload string
+		message.Scan(&payload)
+		if payload == "panic" {
+			panic("handler failed")
+		}
+		message.Ack(ctx)
+	}), Recover(), ConsumeMetrics(registry), tag("first"), tag("second"))
+
+	ok := &testMessage{Payload: StringPayload("ok")}
+	handler.HandleMessage(ctx, ok)
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Errorf("expect middlewares applied in order, got %v", order)
+	}
+	if ok.acked != 1 {
+		t.Errorf("expect message acknowledged, got %d", ok.acked)
+	}
+
+	panicking := &testMessage{Payload: StringPayload("panic")}
+	handler.HandleMessage(ctx, panicking)
+	if panicking.acked != 1 || panicking.nacked != 0 {
+		t.Errorf("expect panicking message acknowledged once, got %d acks and %d nacks", panicking.acked, panicking.nacked)
+	}
+
+	if v := registry.Counter("event_consumed_total", "topic", "test").Value(); v != 1 {
+		t.Errorf("expect 1 consumed message before the panic, got %d", v)
+	}
+	if v := registry.Counter("event_acked_total", "topic", "test").Value(); v != 1 {
+		t.Errorf("expect 1 acked message, got %d", v)
+	}
+}
+
+func TestPublishTrace(t *testing.T) {
+	var headers map[string]string
+	publish := ChainPublish(func(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) Publishing {
+		headers = NewPublishOption(opts...).Headers
+		return NewPublishingChanForward(nil)
+	}, PublishTrace())
+
+	publish(ContextWithTraceID(context.Background(), "abc"), "test", StringPayload("ok"))
+	if headers[HeaderTraceID] != "abc" {
+		t.Errorf("expect trace id abc propagated, got %s", headers[HeaderTraceID])
+	}
+
+	publish(context.Background(), "test", StringPayload("ok"))
+	if headers[HeaderTraceID] == "" {
+		t.Error("expect new trace id made")
+	}
+}
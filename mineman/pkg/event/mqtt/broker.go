@@ -0,0 +1,724 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/app/api"
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+)
+
+const (
+	topicSeparator      = "/"
+	singleLevelWildcard = "+"
+	multiLevelWildcard  = "#"
+
+	// headerRetain mark the live update of a retained value, the server
+	// only set the retain flag when it replays the value to a new subscription
+	headerRetain = "x-mqtt-retain"
+)
+
+var (
+	ErrInvalidQoS     = errors.New("invalid mqtt qos, only 0 and 1 are supported")
+	ErrMessageSettled = errors.New("message already acknowledged or not acknowledged")
+)
+
+type (
+	Config struct {
+		// Address of the mqtt server, e.g. tcp://localhost:1883 or tls://broker.local:8883
+		Address         string `mapstructure:"address"`
+		ClientID        string `mapstructure:"client_id"`
+		Username        string `mapstructure:"username"`
+		Password        string `mapstructure:"password"`
+		ProtocolVersion byte   `mapstructure:"protocol_version"`
+		// QoS used for publish and subscribe, with qos 1 the server will
+		// redeliver unacknowledged messages when the session is kept
+		QoS          byte `mapstructure:"qos"`
+		CleanSession bool `mapstructure:"clean_session"`
+		// TopicPrefix is prepended to every topic, e.g. network.status-changed
+		// is mapped into mineman/network/status-changed
+		TopicPrefix          string        `mapstructure:"topic_prefix"`
+		KeepAlive            time.Duration `mapstructure:"keep_alive"`
+		ConnectTimeout       time.Duration `mapstructure:"connect_timeout"`
+		MaxReconnectInterval time.Duration `mapstructure:"max_reconnect_interval"`
+		SubBufferSize        int           `mapstructure:"sub_buffer_size"`
+		// MaxDeliveries limit the nack of a message before it moved to the
+		// dead letter topic, zero means unlimited
+		MaxDeliveries   int    `mapstructure:"max_deliveries"`
+		DeadLetterTopic string `mapstructure:"dead_letter_topic"`
+		// Codec used to encode the payloads, every rig on the same bus
+		// must use the same codec
+		Codec string `mapstructure:"codec"`
+		// DedupWindow is how long the idempotency keys are remembered, the
+		// duplicates are dropped by the publishing process only
+		DedupWindow time.Duration `mapstructure:"dedup_window"`
+	}
+
+	// Broker is an event broker backed by a mqtt 3.1.1/5 server, so the events
+	// can be shared between multiple processes or rigs
+	Broker struct {
+		config Config
+		codec  event.Codec
+		client *client
+		dedup  *event.Deduplicator
+		ctx    context.Context
+		cancel func()
+
+		mu          sync.Mutex
+		subs        map[string]*subscription
+		filters     map[string]int
+		groupCursor map[string]int
+
+		countersMu sync.Mutex
+		counters   map[string]int64
+
+		// retained keep the last retained value of each topic, so the local
+		// subscriptions that share a server filter also receive them
+		retainedMu sync.Mutex
+		retained   map[string]*retainedMsg
+	}
+
+	retainedMsg struct {
+		data    []byte
+		payload *event.RawPayload
+	}
+
+	Options interface {
+		Configure(b *Broker)
+	}
+
+	OptionsFunc func(b *Broker)
+)
+
+func (f OptionsFunc) Configure(b *Broker) {
+	f(b)
+}
+
+func (b *Broker) Init(ctx context.Context, c config.Config) error {
+	log.Trace("loading event mqtt config...")
+	if err := c.Get("mqtt").Scan(&b.config); err != nil {
+		return err
+	}
+
+	return b.Start(ctx)
+}
+
+// Start connect to the mqtt server, failing to connect doesn't return an
+// error since the client keep reconnecting in the background
+func (b *Broker) Start(ctx context.Context) error {
+	if b.config.ProtocolVersion != ProtocolV311 && b.config.ProtocolVersion != ProtocolV5 {
+		return ErrUnsupportedVersion
+	}
+	if b.config.QoS > 1 {
+		return ErrInvalidQoS
+	}
+
+	codec, err := event.GetCodec(b.config.Codec)
+	if err != nil {
+		return err
+	}
+	b.codec = codec
+	b.dedup = event.NewDeduplicator(b.config.DedupWindow)
+
+	b.ctx, b.cancel = context.WithCancel(ctx)
+	b.client = newClient(b.config, b.handlePublish, b.resubscribe)
+	b.client.start(b.ctx)
+
+	if err := b.client.waitConnected(ctx, b.config.ConnectTimeout); err != nil {
+		log.Warning("mqtt server is not reachable yet, keep retrying in background",
+			log.WithField("address", b.config.Address),
+			log.WithError(err),
+		)
+	}
+
+	return nil
+}
+
+func (b *Broker) Close(ctx context.Context) error {
+	b.mu.Lock()
+	subs := make([]*subscription, 0, len(b.subs))
+	for _, s := range b.subs {
+		subs = append(subs, s)
+	}
+	b.subs = make(map[string]*subscription)
+	b.filters = make(map[string]int)
+	b.mu.Unlock()
+
+	for _, s := range subs {
+		s.cancel()
+	}
+
+	err := b.client.close(ctx)
+	b.cancel()
+	return err
+}
+
+func (b *Broker) Publish(ctx context.Context, topic string, payload event.Payload, opts ...event.PublishConfigurator) event.Publishing {
+	errChan := make(chan error, 1)
+
+	if err := event.ValidateTopic(topic); err != nil {
+		errChan <- err
+		close(errChan)
+		return event.NewPublishingChanForward(errChan)
+	}
+
+	option := event.NewPublishOption(opts...)
+	if b.dedup.Duplicate(topic, option.IdempotencyKey(), time.Now()) {
+		log.Debug("dropping duplicated message", log.WithField("topic", topic), log.WithField("idempotency_key", option.IdempotencyKey()))
+		b.count("duplicates")
+		errChan <- nil
+		close(errChan)
+		return event.NewPublishingChanForward(errChan)
+	}
+
+	// the expiry travels as header, so the receivers can drop stale messages
+	headers := option.Headers
+	if !option.ExpiresAt.IsZero() || option.Retain {
+		headers = copyHeaders(option.Headers)
+	}
+	if !option.ExpiresAt.IsZero() {
+		headers[event.HeaderExpiresAt] = option.ExpiresAt.Format(time.RFC3339Nano)
+	}
+	if option.Retain {
+		headers[headerRetain] = "true"
+	}
+
+	data, err := event.EncodeWithHeaders(b.codec, payload, headers)
+	if err != nil {
+		b.dedup.Forget(topic, option.IdempotencyKey())
+		errChan <- err
+		close(errChan)
+		return event.NewPublishingChanForward(errChan)
+	}
+
+	// the delayed message is kept by the publisher, it is lost on close
+	if delay := time.Until(option.DeliverAt); delay > 0 {
+		go b.publishDelayed(topic, data, option, delay)
+		errChan <- nil
+		close(errChan)
+		return event.NewPublishingChanForward(errChan)
+	}
+
+	go func() {
+		defer close(errChan)
+		err := b.client.publish(ctx, b.toMQTTTopic(topic), data, b.config.QoS, option.Retain)
+		if err != nil {
+			// the publish may be retried, e.g. by the outbox
+			b.dedup.Forget(topic, option.IdempotencyKey())
+			b.count("publish_failed")
+		} else {
+			b.count("published")
+		}
+		errChan <- err
+	}()
+
+	return event.NewPublishingChanForward(errChan)
+}
+
+func (b *Broker) publishDelayed(topic string, data []byte, option *event.PublishOption, delay time.Duration) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-b.ctx.Done():
+		log.Warning("dropping delayed message on close", log.WithField("topic", topic))
+		return
+	case <-timer.C:
+	}
+
+	if option.Expired(time.Now()) {
+		log.Trace("dropping expired message", log.WithField("topic", topic))
+		return
+	}
+
+	if err := b.client.publish(b.ctx, b.toMQTTTopic(topic), data, b.config.QoS, option.Retain); err != nil {
+		log.Error("failed when publishing delayed message", log.WithField("topic", topic), log.WithError(err))
+	}
+}
+
+func (b *Broker) Subscribe(ctx context.Context, topic string, opts ...event.SubscribeConfigurator) event.SubscriptionMsg {
+	if err := event.ValidateTopicPattern(topic); err != nil {
+		return newSubscriptionErr(b, err)
+	}
+
+	s := newSubscription(ctx, b, topic, b.toMQTTTopic(topic), event.NewSubscribeOption(opts...))
+
+	b.mu.Lock()
+	b.subs[s.id] = s
+	b.filters[s.filter]++
+	first := b.filters[s.filter] == 1
+	b.mu.Unlock()
+
+	// the filter will be subscribed upon connected when it is offline now,
+	// the server replays the retained values of a new filter by itself
+	if first {
+		if err := b.client.subscribe(ctx, []string{s.filter}, b.config.QoS); err != nil && err != ErrNotConnected {
+			b.unsubscribe(s)
+			return newSubscriptionErr(b, err)
+		}
+	} else {
+		go b.deliverRetained(s)
+	}
+
+	// watch subscription cancelation to release it
+	go func() {
+		<-s.Done()
+		b.unsubscribe(s)
+	}()
+
+	return s
+}
+
+func (b *Broker) SubscribeHandler(ctx context.Context, topic string, handler event.MessageHandler, opts ...event.SubscribeConfigurator) event.Subscription {
+	subscription := b.Subscribe(ctx, topic, opts...)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-subscription.Done():
+				return
+			case msg := <-subscription.Message():
+				// msg nil due to closed chan, skip the loop
+				if msg == nil {
+					continue
+				}
+				handler.HandleMessage(ctx, msg)
+			}
+		}
+	}()
+
+	return subscription
+}
+
+func (b *Broker) unsubscribe(s *subscription) {
+	b.mu.Lock()
+	if _, ok := b.subs[s.id]; !ok {
+		b.mu.Unlock()
+		return
+	}
+
+	delete(b.subs, s.id)
+	b.filters[s.filter]--
+	last := b.filters[s.filter] == 0
+	if last {
+		delete(b.filters, s.filter)
+	}
+	b.mu.Unlock()
+
+	s.cancel()
+	if last {
+		if err := b.client.unsubscribe(b.ctx, []string{s.filter}); err != nil && err != ErrNotConnected {
+			log.Warning("failed when unsubscribing mqtt filter", log.WithField("filter", s.filter), log.WithError(err))
+		}
+	}
+}
+
+// resubscribe all the filters after (re)connected
+func (b *Broker) resubscribe(ctx context.Context) {
+	b.mu.Lock()
+	filters := make([]string, 0, len(b.filters))
+	for f := range b.filters {
+		filters = append(filters, f)
+	}
+	b.mu.Unlock()
+
+	if err := b.client.subscribe(ctx, filters, b.config.QoS); err != nil {
+		log.Error("failed when resubscribing mqtt filters", log.WithError(err))
+	}
+}
+
+// handlePublish dispatch incoming message to the matched subscriptions, the
+// message is acknowledged to the server after all of them acknowledged it
+func (b *Broker) handlePublish(p *publishPacket) {
+	ack := func() {
+		if p.qos == 0 {
+			return
+		}
+		if err := b.client.puback(p.id); err != nil {
+			log.Warning("failed when sending mqtt puback", log.WithError(err))
+		}
+	}
+
+	topic, ok := b.fromMQTTTopic(p.topic)
+	if !ok {
+		ack()
+		return
+	}
+	b.count("received")
+
+	// decode eagerly to drop the malformed messages before they are delivered
+	payload := event.Decode(b.codec, p.payload)
+	if _, err := payload.Decode(); err != nil {
+		log.Warning("dropping undecodable mqtt message", log.WithField("topic", topic), log.WithError(err))
+		ack()
+		return
+	}
+
+	if expired(payload.Headers(), time.Now()) {
+		log.Trace("dropping expired message", log.WithField("topic", topic))
+		b.count("expired")
+		ack()
+		return
+	}
+
+	retainedValue := p.retain || payload.Headers()[headerRetain] != ""
+	if retainedValue {
+		b.retain(topic, p.payload, payload)
+	}
+
+	var recipients []*subscription
+	if p.retain {
+		// the server replays the value for a new subscription
+		recipients = b.selectRetainedRecipients(topic, p.payload)
+	} else {
+		recipients = b.selectRecipients(topic)
+	}
+	if len(recipients) == 0 {
+		ack()
+		return
+	}
+
+	d := newDelivery(len(recipients), ack)
+	for _, s := range recipients {
+		msg := newMessage(s, topic, payload, d)
+		if retainedValue && s.option.Policy != event.WorkQueuePolicy {
+			s.markRetained(topic, p.payload)
+		}
+		if p.retain {
+			msg.headers = retainedHeaders(payload)
+		} else if retainedValue {
+			msg.headers = copyHeaders(payload.Headers())
+			delete(msg.headers, headerRetain)
+		}
+		s.enqueue(msg)
+	}
+}
+
+func (b *Broker) retain(topic string, data []byte, payload *event.RawPayload) {
+	b.retainedMu.Lock()
+	defer b.retainedMu.Unlock()
+
+	b.retained[topic] = &retainedMsg{
+		data:    data,
+		payload: payload,
+	}
+}
+
+// deliverRetained send the cached retained values to a new subscription
+// of a filter that already subscribed to the server
+func (b *Broker) deliverRetained(s *subscription) {
+	if s.option.Policy == event.WorkQueuePolicy {
+		return
+	}
+
+	now := time.Now()
+	b.retainedMu.Lock()
+	topics := []string{}
+	values := make(map[string]*retainedMsg)
+	for topic, r := range b.retained {
+		if expired(r.payload.Headers(), now) {
+			delete(b.retained, topic)
+			continue
+		}
+
+		if event.MatchTopic(s.pattern, topic) {
+			topics = append(topics, topic)
+			values[topic] = r
+		}
+	}
+	b.retainedMu.Unlock()
+	sort.Strings(topics)
+
+	for _, topic := range topics {
+		r := values[topic]
+		if s.seenRetained(topic, r.data) {
+			continue
+		}
+
+		s.markRetained(topic, r.data)
+		msg := newMessage(s, topic, r.payload, newDelivery(1, func() {}))
+		msg.headers = retainedHeaders(r.payload)
+		s.enqueue(msg)
+	}
+}
+
+// selectRetainedRecipients pick the fan out subscriptions that haven't
+// received the retained value yet
+func (b *Broker) selectRetainedRecipients(topic string, data []byte) []*subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	recipients := []*subscription{}
+	for _, s := range b.subs {
+		if s.option.Policy == event.WorkQueuePolicy || !event.MatchTopic(s.pattern, topic) {
+			continue
+		}
+
+		if !s.seenRetained(topic, data) {
+			recipients = append(recipients, s)
+		}
+	}
+	sortSubscriptions(recipients)
+
+	return recipients
+}
+
+// selectRecipients pick the subscriptions that will receive a message, fan out
+// subscriptions always receive it while each group only has one recipient
+func (b *Broker) selectRecipients(topic string) []*subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	recipients := []*subscription{}
+	groups := make(map[string][]*subscription)
+	groupOrder := []string{}
+
+	for _, s := range b.subs {
+		if !event.MatchTopic(s.pattern, topic) {
+			continue
+		}
+
+		if s.option.Policy != event.WorkQueuePolicy {
+			recipients = append(recipients, s)
+			continue
+		}
+
+		key := s.pattern + "\x00" + s.option.Group
+		if _, ok := groups[key]; !ok {
+			groupOrder = append(groupOrder, key)
+		}
+		groups[key] = append(groups[key], s)
+	}
+
+	for _, key := range groupOrder {
+		members := groups[key]
+		sortSubscriptions(members)
+		cursor := b.groupCursor[key] % len(members)
+		b.groupCursor[key] = cursor + 1
+		recipients = append(recipients, members[cursor])
+	}
+
+	return recipients
+}
+
+func (b *Broker) deadLetter(msg *message) {
+	fields := log.WithFields(map[string]interface{}{
+		"id":         msg.id,
+		"topic":      msg.topic,
+		"deliveries": msg.deliveries,
+	})
+
+	if b.config.DeadLetterTopic == "" || msg.topic == b.config.DeadLetterTopic {
+		log.Warning("message exceeds max deliveries, dropping it", fields)
+		b.count("dropped")
+		return
+	}
+	b.count("dead_lettered")
+
+	log.Warning("message exceeds max deliveries, moving it to the dead letter topic", fields,
+		log.WithField("dead_letter_topic", b.config.DeadLetterTopic),
+	)
+	// the message is no longer subject to its ttl
+	headers := copyHeaders(msg.Headers())
+	delete(headers, event.HeaderExpiresAt)
+	headers[event.HeaderOriginalTopic] = msg.topic
+
+	if err := <-b.Publish(b.ctx, b.config.DeadLetterTopic, msg.payload, event.WithHeaders(headers)).Error(); err != nil {
+		log.Error("failed when publish to the dead letter topic", log.WithError(err), fields)
+	}
+}
+
+// Stats report the local subscriptions, the messages kept by the server
+// aren't visible to the client
+func (b *Broker) Stats(ctx context.Context) (*event.Stats, error) {
+	b.mu.Lock()
+	subs := make([]*subscription, 0, len(b.subs))
+	for _, s := range b.subs {
+		subs = append(subs, s)
+	}
+	b.mu.Unlock()
+	sortSubscriptions(subs)
+
+	now := time.Now()
+	stats := event.Stats{
+		Broker:        "mqtt",
+		Subscriptions: make([]event.SubscriptionStats, len(subs)),
+		Counters:      make(map[string]int64),
+	}
+	for i, s := range subs {
+		inFlight, oldest := s.unackedStats(now)
+		stats.Subscriptions[i] = event.SubscriptionStats{
+			ID:            s.id,
+			Topic:         s.pattern,
+			Policy:        s.option.Policy.String(),
+			Group:         s.option.Group,
+			Buffered:      len(s.channel),
+			Capacity:      cap(s.channel),
+			InFlight:      inFlight,
+			Overflow:      s.option.Overflow.String(),
+			Dropped:       atomic.LoadInt64(&s.dropped),
+			OldestUnacked: oldest,
+		}
+		stats.InFlight += inFlight
+	}
+	event.SortSubscriptions(stats.Subscriptions)
+	stats.Topics = event.SummarizeTopics(stats.Subscriptions)
+
+	b.countersMu.Lock()
+	for k, v := range b.counters {
+		stats.Counters[k] = v
+	}
+	b.countersMu.Unlock()
+
+	b.retainedMu.Lock()
+	stats.Counters["retained"] = int64(len(b.retained))
+	b.retainedMu.Unlock()
+
+	stats.Counters["connected"] = 0
+	if b.client != nil && b.client.isConnected() {
+		stats.Counters["connected"] = 1
+	}
+
+	return &stats, nil
+}
+
+func (b *Broker) count(name string) {
+	b.countersMu.Lock()
+	b.counters[name]++
+	b.countersMu.Unlock()
+}
+
+// toMQTTTopic map event topic or pattern into mqtt topic or filter
+func (b *Broker) toMQTTTopic(topic string) string {
+	levels := event.SplitTopic(topic)
+	for i, level := range levels {
+		switch level {
+		case event.SingleLevelWildcard:
+			levels[i] = singleLevelWildcard
+		case event.MultiLevelWildcard:
+			levels[i] = multiLevelWildcard
+		}
+	}
+
+	if b.config.TopicPrefix != "" {
+		levels = append([]string{b.config.TopicPrefix}, levels...)
+	}
+
+	return strings.Join(levels, topicSeparator)
+}
+
+// fromMQTTTopic map mqtt topic into event topic, it returns false when the
+// topic doesn't have the configured prefix
+func (b *Broker) fromMQTTTopic(topic string) (string, bool) {
+	if b.config.TopicPrefix != "" {
+		prefix := b.config.TopicPrefix + topicSeparator
+		if !strings.HasPrefix(topic, prefix) {
+			return "", false
+		}
+		topic = strings.TrimPrefix(topic, prefix)
+	}
+
+	return strings.Join(strings.Split(topic, topicSeparator), event.TopicSeparator), true
+}
+
+// expired check the expiry header of a received message
+func expired(headers map[string]string, now time.Time) bool {
+	value, ok := headers[event.HeaderExpiresAt]
+	if !ok {
+		return false
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return false
+	}
+
+	return !now.Before(expiresAt)
+}
+
+// retainedHeaders mark the message delivered from the retained value
+func retainedHeaders(payload *event.RawPayload) map[string]string {
+	headers := copyHeaders(payload.Headers())
+	delete(headers, headerRetain)
+	headers[event.HeaderRetained] = "true"
+	return headers
+}
+
+func copyHeaders(headers map[string]string) map[string]string {
+	copied := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		copied[k] = v
+	}
+	return copied
+}
+
+func WithConfig(config Config) OptionsFunc {
+	return OptionsFunc(func(b *Broker) {
+		b.config = config
+	})
+}
+
+func defaultClientID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	return fmt.Sprintf("mineman-%s", hostname)
+}
+
+func New(opts ...Options) *Broker {
+	broker := Broker{
+		config: Config{
+			Address:              "tcp://localhost:1883",
+			ClientID:             defaultClientID(),
+			ProtocolVersion:      ProtocolV311,
+			QoS:                  1,
+			CleanSession:         true,
+			TopicPrefix:          "mineman",
+			KeepAlive:            time.Second * 30,
+			ConnectTimeout:       time.Second * 10,
+			MaxReconnectInterval: time.Second * 30,
+			SubBufferSize:        16,
+			MaxDeliveries:        5,
+			DeadLetterTopic:      "event.dead-letter",
+			Codec:                event.DefaultCodec,
+			DedupWindow:          time.Minute,
+		},
+		subs:        make(map[string]*subscription),
+		filters:     make(map[string]int),
+		groupCursor: make(map[string]int),
+		counters:    make(map[string]int64),
+		retained:    make(map[string]*retainedMsg),
+	}
+
+	for _, o := range opts {
+		o.Configure(&broker)
+	}
+
+	return &broker
+}
+
+// newEventBroker return the event's Broker interface, to help
+// static check whether our implementation comply with the interface
+func newEventBroker() event.Broker {
+	return New()
+}
+
+func newModule() api.Module {
+	return newEventBroker()
+}
+
+func init() {
+	event.RegisterBroker("mqtt", newModule)
+}
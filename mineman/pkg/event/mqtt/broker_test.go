@@ -0,0 +1,454 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+)
+
+type (
+	// fakeServer is a tiny mqtt server that route publishes to the
+	// subscribed connections, enough to exercise the broker
+	fakeServer struct {
+		listener net.Listener
+
+		mu       sync.Mutex
+		clients  map[net.Conn]*fakeClient
+		retained map[string]*publishPacket
+	}
+
+	fakeClient struct {
+		mu      sync.Mutex
+		conn    net.Conn
+		version byte
+		filters map[string]bool
+		nextID  uint16
+	}
+)
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	pkt, err := readPacket(reader)
+	if err != nil || pkt.kind != connectType {
+		return
+	}
+
+	connect, err := decodeConnect(pkt.body)
+	if err != nil {
+		return
+	}
+
+	c := &fakeClient{conn: conn, version: connect.version, filters: make(map[string]bool)}
+	connack := connackPacket{}
+	if err := c.write(connackType, 0, connack.encode(c.version)); err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.clients[conn] = c
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, conn)
+		s.mu.Unlock()
+	}()
+
+	for {
+		pkt, err := readPacket(reader)
+		if err != nil {
+			return
+		}
+
+		switch pkt.kind {
+		case publishType:
+			p, err := decodePublish(pkt, c.version)
+			if err != nil {
+				return
+			}
+			if p.qos > 0 {
+				ack := ackPacket{id: p.id}
+				c.write(pubackType, 0, ack.encode(pubackType, c.version))
+			}
+			if p.retain {
+				s.mu.Lock()
+				s.retained[p.topic] = p
+				s.mu.Unlock()
+			}
+			s.route(p)
+		case subscribeType, unsubscribeType:
+			p, err := decodeSubscribe(pkt.body, c.version, pkt.kind == subscribeType)
+			if err != nil {
+				return
+			}
+
+			c.mu.Lock()
+			for _, f := range p.filters {
+				c.filters[f] = pkt.kind == subscribeType
+			}
+			c.mu.Unlock()
+
+			ack := ackPacket{id: p.id, codes: make([]byte, len(p.filters))}
+			copy(ack.codes, p.qos)
+			if pkt.kind == subscribeType {
+				c.write(subackType, 0, ack.encode(subackType, c.version))
+				s.replayRetained(c, p.filters)
+			} else {
+				c.write(unsubackType, 0, ack.encode(unsubackType, c.version))
+			}
+		case pingreqType:
+			c.write(pingrespType, 0, nil)
+		case disconnectType:
+			return
+		}
+	}
+}
+
+func (s *fakeServer) route(p *publishPacket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.clients {
+		c.mu.Lock()
+		matched := false
+		for f, active := range c.filters {
+			if active && matchFilter(f, p.topic) {
+				matched = true
+				break
+			}
+		}
+		c.nextID++
+		id := c.nextID
+		c.mu.Unlock()
+
+		if matched {
+			out := publishPacket{id: id, topic: p.topic, qos: p.qos, payload: p.payload}
+			c.write(publishType, out.flags(), out.encode(c.version))
+		}
+	}
+}
+
+// replayRetained send the retained messages matching the new filters with
+// the retain flag set
+func (s *fakeServer) replayRetained(c *fakeClient, filters []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for topic, p := range s.retained {
+		for _, f := range filters {
+			if !matchFilter(f, topic) {
+				continue
+			}
+
+			c.mu.Lock()
+			c.nextID++
+			out := publishPacket{id: c.nextID, topic: topic, qos: p.qos, retain: true, payload: p.payload}
+			c.mu.Unlock()
+			c.write(publishType, out.flags(), out.encode(c.version))
+			break
+		}
+	}
+}
+
+func (s *fakeServer) close() {
+	s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.clients {
+		conn.Close()
+	}
+}
+
+func (c *fakeClient) write(kind byte, flags byte, body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return writePacket(c.conn, kind, flags, body)
+}
+
+func matchFilter(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, topicSeparator)
+	topicLevels := strings.Split(topic, topicSeparator)
+
+	for i, level := range filterLevels {
+		if level == multiLevelWildcard {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != singleLevelWildcard && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeServer{
+		listener: listener,
+		clients:  make(map[net.Conn]*fakeClient),
+		retained: make(map[string]*publishPacket),
+	}
+	go s.serve()
+	return s
+}
+
+func newTestBroker(t *testing.T, ctx context.Context, server *fakeServer, clientID string, version byte) *Broker {
+	b := New(WithConfig(Config{
+		Address:              "tcp://" + server.listener.Addr().String(),
+		ClientID:             clientID,
+		ProtocolVersion:      version,
+		QoS:                  1,
+		CleanSession:         true,
+		TopicPrefix:          "mineman",
+		KeepAlive:            time.Second * 30,
+		ConnectTimeout:       time.Second,
+		MaxReconnectInterval: time.Second,
+		SubBufferSize:        16,
+		MaxDeliveries:        2,
+		DeadLetterTopic:      "event.dead-letter",
+		Codec:                "binary",
+	}))
+	if err := b.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close(context.Background()) })
+	return b
+}
+
+func receive(t *testing.T, sub event.SubscriptionMsg) event.Message {
+	select {
+	case msg := <-sub.Message():
+		return msg
+	case <-time.After(time.Second * 2):
+		t.Fatal("expect receiving a message")
+	}
+	return nil
+}
+
+func TestPubSub(t *testing.T) {
+	for _, version := range []byte{ProtocolV311, ProtocolV5} {
+		version := version
+		t.Run("v"+string('0'+version), func(t *testing.T) {
+			ctx := context.Background()
+			server := newFakeServer(t)
+			defer server.close()
+
+			publisher := newTestBroker(t, ctx, server, "publisher", version)
+			consumer := newTestBroker(t, ctx, server, "consumer", version)
+
+			wildcard := consumer.Subscribe(ctx, "miner.*")
+			if err := wildcard.Error(); err != nil {
+				t.Fatal(err)
+			}
+			exact := consumer.Subscribe(ctx, "miner.started")
+
+			if err := <-publisher.Publish(ctx, "miner.started", event.StringPayload("hello")).Error(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, sub := range []event.SubscriptionMsg{wildcard, exact} {
+				msg := receive(t, sub)
+				var payload string
+				if err := msg.Scan(&payload); err != nil {
+					t.Fatal(err)
+				}
+				if payload != "hello" {
+					t.Fatalf("expect payload hello, got %s", payload)
+				}
+				if err := <-msg.Ack(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// unsubscribed topic must not be received
+			exact.Close()
+			if err := <-publisher.Publish(ctx, "miner.stopped", event.StringPayload("bye")).Error(); err != nil {
+				t.Fatal(err)
+			}
+			msg := receive(t, wildcard)
+			var payload string
+			msg.Scan(&payload)
+			if payload != "bye" {
+				t.Fatalf("expect payload bye, got %s", payload)
+			}
+			msg.Ack(ctx)
+		})
+	}
+}
+
+func TestNackDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeServer(t)
+	defer server.close()
+
+	broker := newTestBroker(t, ctx, server, "nack", ProtocolV311)
+	sub := broker.Subscribe(ctx, "network.status-changed")
+	deadLetter := broker.Subscribe(ctx, "event.dead-letter")
+
+	if err := <-broker.Publish(ctx, "network.status-changed", event.StringPayload("down")).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		msg := receive(t, sub)
+		if msg.Deliveries() != i {
+			t.Fatalf("expect delivery %d, got %d", i, msg.Deliveries())
+		}
+		if err := <-msg.Nack(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg := receive(t, deadLetter)
+	var payload string
+	msg.Scan(&payload)
+	if payload != "down" {
+		t.Fatalf("expect dead letter payload down, got %s", payload)
+	}
+	msg.Ack(ctx)
+}
+
+func TestRetained(t *testing.T) {
+	ctx := context.Background()
+	server := newFakeServer(t)
+	defer server.close()
+
+	publisher := newTestBroker(t, ctx, server, "publisher", ProtocolV5)
+	consumer := newTestBroker(t, ctx, server, "consumer", ProtocolV5)
+
+	if err := <-publisher.Publish(ctx, "miner.status-changed", event.StringPayload("running"), event.Retain()).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectRetained := func(sub event.SubscriptionMsg) {
+		msg := receive(t, sub)
+		var payload string
+		msg.Scan(&payload)
+		if payload != "running" {
+			t.Fatalf("expect retained payload running, got %s", payload)
+		}
+		if msg.Headers()[event.HeaderRetained] != "true" {
+			t.Errorf("expect retained header, got %v", msg.Headers())
+		}
+		msg.Ack(ctx)
+	}
+	expectNothing := func(sub event.SubscriptionMsg) {
+		select {
+		case msg := <-sub.Message():
+			var payload string
+			msg.Scan(&payload)
+			t.Fatalf("expect no duplicate of the retained value, got %s", payload)
+		case <-time.After(time.Millisecond * 200):
+		}
+	}
+
+	// replayed by the server for the new filter
+	first := consumer.Subscribe(ctx, "miner.*")
+	expectRetained(first)
+
+	// the filter is already subscribed, so it comes from the local cache
+	second := consumer.Subscribe(ctx, "miner.*")
+	expectRetained(second)
+	expectNothing(first)
+
+	// the server replay for another filter must not be delivered twice
+	exact := consumer.Subscribe(ctx, "miner.status-changed")
+	expectRetained(exact)
+	expectNothing(first)
+	expectNothing(second)
+}
+
+func TestTopicMapping(t *testing.T) {
+	b := New()
+	cases := map[string]string{
+		"network.status-changed": "mineman/network/status-changed",
+		"miner.*":                "mineman/miner/+",
+		"#":                      "mineman/#",
+	}
+
+	for topic, expected := range cases {
+		if got := b.toMQTTTopic(topic); got != expected {
+			t.Errorf("expect %s mapped into %s, got %s", topic, expected, got)
+		}
+	}
+
+	if topic, ok := b.fromMQTTTopic("mineman/network/status-changed"); !ok || topic != "network.status-changed" {
+		t.Errorf("expect network.status-changed, got %s", topic)
+	}
+	if _, ok := b.fromMQTTTopic("other/network"); ok {
+		t.Error("expect topic outside of the prefix rejected")
+	}
+}
+
+func TestHandlerPublishSlowSubscriber(t *testing.T) {
+	const total = 40
+
+	ctx := context.Background()
+	server := newFakeServer(t)
+	defer server.close()
+
+	broker := newTestBroker(t, ctx, server, "handler", ProtocolV311)
+
+	// never read, its buffer is full after the first replies
+	slow := broker.Subscribe(ctx, "job.done")
+	if err := slow.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan struct{}, total)
+	broker.SubscribeHandler(ctx, "job.started", event.MessageHandlerFunc(func(ctx context.Context, msg event.Message) {
+		if err := <-broker.Publish(ctx, "job.done", event.StringPayload(msg.ID())).Error(); err != nil {
+			t.Errorf("expect the reply published, got %s", err)
+		}
+		msg.Ack(ctx)
+		handled <- struct{}{}
+	}))
+
+	for i := 0; i < total; i++ {
+		if err := <-broker.Publish(ctx, "job.started", event.StringPayload(strconv.Itoa(i))).Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < total; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second * 2):
+			t.Fatalf("expect the handler keep publishing, only %d handled", i)
+		}
+	}
+
+	stats, err := broker.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Counters["dropped_rejected"] == 0 {
+		t.Errorf("expect the replies rejected for the slow subscriber, got %v", stats.Counters)
+	}
+}
@@ -0,0 +1,438 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+)
+
+var (
+	// ErrNotConnected wraps event.ErrBrokerUnavailable, so the publishes are
+	// queued in the outbox until the connection is back
+	ErrNotConnected      = fmt.Errorf("mqtt client is not connected: %w", event.ErrBrokerUnavailable)
+	ErrConnectionRefused = errors.New("mqtt connection refused by the server")
+	ErrSubscribeRejected = errors.New("mqtt subscription rejected by the server")
+	ErrPublishRejected   = errors.New("mqtt publish rejected by the server")
+	ErrClientClosed      = errors.New("mqtt client already closed")
+)
+
+type (
+	// client maintain a single connection to the mqtt server, it reconnects
+	// with exponential backoff whenever the connection is lost
+	client struct {
+		config    Config
+		onPublish func(p *publishPacket)
+		onConnect func(ctx context.Context)
+
+		mu        sync.Mutex
+		conn      net.Conn
+		connected chan struct{}
+		nextID    uint16
+		pending   map[uint16]chan *ackPacket
+
+		ctx    context.Context
+		cancel func()
+		done   chan struct{}
+	}
+)
+
+func (c *client) start(ctx context.Context) {
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.done = make(chan struct{})
+	go c.run(c.ctx)
+}
+
+// waitConnected block until the client is connected or the timeout reached
+func (c *client) waitConnected(ctx context.Context, timeout time.Duration) error {
+	c.mu.Lock()
+	connected := c.connected
+	c.mu.Unlock()
+
+	select {
+	case <-connected:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(timeout):
+		return ErrNotConnected
+	}
+}
+
+func (c *client) isConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn != nil
+}
+
+func (c *client) close(ctx context.Context) error {
+	if c.cancel == nil {
+		return ErrClientClosed
+	}
+
+	// disconnect gracefully, so the server doesn't publish the will message
+	if err := c.send(disconnectType, 0, nil); err != nil && err != ErrNotConnected {
+		log.Warning("failed when sending mqtt disconnect", log.WithError(err))
+	}
+
+	c.cancel()
+	c.mu.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *client) run(ctx context.Context) {
+	defer close(c.done)
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = time.Second
+	b.MaxInterval = c.config.MaxReconnectInterval
+	b.MaxElapsedTime = 0
+	b.Reset()
+
+	for {
+		conn, err := c.connect(ctx)
+		if err == nil {
+			b.Reset()
+			c.serve(ctx, conn)
+		} else {
+			log.Warning("failed when connecting to mqtt server",
+				log.WithField("address", c.config.Address),
+				log.WithError(err),
+			)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(b.NextBackOff()):
+		}
+	}
+}
+
+func (c *client) connect(ctx context.Context) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.ConnectTimeout)
+	defer cancel()
+
+	network, address, useTLS := parseAddress(c.config.Address)
+	dialer := net.Dialer{}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if useTLS {
+		tlsDialer := tls.Dialer{NetDialer: &dialer}
+		conn, err = tlsDialer.DialContext(ctx, network, address)
+	} else {
+		conn, err = dialer.DialContext(ctx, network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	connect := connectPacket{
+		version:      c.config.ProtocolVersion,
+		clientID:     c.config.ClientID,
+		username:     c.config.Username,
+		password:     c.config.Password,
+		keepAlive:    uint16(c.config.KeepAlive / time.Second),
+		cleanSession: c.config.CleanSession,
+	}
+	if err := writePacket(conn, connectType, 0, connect.encode()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	pkt, err := readPacket(bufio.NewReader(conn))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if pkt.kind != connackType {
+		conn.Close()
+		return nil, ErrUnexpectedPacket
+	}
+
+	connack, err := decodeConnack(pkt.body, c.config.ProtocolVersion)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if connack.code != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("%w, reason code %d", ErrConnectionRefused, connack.code)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// serve read the incoming packets till the connection is lost
+func (c *client) serve(ctx context.Context, conn net.Conn) {
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c.mu.Lock()
+	c.conn = conn
+	close(c.connected)
+	c.mu.Unlock()
+
+	log.Info("connected to mqtt server", log.WithField("address", c.config.Address))
+
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.connected = make(chan struct{})
+		for id, ack := range c.pending {
+			close(ack)
+			delete(c.pending, id)
+		}
+		c.mu.Unlock()
+		conn.Close()
+	}()
+
+	go c.keepAlive(connCtx)
+	if c.onConnect != nil {
+		go c.onConnect(connCtx)
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		pkt, err := readPacket(reader)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			default:
+				log.Warning("mqtt connection lost", log.WithError(err))
+			}
+			return
+		}
+
+		switch pkt.kind {
+		case publishType:
+			p, err := decodePublish(pkt, c.config.ProtocolVersion)
+			if err != nil {
+				log.Warning("skipping malformed mqtt publish", log.WithError(err))
+				continue
+			}
+			c.onPublish(p)
+		case pubackType, subackType, unsubackType:
+			ack, err := decodeAck(pkt.body, pkt.kind, c.config.ProtocolVersion)
+			if err != nil {
+				log.Warning("skipping malformed mqtt ack", log.WithError(err))
+				continue
+			}
+			c.resolve(ack)
+		case pingrespType:
+			// do nothing, keep alive is satisfied by any read
+		case disconnectType:
+			log.Warning("mqtt server closed the connection")
+			return
+		}
+	}
+}
+
+func (c *client) keepAlive(ctx context.Context) {
+	if c.config.KeepAlive <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.config.KeepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.send(pingreqType, 0, nil); err != nil {
+				log.Trace("failed when sending mqtt ping", log.WithError(err))
+			}
+		}
+	}
+}
+
+func (c *client) send(kind byte, flags byte, body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.sendLocked(kind, flags, body)
+}
+
+func (c *client) sendLocked(kind byte, flags byte, body []byte) error {
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.config.ConnectTimeout))
+	return writePacket(c.conn, kind, flags, body)
+}
+
+// request send a packet that need to be acknowledged by the server, and
+// wait for its acknowledgement
+func (c *client) request(ctx context.Context, kind byte, flags byte, encode func(id uint16) []byte) (*ackPacket, error) {
+	ackChan := make(chan *ackPacket, 1)
+
+	c.mu.Lock()
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	id := c.nextID
+	c.pending[id] = ackChan
+
+	if err := c.sendLocked(kind, flags, encode(id)); err != nil {
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.mu.Unlock()
+
+	select {
+	case ack, ok := <-ackChan:
+		if !ok {
+			return nil, ErrNotConnected
+		}
+		return ack, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *client) resolve(ack *ackPacket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ackChan, ok := c.pending[ack.id]; ok {
+		ackChan <- ack
+		close(ackChan)
+		delete(c.pending, ack.id)
+	}
+}
+
+func (c *client) publish(ctx context.Context, topic string, payload []byte, qos byte, retain bool) error {
+	p := publishPacket{
+		topic:   topic,
+		qos:     qos,
+		retain:  retain,
+		payload: payload,
+	}
+
+	if qos == 0 {
+		return c.send(publishType, p.flags(), p.encode(c.config.ProtocolVersion))
+	}
+
+	ack, err := c.request(ctx, publishType, p.flags(), func(id uint16) []byte {
+		p.id = id
+		return p.encode(c.config.ProtocolVersion)
+	})
+	if err != nil {
+		return err
+	}
+
+	// only mqtt 5 has reason code, 0x10 means success without matching subscribers
+	if len(ack.codes) > 0 && ack.codes[0] >= 0x80 {
+		return fmt.Errorf("%w, reason code %d", ErrPublishRejected, ack.codes[0])
+	}
+
+	return nil
+}
+
+func (c *client) puback(id uint16) error {
+	ack := ackPacket{id: id}
+	return c.send(pubackType, 0, ack.encode(pubackType, c.config.ProtocolVersion))
+}
+
+func (c *client) subscribe(ctx context.Context, filters []string, qos byte) error {
+	if len(filters) == 0 {
+		return nil
+	}
+
+	p := subscribePacket{
+		filters: filters,
+		qos:     make([]byte, len(filters)),
+	}
+	for i := range p.qos {
+		p.qos[i] = qos
+	}
+
+	ack, err := c.request(ctx, subscribeType, 0x02, func(id uint16) []byte {
+		p.id = id
+		return p.encode(c.config.ProtocolVersion)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, code := range ack.codes {
+		if code >= 0x80 {
+			return fmt.Errorf("%w, filter %s with reason code %d", ErrSubscribeRejected, filters[i], code)
+		}
+	}
+
+	return nil
+}
+
+func (c *client) unsubscribe(ctx context.Context, filters []string) error {
+	p := subscribePacket{filters: filters}
+	_, err := c.request(ctx, unsubscribeType, 0x02, func(id uint16) []byte {
+		p.id = id
+		return p.encode(c.config.ProtocolVersion)
+	})
+	return err
+}
+
+// parseAddress parse the server address with optional scheme, e.g.
+// tcp://localhost:1883 or tls://broker.local:8883
+func parseAddress(address string) (network string, host string, useTLS bool) {
+	network, host = "tcp", address
+	for _, scheme := range []string{"tcp://", "mqtt://"} {
+		if strings.HasPrefix(address, scheme) {
+			return network, strings.TrimPrefix(address, scheme), false
+		}
+	}
+
+	for _, scheme := range []string{"tls://", "ssl://", "mqtts://"} {
+		if strings.HasPrefix(address, scheme) {
+			return network, strings.TrimPrefix(address, scheme), true
+		}
+	}
+
+	return network, host, false
+}
+
+func newClient(config Config, onPublish func(p *publishPacket), onConnect func(ctx context.Context)) *client {
+	return &client{
+		config:    config,
+		onPublish: onPublish,
+		onConnect: onConnect,
+		connected: make(chan struct{}),
+		pending:   make(map[uint16]chan *ackPacket),
+	}
+}
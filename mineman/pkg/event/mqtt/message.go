@@ -0,0 +1,170 @@
+package mqtt
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+)
+
+type (
+	message struct {
+		id           string
+		subscription *subscription
+		topic        string
+		payload      event.Payload
+		deliveries   int
+		delivery     *delivery
+		// headers override the envelope headers, e.g. for retained values
+		headers map[string]string
+
+		settled int32
+	}
+
+	// delivery track the local recipients of a single mqtt publish, the server
+	// is acknowledged after all of them settled the message
+	delivery struct {
+		remaining int32
+		once      sync.Once
+		ack       func()
+	}
+)
+
+func (d *delivery) done() {
+	if atomic.AddInt32(&d.remaining, -1) <= 0 {
+		d.once.Do(d.ack)
+	}
+}
+
+func (m *message) Scan(v interface{}, opts ...event.ScanOption) error {
+	return m.payload.Scan(v, opts...)
+}
+
+func (m *message) ID() string {
+	return m.id
+}
+
+func (m *message) Topic() string {
+	return m.topic
+}
+
+func (m *message) Deliveries() int {
+	return m.deliveries
+}
+
+// Headers return the headers carried by the envelope
+func (m *message) Headers() map[string]string {
+	if m.headers != nil {
+		return m.headers
+	}
+
+	if raw, ok := m.payload.(*event.RawPayload); ok {
+		return raw.Headers()
+	}
+
+	return nil
+}
+
+// Ack will acknowledge the message and release the message
+func (m *message) Ack(ctx context.Context) <-chan error {
+	errChan := make(chan error, 1)
+	defer close(errChan)
+
+	if !m.settle() {
+		errChan <- ErrMessageSettled
+		return errChan
+	}
+
+	m.subscription.untrack(m.id)
+	m.subscription.broker.count("acked")
+	m.delivery.done()
+	errChan <- nil
+	return errChan
+}
+
+// Progress does nothing, the mqtt server doesn't have acknowledgement deadline
+func (m *message) Progress(ctx context.Context) <-chan error {
+	errChan := make(chan error, 1)
+	defer close(errChan)
+
+	errChan <- nil
+	return errChan
+}
+
+// Nack will redeliver the message to the current subscriber, the message is
+// moved to the dead letter topic after reaching the max deliveries
+func (m *message) Nack(ctx context.Context) <-chan error {
+	errChan := make(chan error, 1)
+
+	if !m.settle() {
+		errChan <- ErrMessageSettled
+		close(errChan)
+		return errChan
+	}
+
+	broker := m.subscription.broker
+	broker.count("nacked")
+
+	// stale message is released instead of redelivered
+	if expired(m.Headers(), time.Now()) {
+		m.subscription.untrack(m.id)
+		broker.count("expired")
+		m.delivery.done()
+		errChan <- nil
+		close(errChan)
+		return errChan
+	}
+
+	if broker.config.MaxDeliveries > 0 && m.deliveries >= broker.config.MaxDeliveries {
+		m.subscription.untrack(m.id)
+		go func() {
+			defer close(errChan)
+			broker.deadLetter(m)
+			m.delivery.done()
+			errChan <- nil
+		}()
+		return errChan
+	}
+
+	redelivered := newMessage(m.subscription, m.topic, m.payload, m.delivery)
+	redelivered.id = m.id
+	redelivered.headers = m.headers
+	redelivered.deliveries = m.deliveries + 1
+	m.subscription.enqueue(redelivered)
+
+	errChan <- nil
+	close(errChan)
+	return errChan
+}
+
+// Reply will publish the payload to the reply topic of the request
+func (m *message) Reply(ctx context.Context, payload event.Payload, opts ...event.PublishConfigurator) <-chan error {
+	return event.ReplyWith(ctx, m.subscription.broker, m, payload, opts...).Error()
+}
+
+// settle mark the message as acknowledged or not acknowledged, it returns
+// false when it is already settled
+func (m *message) settle() bool {
+	return atomic.CompareAndSwapInt32(&m.settled, 0, 1)
+}
+
+func newDelivery(recipients int, ack func()) *delivery {
+	return &delivery{
+		remaining: int32(recipients),
+		ack:       ack,
+	}
+}
+
+func newMessage(s *subscription, topic string, payload event.Payload, d *delivery) *message {
+	return &message{
+		id:           strconv.FormatInt(atomic.AddInt64(&globalNumber, 1), 10),
+		subscription: s,
+		topic:        topic,
+		payload:      payload,
+		deliveries:   1,
+		delivery:     d,
+	}
+}
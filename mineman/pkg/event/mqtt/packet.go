@@ -0,0 +1,493 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// control packet types
+const (
+	connectType     byte = 1
+	connackType     byte = 2
+	publishType     byte = 3
+	pubackType      byte = 4
+	subscribeType   byte = 8
+	subackType      byte = 9
+	unsubscribeType byte = 10
+	unsubackType    byte = 11
+	pingreqType     byte = 12
+	pingrespType    byte = 13
+	disconnectType  byte = 14
+)
+
+// supported protocol levels
+const (
+	ProtocolV311 byte = 4
+	ProtocolV5   byte = 5
+)
+
+const maxRemainingLength = 268435455
+
+var (
+	ErrMalformedPacket    = errors.New("malformed mqtt packet")
+	ErrPacketTooLarge     = errors.New("mqtt packet exceeds maximum remaining length")
+	ErrUnexpectedPacket   = errors.New("unexpected mqtt packet")
+	ErrUnsupportedVersion = errors.New("unsupported mqtt protocol version, only 4 (3.1.1) and 5 are supported")
+)
+
+type (
+	// packet is the raw control packet, the variable header and payload
+	// are decoded by the specific packet type
+	packet struct {
+		kind  byte
+		flags byte
+		body  []byte
+	}
+
+	connectPacket struct {
+		version      byte
+		clientID     string
+		username     string
+		password     string
+		keepAlive    uint16
+		cleanSession bool
+	}
+
+	connackPacket struct {
+		sessionPresent bool
+		code           byte
+	}
+
+	publishPacket struct {
+		id      uint16
+		topic   string
+		qos     byte
+		retain  bool
+		dup     bool
+		payload []byte
+	}
+
+	subscribePacket struct {
+		id      uint16
+		filters []string
+		qos     []byte
+	}
+
+	// ackPacket is used for puback, suback, unsubscribe and unsuback
+	// that only differ in their type and payload
+	ackPacket struct {
+		id    uint16
+		codes []byte
+	}
+
+	packetWriter struct {
+		bytes.Buffer
+	}
+
+	packetReader struct {
+		b   []byte
+		pos int
+	}
+)
+
+func (w *packetWriter) writeUint16(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *packetWriter) writeString(s string) {
+	w.writeUint16(uint16(len(s)))
+	w.WriteString(s)
+}
+
+func (w *packetWriter) writeVarint(v int) {
+	for {
+		b := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			b |= 0x80
+		}
+		w.WriteByte(b)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+// writeProperties write an empty property set, only used by mqtt 5
+func (w *packetWriter) writeProperties(version byte) {
+	if version == ProtocolV5 {
+		w.writeVarint(0)
+	}
+}
+
+func (r *packetReader) remaining() int {
+	return len(r.b) - r.pos
+}
+
+func (r *packetReader) readByte() (byte, error) {
+	if r.remaining() < 1 {
+		return 0, ErrMalformedPacket
+	}
+	b := r.b[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *packetReader) readUint16() (uint16, error) {
+	if r.remaining() < 2 {
+		return 0, ErrMalformedPacket
+	}
+	v := binary.BigEndian.Uint16(r.b[r.pos:])
+	r.pos += 2
+	return v, nil
+}
+
+func (r *packetReader) readString() (string, error) {
+	n, err := r.readUint16()
+	if err != nil {
+		return "", err
+	}
+	if r.remaining() < int(n) {
+		return "", ErrMalformedPacket
+	}
+	s := string(r.b[r.pos : r.pos+int(n)])
+	r.pos += int(n)
+	return s, nil
+}
+
+func (r *packetReader) readVarint() (int, error) {
+	v, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		b, err := r.readByte()
+		if err != nil {
+			return 0, err
+		}
+		v += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			return v, nil
+		}
+		multiplier *= 128
+	}
+	return 0, ErrMalformedPacket
+}
+
+// skipProperties ignore the property set, only used by mqtt 5
+func (r *packetReader) skipProperties(version byte) error {
+	if version != ProtocolV5 {
+		return nil
+	}
+
+	n, err := r.readVarint()
+	if err != nil {
+		return err
+	}
+	if r.remaining() < n {
+		return ErrMalformedPacket
+	}
+	r.pos += n
+	return nil
+}
+
+func (r *packetReader) rest() []byte {
+	b := r.b[r.pos:]
+	r.pos = len(r.b)
+	return b
+}
+
+func readPacket(r *bufio.Reader) (*packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i >= 4 {
+			return nil, ErrMalformedPacket
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	return &packet{
+		kind:  header >> 4,
+		flags: header & 0x0f,
+		body:  body,
+	}, nil
+}
+
+func writePacket(w io.Writer, kind byte, flags byte, body []byte) error {
+	if len(body) > maxRemainingLength {
+		return ErrPacketTooLarge
+	}
+
+	var buf packetWriter
+	buf.WriteByte(kind<<4 | flags&0x0f)
+	buf.writeVarint(len(body))
+	buf.Write(body)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (p *connectPacket) encode() []byte {
+	var w packetWriter
+	w.writeString("MQTT")
+	w.WriteByte(p.version)
+
+	var flags byte
+	if p.cleanSession {
+		flags |= 0x02
+	}
+	if p.username != "" {
+		flags |= 0x80
+	}
+	if p.password != "" {
+		flags |= 0x40
+	}
+	w.WriteByte(flags)
+	w.writeUint16(p.keepAlive)
+	w.writeProperties(p.version)
+
+	w.writeString(p.clientID)
+	if p.username != "" {
+		w.writeString(p.username)
+	}
+	if p.password != "" {
+		w.writeString(p.password)
+	}
+	return w.Bytes()
+}
+
+func decodeConnect(body []byte) (*connectPacket, error) {
+	r := packetReader{b: body}
+	if _, err := r.readString(); err != nil {
+		return nil, err
+	}
+
+	p := new(connectPacket)
+	var err error
+	if p.version, err = r.readByte(); err != nil {
+		return nil, err
+	}
+	if p.version != ProtocolV311 && p.version != ProtocolV5 {
+		return p, ErrUnsupportedVersion
+	}
+
+	flags, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	p.cleanSession = flags&0x02 != 0
+
+	if p.keepAlive, err = r.readUint16(); err != nil {
+		return nil, err
+	}
+	if err := r.skipProperties(p.version); err != nil {
+		return nil, err
+	}
+	if p.clientID, err = r.readString(); err != nil {
+		return nil, err
+	}
+	if flags&0x80 != 0 {
+		if p.username, err = r.readString(); err != nil {
+			return nil, err
+		}
+	}
+	if flags&0x40 != 0 {
+		if p.password, err = r.readString(); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func (p *connackPacket) encode(version byte) []byte {
+	var w packetWriter
+	if p.sessionPresent {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+	w.WriteByte(p.code)
+	w.writeProperties(version)
+	return w.Bytes()
+}
+
+func decodeConnack(body []byte, version byte) (*connackPacket, error) {
+	r := packetReader{b: body}
+	flags, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.skipProperties(version); err != nil {
+		return nil, err
+	}
+
+	return &connackPacket{sessionPresent: flags&0x01 != 0, code: code}, nil
+}
+
+func (p *publishPacket) flags() byte {
+	flags := p.qos << 1
+	if p.dup {
+		flags |= 0x08
+	}
+	if p.retain {
+		flags |= 0x01
+	}
+	return flags
+}
+
+func (p *publishPacket) encode(version byte) []byte {
+	var w packetWriter
+	w.writeString(p.topic)
+	if p.qos > 0 {
+		w.writeUint16(p.id)
+	}
+	w.writeProperties(version)
+	w.Write(p.payload)
+	return w.Bytes()
+}
+
+func decodePublish(pkt *packet, version byte) (*publishPacket, error) {
+	r := packetReader{b: pkt.body}
+	p := &publishPacket{
+		qos:    (pkt.flags >> 1) & 0x03,
+		dup:    pkt.flags&0x08 != 0,
+		retain: pkt.flags&0x01 != 0,
+	}
+
+	var err error
+	if p.topic, err = r.readString(); err != nil {
+		return nil, err
+	}
+	if p.qos > 0 {
+		if p.id, err = r.readUint16(); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.skipProperties(version); err != nil {
+		return nil, err
+	}
+	p.payload = r.rest()
+
+	return p, nil
+}
+
+func (p *subscribePacket) encode(version byte) []byte {
+	var w packetWriter
+	w.writeUint16(p.id)
+	w.writeProperties(version)
+	for i, f := range p.filters {
+		w.writeString(f)
+		if p.qos != nil {
+			w.WriteByte(p.qos[i])
+		}
+	}
+	return w.Bytes()
+}
+
+// decodeSubscribe decode subscribe and unsubscribe packet, the later doesn't
+// have the qos of each filter
+func decodeSubscribe(body []byte, version byte, withQos bool) (*subscribePacket, error) {
+	r := packetReader{b: body}
+	p := new(subscribePacket)
+
+	var err error
+	if p.id, err = r.readUint16(); err != nil {
+		return nil, err
+	}
+	if err := r.skipProperties(version); err != nil {
+		return nil, err
+	}
+
+	for r.remaining() > 0 {
+		f, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		p.filters = append(p.filters, f)
+
+		if withQos {
+			options, err := r.readByte()
+			if err != nil {
+				return nil, err
+			}
+			p.qos = append(p.qos, options&0x03)
+		}
+	}
+
+	return p, nil
+}
+
+// encode ack packet, mqtt 3.1.1 puback and unsuback only have the packet id
+func (p *ackPacket) encode(kind byte, version byte) []byte {
+	var w packetWriter
+	w.writeUint16(p.id)
+
+	switch {
+	case kind == subackType:
+		w.writeProperties(version)
+		w.Write(p.codes)
+	case version == ProtocolV5 && kind == unsubackType:
+		w.writeProperties(version)
+		w.Write(p.codes)
+	}
+
+	return w.Bytes()
+}
+
+func decodeAck(body []byte, kind byte, version byte) (*ackPacket, error) {
+	r := packetReader{b: body}
+	p := new(ackPacket)
+
+	var err error
+	if p.id, err = r.readUint16(); err != nil {
+		return nil, err
+	}
+
+	// mqtt 5 puback may omit the reason code when success
+	if kind == pubackType {
+		if version == ProtocolV5 && r.remaining() > 0 {
+			code, err := r.readByte()
+			if err != nil {
+				return nil, err
+			}
+			p.codes = []byte{code}
+		}
+		return p, nil
+	}
+
+	if kind == subackType || version == ProtocolV5 {
+		if err := r.skipProperties(version); err != nil {
+			return nil, err
+		}
+		p.codes = r.rest()
+	}
+
+	return p, nil
+}
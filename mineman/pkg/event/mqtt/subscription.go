@@ -0,0 +1,311 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+)
+
+var globalNumber int64 = 0
+
+type (
+	subscription struct {
+		broker  *Broker
+		seq     int64
+		id      string
+		pattern string
+		filter  string
+		option  *event.SubscribeOption
+		err     error
+		channel chan event.Message
+
+		// unacked keep the first delivery time of the unsettled messages
+		mu      sync.Mutex
+		unacked map[string]time.Time
+		dropped int64
+		// retained hold the last retained value received by topic, so the
+		// replay of the server doesn't deliver it twice
+		retained map[string][]byte
+		// queue hold the messages waiting to be delivered, so the connection
+		// reader never waits for the subscriber
+		queue   []*message
+		queued  chan struct{}
+		stopped bool
+
+		// to hold cancelation with ease
+		ctx    context.Context
+		cancel func()
+	}
+)
+
+func (s *subscription) ID() string {
+	return s.id
+}
+
+func (s *subscription) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+func (s *subscription) Close() error {
+	if s.broker != nil && s.Error() == nil {
+		s.broker.unsubscribe(s)
+	}
+
+	s.cancel()
+	return nil
+}
+
+func (s *subscription) Message() <-chan event.Message {
+	return s.channel
+}
+
+func (s *subscription) Error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// enqueue hand the message over to the delivery loop of the subscription,
+// the message is released right away when the subscription is closed
+func (s *subscription) enqueue(msg *message) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		s.release(msg)
+		return
+	}
+	s.queue = append(s.queue, msg)
+	s.mu.Unlock()
+
+	select {
+	case s.queued <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch deliver the queued messages in order until the subscription is
+// closed, the remaining ones are released
+func (s *subscription) dispatch() {
+	for {
+		select {
+		case <-s.Done():
+			s.mu.Lock()
+			queue := s.queue
+			s.queue = nil
+			s.stopped = true
+			s.mu.Unlock()
+
+			for _, msg := range queue {
+				s.release(msg)
+			}
+			return
+		case <-s.queued:
+		}
+
+		for {
+			s.mu.Lock()
+			if len(s.queue) == 0 {
+				s.mu.Unlock()
+				break
+			}
+			msg := s.queue[0]
+			s.queue[0] = nil
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+
+			s.deliver(msg)
+		}
+	}
+}
+
+// deliver send the message to the subscriber, the overflow policy is
+// applied when its buffer is full
+func (s *subscription) deliver(msg *message) {
+	s.track(msg.id)
+
+	select {
+	case s.channel <- msg:
+		return
+	case <-s.Done():
+		// release the message, the subscriber no longer exists
+		s.release(msg)
+		return
+	default:
+	}
+
+	switch s.option.Overflow {
+	case event.DropOldest:
+		select {
+		case oldest := <-s.channel:
+			if m, ok := oldest.(*message); ok {
+				s.release(m)
+				s.drop(m, "oldest")
+			}
+		default:
+		}
+
+		// redeliveries are sent concurrently, so the room may be taken
+		select {
+		case s.channel <- msg:
+		default:
+			s.release(msg)
+			s.drop(msg, "newest")
+		}
+	case event.DropNewest:
+		s.release(msg)
+		s.drop(msg, "newest")
+	case event.Disconnect:
+		s.release(msg)
+		s.disconnect()
+	case event.Block:
+		// only the queued messages of the subscription wait, the connection
+		// keeps reading
+		timer := time.NewTimer(s.option.OverflowTimeout)
+		defer timer.Stop()
+
+		select {
+		case s.channel <- msg:
+		case <-timer.C:
+			s.release(msg)
+			s.drop(msg, "blocked")
+		case <-s.Done():
+			s.release(msg)
+		}
+	default:
+		// the remote publisher can't be rejected, the message is skipped
+		// for this subscriber only
+		s.release(msg)
+		s.drop(msg, "rejected")
+	}
+}
+
+func (s *subscription) seenRetained(topic string, data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen, ok := s.retained[topic]
+	return ok && bytes.Equal(seen, data)
+}
+
+func (s *subscription) markRetained(topic string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retained[topic] = data
+}
+
+// release settle the message that never reach the subscriber
+func (s *subscription) release(msg *message) {
+	s.untrack(msg.id)
+	msg.delivery.done()
+}
+
+func (s *subscription) drop(msg *message, reason string) {
+	atomic.AddInt64(&s.dropped, 1)
+	s.broker.count("dropped_" + reason)
+	log.Warning("subscriber buffer is full, dropping message", log.WithFields(map[string]interface{}{
+		"id":         msg.id,
+		"subscriber": s.id,
+		"topic":      msg.topic,
+		"overflow":   s.option.Overflow.String(),
+	}))
+}
+
+// disconnect close the subscription that can't keep up with the messages
+func (s *subscription) disconnect() {
+	log.Warning("subscriber buffer is full, disconnecting it",
+		log.WithField("subscriber", s.id),
+		log.WithField("topic", s.pattern),
+	)
+	s.broker.count("disconnected")
+
+	s.mu.Lock()
+	s.err = event.ErrSlowConsumer
+	s.mu.Unlock()
+	s.broker.unsubscribe(s)
+}
+
+// track record the message as unsettled, redelivery keeps its first time
+func (s *subscription) track(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.unacked[id]; !ok {
+		s.unacked[id] = time.Now()
+	}
+}
+
+func (s *subscription) untrack(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.unacked, id)
+}
+
+// unackedStats return the number of unsettled messages and the age of the
+// oldest one
+func (s *subscription) unackedStats(now time.Time) (int, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var oldest time.Duration
+	for _, at := range s.unacked {
+		if age := now.Sub(at); age > oldest {
+			oldest = age
+		}
+	}
+
+	return len(s.unacked), oldest
+}
+
+func newSubscription(ctx context.Context, b *Broker, pattern string, filter string, option *event.SubscribeOption) *subscription {
+	ctx, cancel := context.WithCancel(ctx)
+	seq := atomic.AddInt64(&globalNumber, 1)
+	s := &subscription{
+		broker:   b,
+		seq:      seq,
+		id:       strconv.FormatInt(seq, 10),
+		pattern:  pattern,
+		filter:   filter,
+		option:   option,
+		channel:  make(chan event.Message, b.config.SubBufferSize),
+		unacked:  make(map[string]time.Time),
+		retained: make(map[string][]byte),
+		queued:   make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	go s.dispatch()
+	return s
+}
+
+// newSubscriptionErr create an already closed subscription that hold the error
+func newSubscriptionErr(b *Broker, err error) *subscription {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return &subscription{
+		broker:   b,
+		err:      err,
+		channel:  make(chan event.Message),
+		unacked:  make(map[string]time.Time),
+		retained: make(map[string][]byte),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// sortSubscriptions order the subscriptions by their creation
+func sortSubscriptions(subs []*subscription) {
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].seq < subs[j].seq
+	})
+}
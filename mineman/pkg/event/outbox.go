@@ -0,0 +1,277 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+)
+
+type (
+	OutboxConfig struct {
+		// Size is the maximum number of queued publishes
+		Size int `mapstructure:"size"`
+		// Overflow is applied when the outbox is full, either block,
+		// drop-newest or drop-oldest
+		Overflow string `mapstructure:"overflow"`
+		// RetryInterval is the wait before retrying an unavailable broker
+		RetryInterval time.Duration `mapstructure:"retry_interval"`
+	}
+
+	// Outbox queue the publishes made before the broker is ready or while it
+	// is unavailable, and flush them in order once it is available. The
+	// queued publishes are kept in memory only.
+	Outbox struct {
+		mu            sync.Mutex
+		size          int
+		overflow      OverflowPolicy
+		retryInterval time.Duration
+		publisher     Publisher
+		queue         []*outboxEntry
+		dropped       int64
+		running       bool
+
+		// kick wake the flusher, space is closed and replaced whenever an
+		// entry leaves the queue
+		kick  chan struct{}
+		space chan struct{}
+	}
+
+	outboxEntry struct {
+		ctx     context.Context
+		topic   string
+		payload Payload
+		// option is resolved on publish, so the TTL and the delivery delay
+		// are measured from the original publish instead of the flush
+		option *PublishOption
+	}
+
+	// detachedContext keep the values of the publisher context, e.g. the
+	// trace id, without its cancellation since it is flushed later
+	detachedContext struct {
+		context.Context
+	}
+)
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// Configure apply the config, the already queued publishes are kept even
+// when they exceed the new size
+func (o *Outbox) Configure(c OutboxConfig) {
+	defaults := DefaultOutboxConfig()
+	if c.Size <= 0 {
+		c.Size = defaults.Size
+	}
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = defaults.RetryInterval
+	}
+	if c.Overflow == "" {
+		c.Overflow = defaults.Overflow
+	}
+
+	overflow, err := ParseOverflowPolicy(c.Overflow)
+	if err != nil || overflow == Disconnect {
+		log.Error("invalid outbox overflow policy, using drop-oldest", log.WithField("overflow", c.Overflow))
+		overflow = DropOldest
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.size = c.Size
+	o.overflow = overflow
+	o.retryInterval = c.RetryInterval
+}
+
+// SetPublisher start flushing to the publisher, a nil publisher stop the
+// flushing and queue the subsequent publishes
+func (o *Outbox) SetPublisher(p Publisher) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.publisher = p
+	if p != nil && !o.running {
+		o.running = true
+		go o.run()
+	}
+	o.wake()
+}
+
+// Publish send the message directly when the outbox is empty, otherwise it
+// is queued behind the others to keep the order
+func (o *Outbox) Publish(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) Publishing {
+	e := outboxEntry{
+		ctx:     detachedContext{ctx},
+		topic:   topic,
+		payload: payload,
+		option:  NewPublishOption(opts...),
+	}
+
+	o.mu.Lock()
+	p := o.publisher
+	if p == nil || len(o.queue) > 0 {
+		o.mu.Unlock()
+		return NewPublishingChan(o.enqueue(ctx, &e))
+	}
+	o.mu.Unlock()
+
+	publishing := p.Publish(ctx, topic, payload, e.option)
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(errChan)
+		err := <-publishing.Error()
+		if errors.Is(err, ErrBrokerUnavailable) {
+			err = o.enqueue(ctx, &e)
+		}
+		errChan <- err
+	}()
+
+	return NewPublishingChanForward(errChan)
+}
+
+// Flush publish the queued messages until the outbox is empty or the broker
+// unavailable, it returns false on the latter
+func (o *Outbox) Flush() bool {
+	for {
+		o.mu.Lock()
+		if o.publisher == nil || len(o.queue) == 0 {
+			o.mu.Unlock()
+			return true
+		}
+		p := o.publisher
+		e := o.queue[0]
+		o.mu.Unlock()
+
+		// the message expired while it is queued
+		if e.option.Expired(time.Now()) {
+			log.Debug("dropping expired message from the outbox", log.WithField("topic", e.topic))
+		} else {
+			err := <-p.Publish(e.ctx, e.topic, e.payload, e.option).Error()
+			if errors.Is(err, ErrBrokerUnavailable) {
+				return false
+			}
+			if err != nil {
+				log.Error("failed when flushing the outbox", log.WithError(err), log.WithField("topic", e.topic))
+			}
+		}
+
+		o.mu.Lock()
+		// the entry may be dropped while it is published
+		if len(o.queue) > 0 && o.queue[0] == e {
+			o.queue[0] = nil
+			o.queue = o.queue[1:]
+			o.release()
+		}
+		o.mu.Unlock()
+	}
+}
+
+func (o *Outbox) counts() (int, int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.queue), o.dropped
+}
+
+func (o *Outbox) enqueue(ctx context.Context, e *outboxEntry) error {
+	for {
+		o.mu.Lock()
+		if len(o.queue) < o.size {
+			o.queue = append(o.queue, e)
+			o.wake()
+			o.mu.Unlock()
+			return nil
+		}
+
+		switch o.overflow {
+		case DropOldest:
+			log.Debug("outbox full, dropping the oldest publish", log.WithField("topic", o.queue[0].topic))
+			o.queue[0] = nil
+			o.queue = append(o.queue[1:], e)
+			o.dropped++
+			o.wake()
+			o.mu.Unlock()
+			return nil
+		case Block:
+			space := o.space
+			o.mu.Unlock()
+			select {
+			case <-space:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		default:
+			o.dropped++
+			o.mu.Unlock()
+			return ErrOutboxFull
+		}
+	}
+}
+
+// run flush the outbox whenever it is kicked until the publisher removed,
+// an unavailable broker is retried after the interval
+func (o *Outbox) run() {
+	for {
+		if !o.Flush() {
+			o.mu.Lock()
+			interval := o.retryInterval
+			o.mu.Unlock()
+			time.Sleep(interval)
+			continue
+		}
+
+		<-o.kick
+
+		o.mu.Lock()
+		if o.publisher == nil {
+			o.running = false
+			o.mu.Unlock()
+			return
+		}
+		o.mu.Unlock()
+	}
+}
+
+// wake kick the flusher without blocking, must be called with the lock held
+func (o *Outbox) wake() {
+	select {
+	case o.kick <- struct{}{}:
+	default:
+	}
+}
+
+// release notify the blocked publishers, must be called with the lock held
+func (o *Outbox) release() {
+	close(o.space)
+	o.space = make(chan struct{})
+}
+
+func DefaultOutboxConfig() OutboxConfig {
+	return OutboxConfig{
+		Size:          1000,
+		Overflow:      DropOldest.String(),
+		RetryInterval: time.Second,
+	}
+}
+
+func NewOutbox(c OutboxConfig) *Outbox {
+	o := Outbox{
+		kick:  make(chan struct{}, 1),
+		space: make(chan struct{}),
+	}
+	o.Configure(c)
+
+	return &o
+}
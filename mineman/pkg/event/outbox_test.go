@@ -0,0 +1,161 @@
+package event
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingPublisher record the published topics, it is unavailable until
+// the given number of attempts failed
+type recordingPublisher struct {
+	mu          sync.Mutex
+	topics      []string
+	unavailable int
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) Publishing {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.unavailable > 0 {
+		p.unavailable--
+		return NewPublishingChan(ErrBrokerUnavailable)
+	}
+
+	p.topics = append(p.topics, topic)
+	return NewPublishingChan(nil)
+}
+
+func (p *recordingPublisher) waitTopics(t *testing.T, expect ...string) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		p.mu.Lock()
+		topics := append([]string{}, p.topics...)
+		p.mu.Unlock()
+
+		if len(topics) == len(expect) {
+			for i := range expect {
+				if topics[i] != expect[i] {
+					t.Fatalf("expect topics %v, got %v", expect, topics)
+				}
+			}
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expect topics %v, got %v", expect, topics)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	o := NewOutbox(OutboxConfig{Size: 10, RetryInterval: time.Millisecond})
+	publisher := recordingPublisher{unavailable: 1}
+
+	// queued before the broker is ready
+	for _, topic := range []string{"a", "b"} {
+		if err := <-o.Publish(ctx, topic, StringPayload(topic)).Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// flushed in order once it is available, the first attempt is retried
+	o.SetPublisher(&publisher)
+	publisher.waitTopics(t, "a", "b")
+
+	// unavailable broker queue the publish as well
+	publisher.mu.Lock()
+	publisher.unavailable = 2
+	publisher.mu.Unlock()
+	for _, topic := range []string{"c", "d"} {
+		if err := <-o.Publish(ctx, topic, StringPayload(topic)).Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publisher.waitTopics(t, "a", "b", "c", "d")
+
+	o.SetPublisher(nil)
+	if pending, _ := o.counts(); pending != 0 {
+		t.Fatalf("expect empty outbox, got %d pending", pending)
+	}
+}
+
+func TestOutboxTTL(t *testing.T) {
+	ctx := context.Background()
+	o := NewOutbox(OutboxConfig{Size: 10, RetryInterval: time.Millisecond})
+	publisher := recordingPublisher{}
+
+	// the ttl count from the publish, not from the flush
+	if err := <-o.Publish(ctx, "stale", StringPayload("stale"), TTL(time.Millisecond*20)).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-o.Publish(ctx, "fresh", StringPayload("fresh"), TTL(time.Minute)).Error(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	o.SetPublisher(&publisher)
+	publisher.waitTopics(t, "fresh")
+	o.SetPublisher(nil)
+}
+
+func TestOutboxOverflow(t *testing.T) {
+	ctx := context.Background()
+	fill := func(o *Outbox) {
+		for _, topic := range []string{"a", "b"} {
+			if err := <-o.Publish(ctx, topic, StringPayload(topic)).Error(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	o := NewOutbox(OutboxConfig{Size: 2, Overflow: DropNewest.String()})
+	fill(o)
+	if err := <-o.Publish(ctx, "c", StringPayload("c")).Error(); err != ErrOutboxFull {
+		t.Fatalf("expect outbox full, got %v", err)
+	}
+	publisher := recordingPublisher{}
+	o.SetPublisher(&publisher)
+	publisher.waitTopics(t, "a", "b")
+	o.SetPublisher(nil)
+
+	o = NewOutbox(OutboxConfig{Size: 2, Overflow: DropOldest.String()})
+	fill(o)
+	if err := <-o.Publish(ctx, "c", StringPayload("c")).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if _, dropped := o.counts(); dropped != 1 {
+		t.Fatalf("expect 1 dropped publish, got %d", dropped)
+	}
+	publisher = recordingPublisher{}
+	o.SetPublisher(&publisher)
+	publisher.waitTopics(t, "b", "c")
+	o.SetPublisher(nil)
+
+	o = NewOutbox(OutboxConfig{Size: 2, Overflow: Block.String()})
+	fill(o)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := <-o.Publish(timeoutCtx, "c", StringPayload("c")).Error(); err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+
+	// the blocked publish continue once there is room
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- <-o.Publish(ctx, "d", StringPayload("d")).Error()
+	}()
+	publisher = recordingPublisher{}
+	o.SetPublisher(&publisher)
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	publisher.waitTopics(t, "a", "b", "d")
+	o.SetPublisher(nil)
+}
@@ -21,3 +21,7 @@ func LoadBrokers() []app.ModuleFactory {
 func LoadBrokersMap() map[string]app.ModuleFactory {
 	return moduleRegistry.LoadMap()
 }
+
+func init() {
+	app.RegisterProvider(DefaultPublisher)
+}
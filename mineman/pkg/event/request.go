@@ -0,0 +1,127 @@
+package event
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// reserved request/reply headers
+const (
+	// HeaderCorrelationID identify the request that a reply answers
+	HeaderCorrelationID = "x-correlation-id"
+	// HeaderReplyTo hold the topic where the reply should be published
+	HeaderReplyTo = "x-reply-to"
+	// HeaderError hold the error message of a failed request
+	HeaderError = "x-error"
+
+	replyTopicLevel = "_reply"
+)
+
+var (
+	ErrNoReplyTopic  = errors.New("message is not a request, it doesn't have reply topic")
+	ErrRequestFailed = errors.New("request failed")
+	ErrReplyClosed   = errors.New("reply subscription closed before the reply is received")
+)
+
+// Request publish the payload and wait for its reply, the waiting time is
+// bounded by the context deadline
+func Request(ctx context.Context, topic string, payload Payload, opts ...PublishConfigurator) (Payload, error) {
+	broker := Default()
+	if broker == nil {
+		return nil, ErrEventHookNotInitialized
+	}
+
+	return RequestWith(ctx, broker, topic, payload, opts...)
+}
+
+// RequestWith send the request through the given broker, the returned
+// payload is the reply message that already acknowledged
+func RequestWith(ctx context.Context, b Broker, topic string, payload Payload, opts ...PublishConfigurator) (Payload, error) {
+	id, err := newCorrelationID()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// subscribe before publishing, so the reply can't be missed
+	replyTopic := topic + TopicSeparator + replyTopicLevel + TopicSeparator + id
+	sub := b.Subscribe(ctx, replyTopic)
+	if err := sub.Error(); err != nil {
+		return nil, err
+	}
+	defer sub.Close()
+
+	opts = append(opts,
+		WithHeader(HeaderCorrelationID, id),
+		WithHeader(HeaderReplyTo, replyTopic),
+	)
+	if err := <-b.Publish(ctx, topic, payload, opts...).Error(); err != nil {
+		return nil, err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-sub.Done():
+			// the subscription may be closed by the broker while the context
+			// is still alive
+			if err := sub.Error(); err != nil {
+				return nil, err
+			}
+			return nil, ErrReplyClosed
+		case msg := <-sub.Message():
+			if msg == nil {
+				continue
+			}
+			<-msg.Ack(ctx)
+
+			// skip the stale replies of the other requests
+			headers := msg.Headers()
+			if headers[HeaderCorrelationID] != id {
+				continue
+			}
+
+			if reason, ok := headers[HeaderError]; ok {
+				return msg, fmt.Errorf("%w: %s", ErrRequestFailed, reason)
+			}
+
+			return msg, nil
+		}
+	}
+}
+
+// ReplyWith publish the reply of a request message through the given
+// publisher, broker implementation use this to implement Message.Reply
+func ReplyWith(ctx context.Context, p Publisher, message Message, payload Payload, opts ...PublishConfigurator) Publishing {
+	headers := message.Headers()
+	replyTo, ok := headers[HeaderReplyTo]
+	if !ok {
+		errChan := make(chan error, 1)
+		errChan <- ErrNoReplyTopic
+		close(errChan)
+		return NewPublishingChanForward(errChan)
+	}
+
+	opts = append(opts, WithHeader(HeaderCorrelationID, headers[HeaderCorrelationID]))
+	return p.Publish(ctx, replyTo, payload, opts...)
+}
+
+// WithReplyError mark the reply as a failed request
+func WithReplyError(err error) PublishConfigurator {
+	return WithHeader(HeaderError, err.Error())
+}
+
+func newCorrelationID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b[:]), nil
+}
@@ -0,0 +1,104 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/euiko/tooyoul/mineman/pkg/log"
+)
+
+var (
+	ErrRouteNameEmpty = errors.New("route event descriptor must have a name")
+)
+
+type (
+	// DescriptorFactory create a fresh event descriptor to be filled by the router
+	DescriptorFactory func() EventDescriptor
+
+	// RouteHandler handle a decoded event, the message is acknowledged
+	// when it returns nil and not acknowledged otherwise
+	RouteHandler func(ctx context.Context, message Message, ed EventDescriptor) error
+
+	// Router dispatch event payload messages to the handler registered
+	// for their name, the payload is decoded only once per message
+	Router struct {
+		mu       sync.RWMutex
+		routes   map[string]route
+		fallback MessageHandlerFuncErr
+	}
+
+	route struct {
+		factory DescriptorFactory
+		handler RouteHandler
+	}
+)
+
+// Handle register the handler of the event created by the factory,
+// registering the same name twice replaces the previous handler
+func (r *Router) Handle(factory DescriptorFactory, handler RouteHandler) *Router {
+	name := factory().Name()
+	if name == "" {
+		panic(ErrRouteNameEmpty)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[name] = route{factory: factory, handler: handler}
+	return r
+}
+
+// Fallback set the handler for messages that doesn't have any route,
+// including the non event payload ones
+func (r *Router) Fallback(handler MessageHandlerFuncErr) *Router {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = handler
+	return r
+}
+
+func (r *Router) HandleMessage(ctx context.Context, message Message) {
+	MessageHandlerFuncErr(r.route).HandleMessage(ctx, message)
+}
+
+func (r *Router) route(ctx context.Context, message Message) error {
+	r.mu.RLock()
+	fallback := r.fallback
+	var payload EventPayload
+	if err := message.Scan(&payload); err != nil {
+		r.mu.RUnlock()
+		return fallback(ctx, message)
+	}
+
+	rt, ok := r.routes[payload.Name]
+	r.mu.RUnlock()
+	if !ok {
+		return fallback(ctx, message)
+	}
+
+	ed := rt.factory()
+	if err := payload.Scan(ed); err != nil {
+		return err
+	}
+
+	return rt.handler(ctx, message, ed)
+}
+
+// defaultFallback acknowledge unknown events, so they are not redelivered
+func defaultFallback(ctx context.Context, message Message) error {
+	var payload EventPayload
+	if err := message.Scan(&payload); err != nil {
+		log.Debug("skipping non event message", log.WithField("id", message.ID()))
+		return nil
+	}
+
+	log.Debug("skipping event without route", log.WithField("id", message.ID()), log.WithField("name", payload.Name))
+	return nil
+}
+
+func NewRouter() *Router {
+	return &Router{
+		routes:   make(map[string]route),
+		fallback: defaultFallback,
+	}
+}
@@ -0,0 +1,118 @@
+package event
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type (
+	testEvent struct {
+		At    time.Time `mapstructure:"x-at"`
+		Value string    `mapstructure:"value"`
+	}
+
+	testMessage struct {
+		Payload
+		acked  int
+		nacked int
+	}
+)
+
+func (e *testEvent) Name() string {
+	return "test.happened"
+}
+
+func (e *testEvent) ToEvent() *EventPayload {
+	return &EventPayload{
+		Name: e.Name(),
+		At:   e.At,
+		Data: map[string]interface{}{"value": e.Value},
+	}
+}
+
+func (m *testMessage) ID() string {
+	return "1"
+}
+
+func (m *testMessage) Topic() string {
+	return "test"
+}
+
+func (m *testMessage) Deliveries() int {
+	return 1
+}
+
+func (m *testMessage) Headers() map[string]string {
+	return nil
+}
+
+func (m *testMessage) Ack(context.Context) <-chan error {
+	m.acked++
+	return closedErrChan()
+}
+
+func (m *testMessage) Progress(context.Context) <-chan error {
+	return closedErrChan()
+}
+
+func (m *testMessage) Nack(context.Context) <-chan error {
+	m.nacked++
+	return closedErrChan()
+}
+
+func (m *testMessage) Reply(ctx context.Context, payload Payload, opts ...PublishConfigurator) <-chan error {
+	return closedErrChan()
+}
+
+func closedErrChan() <-chan error {
+	errChan := make(chan error)
+	close(errChan)
+	return errChan
+}
+
+func TestRouter(t *testing.T) {
+	ctx := context.Background()
+	received := []string{}
+	fallback := 0
+
+	router := NewRouter().
+		Handle(func() EventDescriptor { return &testEvent{} },
+			func(ctx context.Context, message Message, ed EventDescriptor) error {
+				e := ed.(*testEvent)
+				received = append(received, e.Value)
+				if e.Value == "fail" {
+					return errors.New("failed")
+				}
+				return nil
+			}).
+		Fallback(func(ctx context.Context, message Message) error {
+			fallback++
+			return nil
+		})
+
+	ok := &testMessage{Payload: FromEventDescriptor(&testEvent{At: time.Now(), Value: "ok"})}
+	router.HandleMessage(ctx, ok)
+	if ok.acked != 1 || ok.nacked != 0 {
+		t.Errorf("expect handled message acknowledged, got %d ack %d nack", ok.acked, ok.nacked)
+	}
+
+	fail := &testMessage{Payload: FromEventDescriptor(&testEvent{Value: "fail"})}
+	router.HandleMessage(ctx, fail)
+	if fail.acked != 0 || fail.nacked != 1 {
+		t.Errorf("expect failed message not acknowledged, got %d ack %d nack", fail.acked, fail.nacked)
+	}
+
+	if len(received) != 2 || received[0] != "ok" || received[1] != "fail" {
+		t.Errorf("expect ok and fail received, got %v", received)
+	}
+
+	unknown := &testMessage{Payload: &EventPayload{Name: "test.unknown"}}
+	router.HandleMessage(ctx, unknown)
+	str := &testMessage{Payload: StringPayload("hello")}
+	router.HandleMessage(ctx, str)
+	if fallback != 2 || unknown.acked != 1 || str.acked != 1 {
+		t.Errorf("expect unknown messages handled by the fallback, got %d", fallback)
+	}
+}
@@ -0,0 +1,136 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type (
+	// Stats is a point in time view of the broker internals
+	Stats struct {
+		Broker        string              `json:"broker"`
+		Topics        []TopicStats        `json:"topics"`
+		Subscriptions []SubscriptionStats `json:"subscriptions"`
+		// InFlight is the number of delivered messages that not yet acknowledged
+		InFlight int `json:"in_flight"`
+		// Counters hold the broker specific totals since it started,
+		// e.g. published, delivered, acked, nacked and dead_lettered
+		Counters map[string]int64 `json:"counters"`
+	}
+
+	TopicStats struct {
+		Topic       string `json:"topic"`
+		Subscribers int    `json:"subscribers"`
+	}
+
+	SubscriptionStats struct {
+		ID     string `json:"id"`
+		Topic  string `json:"topic"`
+		Policy string `json:"policy"`
+		Group  string `json:"group,omitempty"`
+		// Buffered is the number of messages waiting to be received, the
+		// subscriber is slow when it stays near the capacity
+		Buffered int `json:"buffered"`
+		Capacity int `json:"capacity"`
+		InFlight int `json:"in_flight"`
+		// Overflow is the policy applied when the buffer is full, Dropped
+		// count the messages that discarded due to it
+		Overflow string `json:"overflow"`
+		Dropped  int64  `json:"dropped"`
+		// OldestUnacked is the age of the oldest unacknowledged message
+		OldestUnacked time.Duration `json:"oldest_unacked"`
+	}
+
+	// Inspector expose the broker internals for debugging purpose
+	Inspector interface {
+		Stats(ctx context.Context) (*Stats, error)
+	}
+)
+
+func (p SubscribePolicy) String() string {
+	switch p {
+	case WorkQueuePolicy:
+		return "work-queue"
+	default:
+		return "fan-out"
+	}
+}
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Disconnect:
+		return "disconnect"
+	default:
+		return "reject"
+	}
+}
+
+// ParseOverflowPolicy parse the policy name returned by String
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for _, p := range []OverflowPolicy{Reject, Block, DropNewest, DropOldest, Disconnect} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+
+	return Reject, fmt.Errorf("unknown overflow policy %q", name)
+}
+
+// SummarizeTopics count the subscribers of each topic, ordered by the topic
+func SummarizeTopics(subs []SubscriptionStats) []TopicStats {
+	counts := make(map[string]int)
+	for _, s := range subs {
+		counts[s.Topic]++
+	}
+
+	topics := make([]TopicStats, 0, len(counts))
+	for topic, n := range counts {
+		topics = append(topics, TopicStats{Topic: topic, Subscribers: n})
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Topic < topics[j].Topic
+	})
+
+	return topics
+}
+
+// SortSubscriptions order the subscriptions by topic then id
+func SortSubscriptions(subs []SubscriptionStats) {
+	sort.Slice(subs, func(i, j int) bool {
+		if subs[i].Topic != subs[j].Topic {
+			return subs[i].Topic < subs[j].Topic
+		}
+		return subs[i].ID < subs[j].ID
+	})
+}
+
+// GetStats return the stats of the broker used by the hook, including the
+// publishes still queued in the outbox
+func GetStats(ctx context.Context) (*Stats, error) {
+	broker := Default()
+	if broker == nil {
+		return nil, ErrEventHookNotInitialized
+	}
+
+	stats, err := broker.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if stats.Counters == nil {
+		stats.Counters = make(map[string]int64)
+	}
+	pending, dropped := globalOutbox.counts()
+	stats.Counters["outbox_pending"] = int64(pending)
+	stats.Counters["outbox_dropped"] = dropped
+
+	return stats, nil
+}
@@ -0,0 +1,146 @@
+package event
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// TopicSeparator split a topic into its hierarchical levels
+	TopicSeparator = "."
+	// SingleLevelWildcard match exactly one level of a topic, e.g. network.*
+	SingleLevelWildcard = "*"
+	// MultiLevelWildcard match zero or more trailing levels of a topic, e.g. miner.#
+	MultiLevelWildcard = "#"
+)
+
+var (
+	ErrInvalidTopic        = errors.New("invalid topic, it must not be empty nor contains wildcard")
+	ErrInvalidTopicPattern = errors.New("invalid topic pattern, wildcard must be a whole level and # only allowed at the last level")
+)
+
+// SplitTopic split topic or pattern into its levels
+func SplitTopic(topic string) []string {
+	return strings.Split(topic, TopicSeparator)
+}
+
+// IsTopicPattern check whether the topic contains any wildcard
+func IsTopicPattern(topic string) bool {
+	for _, level := range SplitTopic(topic) {
+		if level == SingleLevelWildcard || level == MultiLevelWildcard {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateTopic validate topic used for publishing, it doesn't allow any wildcard
+func ValidateTopic(topic string) error {
+	if topic == "" {
+		return ErrInvalidTopic
+	}
+
+	for _, level := range SplitTopic(topic) {
+		if level == "" || strings.ContainsAny(level, SingleLevelWildcard+MultiLevelWildcard) {
+			return ErrInvalidTopic
+		}
+	}
+
+	return nil
+}
+
+// ValidateTopicPattern validate topic used for subscribing, which may contains wildcard
+func ValidateTopicPattern(pattern string) error {
+	if pattern == "" {
+		return ErrInvalidTopicPattern
+	}
+
+	levels := SplitTopic(pattern)
+	for i, level := range levels {
+		switch {
+		case level == "":
+			return ErrInvalidTopicPattern
+		case level == MultiLevelWildcard:
+			if i != len(levels)-1 {
+				return ErrInvalidTopicPattern
+			}
+		case level == SingleLevelWildcard:
+			// always valid
+		case strings.ContainsAny(level, SingleLevelWildcard+MultiLevelWildcard):
+			return ErrInvalidTopicPattern
+		}
+	}
+
+	return nil
+}
+
+// MatchTopic check whether the topic is matched by the pattern, the * wildcard match
+// exactly one level and the # wildcard match zero or more trailing levels
+func MatchTopic(pattern string, topic string) bool {
+	return matchLevels(SplitTopic(pattern), SplitTopic(topic))
+}
+
+func matchLevels(pattern []string, topic []string) bool {
+	for i, level := range pattern {
+		if level == MultiLevelWildcard {
+			return true
+		}
+
+		if i >= len(topic) {
+			return false
+		}
+
+		if level != SingleLevelWildcard && level != topic[i] {
+			return false
+		}
+	}
+
+	return len(pattern) == len(topic)
+}
+
+// TopicsOverlap check whether there is any topic matched by both patterns
+func TopicsOverlap(a string, b string) bool {
+	return overlapLevels(SplitTopic(a), SplitTopic(b))
+}
+
+func overlapLevels(a []string, b []string) bool {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		switch {
+		case i < len(a) && a[i] == MultiLevelWildcard:
+			return true
+		case i < len(b) && b[i] == MultiLevelWildcard:
+			return true
+		case i >= len(a) || i >= len(b):
+			return false
+		case a[i] != SingleLevelWildcard && b[i] != SingleLevelWildcard && a[i] != b[i]:
+			return false
+		}
+	}
+
+	return true
+}
+
+// TopicCovers check whether every topic matched by the other pattern is
+// also matched by the pattern
+func TopicCovers(pattern string, other string) bool {
+	return coverLevels(SplitTopic(pattern), SplitTopic(other))
+}
+
+func coverLevels(pattern []string, other []string) bool {
+	for i, level := range pattern {
+		if level == MultiLevelWildcard {
+			return true
+		}
+
+		if i >= len(other) || other[i] == MultiLevelWildcard {
+			return false
+		}
+
+		if level != SingleLevelWildcard && level != other[i] {
+			return false
+		}
+	}
+
+	return len(pattern) == len(other)
+}
@@ -0,0 +1,99 @@
+package event
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		topic   string
+		expect  bool
+	}{
+		{"network.status-changed", "network.status-changed", true},
+		{"network.status-changed", "network.status", false},
+		{"network.*", "network.status-changed", true},
+		{"network.*", "network.status-changed.detail", false},
+		{"network.*", "network", false},
+		{"*.status-changed", "network.status-changed", true},
+		{"miner.#", "miner", true},
+		{"miner.#", "miner.status-changed", true},
+		{"miner.#", "miner.teamredminer.hashrate", true},
+		{"miner.#", "network.status-changed", false},
+		{"#", "network.status-changed", true},
+		{"miner.*.hashrate", "miner.teamredminer.hashrate", true},
+		{"miner.*.hashrate", "miner.teamredminer.status", false},
+	}
+
+	for _, tc := range testCases {
+		if got := MatchTopic(tc.pattern, tc.topic); got != tc.expect {
+			t.Errorf("expect match pattern '%s' with topic '%s' is %v, but got %v", tc.pattern, tc.topic, tc.expect, got)
+		}
+	}
+}
+
+func TestValidateTopicPattern(t *testing.T) {
+	valids := []string{"network.*", "miner.#", "#", "*.status-changed", "network.status-changed"}
+	invalids := []string{"", "miner.#.status", "network.stat*", "network..status", "miner.##"}
+
+	for _, pattern := range valids {
+		if err := ValidateTopicPattern(pattern); err != nil {
+			t.Errorf("expect pattern '%s' valid, but got %s", pattern, err)
+		}
+	}
+
+	for _, pattern := range invalids {
+		if err := ValidateTopicPattern(pattern); err == nil {
+			t.Errorf("expect pattern '%s' invalid", pattern)
+		}
+	}
+}
+
+func TestTopicsOverlap(t *testing.T) {
+	testCases := []struct {
+		a      string
+		b      string
+		expect bool
+	}{
+		{"fleet.#", "fleet.rig-1.status", true},
+		{"fleet.#", "fleet", true},
+		{"fleet.#", "#", true},
+		{"fleet.#", "miner.#", false},
+		{"fleet.*", "*.status-changed", true},
+		{"fleet.*", "fleet.rig-1.status", false},
+		{"network.*", "network.status-changed", true},
+		{"network.*", "network", false},
+		{"*.*", "miner.*.hashrate", false},
+	}
+
+	for _, tc := range testCases {
+		if got := TopicsOverlap(tc.a, tc.b); got != tc.expect {
+			t.Errorf("expect overlap of '%s' and '%s' is %v, but got %v", tc.a, tc.b, tc.expect, got)
+		}
+		if got := TopicsOverlap(tc.b, tc.a); got != tc.expect {
+			t.Errorf("expect overlap of '%s' and '%s' is %v, but got %v", tc.b, tc.a, tc.expect, got)
+		}
+	}
+}
+
+func TestTopicCovers(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		other   string
+		expect  bool
+	}{
+		{"fleet.#", "fleet.rig-1.status", true},
+		{"fleet.#", "fleet.*", true},
+		{"fleet.#", "fleet.#", true},
+		{"fleet.#", "#", false},
+		{"fleet.*", "fleet.status", true},
+		{"fleet.*", "fleet.#", false},
+		{"fleet.status", "fleet.*", false},
+		{"*.status-changed", "network.status-changed", true},
+		{"#", "miner.*.hashrate", true},
+	}
+
+	for _, tc := range testCases {
+		if got := TopicCovers(tc.pattern, tc.other); got != tc.expect {
+			t.Errorf("expect '%s' covers '%s' is %v, but got %v", tc.pattern, tc.other, tc.expect, got)
+		}
+	}
+}
@@ -62,6 +62,12 @@ type (
 	}
 
 	OptionsFunc func(o *Option)
+
+	// Printer log the messages through its logger instead of the default
+	// one, it is used by the modules that receive their logger by injection
+	Printer struct {
+		logger Logger
+	}
 )
 
 var globalLogger Logger
@@ -146,6 +152,38 @@ func Trace(msg string, opts ...Options) error {
 	return log(TraceLevel, msg, opts...)
 }
 
+func (p Printer) Fatal(msg string, opts ...Options) error {
+	return p.log(FatalLevel, msg, opts...)
+}
+
+func (p Printer) Error(msg string, opts ...Options) error {
+	return p.log(ErrorLevel, msg, opts...)
+}
+
+func (p Printer) Warning(msg string, opts ...Options) error {
+	return p.log(WarningLevel, msg, opts...)
+}
+
+func (p Printer) Info(msg string, opts ...Options) error {
+	return p.log(InfoLevel, msg, opts...)
+}
+
+func (p Printer) Debug(msg string, opts ...Options) error {
+	return p.log(DebugLevel, msg, opts...)
+}
+
+func (p Printer) Trace(msg string, opts ...Options) error {
+	return p.log(TraceLevel, msg, opts...)
+}
+
+func (p Printer) log(level Level, msg string, opts ...Options) error {
+	return log(level, msg, append([]Options{WithLogger(p.logger)}, opts...)...)
+}
+
+func NewPrinter(logger Logger) Printer {
+	return Printer{logger: logger}
+}
+
 func newMessageOption(message string, options ...Options) Option {
 
 	// instantiate message
@@ -172,11 +210,6 @@ func newMessageOption(message string, options ...Options) Option {
 }
 
 func log(level Level, msg string, opts ...Options) error {
-	// global logger not yet specified, then do nothing
-	if globalLogger == nil {
-		return nil
-	}
-
 	opt := newMessageOption(msg, opts...)
 	logger := opt.logger
 
@@ -198,6 +231,11 @@ func log(level Level, msg string, opts ...Options) error {
 		}
 	}
 
+	// logger not yet specified, then do nothing
+	if logger == nil {
+		return nil
+	}
+
 	// format log message when values exists
 	if len(opt.formatValues) > 0 {
 		opt.msg.message = fmt.Sprintf(opt.msg.message, opt.formatValues...)
@@ -0,0 +1,57 @@
+package log
+
+import (
+	"context"
+
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+)
+
+// NamedLogger add the module field of its name to every message, it log
+// through the default logger when the parent is nil
+type NamedLogger struct {
+	name   string
+	parent Logger
+}
+
+// Init do nothing, the parent is managed by its owner
+func (l *NamedLogger) Init(ctx context.Context, c config.Config) error {
+	return nil
+}
+
+// Close do nothing, the parent is managed by its owner
+func (l *NamedLogger) Close(ctx context.Context) error {
+	return nil
+}
+
+func (l *NamedLogger) SetLevel(level Level) {
+	if logger := l.logger(); logger != nil {
+		logger.SetLevel(level)
+	}
+}
+
+func (l *NamedLogger) Log(level Level, msg *MessageLog) {
+	logger := l.logger()
+	if logger == nil {
+		return
+	}
+
+	if _, ok := msg.fields["module"]; !ok {
+		msg.fields["module"] = l.name
+	}
+	logger.Log(level, msg)
+}
+
+func (l *NamedLogger) logger() Logger {
+	if l.parent != nil {
+		return l.parent
+	}
+
+	return Default()
+}
+
+func Named(name string, parent Logger) *NamedLogger {
+	return &NamedLogger{
+		name:   name,
+		parent: parent,
+	}
+}
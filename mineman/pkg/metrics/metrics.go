@@ -0,0 +1,218 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// Registry hold the counters and timers by their name and labels
+	Registry struct {
+		mu       sync.RWMutex
+		counters map[string]*Counter
+		timers   map[string]*Timer
+	}
+
+	// Counter is a monotonically increasing value
+	Counter struct {
+		name   string
+		labels map[string]string
+		value  int64
+	}
+
+	// Timer summarize the observed durations
+	Timer struct {
+		name   string
+		labels map[string]string
+
+		mu    sync.Mutex
+		count int64
+		sum   time.Duration
+		max   time.Duration
+	}
+
+	CounterSnapshot struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels,omitempty"`
+		Value  int64             `json:"value"`
+	}
+
+	TimerSnapshot struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels,omitempty"`
+		Count  int64             `json:"count"`
+		Sum    time.Duration     `json:"sum"`
+		Max    time.Duration     `json:"max"`
+	}
+
+	Snapshot struct {
+		Counters []CounterSnapshot `json:"counters"`
+		Timers   []TimerSnapshot   `json:"timers"`
+	}
+)
+
+var defaultRegistry = NewRegistry()
+
+// Counter return the counter of the name and labels, the labels are
+// supplied as key value pairs
+func (r *Registry) Counter(name string, labels ...string) *Counter {
+	key, labelsMap := metricKey(name, labels)
+
+	r.mu.RLock()
+	c, ok := r.counters[key]
+	r.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.counters[key]; ok {
+		return c
+	}
+
+	c = &Counter{name: name, labels: labelsMap}
+	r.counters[key] = c
+	return c
+}
+
+// Timer return the timer of the name and labels, the labels are
+// supplied as key value pairs
+func (r *Registry) Timer(name string, labels ...string) *Timer {
+	key, labelsMap := metricKey(name, labels)
+
+	r.mu.RLock()
+	t, ok := r.timers[key]
+	r.mu.RUnlock()
+	if ok {
+		return t
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t, ok := r.timers[key]; ok {
+		return t
+	}
+
+	t = &Timer{name: name, labels: labelsMap}
+	r.timers[key] = t
+	return t
+}
+
+// Snapshot copy the current values ordered by their name
+func (r *Registry) Snapshot() Snapshot {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s := Snapshot{
+		Counters: make([]CounterSnapshot, 0, len(r.counters)),
+		Timers:   make([]TimerSnapshot, 0, len(r.timers)),
+	}
+
+	counterKeys := make([]string, 0, len(r.counters))
+	for key := range r.counters {
+		counterKeys = append(counterKeys, key)
+	}
+	sort.Strings(counterKeys)
+	for _, key := range counterKeys {
+		c := r.counters[key]
+		s.Counters = append(s.Counters, CounterSnapshot{
+			Name:   c.name,
+			Labels: c.labels,
+			Value:  c.Value(),
+		})
+	}
+
+	timerKeys := make([]string, 0, len(r.timers))
+	for key := range r.timers {
+		timerKeys = append(timerKeys, key)
+	}
+	sort.Strings(timerKeys)
+	for _, key := range timerKeys {
+		t := r.timers[key]
+		t.mu.Lock()
+		s.Timers = append(s.Timers, TimerSnapshot{
+			Name:   t.name,
+			Labels: t.labels,
+			Count:  t.count,
+			Sum:    t.sum,
+			Max:    t.max,
+		})
+		t.mu.Unlock()
+	}
+
+	return s
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+func (t *Timer) Observe(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.count++
+	t.sum += d
+	if d > t.max {
+		t.max = d
+	}
+}
+
+// Since observe the elapsed time from the start
+func (t *Timer) Since(start time.Time) {
+	t.Observe(time.Since(start))
+}
+
+// metricKey build a unique key from the name and sorted labels, an odd
+// label without value is ignored
+func metricKey(name string, labels []string) (string, map[string]string) {
+	if len(labels) < 2 {
+		return name, nil
+	}
+
+	labelsMap := make(map[string]string, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		labelsMap[labels[i]] = labels[i+1]
+	}
+
+	keys := make([]string, 0, len(labelsMap))
+	for k := range labelsMap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		b.WriteString("|")
+		b.WriteString(k)
+		b.WriteString("=")
+		b.WriteString(labelsMap[k])
+	}
+
+	return b.String(), labelsMap
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters: make(map[string]*Counter),
+		timers:   make(map[string]*Timer),
+	}
+}
+
+// Default return the process wide registry
+func Default() *Registry {
+	return defaultRegistry
+}
@@ -0,0 +1,41 @@
+package miner
+
+import (
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+)
+
+// request topics answered by the miner module
+const (
+	EventStatusTopic = "miner.status"
+	EventStartTopic  = "miner.start"
+	EventStopTopic   = "miner.stop"
+)
+
+// EventStatusChangedTopic receive the retained miner status whenever the
+// miners are started or stopped
+const EventStatusChangedTopic = "miner.status-changed"
+
+type (
+	EventMinerStatus struct {
+		At      time.Time `json:"x-at" mapstructure:"x-at"`
+		Running bool      `json:"running" mapstructure:"running"`
+		Miners  []string  `json:"miners" mapstructure:"miners"`
+	}
+)
+
+func (e *EventMinerStatus) Name() string {
+	return "miner.status"
+}
+
+func (e *EventMinerStatus) ToEvent() *event.EventPayload {
+	return &event.EventPayload{
+		Name: e.Name(),
+		At:   e.At,
+		Data: map[string]interface{}{
+			"running": e.Running,
+			"miners":  e.Miners,
+		},
+	}
+}
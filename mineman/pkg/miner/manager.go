@@ -3,11 +3,16 @@ package miner
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"sync"
+	"time"
 
 	"github.com/euiko/tooyoul/mineman/pkg/config"
 	"github.com/euiko/tooyoul/mineman/pkg/log"
 )
 
+const killTimeout = time.Second * 5
+
 type (
 	MiningConfig struct {
 		Miner  string `mapstructure:"miner"`
@@ -25,6 +30,13 @@ type (
 		pools        map[string]Pool
 		minersConfig []MiningConfig
 		miners       []Miner
+
+		mu      sync.Mutex
+		running bool
+
+		// reloadMu serialize the reloads, the config fields are only written
+		// under both locks so the reload reads them without the mu
+		reloadMu sync.Mutex
 	}
 )
 
@@ -41,7 +53,7 @@ func (m *Manager) Init(ctx context.Context, c config.Config) error {
 	m.miners = make([]Miner, len(m.minersConfig))
 	for i, config := range m.minersConfig {
 		configKey := fmt.Sprintf("miners.%d", i)
-		miner, err := m.createMiner(ctx, m.c.Sub(configKey), config)
+		miner, err := createMiner(ctx, m.pools, m.c.Sub(configKey), config)
 		if err != nil {
 			return err
 		}
@@ -51,13 +63,52 @@ func (m *Manager) Init(ctx context.Context, c config.Config) error {
 	return nil
 }
 
+// Close stop and close the miners, the miners are killed when they aren't
+// closed before the context is done
 func (m *Manager) Close(ctx context.Context) error {
+	m.mu.Lock()
+	miners := m.miners
+	m.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.close(ctx, miners)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		log.Warning("closing miners takes too long, killing them")
+		killMiners(miners)
+		return ctx.Err()
+	}
+}
+
+// killMiners kill the miners one by one, waiting a bit for each of them to
+// exit, so the programs aren't left behind when the app exits right after
+func killMiners(miners []Miner) {
+	ctx, cancel := context.WithTimeout(context.Background(), killTimeout)
+	defer cancel()
 
+	for _, miner := range miners {
+		k, ok := miner.(Killable)
+		if !ok {
+			continue
+		}
+
+		if err := k.Kill(ctx); err != nil {
+			log.Error("failed when killing miner", log.WithError(err), log.WithField("miner", miner.Name()))
+		}
+	}
+}
+
+func (m *Manager) close(ctx context.Context, miners []Miner) error {
 	if err := m.Stop(ctx); err != nil {
 		return err
 	}
 
-	for _, miner := range m.miners {
+	for _, miner := range miners {
 		if err := miner.Close(ctx); err != nil {
 			return err
 		}
@@ -67,6 +118,8 @@ func (m *Manager) Close(ctx context.Context) error {
 }
 
 func (m *Manager) Start(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	log.Trace("starting miner...")
 
 	for _, miner := range m.miners {
@@ -80,11 +133,14 @@ func (m *Manager) Start(ctx context.Context) error {
 		}
 	}
 
+	m.running = true
 	log.Trace("miner started")
 	return nil
 }
 
 func (m *Manager) Stop(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	log.Trace("stopping miner...")
 
 	for _, miner := range m.miners {
@@ -98,13 +154,176 @@ func (m *Manager) Stop(ctx context.Context) error {
 		}
 	}
 
+	m.running = false
 	log.Trace("miner stopped")
 	return nil
 }
 
-func (m *Manager) createMiner(ctx context.Context, c config.Config, config MiningConfig) (Miner, error) {
+// Status return the current state of the miners
+func (m *Manager) Status() *EventMinerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, len(m.miners))
+	for i, miner := range m.miners {
+		names[i] = miner.Name()
+	}
+
+	return &EventMinerStatus{
+		At:      time.Now(),
+		Running: m.running,
+		Miners:  names,
+	}
+}
+
+// ValidateReload check the pools and miners of the new config without
+// creating the miners
+func (m *Manager) ValidateReload(c config.Config) error {
+	pools, minersConfig, err := loadMiningConfig(c)
+	if err != nil {
+		return err
+	}
+
+	for i, config := range minersConfig {
+		if _, err := newMiner(pools, config); err != nil {
+			return fmt.Errorf("invalid miners.%d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Reload apply the new pools and miners, only the miners whose config or
+// pool changed are replaced and started again when running. The current
+// miners are kept when any of the new ones can't be created. The miners are
+// created, closed and started outside of the lock, only the swap is made
+// under it.
+func (m *Manager) Reload(ctx context.Context, c config.Config) error {
+	pools, minersConfig, err := loadMiningConfig(c)
+	if err != nil {
+		return err
+	}
+
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	m.mu.Lock()
+	current := m.miners
+	m.mu.Unlock()
+
+	// create the changed ones first, so nothing is touched when it fails
+	miners := make([]Miner, len(minersConfig))
+	created := []int{}
+	for i, config := range minersConfig {
+		if i < len(current) && !m.minerChanged(i, c, pools) {
+			miners[i] = current[i]
+			continue
+		}
+
+		configKey := fmt.Sprintf("miners.%d", i)
+		miner, err := createMiner(ctx, pools, c.Sub(configKey), config)
+		if err != nil {
+			for _, j := range created {
+				miners[j].Close(ctx)
+			}
+			return fmt.Errorf("failed when create %s: %w", configKey, err)
+		}
+		miners[i] = miner
+		created = append(created, i)
+	}
+
+	m.mu.Lock()
+	m.c = c
+	m.pools = pools
+	m.minersConfig = minersConfig
+	m.miners = miners
+	m.mu.Unlock()
+
+	// close the replaced and removed ones, it stops their process
+	for i, miner := range current {
+		if i < len(miners) && miners[i] == miner {
+			continue
+		}
+
+		log.Info("closing changed miner", log.WithField("index", i), log.WithField("miner", miner.Name()))
+		if err := miner.Close(ctx); err != nil {
+			log.Error("failed when closing changed miner", log.WithError(err), log.WithField("index", i))
+		}
+	}
+
+	if !m.isRunning() {
+		return nil
+	}
+
+	for _, i := range created {
+		log.Info("starting changed miner", log.WithField("index", i), log.WithField("miner", miners[i].Name()))
+		if err := miners[i].Start(ctx); err != nil && err != ErrMinerAlreadyStarted {
+			log.Error("failed when starting changed miner", log.WithError(err), log.WithField("index", i))
+		}
+	}
+
+	// the manager is stopped while starting them, the stop only sees the
+	// ones that not yet started
+	if !m.isRunning() {
+		for _, i := range created {
+			if err := miners[i].Stop(); err != nil && err != ErrMinerAlreadyStopped {
+				log.Error("failed when stopping changed miner", log.WithError(err), log.WithField("index", i))
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *Manager) isRunning() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.running
+}
+
+// loadMiningConfig read the pools and miners config
+func loadMiningConfig(c config.Config) (map[string]Pool, []MiningConfig, error) {
+	var (
+		pools        map[string]Pool
+		minersConfig []MiningConfig
+	)
+	if err := c.Get("pools").Scan(&pools); err != nil {
+		return nil, nil, err
+	}
+	if err := c.Get("miners").Scan(&minersConfig); err != nil {
+		return nil, nil, err
+	}
+
+	return pools, minersConfig, nil
+}
+
+// minerChanged check whether the miner at the index has a different config
+// or pool in the new config
+func (m *Manager) minerChanged(i int, c config.Config, pools map[string]Pool) bool {
+	configKey := fmt.Sprintf("miners.%d", i)
+	if !reflect.DeepEqual(m.c.Get(configKey).StringMap(), c.Get(configKey).StringMap()) {
+		return true
+	}
+
+	pool := m.minersConfig[i].Pool
+	return m.pools[pool] != pools[pool]
+}
 
-	pool, ok := m.pools[config.Pool]
+func createMiner(ctx context.Context, pools map[string]Pool, c config.Config, config MiningConfig) (Miner, error) {
+	miner, err := newMiner(pools, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := miner.Init(ctx, c); err != nil {
+		return nil, err
+	}
+
+	return miner, nil
+}
+
+// newMiner make the miner of the config without initializing it
+func newMiner(pools map[string]Pool, config MiningConfig) (Miner, error) {
+	pool, ok := pools[config.Pool]
 	if !ok {
 		return nil, fmt.Errorf("pool %s doesn't exists, are your forget to add the pools", config.Pool)
 	}
@@ -132,9 +351,6 @@ func (m *Manager) createMiner(ctx context.Context, c config.Config, config Minin
 		// TODO: handle when miner program not available (maybe download from source)
 		return nil, fmt.Errorf("miner %s are not available in your system, make sure you are install it properly", config.Miner)
 	}
-	if err := miner.Init(ctx, c); err != nil {
-		return nil, err
-	}
 
 	return miner, nil
 }
@@ -0,0 +1,233 @@
+package miner
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/config"
+)
+
+type fakeMiner struct {
+	settings *Settings
+	running  bool
+	closed   bool
+}
+
+func (m *fakeMiner) Init(ctx context.Context, c config.Config) error { return nil }
+func (m *fakeMiner) Name() string                                    { return "fake" }
+func (m *fakeMiner) Algorithms() []Algorithm                         { return []Algorithm{Kawpow} }
+func (m *fakeMiner) Available() bool                                 { return true }
+
+func (m *fakeMiner) Close(ctx context.Context) error {
+	m.running = false
+	m.closed = true
+	return nil
+}
+
+func (m *fakeMiner) Start(ctx context.Context) error {
+	m.running = true
+	return nil
+}
+
+func (m *fakeMiner) Stop() error {
+	m.running = false
+	return nil
+}
+
+// newTestConfig write the config into a file, the miners are looked up by
+// their index that only supported by the file config
+func newTestConfig(t *testing.T, pools map[string]interface{}, miners []interface{}) config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	b, err := json.Marshal(map[string]interface{}{
+		"pools":  pools,
+		"miners": miners,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "manager.json"), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return config.NewViper("manager", config.ViperPaths(dir))
+}
+
+func TestManagerReload(t *testing.T) {
+	ctx := context.Background()
+	Register("fake", func(s *Settings) Miner { return &fakeMiner{settings: s} })
+
+	pools := map[string]interface{}{
+		"raven": map[string]interface{}{"url": "stratum+tcp://raven:3636", "user": "a", "algorithm": "kawpow"},
+		"ergo":  map[string]interface{}{"url": "stratum+tcp://ergo:3636", "user": "a", "algorithm": "autolykos2"},
+	}
+	miners := []interface{}{
+		map[string]interface{}{"miner": "fake", "pool": "raven", "device": "index:0"},
+		map[string]interface{}{"miner": "fake", "pool": "raven", "device": "index:1"},
+		map[string]interface{}{"miner": "fake", "pool": "ergo", "device": "index:2"},
+	}
+
+	m := NewManager()
+	if err := m.Init(ctx, newTestConfig(t, pools, miners)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	before := append([]Miner{}, m.miners...)
+
+	// move the second miner to another device, change the ergo pool and
+	// drop nothing
+	miners[1] = map[string]interface{}{"miner": "fake", "pool": "raven", "device": "index:3"}
+	pools["ergo"] = map[string]interface{}{"url": "stratum+tcp://ergo:4444", "user": "a", "algorithm": "autolykos2"}
+	if err := m.Reload(ctx, newTestConfig(t, pools, miners)); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.miners[0] != before[0] {
+		t.Error("expect the unchanged miner kept")
+	}
+	for _, i := range []int{1, 2} {
+		if m.miners[i] == before[i] {
+			t.Errorf("expect miner %d replaced", i)
+		}
+		if !before[i].(*fakeMiner).closed {
+			t.Errorf("expect the old miner %d closed", i)
+		}
+		if !m.miners[i].(*fakeMiner).running {
+			t.Errorf("expect the new miner %d started", i)
+		}
+	}
+	if url := m.miners[2].(*fakeMiner).settings.Pool.Url; url != "stratum+tcp://ergo:4444" {
+		t.Errorf("expect the new pool used, got %s", url)
+	}
+
+	// an unknown pool keeps the current miners
+	current := append([]Miner{}, m.miners...)
+	miners[0] = map[string]interface{}{"miner": "fake", "pool": "unknown", "device": "index:0"}
+	if err := m.Reload(ctx, newTestConfig(t, pools, miners)); err == nil {
+		t.Fatal("expect the invalid config rejected")
+	}
+	for i := range current {
+		if m.miners[i] != current[i] || !current[i].(*fakeMiner).running {
+			t.Errorf("expect miner %d kept running", i)
+		}
+	}
+}
+
+// slowMiner signal its start and wait to be released
+type slowMiner struct {
+	fakeMiner
+	starting chan struct{}
+	release  chan struct{}
+}
+
+func (m *slowMiner) Start(ctx context.Context) error {
+	m.starting <- struct{}{}
+	<-m.release
+	return m.fakeMiner.Start(ctx)
+}
+
+func TestManagerReloadUnlocked(t *testing.T) {
+	ctx := context.Background()
+	starting := make(chan struct{}, 1)
+	release := make(chan struct{})
+	Register("fake", func(s *Settings) Miner { return &fakeMiner{settings: s} })
+	Register("slow", func(s *Settings) Miner {
+		return &slowMiner{fakeMiner: fakeMiner{settings: s}, starting: starting, release: release}
+	})
+
+	pools := map[string]interface{}{
+		"raven": map[string]interface{}{"url": "stratum+tcp://raven:3636", "user": "a", "algorithm": "kawpow"},
+	}
+	miners := []interface{}{
+		map[string]interface{}{"miner": "fake", "pool": "raven", "device": "index:0"},
+	}
+
+	m := NewManager()
+	if err := m.Init(ctx, newTestConfig(t, pools, miners)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// an unknown miner is rejected before anything is created
+	miners[0] = map[string]interface{}{"miner": "unknown", "pool": "raven", "device": "index:0"}
+	if err := m.ValidateReload(newTestConfig(t, pools, miners)); err == nil {
+		t.Error("expect the unknown miner rejected")
+	}
+
+	miners[0] = map[string]interface{}{"miner": "slow", "pool": "raven", "device": "index:0"}
+	reloaded := make(chan error, 1)
+	go func() {
+		reloaded <- m.Reload(ctx, newTestConfig(t, pools, miners))
+	}()
+
+	select {
+	case <-starting:
+	case <-time.After(time.Second):
+		t.Fatal("expect the new miner started")
+	}
+
+	// the status is available while the new miner is starting
+	status := make(chan *EventMinerStatus, 1)
+	go func() {
+		status <- m.Status()
+	}()
+	select {
+	case s := <-status:
+		if !s.Running {
+			t.Error("expect the manager still running")
+		}
+	case <-time.After(time.Second):
+		t.Error("expect the status not blocked by the reload")
+	}
+
+	close(release)
+	if err := <-reloaded; err != nil {
+		t.Fatal(err)
+	}
+	if !m.miners[0].(*slowMiner).running {
+		t.Error("expect the new miner running")
+	}
+}
+
+// stuckMiner doesn't stop until it is killed
+type stuckMiner struct {
+	fakeMiner
+	killed chan struct{}
+}
+
+func (m *stuckMiner) Stop() error {
+	<-m.killed
+	return nil
+}
+
+func (m *stuckMiner) Kill(ctx context.Context) error {
+	close(m.killed)
+	return nil
+}
+
+func TestManagerCloseKill(t *testing.T) {
+	stuck := &stuckMiner{killed: make(chan struct{})}
+	m := NewManager()
+	m.miners = []Miner{stuck}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	if err := m.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+
+	select {
+	case <-stuck.killed:
+	default:
+		t.Fatal("expect the stuck miner killed")
+	}
+}
@@ -73,6 +73,13 @@ type (
 		Available() bool
 	}
 
+	// Killable is extension to Miner that terminate its program right away
+	// and wait for it to exit until the context is done, it is used when
+	// stopping the miner takes too long
+	Killable interface {
+		Kill(ctx context.Context) error
+	}
+
 	MinerFactory func(*Settings) Miner
 )
 
@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"io"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/euiko/tooyoul/mineman/pkg/config"
@@ -37,6 +39,7 @@ type (
 
 		ctx     context.Context
 		cancel  func()
+		kill    func() // cancel the loop and its program, safe to call anytime
 		cmdChan chan command
 
 		// some variables that only accessible from the loop
@@ -46,6 +49,10 @@ type (
 		stdIn      io.WriteCloser
 		reader     *pkgio.ManagedReader
 		execCancel func() // to cancel program prior to stopping
+
+		// processMu guard the running program, it is killed outside the loop
+		processMu sync.Mutex
+		process   *os.Process
 	}
 )
 
@@ -63,7 +70,8 @@ func (m *Miner) Init(ctx context.Context, c config.Config) error {
 	// start the goroutine
 	log.Trace("starting background loop")
 	m.ctx, m.cancel = context.WithCancel(ctx)
-	go m.run(ctx)
+	m.kill = m.cancel
+	go m.run(m.ctx)
 
 	return nil
 }
@@ -90,6 +98,39 @@ func (m *Miner) Close(ctx context.Context) error {
 	return nil
 }
 
+// Kill terminate the running program without waiting for the stop command
+// and wait for it to exit, the loop is canceled as well
+func (m *Miner) Kill(ctx context.Context) error {
+	if m.kill != nil {
+		m.kill()
+	}
+
+	m.processMu.Lock()
+	process := m.process
+	m.processMu.Unlock()
+
+	if process == nil {
+		return nil
+	}
+
+	if err := process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		process.Wait()
+		close(exited)
+	}()
+
+	select {
+	case <-exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (m *Miner) Algorithms() []miner.Algorithm {
 	return []miner.Algorithm{
 		miner.Ethash,
@@ -253,6 +294,7 @@ func (m *Miner) start(ctx context.Context, cmd *commandStart) error {
 	// bind std in/out and start the command
 	execCmd := m.settings.Executor.Execute(ctx, execName, args)
 	cancelStart := func(stop bool) {
+		m.setProcess(nil)
 		m.stdIn = nil
 		m.stdOut = nil
 		m.stdErr = nil
@@ -282,6 +324,7 @@ func (m *Miner) start(ctx context.Context, cmd *commandStart) error {
 		cancelStart(false)
 		return err
 	}
+	m.setProcess(execCmd.Process)
 
 	log.Trace("starting manager to process stdout")
 	m.reader = pkgio.NewManagedReader(m.stdOut, m.stdErr)
@@ -317,6 +360,7 @@ func (m *Miner) stop(ctx context.Context, cmd *commandStop) error {
 	}
 
 	m.execCancel()
+	m.setProcess(nil)
 
 	m.stdIn = nil
 	m.stdOut = nil
@@ -326,6 +370,12 @@ func (m *Miner) stop(ctx context.Context, cmd *commandStop) error {
 	return nil
 }
 
+func (m *Miner) setProcess(process *os.Process) {
+	m.processMu.Lock()
+	defer m.processMu.Unlock()
+	m.process = process
+}
+
 func New(settings *miner.Settings) *Miner {
 	return &Miner{
 		settings: settings,
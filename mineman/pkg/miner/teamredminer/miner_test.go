@@ -1 +1,32 @@
 package teamredminer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKill(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Skip("sleep isn't available", err)
+	}
+
+	m := New(nil)
+	m.setProcess(cmd.Process)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.Kill(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the process is already waited by the kill
+	if err := cmd.Process.Signal(syscall.Signal(0)); !errors.Is(err, os.ErrProcessDone) {
+		t.Errorf("expect the process exited, got %v", err)
+	}
+}
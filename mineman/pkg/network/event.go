@@ -10,11 +10,11 @@ const EventStatusChangedTopic = "network.status-changed"
 
 type (
 	EventNetworkDown struct {
-		At time.Time `json:"x-at"`
+		At time.Time `json:"x-at" mapstructure:"x-at"`
 	}
 
 	EventNetworkUp struct {
-		At time.Time `json:"x-at"`
+		At time.Time `json:"x-at" mapstructure:"x-at"`
 	}
 )
 
@@ -0,0 +1,245 @@
+// Package schedule compute the trigger times of cron expressions and the
+// state of the time windows built from them.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCron = errors.New("invalid cron expression")
+
+type (
+	// Schedule return the next trigger strictly after the given time, the
+	// zero time means it never triggers again
+	Schedule interface {
+		Next(t time.Time) time.Time
+	}
+
+	// Cron is the standard 5 fields cron expression, i.e.
+	// minute hour day-of-month month day-of-week
+	Cron struct {
+		minute uint64
+		hour   uint64
+		dom    uint64
+		month  uint64
+		dow    uint64
+		loc    *time.Location
+
+		// the day matches when either of the day fields matches, unless one
+		// of them is a wildcard
+		domStar bool
+		dowStar bool
+	}
+
+	bounds struct {
+		min   int
+		max   int
+		names map[string]int
+	}
+)
+
+var (
+	minuteBounds = bounds{0, 59, nil}
+	hourBounds   = bounds{0, 23, nil}
+	domBounds    = bounds{1, 31, nil}
+	monthBounds  = bounds{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 7 is sunday as well
+	dowBounds = bounds{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+
+	descriptors = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// maxYears bound the search of an expression that never matches, e.g. 30 feb
+const maxYears = 5
+
+func (c *Cron) Next(t time.Time) time.Time {
+	loc := c.loc
+	if loc == nil {
+		loc = t.Location()
+	}
+
+	// start from the next whole minute in the cron location
+	t = t.In(loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + maxYears
+
+	for t.Year() <= limit {
+		if !has(c.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if !has(c.hour, t.Hour()) {
+			// add instead of time.Date, so the repeated hour of a daylight
+			// saving change is not skipped, the minutes are subtracted since
+			// some zones have a half hour offset
+			t = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute)
+			continue
+		}
+
+		if !has(c.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (c *Cron) matchDay(t time.Time) bool {
+	dom := has(c.dom, t.Day())
+	dow := has(c.dow, int(t.Weekday()))
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+
+	return dom || dow
+}
+
+func has(set uint64, v int) bool {
+	return set&(1<<uint(v)) != 0
+}
+
+// ParseCron parse the 5 fields cron expression or the descriptors such as
+// @daily, the triggers are computed in the given location
+func ParseCron(expr string, loc *time.Location) (*Cron, error) {
+	expr = strings.TrimSpace(expr)
+	if d, ok := descriptors[strings.ToLower(expr)]; ok {
+		expr = d
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w %q: expect 5 fields, got %d", ErrInvalidCron, expr, len(fields))
+	}
+
+	var (
+		c   = Cron{loc: loc}
+		err error
+	)
+	parsers := []struct {
+		target *uint64
+		bounds bounds
+	}{
+		{&c.minute, minuteBounds},
+		{&c.hour, hourBounds},
+		{&c.dom, domBounds},
+		{&c.month, monthBounds},
+		{&c.dow, dowBounds},
+	}
+	for i, p := range parsers {
+		if *p.target, err = parseField(fields[i], p.bounds); err != nil {
+			return nil, fmt.Errorf("%w %q: %s", ErrInvalidCron, expr, err.Error())
+		}
+	}
+
+	// sunday could be written as 7
+	if has(c.dow, 7) {
+		c.dow |= 1
+	}
+	c.domStar = strings.HasPrefix(fields[2], "*")
+	c.dowStar = strings.HasPrefix(fields[4], "*")
+
+	return &c, nil
+}
+
+// MustParseCron is like ParseCron but panics when the expression is invalid
+func MustParseCron(expr string, loc *time.Location) *Cron {
+	c, err := ParseCron(expr, loc)
+	if err != nil {
+		panic(err)
+	}
+
+	return c
+}
+
+// parseField parse comma separated list of value, range and step, e.g.
+// 1,5-10,*/15 into the bit set of the matched values
+func parseField(field string, b bounds) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+		}
+
+		var low, high int
+		switch {
+		case rangePart == "*":
+			low, high = b.min, b.max
+		case strings.Contains(rangePart, "-"):
+			i := strings.Index(rangePart, "-")
+			var err error
+			if low, err = b.parse(rangePart[:i]); err != nil {
+				return 0, err
+			}
+			if high, err = b.parse(rangePart[i+1:]); err != nil {
+				return 0, err
+			}
+		default:
+			var err error
+			if low, err = b.parse(rangePart); err != nil {
+				return 0, err
+			}
+			high = low
+			// a single value with step means until the max, e.g. 5/15
+			if step > 1 {
+				high = b.max
+			}
+		}
+
+		if low > high {
+			return 0, fmt.Errorf("invalid range %q", part)
+		}
+
+		for v := low; v <= high; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	return set, nil
+}
+
+func (b bounds) parse(value string) (int, error) {
+	if v, ok := b.names[strings.ToLower(value)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+
+	if v < b.min || v > b.max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", v, b.min, b.max)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,89 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	jakarta, err := time.LoadLocation("Asia/Jakarta")
+	if err != nil {
+		t.Skip("timezone database not available")
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("timezone database not available")
+	}
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skip("timezone database not available")
+	}
+
+	cases := []struct {
+		expr   string
+		loc    *time.Location
+		from   string
+		expect string
+	}{
+		{"0 22 * * *", time.UTC, "2021-10-01T10:00:00Z", "2021-10-01T22:00:00Z"},
+		// strictly after the given time
+		{"0 22 * * *", time.UTC, "2021-10-01T22:00:00Z", "2021-10-02T22:00:00Z"},
+		{"*/15 * * * *", time.UTC, "2021-10-01T10:07:30Z", "2021-10-01T10:15:00Z"},
+		{"5-10/5 8,20 * * *", time.UTC, "2021-10-01T08:10:00Z", "2021-10-01T20:05:00Z"},
+		{"0 0 * * mon-fri", time.UTC, "2021-10-01T12:00:00Z", "2021-10-04T00:00:00Z"},
+		{"0 0 * * 7", time.UTC, "2021-10-01T12:00:00Z", "2021-10-03T00:00:00Z"},
+		{"0 0 1 jan *", time.UTC, "2021-10-01T12:00:00Z", "2022-01-01T00:00:00Z"},
+		{"@monthly", time.UTC, "2021-10-01T12:00:00Z", "2021-11-01T00:00:00Z"},
+		// either of the day fields matches
+		{"0 0 13 * fri", time.UTC, "2021-10-01T12:00:00Z", "2021-10-08T00:00:00Z"},
+		{"0 0 29 feb *", time.UTC, "2021-10-01T12:00:00Z", "2024-02-29T00:00:00Z"},
+		{"0 0 30 feb *", time.UTC, "2021-10-01T12:00:00Z", ""},
+		// computed in the cron location
+		{"0 22 * * *", jakarta, "2021-10-01T10:00:00Z", "2021-10-01T15:00:00Z"},
+		{"0 * * * *", kolkata, "2021-10-01T10:00:00Z", "2021-10-01T10:30:00Z"},
+		// the skipped hour of daylight saving
+		{"30 2 * * *", newYork, "2021-03-14T05:00:00Z", "2021-03-15T06:30:00Z"},
+		// the repeated hour of daylight saving triggers twice
+		{"30 1 * * *", newYork, "2021-11-07T05:45:00Z", "2021-11-07T06:30:00Z"},
+	}
+
+	for _, c := range cases {
+		cron, err := ParseCron(c.expr, c.loc)
+		if err != nil {
+			t.Fatalf("%s: %s", c.expr, err)
+		}
+
+		from, _ := time.Parse(time.RFC3339, c.from)
+		next := cron.Next(from)
+		if c.expect == "" {
+			if !next.IsZero() {
+				t.Fatalf("%s: expect never triggered, got %s", c.expr, next)
+			}
+			continue
+		}
+
+		expect, _ := time.Parse(time.RFC3339, c.expect)
+		if !next.Equal(expect) {
+			t.Fatalf("%s from %s: expect %s, got %s", c.expr, c.from, expect, next.UTC())
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"10-5 * * * *",
+		"*/0 * * * *",
+		"* * * foo *",
+	} {
+		if _, err := ParseCron(expr, time.UTC); err == nil {
+			t.Fatalf("expect %q to be invalid", expr)
+		}
+	}
+}
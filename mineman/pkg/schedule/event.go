@@ -0,0 +1,70 @@
+package schedule
+
+import (
+	"time"
+
+	"github.com/euiko/tooyoul/mineman/pkg/event"
+)
+
+// EventWindowChangedTopic is the prefix of the window topics, each window
+// retains its state on its own topic, subscribe schedule.window-changed.*
+// to receive all of them
+const EventWindowChangedTopic = "schedule.window-changed"
+
+type (
+	EventWindowOpen struct {
+		At       time.Time `json:"x-at" mapstructure:"x-at"`
+		Window   string    `json:"window" mapstructure:"window"`
+		Override string    `json:"override" mapstructure:"override"`
+	}
+
+	EventWindowClosed struct {
+		At       time.Time `json:"x-at" mapstructure:"x-at"`
+		Window   string    `json:"window" mapstructure:"window"`
+		Override string    `json:"override" mapstructure:"override"`
+	}
+)
+
+func (e *EventWindowOpen) Name() string {
+	return "schedule.mining-window-open"
+}
+
+func (e *EventWindowOpen) ToEvent() *event.EventPayload {
+	return &event.EventPayload{
+		Name: e.Name(),
+		At:   e.At,
+		Data: map[string]interface{}{
+			"window":   e.Window,
+			"override": e.Override,
+		},
+	}
+}
+
+func (e *EventWindowClosed) Name() string {
+	return "schedule.mining-window-closed"
+}
+
+func (e *EventWindowClosed) ToEvent() *event.EventPayload {
+	return &event.EventPayload{
+		Name: e.Name(),
+		At:   e.At,
+		Data: map[string]interface{}{
+			"window":   e.Window,
+			"override": e.Override,
+		},
+	}
+}
+
+// WindowChangedTopic return the topic of the window state
+func WindowChangedTopic(window string) string {
+	return EventWindowChangedTopic + event.TopicSeparator + window
+}
+
+// NewStateEvent make the event of the window state
+func NewStateEvent(s State) event.EventDescriptor {
+	if s.Open {
+		return &EventWindowOpen{At: s.At, Window: s.Window, Override: s.Override}
+	}
+
+	return &EventWindowClosed{At: s.At, Window: s.Window, Override: s.Override}
+}
@@ -0,0 +1,147 @@
+package schedule
+
+import (
+	"sort"
+	"time"
+)
+
+type (
+	// Window is opened and closed by its schedules, e.g. the cheap
+	// electricity tariff from 22:00 to 06:00
+	Window struct {
+		Name  string
+		Open  Schedule
+		Close Schedule
+	}
+
+	// Override force the window state within the period, e.g. keep the
+	// window closed during a maintenance
+	Override struct {
+		Name string
+		// Window is the overridden window, empty means all the windows
+		Window string
+		From   time.Time
+		Until  time.Time
+		Open   bool
+	}
+
+	// Calendar hold the windows and their overrides
+	Calendar struct {
+		Windows   []*Window
+		Overrides []*Override
+	}
+
+	// State is the window state at a given time
+	State struct {
+		Window string    `json:"window"`
+		Open   bool      `json:"open"`
+		At     time.Time `json:"at"`
+		// Override is the name of the override that forces the state
+		Override string `json:"override,omitempty"`
+	}
+)
+
+// IsOpen check whether the window is open at the given time, it is open when
+// the next close comes before the next open
+func (w *Window) IsOpen(t time.Time) bool {
+	nextOpen := w.Open.Next(t)
+	nextClose := w.Close.Next(t)
+	if nextClose.IsZero() {
+		return false
+	}
+
+	return nextOpen.IsZero() || nextClose.Before(nextOpen)
+}
+
+func (o *Override) Active(t time.Time) bool {
+	return !t.Before(o.From) && t.Before(o.Until)
+}
+
+func (o *Override) Applies(window string) bool {
+	return o.Window == "" || o.Window == window
+}
+
+// State compute the window state at the given time, the latest override
+// takes precedence
+func (c *Calendar) State(w *Window, t time.Time) State {
+	for i := len(c.Overrides) - 1; i >= 0; i-- {
+		o := c.Overrides[i]
+		if o.Applies(w.Name) && o.Active(t) {
+			return State{Window: w.Name, Open: o.Open, At: t, Override: o.Name}
+		}
+	}
+
+	return State{Window: w.Name, Open: w.IsOpen(t), At: t}
+}
+
+// States compute the state of all the windows
+func (c *Calendar) States(t time.Time) []State {
+	states := make([]State, len(c.Windows))
+	for i, w := range c.Windows {
+		states[i] = c.State(w, t)
+	}
+
+	return states
+}
+
+// NextChange return the earliest time after t where a window state may
+// change, either by a schedule or an override boundary
+func (c *Calendar) NextChange(t time.Time) time.Time {
+	var next time.Time
+	earliest := func(candidate time.Time) {
+		if candidate.IsZero() || !candidate.After(t) {
+			return
+		}
+		if next.IsZero() || candidate.Before(next) {
+			next = candidate
+		}
+	}
+
+	for _, w := range c.Windows {
+		earliest(w.Open.Next(t))
+		earliest(w.Close.Next(t))
+	}
+
+	for _, o := range c.Overrides {
+		earliest(o.From)
+		earliest(o.Until)
+	}
+
+	return next
+}
+
+// Upcoming list the next n state changes after t, sorted by time
+func (c *Calendar) Upcoming(t time.Time, n int) []State {
+	current := make(map[string]bool, len(c.Windows))
+	for _, s := range c.States(t) {
+		current[s.Window] = s.Open
+	}
+
+	// bound the search, the overrides may suppress the changes for long
+	maxSteps := n * 100
+	result := []State{}
+	for step := 0; len(result) < n && step < maxSteps; step++ {
+		t = c.NextChange(t)
+		if t.IsZero() {
+			break
+		}
+
+		for _, s := range c.States(t) {
+			if current[s.Window] == s.Open {
+				continue
+			}
+
+			current[s.Window] = s.Open
+			result = append(result, s)
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].At.Before(result[j].At)
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+
+	return result
+}
@@ -0,0 +1,60 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalendar(t *testing.T) {
+	at := func(value string) time.Time {
+		tm, _ := time.Parse(time.RFC3339, value)
+		return tm
+	}
+
+	night := &Window{
+		Name:  "night",
+		Open:  MustParseCron("0 22 * * *", time.UTC),
+		Close: MustParseCron("0 6 * * *", time.UTC),
+	}
+	calendar := Calendar{
+		Windows: []*Window{night},
+		Overrides: []*Override{
+			{Name: "maintenance", From: at("2021-10-02T23:00:00Z"), Until: at("2021-10-03T01:00:00Z"), Open: false},
+		},
+	}
+
+	for value, open := range map[string]bool{
+		"2021-10-01T21:59:00Z": false,
+		"2021-10-01T22:00:00Z": true,
+		"2021-10-02T03:00:00Z": true,
+		"2021-10-02T06:00:00Z": false,
+		"2021-10-02T23:30:00Z": false,
+		"2021-10-03T01:00:00Z": true,
+	} {
+		s := calendar.State(night, at(value))
+		if s.Open != open {
+			t.Fatalf("at %s expect open %t, got %+v", value, open, s)
+		}
+	}
+
+	upcoming := calendar.Upcoming(at("2021-10-02T12:00:00Z"), 4)
+	expect := []struct {
+		at       string
+		open     bool
+		override string
+	}{
+		{"2021-10-02T22:00:00Z", true, ""},
+		{"2021-10-02T23:00:00Z", false, "maintenance"},
+		{"2021-10-03T01:00:00Z", true, ""},
+		{"2021-10-03T06:00:00Z", false, ""},
+	}
+	if len(upcoming) != len(expect) {
+		t.Fatalf("expect %d upcoming changes, got %+v", len(expect), upcoming)
+	}
+	for i, e := range expect {
+		s := upcoming[i]
+		if !s.At.Equal(at(e.at)) || s.Open != e.open || s.Override != e.override {
+			t.Fatalf("change %d expect %+v, got %+v", i, e, s)
+		}
+	}
+}